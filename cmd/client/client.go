@@ -4,33 +4,148 @@ import (
 	"bufio"
 	"bytes"
 	"chat-app/pkg/models"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-const tokenFileBaseName = "token"
+const (
+	tokenFileBaseName   = "token"
+	refreshFileBaseName = "refresh"
+	// clientVersion is reported with each login, for the session list
+	clientVersion = "chat-cli/1.0"
+)
 
 var loggedInUsername = ""
 
-func saveToken(username string, token string) error {
+// deviceName names this machine in the session list
+func deviceName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "chat-cli"
+	}
+	return host
+}
+
+// secondFactor asks for an authentication or recovery code and redeems a
+// login challenge with it
+func secondFactor(reader *bufio.Reader, challenge string) (models.Token, error) {
+	var token models.Token
+	fmt.Print("Authentication or recovery code: ")
+	code, _ := reader.ReadString('\n')
+	jsonReq, err := json.Marshal(map[string]string{
+		"challenge": challenge,
+		"code":      strings.TrimSpace(code),
+	})
+	if err != nil {
+		return token, err
+	}
+	resp, err := http.Post("http://localhost:8080/login/2fa", "application/json", bytes.NewBuffer(jsonReq))
+	if err != nil {
+		return token, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return token, fmt.Errorf("%s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	return token, err
+}
+
+func saveToken(username string, token models.Token) error {
 	loggedInUsername = username
 	tokenFile := fmt.Sprintf("%s_%s.txt", tokenFileBaseName, username)
-	return os.WriteFile(tokenFile, []byte(token), 0644)
+	if err := os.WriteFile(tokenFile, []byte(token.Token), 0600); err != nil {
+		return err
+	}
+	refreshFile := fmt.Sprintf("%s_%s.txt", refreshFileBaseName, username)
+	return os.WriteFile(refreshFile, []byte(token.RefreshToken), 0600)
 }
 
+// getToken returns the saved access token, first exchanging the refresh
+// token for a new one if it is about to expire
 func getToken() (string, error) {
 	tokenFile := fmt.Sprintf("%s_%s.txt", tokenFileBaseName, loggedInUsername)
 	token, err := os.ReadFile(tokenFile)
 	if err != nil {
 		return "", err
 	}
-	return string(token), nil
+	if !tokenExpiring(string(token)) {
+		return string(token), nil
+	}
+
+	refreshFile := fmt.Sprintf("%s_%s.txt", refreshFileBaseName, loggedInUsername)
+	refresh, err := os.ReadFile(refreshFile)
+	if err != nil {
+		return "", err
+	}
+	jsonReq, err := json.Marshal(map[string]string{"refresh_token": string(refresh)})
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.Post("http://localhost:8080/token/refresh", "application/json", bytes.NewBuffer(jsonReq))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("session expired, please log in again (%s)", resp.Status)
+	}
+
+	var newToken models.Token
+	if err := json.NewDecoder(resp.Body).Decode(&newToken); err != nil {
+		return "", err
+	}
+	if err := saveToken(loggedInUsername, newToken); err != nil {
+		return "", err
+	}
+	return newToken.Token, nil
+}
+
+// tokenExpiring reports whether an access token expires within the next
+// half minute. The signature is the server's business, so it is not checked.
+func tokenExpiring(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return true
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return true
+	}
+	var claims struct {
+		ExpiresAt int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return true
+	}
+	return time.Until(time.Unix(claims.ExpiresAt, 0)) < 30*time.Second
+}
+
+// tokenUsername reads the username an access token was issued to
+func tokenUsername(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Username string `json:"username"`
+	}
+	json.Unmarshal(payload, &claims)
+	return claims.Username
 }
 
 func main() {
@@ -61,112 +176,1034 @@ func main() {
 				fmt.Println("Usage: register <username> <password>")
 
 			}
-			username := args[1]
-			password := args[2]
+			username := args[1]
+			password := args[2]
+
+			user := map[string]string{
+				"username":       username,
+				"password":       password,
+				"device_name":    deviceName(),
+				"client_version": clientVersion,
+			}
+
+			jsonUser, err := json.Marshal(user)
+			if err != nil {
+				fmt.Println("Error marshalling user:", err)
+				continue
+			}
+
+			resp, err := http.Post("http://localhost:8080/register", "application/json", bytes.NewBuffer(jsonUser))
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusCreated {
+				fmt.Println("Error registering user:", resp.Status)
+				continue
+			}
+
+			fmt.Println("User registered successfully")
+
+		case "login":
+			if len(args) != 3 {
+				fmt.Println("Usage: login <username> <password>")
+			}
+			username := args[1]
+			password := args[2]
+
+			user := map[string]string{
+				"username": username,
+				"password": password,
+			}
+
+			jsonUser, err := json.Marshal(user)
+			if err != nil {
+				fmt.Println("Error marshalling user:", err)
+				continue
+			}
+
+			resp, err := http.Post("http://localhost:8080/login", "application/json", bytes.NewBuffer(jsonUser))
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				fmt.Println("Error logging in:", resp.Status)
+				continue
+			}
+
+			var login struct {
+				models.Token
+				Challenge string `json:"challenge"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&login)
+			if err != nil {
+				fmt.Println("Error decoding token:", err)
+				continue
+			}
+			token := login.Token
+
+			// with two-factor authentication the password only gets a
+			// challenge, which a code from the authenticator redeems
+			if login.Challenge != "" {
+				token, err = secondFactor(reader, login.Challenge)
+				if err != nil {
+					fmt.Println("Error logging in:", err)
+					continue
+				}
+			}
+
+			err = saveToken(username, token)
+			if err != nil {
+				fmt.Println("Error saving token:", err)
+				continue
+			}
+
+			fmt.Println("User logged in successfully")
+
+		case "login-sso":
+			// log in with the identity provider in a browser, possibly on
+			// another machine, while we poll for the result
+			jsonDevice, err := json.Marshal(map[string]string{"device_name": deviceName()})
+			if err != nil {
+				fmt.Println("Error marshalling request:", err)
+				continue
+			}
+			resp, err := http.Post("http://localhost:8080/oidc/device/authorize", "application/json", bytes.NewBuffer(jsonDevice))
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				fmt.Println("Error starting login:", resp.Status)
+				continue
+			}
+			var authorization struct {
+				DeviceCode              string `json:"device_code"`
+				UserCode                string `json:"user_code"`
+				VerificationURI         string `json:"verification_uri"`
+				VerificationURIComplete string `json:"verification_uri_complete"`
+				ExpiresIn               int    `json:"expires_in"`
+				Interval                int    `json:"interval"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&authorization)
+			resp.Body.Close()
+			if err != nil {
+				fmt.Println("Error decoding response:", err)
+				continue
+			}
+
+			fmt.Printf("Open %s and enter the code %s\n", authorization.VerificationURI, authorization.UserCode)
+			fmt.Println("or go straight to", authorization.VerificationURIComplete)
+
+			jsonReq, err := json.Marshal(map[string]string{
+				"device_code":    authorization.DeviceCode,
+				"device_name":    deviceName(),
+				"client_version": clientVersion,
+			})
+			if err != nil {
+				fmt.Println("Error marshalling request:", err)
+				continue
+			}
+			interval := time.Duration(authorization.Interval) * time.Second
+			deadline := time.Now().Add(time.Duration(authorization.ExpiresIn) * time.Second)
+			var login struct {
+				models.Token
+				Challenge string `json:"challenge"`
+			}
+			for time.Now().Before(deadline) {
+				time.Sleep(interval)
+				resp, err := http.Post("http://localhost:8080/oidc/device/token", "application/json", bytes.NewBuffer(jsonReq))
+				if err != nil {
+					fmt.Println("Error making request:", err)
+					break
+				}
+				if resp.StatusCode == http.StatusOK {
+					err = json.NewDecoder(resp.Body).Decode(&login)
+					resp.Body.Close()
+					if err != nil {
+						fmt.Println("Error decoding token:", err)
+					}
+					break
+				}
+				var pollErr struct {
+					Error string `json:"error"`
+				}
+				json.NewDecoder(resp.Body).Decode(&pollErr)
+				resp.Body.Close()
+				if pollErr.Error == "slow_down" {
+					interval += 5 * time.Second
+				} else if pollErr.Error != "authorization_pending" {
+					fmt.Println("Error logging in:", resp.Status, pollErr.Error)
+					break
+				}
+			}
+			token := login.Token
+			if login.Challenge != "" {
+				token, err = secondFactor(reader, login.Challenge)
+				if err != nil {
+					fmt.Println("Error logging in:", err)
+					continue
+				}
+			}
+			if token.Token == "" {
+				fmt.Println("Login did not complete")
+				continue
+			}
+
+			username := tokenUsername(token.Token)
+			if err := saveToken(username, token); err != nil {
+				fmt.Println("Error saving token:", err)
+				continue
+			}
+			fmt.Println("Logged in as", username)
+
+		case "link":
+			// the link URL is opened in a browser, which does not have our
+			// token, so the server hands out a single-use URL instead
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
+			}
+
+			req, err := http.NewRequest("POST", "http://localhost:8080/oidc/link", nil)
+			if err != nil {
+				fmt.Println("Error creating request:", err)
+				continue
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
+
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				fmt.Println("Error starting link:", resp.Status)
+				continue
+			}
+			var link struct {
+				LinkURL   string `json:"link_url"`
+				ExpiresIn int    `json:"expires_in"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&link)
+			resp.Body.Close()
+			if err != nil {
+				fmt.Println("Error decoding response:", err)
+				continue
+			}
+			fmt.Printf("Open %s in a browser within %d seconds and log in with the account to link\n", link.LinkURL, link.ExpiresIn)
+
+		case "logout":
+			// end the session on the server too, so the saved tokens stop
+			// working even if a copy of them exists
+			token, err := getToken()
+			if err == nil {
+				req, err := http.NewRequest("POST", "http://localhost:8080/logout", nil)
+				if err != nil {
+					fmt.Println("Error creating request:", err)
+					continue
+				}
+				req.Header.Add("Authorization", "Bearer "+token)
+				client := &http.Client{}
+				resp, err := client.Do(req)
+				if err != nil {
+					fmt.Println("Error making request:", err)
+					continue
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+					fmt.Println("Error logging out:", resp.Status)
+					continue
+				}
+			}
+
+			os.Remove(fmt.Sprintf("%s_%s.txt", refreshFileBaseName, loggedInUsername))
+			err = os.Remove(fmt.Sprintf("%s_%s.txt", tokenFileBaseName, loggedInUsername))
+			if err != nil {
+				fmt.Println("Error removing token:", err)
+				continue
+			}
+			loggedInUsername = ""
+			fmt.Println("User logged out successfully")
+
+		case "profile":
+			if len(args) > 2 {
+				fmt.Println("Usage: profile [user_id]")
+				continue
+			}
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
+			}
+
+			who := "me"
+			if len(args) == 2 {
+				who = args[1]
+			}
+			req, err := http.NewRequest("GET", "http://localhost:8080/users/"+who, nil)
+			if err != nil {
+				fmt.Println("Error creating request:", err)
+				continue
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
+
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				fmt.Println("Error fetching profile:", resp.Status)
+				continue
+			}
+
+			var user models.User
+			if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+				fmt.Println("Error decoding profile:", err)
+				continue
+			}
+			fmt.Printf("%s (ID: %d)\n", user.Username, user.ID)
+			for _, field := range [][2]string{
+				{"Display name", user.DisplayName},
+				{"Status", user.Status},
+				{"Bio", user.Bio},
+				{"Avatar", user.AvatarURL},
+				{"Email", user.Email},
+			} {
+				if field[1] != "" {
+					fmt.Printf("  %s: %s\n", field[0], field[1])
+				}
+			}
+
+		case "set-profile":
+			fields := map[string]bool{"display_name": true, "bio": true, "status": true, "dm_policy": true}
+			if len(args) < 2 || !fields[args[1]] {
+				fmt.Println("Usage: set-profile display_name|bio|status|dm_policy [text]")
+				continue
+			}
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
+			}
+
+			// leaving the text out clears the field
+			jsonBody, err := json.Marshal(map[string]string{args[1]: strings.Join(args[2:], " ")})
+			if err != nil {
+				fmt.Println("Error marshalling request:", err)
+				continue
+			}
+			req, err := http.NewRequest("PATCH", "http://localhost:8080/users/me", bytes.NewBuffer(jsonBody))
+			if err != nil {
+				fmt.Println("Error creating request:", err)
+				continue
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
+			req.Header.Set("Content-Type", "application/json")
+
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				fmt.Println("Error updating profile:", resp.Status)
+				continue
+			}
+			fmt.Println("Profile updated")
+
+		case "export":
+			if len(args) > 2 {
+				fmt.Println("Usage: export [file]")
+				continue
+			}
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
+			}
+
+			req, err := http.NewRequest("GET", "http://localhost:8080/users/me/export", nil)
+			if err != nil {
+				fmt.Println("Error creating request:", err)
+				continue
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
+
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				fmt.Println("Error exporting data:", resp.Status)
+				continue
+			}
+
+			file := "chat-export.zip"
+			if len(args) == 2 {
+				file = args[1]
+			}
+			out, err := os.Create(file)
+			if err != nil {
+				fmt.Println("Error creating file:", err)
+				continue
+			}
+			_, err = io.Copy(out, resp.Body)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				fmt.Println("Error saving export:", err)
+				continue
+			}
+			fmt.Println("Your data was saved to", file)
+
+		case "sessions":
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
+			}
+
+			req, err := http.NewRequest("GET", "http://localhost:8080/sessions", nil)
+			if err != nil {
+				fmt.Println("Error creating request:", err)
+				continue
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
+
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				fmt.Println("Error listing sessions:", resp.Status)
+				continue
+			}
+
+			var sessions []models.Session
+			if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+				fmt.Println("Error decoding sessions:", err)
+				continue
+			}
+			for _, session := range sessions {
+				var marks []string
+				if session.Current {
+					marks = append(marks, "this session")
+				}
+				if session.Connected {
+					marks = append(marks, "connected")
+				}
+				fmt.Printf("- %d: %s %s from %s, last active %s",
+					session.ID, session.DeviceName, session.ClientVersion, session.IP,
+					session.LastUsedAt.Local().Format("2006-01-02 15:04"))
+				if len(marks) > 0 {
+					fmt.Printf(" (%s)", strings.Join(marks, ", "))
+				}
+				fmt.Println()
+			}
+
+		case "revoke-session":
+			if len(args) != 2 {
+				fmt.Println("Usage: revoke-session <session_id>")
+				continue
+			}
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
+			}
+
+			req, err := http.NewRequest("DELETE", "http://localhost:8080/sessions/"+args[1], nil)
+			if err != nil {
+				fmt.Println("Error creating request:", err)
+				continue
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
+
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				fmt.Println("Error revoking session:", resp.Status)
+				continue
+			}
+			fmt.Println("Session revoked")
+
+		case "block", "unblock":
+			if len(args) != 2 {
+				fmt.Printf("Usage: %s <user_id>\n", command)
+				continue
+			}
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
+			}
+
+			method := "PUT"
+			if command == "unblock" {
+				method = "DELETE"
+			}
+			req, err := http.NewRequest(method, "http://localhost:8080/users/me/blocks/"+args[1], nil)
+			if err != nil {
+				fmt.Println("Error creating request:", err)
+				continue
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
+
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				fmt.Printf("Error running %s: %s\n", command, resp.Status)
+				continue
+			}
+			if command == "block" {
+				fmt.Println("User blocked")
+			} else {
+				fmt.Println("User unblocked")
+			}
+
+		case "2fa":
+			wantArgs := map[string]int{"enroll": 2, "verify": 3, "disable": 3}
+			if len(args) < 2 || wantArgs[args[1]] != len(args) {
+				fmt.Println("Usage: 2fa enroll | 2fa verify <code> | 2fa disable <code>")
+				continue
+			}
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
+			}
+
+			body := map[string]string{}
+			if len(args) == 3 {
+				body["code"] = args[2]
+			}
+			jsonBody, err := json.Marshal(body)
+			if err != nil {
+				fmt.Println("Error marshalling request:", err)
+				continue
+			}
+			req, err := http.NewRequest("POST", "http://localhost:8080/users/me/2fa/"+args[1], bytes.NewBuffer(jsonBody))
+			if err != nil {
+				fmt.Println("Error creating request:", err)
+				continue
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
+			req.Header.Set("Content-Type", "application/json")
+
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				fmt.Println("Error:", resp.Status)
+				continue
+			}
+
+			var result struct {
+				Secret          string   `json:"secret"`
+				ProvisioningURI string   `json:"provisioning_uri"`
+				RecoveryCodes   []string `json:"recovery_codes"`
+			}
+			switch args[1] {
+			case "enroll":
+				if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+					fmt.Println("Error decoding response:", err)
+					continue
+				}
+				fmt.Println("Add this to your authenticator app:", result.ProvisioningURI)
+				fmt.Println("or enter the secret", result.Secret)
+				fmt.Println("Then run '2fa verify <code>' with the code it shows")
+			case "verify":
+				if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+					fmt.Println("Error decoding response:", err)
+					continue
+				}
+				fmt.Println("Two-factor authentication enabled. Keep these recovery codes somewhere safe, each works once:")
+				for _, code := range result.RecoveryCodes {
+					fmt.Println("  " + code)
+				}
+			case "disable":
+				fmt.Println("Two-factor authentication disabled")
+			}
+
+		case "create-room":
+			if len(args) != 2 && len(args) != 3 {
+				fmt.Println("Usage: create-room <room_name> [public|restricted|private|secret]")
+				continue
+			}
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
+			}
+			roomName := args[1]
+
+			room := map[string]string{
+				"name": roomName,
+			}
+			if len(args) == 3 {
+				room["visibility"] = args[2]
+			}
+
+			jsonRoom, err := json.Marshal(room)
+			if err != nil {
+				fmt.Println("Error marshalling room:", err)
+				continue
+			}
+
+			client := &http.Client{}
+			req, err := http.NewRequest("POST", "http://localhost:8080/create-room", bytes.NewBuffer(jsonRoom))
+			if err != nil {
+				fmt.Println("Error creating request:", err)
+				continue
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := client.Do(req)
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusCreated {
+				fmt.Println("Error creating room:", resp.Status)
+
+			}
+
+			fmt.Println("Chat room created successfully")
+
+		case "join-room":
+			if len(args) < 2 {
+				fmt.Println("Usage: join-room <room_id|invite_code> [message]")
+				continue
+			}
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
+			}
+
+			// anything that is not a room ID is taken for an invite code
+			room := map[string]interface{}{}
+			if roomID, err := strconv.Atoi(args[1]); err == nil {
+				room["room_id"] = roomID
+			} else {
+				room["invite_code"] = args[1]
+			}
+			// the message only matters for rooms that need approval to join
+			if len(args) > 2 {
+				room["message"] = strings.Join(args[2:], " ")
+			}
+
+			jsonRoom, err := json.Marshal(room)
+			if err != nil {
+				fmt.Println("Error marshalling room:", err)
+				continue
+			}
+
+			client := &http.Client{}
+			req, err := http.NewRequest("POST", "http://localhost:8080/join-room", bytes.NewBuffer(jsonRoom))
+			if err != nil {
+				fmt.Println("Error creating request:", err)
+				continue
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := client.Do(req)
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode == http.StatusAccepted {
+				var request models.JoinRequest
+				if err := json.NewDecoder(resp.Body).Decode(&request); err != nil {
+					fmt.Println("Error decoding join request:", err)
+					continue
+				}
+				fmt.Printf("Asked to join chat room %s (ID: %d). You will be let in once an admin approves.\n", request.RoomName, request.RoomID)
+				continue
+			}
+			if resp.StatusCode != http.StatusOK {
+				fmt.Println("Error joining room:", resp.Status)
+				continue
+			}
+
+			var joined models.ChatRoom
+			if err := json.NewDecoder(resp.Body).Decode(&joined); err != nil {
+				fmt.Println("Error decoding room:", err)
+				continue
+			}
+			fmt.Printf("Joined chat room %s (ID: %d)\n", joined.Name, joined.ID)
+
+		case "invite":
+			if len(args) != 3 {
+				fmt.Println("Usage: invite <room_id> <user_id>")
+				continue
+			}
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
+			}
+			userID, err := strconv.Atoi(args[2])
+			if err != nil {
+				fmt.Println("Invalid user ID:", err)
+				continue
+			}
+
+			jsonBody, err := json.Marshal(map[string]int{"user_id": userID})
+			if err != nil {
+				fmt.Println("Error marshalling request:", err)
+				continue
+			}
+			req, err := http.NewRequest("POST", "http://localhost:8080/rooms/"+args[1]+"/invites", bytes.NewBuffer(jsonBody))
+			if err != nil {
+				fmt.Println("Error creating request:", err)
+				continue
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
+			req.Header.Set("Content-Type", "application/json")
+
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated {
+				fmt.Println("Error inviting user:", resp.Status)
+				continue
+			}
+			fmt.Println("User invited")
+
+		case "create-invite":
+			if len(args) < 2 || len(args) > 4 {
+				fmt.Println("Usage: create-invite <room_id> [expires_in_seconds] [max_uses]")
+				continue
+			}
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
+			}
+			limits := map[string]int{}
+			if len(args) > 2 {
+				if limits["expires_in"], err = strconv.Atoi(args[2]); err != nil {
+					fmt.Println("Invalid expiry:", err)
+					continue
+				}
+			}
+			if len(args) > 3 {
+				if limits["max_uses"], err = strconv.Atoi(args[3]); err != nil {
+					fmt.Println("Invalid max uses:", err)
+					continue
+				}
+			}
+
+			jsonBody, err := json.Marshal(limits)
+			if err != nil {
+				fmt.Println("Error marshalling request:", err)
+				continue
+			}
+			req, err := http.NewRequest("POST", "http://localhost:8080/rooms/"+args[1]+"/invite-codes", bytes.NewBuffer(jsonBody))
+			if err != nil {
+				fmt.Println("Error creating request:", err)
+				continue
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
+			req.Header.Set("Content-Type", "application/json")
+
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated {
+				fmt.Println("Error creating invite code:", resp.Status)
+				continue
+			}
+
+			var invite models.InviteCode
+			if err := json.NewDecoder(resp.Body).Decode(&invite); err != nil {
+				fmt.Println("Error decoding invite code:", err)
+				continue
+			}
+			fmt.Println("Invite code:", invite.Code)
+			fmt.Println("Anyone can join with: join-room", invite.Code)
+
+		case "invites":
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
+			}
+
+			req, err := http.NewRequest("GET", "http://localhost:8080/users/me/invites", nil)
+			if err != nil {
+				fmt.Println("Error creating request:", err)
+				continue
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
+
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				fmt.Println("Error listing invitations:", resp.Status)
+				continue
+			}
+
+			var invitations []models.Invitation
+			if err := json.NewDecoder(resp.Body).Decode(&invitations); err != nil {
+				fmt.Println("Error decoding invitations:", err)
+				continue
+			}
+			if len(invitations) == 0 {
+				fmt.Println("No pending invitations")
+			}
+			for _, invitation := range invitations {
+				fmt.Printf("- %s (ID: %d), invited by %s\n", invitation.RoomName, invitation.RoomID, invitation.InviterUsername)
+			}
 
-			user := map[string]string{
-				"username": username,
-				"password": password,
+		case "decline":
+			if len(args) != 2 {
+				fmt.Println("Usage: decline <room_id>")
+				continue
+			}
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
 			}
 
-			jsonUser, err := json.Marshal(user)
+			req, err := http.NewRequest("DELETE", "http://localhost:8080/users/me/invites/"+args[1], nil)
 			if err != nil {
-				fmt.Println("Error marshalling user:", err)
+				fmt.Println("Error creating request:", err)
 				continue
 			}
+			req.Header.Add("Authorization", "Bearer "+token)
 
-			resp, err := http.Post("http://localhost:8080/register", "application/json", bytes.NewBuffer(jsonUser))
+			client := &http.Client{}
+			resp, err := client.Do(req)
 			if err != nil {
 				fmt.Println("Error making request:", err)
 				continue
 			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode != http.StatusCreated {
-				fmt.Println("Error registering user:", resp.Status)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				fmt.Println("Error declining invitation:", resp.Status)
 				continue
 			}
+			fmt.Println("Invitation declined")
 
-			fmt.Println("User registered successfully")
-
-		case "login":
-			if len(args) != 3 {
-				fmt.Println("Usage: login <username> <password>")
+		case "join-requests":
+			if len(args) != 2 {
+				fmt.Println("Usage: join-requests <room_id>")
+				continue
 			}
-			username := args[1]
-			password := args[2]
-
-			user := map[string]string{
-				"username": username,
-				"password": password,
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
 			}
 
-			jsonUser, err := json.Marshal(user)
+			req, err := http.NewRequest("GET", "http://localhost:8080/rooms/"+args[1]+"/join-requests", nil)
 			if err != nil {
-				fmt.Println("Error marshalling user:", err)
+				fmt.Println("Error creating request:", err)
 				continue
 			}
+			req.Header.Add("Authorization", "Bearer "+token)
 
-			resp, err := http.Post("http://localhost:8080/login", "application/json", bytes.NewBuffer(jsonUser))
+			client := &http.Client{}
+			resp, err := client.Do(req)
 			if err != nil {
 				fmt.Println("Error making request:", err)
 				continue
 			}
 			defer resp.Body.Close()
-
 			if resp.StatusCode != http.StatusOK {
-				fmt.Println("Error logging in:", resp.Status)
+				fmt.Println("Error listing requests to join:", resp.Status)
 				continue
 			}
 
-			var token map[string]string
-			err = json.NewDecoder(resp.Body).Decode(&token)
-			if err != nil {
-				fmt.Println("Error decoding token:", err)
+			var requests []models.JoinRequest
+			if err := json.NewDecoder(resp.Body).Decode(&requests); err != nil {
+				fmt.Println("Error decoding requests to join:", err)
 				continue
 			}
+			if len(requests) == 0 {
+				fmt.Println("No pending requests to join")
+			}
+			for _, request := range requests {
+				fmt.Printf("- %s (ID: %d)", request.Username, request.UserID)
+				if request.Message != "" {
+					fmt.Printf(": %s", request.Message)
+				}
+				fmt.Println()
+			}
 
-			err = saveToken(username, token["token"])
+		case "approve", "deny":
+			if len(args) != 3 {
+				fmt.Printf("Usage: %s <room_id> <user_id>\n", command)
+				continue
+			}
+			token, err := getToken()
 			if err != nil {
-				fmt.Println("Error saving token:", err)
+				fmt.Println("Error reading token:", err)
 				continue
 			}
 
-			fmt.Println("User logged in successfully")
+			method, url := "DELETE", "http://localhost:8080/rooms/"+args[1]+"/join-requests/"+args[2]
+			if command == "approve" {
+				method, url = "POST", url+"/approve"
+			}
+			req, err := http.NewRequest(method, url, nil)
+			if err != nil {
+				fmt.Println("Error creating request:", err)
+				continue
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
 
-		case "logout":
-			err := os.Remove(fmt.Sprintf("%s_%s.txt", tokenFileBaseName, loggedInUsername))
+			client := &http.Client{}
+			resp, err := client.Do(req)
 			if err != nil {
-				fmt.Println("Error removing token:", err)
+				fmt.Println("Error making request:", err)
 				continue
 			}
-			loggedInUsername = ""
-			fmt.Println("User logged out successfully")
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				fmt.Println("Error answering request to join:", resp.Status)
+				continue
+			}
+			if command == "approve" {
+				fmt.Println("Request to join approved")
+			} else {
+				fmt.Println("Request to join denied")
+			}
 
-		case "create-room":
+		case "withdraw":
 			if len(args) != 2 {
-				fmt.Println("Usage: create-room <room_name>")
-
+				fmt.Println("Usage: withdraw <room_id>")
+				continue
 			}
 			token, err := getToken()
 			if err != nil {
 				fmt.Println("Error reading token:", err)
 				continue
 			}
-			roomName := args[1]
 
-			room := map[string]string{
-				"name": roomName,
+			req, err := http.NewRequest("DELETE", "http://localhost:8080/users/me/join-requests/"+args[1], nil)
+			if err != nil {
+				fmt.Println("Error creating request:", err)
+				continue
 			}
+			req.Header.Add("Authorization", "Bearer "+token)
 
-			jsonRoom, err := json.Marshal(room)
+			client := &http.Client{}
+			resp, err := client.Do(req)
 			if err != nil {
-				fmt.Println("Error marshalling room:", err)
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				fmt.Println("Error withdrawing request to join:", resp.Status)
+				continue
+			}
+			fmt.Println("Request to join withdrawn")
+
+		case "kick", "ban", "unban", "mute", "unmute":
+			usage := map[string]string{
+				"kick":   "kick <room_id> <user_id> [reason]",
+				"ban":    "ban <room_id> <user_id> <seconds, or 0 for no expiry> [reason]",
+				"unban":  "unban <room_id> <user_id>",
+				"mute":   "mute <room_id> <user_id> <seconds> [reason]",
+				"unmute": "unmute <room_id> <user_id>",
+			}[command]
+			timed := command == "ban" || command == "mute"
+			if len(args) < 3 || timed && len(args) < 4 || (command == "unban" || command == "unmute") && len(args) != 3 {
+				fmt.Println("Usage:", usage)
+				continue
+			}
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
 				continue
 			}
 
-			client := &http.Client{}
-			req, err := http.NewRequest("POST", "http://localhost:8080/create-room", bytes.NewBuffer(jsonRoom))
+			roomURL := "http://localhost:8080/rooms/" + args[1]
+			var req *http.Request
+			switch command {
+			case "kick":
+				reason := url.QueryEscape(strings.Join(args[3:], " "))
+				req, err = http.NewRequest("DELETE", roomURL+"/members/"+args[2]+"?reason="+reason, nil)
+			case "ban", "mute":
+				seconds, convErr := strconv.Atoi(args[3])
+				if convErr != nil {
+					fmt.Println("Invalid duration:", convErr)
+					continue
+				}
+				jsonBody, marshalErr := json.Marshal(map[string]interface{}{
+					"expires_in": seconds,
+					"reason":     strings.Join(args[4:], " "),
+				})
+				if marshalErr != nil {
+					fmt.Println("Error marshalling request:", marshalErr)
+					continue
+				}
+				req, err = http.NewRequest("PUT", roomURL+"/"+command+"s/"+args[2], bytes.NewBuffer(jsonBody))
+			case "unban":
+				req, err = http.NewRequest("DELETE", roomURL+"/bans/"+args[2], nil)
+			case "unmute":
+				req, err = http.NewRequest("DELETE", roomURL+"/mutes/"+args[2], nil)
+			}
 			if err != nil {
 				fmt.Println("Error creating request:", err)
 				continue
@@ -174,48 +1211,82 @@ func main() {
 			req.Header.Add("Authorization", "Bearer "+token)
 			req.Header.Set("Content-Type", "application/json")
 
+			client := &http.Client{}
 			resp, err := client.Do(req)
 			if err != nil {
 				fmt.Println("Error making request:", err)
 				continue
 			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode != http.StatusCreated {
-				fmt.Println("Error creating room:", resp.Status)
-
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				fmt.Printf("Error: %s %s\n", resp.Status, strings.TrimSpace(string(body)))
+				continue
 			}
+			fmt.Println("Done:", command, "user", args[2], "in room", args[1])
 
-			fmt.Println("Chat room created successfully")
-
-		case "join-room":
+		case "archive-room", "unarchive-room":
 			if len(args) != 2 {
-				fmt.Println("Usage: join-room <room_id>")
-
+				fmt.Printf("Usage: %s <room_id>\n", command)
+				continue
 			}
 			token, err := getToken()
 			if err != nil {
 				fmt.Println("Error reading token:", err)
 				continue
 			}
-			roomID, err := strconv.Atoi(args[1])
+
+			method := "PUT"
+			if command == "unarchive-room" {
+				method = "DELETE"
+			}
+			req, err := http.NewRequest(method, "http://localhost:8080/rooms/"+args[1]+"/archive", nil)
 			if err != nil {
-				fmt.Println("Invalid room ID:", err)
+				fmt.Println("Error creating request:", err)
 				continue
 			}
+			req.Header.Add("Authorization", "Bearer "+token)
 
-			room := map[string]int{
-				"room_id": roomID,
+			client := &http.Client{}
+			resp, err := client.Do(req)
+			if err != nil {
+				fmt.Println("Error making request:", err)
+				continue
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				fmt.Printf("Error: %s %s\n", resp.Status, strings.TrimSpace(string(body)))
+				continue
+			}
+			if command == "archive-room" {
+				fmt.Println("Room archived")
+			} else {
+				fmt.Println("Room unarchived")
 			}
 
-			jsonRoom, err := json.Marshal(room)
+		case "transfer-ownership":
+			if len(args) != 3 {
+				fmt.Println("Usage: transfer-ownership <room_id> <user_id>")
+				continue
+			}
+			token, err := getToken()
 			if err != nil {
-				fmt.Println("Error marshalling room:", err)
+				fmt.Println("Error reading token:", err)
+				continue
+			}
+			userID, err := strconv.Atoi(args[2])
+			if err != nil {
+				fmt.Println("Invalid user ID:", err)
 				continue
 			}
 
-			client := &http.Client{}
-			req, err := http.NewRequest("POST", "http://localhost:8080/join-room", bytes.NewBuffer(jsonRoom))
+			jsonBody, err := json.Marshal(map[string]int{"user_id": userID})
+			if err != nil {
+				fmt.Println("Error marshalling request:", err)
+				continue
+			}
+			req, err := http.NewRequest("POST", "http://localhost:8080/rooms/"+args[1]+"/transfer-ownership", bytes.NewBuffer(jsonBody))
 			if err != nil {
 				fmt.Println("Error creating request:", err)
 				continue
@@ -223,19 +1294,19 @@ func main() {
 			req.Header.Add("Authorization", "Bearer "+token)
 			req.Header.Set("Content-Type", "application/json")
 
+			client := &http.Client{}
 			resp, err := client.Do(req)
 			if err != nil {
 				fmt.Println("Error making request:", err)
 				continue
 			}
-			defer resp.Body.Close()
-
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
 			if resp.StatusCode != http.StatusOK {
-				fmt.Println("Error joining room:", resp.Status)
+				fmt.Printf("Error: %s %s\n", resp.Status, strings.TrimSpace(string(body)))
 				continue
 			}
-
-			fmt.Println("Joined chat room successfully")
+			fmt.Printf("User %d now owns room %s\n", userID, args[1])
 
 		case "leave-room":
 			if len(args) != 2 {
@@ -352,37 +1423,126 @@ func main() {
 				continue
 			}
 
+			// list-rooms [--mine] [--archived] [--sort activity|members|name] [search text]
+			query := url.Values{"limit": {"20"}}
+			var search []string
+			for i := 1; i < len(args); i++ {
+				switch {
+				case args[i] == "--mine":
+					query.Set("joined", "true")
+				case args[i] == "--archived":
+					query.Set("archived", "true")
+				case args[i] == "--sort" && i+1 < len(args):
+					i++
+					query.Set("sort", args[i])
+				case args[i] != "":
+					search = append(search, args[i])
+				}
+			}
+			if len(search) > 0 {
+				query.Set("q", strings.Join(search, " "))
+			}
+
+			fmt.Println("Available chat rooms:")
 			client := &http.Client{}
-			req, err := http.NewRequest("GET", "http://localhost:8080/list-rooms", nil)
+			for {
+				req, err := http.NewRequest("GET", "http://localhost:8080/rooms?"+query.Encode(), nil)
+				if err != nil {
+					fmt.Println("Error creating request:", err)
+					break
+				}
+				req.Header.Add("Authorization", "Bearer "+token)
+
+				resp, err := client.Do(req)
+				if err != nil {
+					fmt.Println("Error making request:", err)
+					break
+				}
+				if resp.StatusCode != http.StatusOK {
+					body, _ := io.ReadAll(resp.Body)
+					resp.Body.Close()
+					fmt.Printf("Error listing rooms: %s %s\n", resp.Status, strings.TrimSpace(string(body)))
+					break
+				}
+
+				var page models.RoomPage
+				err = json.NewDecoder(resp.Body).Decode(&page)
+				resp.Body.Close()
+				if err != nil {
+					fmt.Println("Error decoding rooms:", err)
+					break
+				}
+
+				for _, room := range page.Rooms {
+					fmt.Printf("- %s (ID: %d, %s, %d members)\n", room.Name, room.ID, room.Visibility, room.MemberCount)
+					if room.Topic != "" {
+						fmt.Printf("    Topic: %s\n", room.Topic)
+					}
+					if room.Description != "" {
+						fmt.Printf("    %s\n", room.Description)
+					}
+					if room.CreatedAt != nil {
+						fmt.Printf("    Created %s by user %d\n", room.CreatedAt.Local().Format(time.DateTime), room.CreatorID)
+					}
+					if room.LastMessageAt != nil {
+						fmt.Printf("    Last message %s\n", room.LastMessageAt.Local().Format(time.DateTime))
+					} else {
+						fmt.Println("    No messages yet")
+					}
+					if room.ArchivedAt != nil {
+						fmt.Printf("    Archived %s\n", room.ArchivedAt.Local().Format(time.DateTime))
+					}
+				}
+
+				if page.NextCursor == "" {
+					break
+				}
+				fmt.Print("Press Enter for more rooms, or q to stop: ")
+				answer, _ := reader.ReadString('\n')
+				if strings.TrimSpace(answer) != "" {
+					break
+				}
+				query.Set("cursor", page.NextCursor)
+			}
+
+		case "edit-room":
+			if len(args) < 3 || args[2] != "name" && args[2] != "topic" && args[2] != "description" ||
+				args[2] == "name" && len(args) < 4 {
+				fmt.Println("Usage: edit-room <room_id> name|topic|description [text]")
+				continue
+			}
+			token, err := getToken()
+			if err != nil {
+				fmt.Println("Error reading token:", err)
+				continue
+			}
+
+			jsonBody, err := json.Marshal(map[string]string{args[2]: strings.Join(args[3:], " ")})
+			if err != nil {
+				fmt.Println("Error marshalling request:", err)
+				continue
+			}
+			req, err := http.NewRequest("PATCH", "http://localhost:8080/rooms/"+args[1], bytes.NewBuffer(jsonBody))
 			if err != nil {
 				fmt.Println("Error creating request:", err)
 				continue
 			}
 			req.Header.Add("Authorization", "Bearer "+token)
+			req.Header.Set("Content-Type", "application/json")
 
+			client := &http.Client{}
 			resp, err := client.Do(req)
 			if err != nil {
 				fmt.Println("Error making request:", err)
 				continue
 			}
-			defer resp.Body.Close()
-
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
 			if resp.StatusCode != http.StatusOK {
-				fmt.Println("Error listing rooms:", resp.Status)
-
-			}
-
-			var rooms []models.ChatRoom
-			err = json.NewDecoder(resp.Body).Decode(&rooms)
-			if err != nil {
-				fmt.Println("Error decoding rooms:", err)
+				fmt.Printf("Error: %s %s\n", resp.Status, strings.TrimSpace(string(body)))
 				continue
 			}
-
-			fmt.Println("Available chat rooms:")
-			for _, room := range rooms {
-				fmt.Printf("- %s (ID: %d)\n", room.Name, room.ID)
-			}
+			fmt.Printf("Room %s %s updated\n", args[1], args[2])
 
 		case "enter-room":
 			if len(args) != 2 {
@@ -413,27 +1573,96 @@ func main() {
 					}
 
 					type Message struct {
-						SenderID    int    `json:"sender_id"`
-						RecipientID int    `json:"recipient_id,omitempty"`
-						RoomID      int    `json:"room_id,omitempty"`
-						Content     string `json:"content"`
+						SenderID          int        `json:"sender_id"`
+						RecipientID       int        `json:"recipient_id,omitempty"`
+						RoomID            int        `json:"room_id,omitempty"`
+						Content           string     `json:"content"`
+						SenderUsername    string     `json:"sender_username"`
+						SenderDisplayName string     `json:"sender_display_name"`
+						Error             string     `json:"error,omitempty"`
+						Type              string     `json:"type,omitempty"`
+						Role              string     `json:"role,omitempty"`
+						RoomName          string     `json:"room_name,omitempty"`
+						UserID            int        `json:"user_id,omitempty"`
+						ActorID           int        `json:"actor_id,omitempty"`
+						Reason            string     `json:"reason,omitempty"`
+						ExpiresAt         *time.Time `json:"expires_at,omitempty"`
 					}
 					var msg Message
 					if err := json.Unmarshal(message, &msg); err != nil {
 						fmt.Println("Error unmarshalling message:", err)
 						continue
 					}
+					switch msg.Type {
+					case "invited":
+						fmt.Printf("You were invited to room %s (ID: %d). Use join-room %d to accept.\n", msg.RoomName, msg.RoomID, msg.RoomID)
+						continue
+					case "join-requested":
+						fmt.Printf("User %d asks to join room %d: %s\n", msg.UserID, msg.RoomID, msg.Content)
+						fmt.Printf("Use !approve-%d or !deny-%d to answer.\n", msg.UserID, msg.UserID)
+						continue
+					case "join-approved":
+						fmt.Printf("Your request to join room %s (ID: %d) was approved.\n", msg.RoomName, msg.RoomID)
+						continue
+					case "join-denied":
+						fmt.Printf("Your request to join room %s (ID: %d) was denied.\n", msg.RoomName, msg.RoomID)
+						continue
+					case "room-archived":
+						fmt.Printf("[Room %d] User %d archived the room. It is now read-only.\n", msg.RoomID, msg.UserID)
+						continue
+					case "room-unarchived":
+						fmt.Printf("[Room %d] User %d unarchived the room\n", msg.RoomID, msg.UserID)
+						continue
+					case "role-changed":
+						fmt.Printf("[Room %d] User %d is now %s\n", msg.RoomID, msg.UserID, msg.Role)
+						continue
+					case "room-renamed":
+						fmt.Printf("[Room %d] User %d renamed the room to %s\n", msg.RoomID, msg.UserID, msg.RoomName)
+						continue
+					case "topic-changed", "description-changed":
+						what := strings.TrimSuffix(msg.Type, "-changed")
+						if msg.Content == "" {
+							fmt.Printf("[Room %d] User %d cleared the %s\n", msg.RoomID, msg.UserID, what)
+						} else {
+							fmt.Printf("[Room %d] User %d changed the %s to: %s\n", msg.RoomID, msg.UserID, what, msg.Content)
+						}
+						continue
+					case "member-removed", "member-banned", "member-unbanned", "member-muted", "member-unmuted":
+						action := strings.TrimPrefix(msg.Type, "member-")
+						fmt.Printf("[Room %d] User %d %s", msg.RoomID, msg.UserID, action)
+						if msg.ActorID != 0 {
+							fmt.Printf(" by user %d", msg.ActorID)
+						}
+						if msg.ExpiresAt != nil {
+							fmt.Printf(" until %s", msg.ExpiresAt.Local().Format(time.DateTime))
+						}
+						if msg.Reason != "" {
+							fmt.Printf(": %s", msg.Reason)
+						}
+						fmt.Println()
+						continue
+					}
+					if msg.Error != "" {
+						fmt.Println("Message not sent:", msg.Error)
+						continue
+					}
 
+					sender := fmt.Sprintf("User %d", msg.SenderID)
+					if msg.SenderDisplayName != "" {
+						sender = fmt.Sprintf("%s (%s)", msg.SenderDisplayName, msg.SenderUsername)
+					} else if msg.SenderUsername != "" {
+						sender = msg.SenderUsername
+					}
 					if msg.RoomID != 0 {
-						fmt.Printf("[Room %d] (User %d): %s\n", msg.RoomID, msg.SenderID, msg.Content)
+						fmt.Printf("[Room %d] %s: %s\n", msg.RoomID, sender, msg.Content)
 					} else if msg.RecipientID != 0 {
-						fmt.Printf("[DM from User %d]: %s\n", msg.SenderID, msg.Content)
+						fmt.Printf("[DM from %s]: %s\n", sender, msg.Content)
 					}
 				}
 			}()
 
 			for {
-				fmt.Println("Enter message (or !dm-<userid> <message> for direct message, or !leave to leave the room):")
+				fmt.Println("Enter message (or !dm-<userid> <message> for direct message, !approve-<userid> or !deny-<userid> to answer a request to join, or !leave to leave the room):")
 				reader := bufio.NewReader(os.Stdin)
 
 				content, err := reader.ReadString('\n')
@@ -459,6 +1688,34 @@ func main() {
 					Content     string `json:"content"`
 				}
 
+				if strings.HasPrefix(content, "!approve-") || strings.HasPrefix(content, "!deny-") {
+					action, userIDStr, _ := strings.Cut(strings.TrimPrefix(content, "!"), "-")
+					userID, err := strconv.Atoi(userIDStr)
+					if err != nil {
+						fmt.Println("Invalid user ID:", err)
+						continue
+					}
+					roomIDInt, err := strconv.Atoi(roomID)
+					if err != nil {
+						fmt.Println("Invalid room ID:", err)
+						continue
+					}
+					commandBytes, err := json.Marshal(map[string]interface{}{
+						"type":    action + "-join-request",
+						"room_id": roomIDInt,
+						"user_id": userID,
+					})
+					if err != nil {
+						fmt.Println("Error marshalling command:", err)
+						continue
+					}
+					if err := c.WriteMessage(websocket.TextMessage, commandBytes); err != nil {
+						fmt.Println("Error sending command:", err)
+						return
+					}
+					continue
+				}
+
 				var msg Message
 				fmt.Println("message", content)
 				if strings.HasPrefix(content, "!dm-") {
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"chat-app/internal/archive"
+	"chat-app/internal/audit"
+	"chat-app/internal/auth"
+	"chat-app/internal/backup"
+	"chat-app/internal/chat"
+	"chat-app/internal/encryption"
+	"chat-app/internal/transfer"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const usage = `Usage: chat-server [command] [arguments]
+
+Without a command the chat server is started on :8080.
+
+Commands:
+  export-room <room_id> [file]   write a room as NDJSON to file or stdout
+  import-room [file]             recreate a room from NDJSON in file or stdin
+  backup [-gzip] [file]          snapshot the database while the server runs
+  restore [-allow-missing-archive] <file>
+                                 validate a snapshot and replace the database with it
+  generate-message-key <file>    write a new random master key for MESSAGE_KEY_FILE
+  rotate-message-key <file>      re-wrap all data keys with the master key in file
+  generate-jwt-key <alg> <file>  write a new HS256, RS256 or EdDSA token signing key
+  jwt-keys                       check JWT_KEYS_FILE and print its public keys as a JWKS
+  encrypt-messages               encrypt messages stored before a key was configured
+  archive-messages <age>         move messages older than age (e.g. 720h) to archive segments
+  grant-admin <username>         give a user access to the /admin endpoints
+  unlock-login <username|ip>     lift a lockout caused by failed logins
+  reset-2fa <username>           turn off two-factor authentication for a user
+  help                           show this message`
+
+// runCommand executes one of the server's maintenance subcommands
+func runCommand(db *sql.DB, command string, args []string) error {
+	switch command {
+	case "export-room":
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("usage: export-room <room_id> [file]")
+		}
+		roomID, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid room ID: %w", err)
+		}
+
+		var out io.Writer = os.Stdout
+		if len(args) == 2 {
+			file, err := os.Create(args[1])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			out = file
+		}
+		return transfer.ExportRoom(db, roomID, out)
+
+	case "import-room":
+		if len(args) > 1 {
+			return errors.New("usage: import-room [file]")
+		}
+
+		var in io.Reader = os.Stdin
+		if len(args) == 1 {
+			file, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			in = file
+		}
+		result, err := transfer.ImportRoom(db, in)
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(os.Stdout).Encode(result)
+
+	case "backup":
+		flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+		compress := flags.Bool("gzip", false, "gzip-compress the snapshot")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() > 1 {
+			return errors.New("usage: backup [-gzip] [file]")
+		}
+
+		path := flags.Arg(0)
+		if path == "" {
+			path = filepath.Join(backupDir(), backup.FileName(time.Now(), *compress))
+		}
+		manifest, err := backup.Create(context.Background(), db, path, *compress)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s (%d bytes, sha256 %s)\n", path, manifest.Size, manifest.SHA256)
+		return nil
+
+	case "restore":
+		flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+		allowMissing := flags.Bool("allow-missing-archive", false, "restore even if archive segments the snapshot refers to are missing")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return errors.New("usage: restore [-allow-missing-archive] <file>")
+		}
+		args = flags.Args()
+		if _, err := backup.Verify(args[0]); err != nil {
+			return err
+		}
+
+		// keep the current contents around in case the snapshot was the
+		// wrong one
+		safety := filepath.Join(backupDir(), "pre-restore-"+backup.FileName(time.Now(), false))
+		if _, err := backup.Create(context.Background(), db, safety, false); err != nil {
+			return fmt.Errorf("saving current database: %w", err)
+		}
+		err := backup.Restore(context.Background(), db, args[0], *allowMissing)
+		var missing *backup.MissingArchiveError
+		if errors.As(err, &missing) {
+			return fmt.Errorf("%w; restore ARCHIVE_DIR from the same backup first, or pass -allow-missing-archive to restore without them", err)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored %s (previous database saved to %s)\n", args[0], safety)
+		return nil
+
+	case "generate-message-key":
+		if len(args) != 1 {
+			return errors.New("usage: generate-message-key <file>")
+		}
+		key, err := encryption.GenerateKey()
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = fmt.Fprintln(file, key)
+		return err
+
+	case "rotate-message-key":
+		if len(args) != 1 {
+			return errors.New("usage: rotate-message-key <new-key-file>")
+		}
+		if encryption.Default == nil {
+			return errors.New("set MESSAGE_KEY_FILE or MESSAGE_KEY to the current master key first")
+		}
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		next, err := encryption.ParseKey(string(data))
+		if err != nil {
+			return err
+		}
+		n, err := encryption.Default.Rewrap(db, next)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Re-wrapped %d data keys with master key %s; point MESSAGE_KEY_FILE at %s before restarting the server\n", n, next.ID(), args[0])
+		fmt.Println("If the server is running, also set MESSAGE_KEY_PREVIOUS_FILE to the old key, so that data keys it creates until then are re-wrapped when it restarts")
+		return nil
+
+	case "generate-jwt-key":
+		if len(args) != 2 {
+			return errors.New("usage: generate-jwt-key <HS256|RS256|EdDSA> <file>")
+		}
+		key, err := auth.GenerateKey(args[0])
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = file.Write(key)
+		return err
+
+	case "jwt-keys":
+		if len(args) != 0 {
+			return errors.New("usage: jwt-keys")
+		}
+		keys, err := auth.LoadKeyset()
+		if err != nil {
+			return err
+		}
+		if keys == nil {
+			return errors.New("neither JWT_KEYS_FILE nor JWT_SECRET is set")
+		}
+		fmt.Fprintf(os.Stderr, "Signing with %s\n", keys.SigningKeyID())
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string][]auth.JWK{"keys": keys.JWKS()})
+
+	case "encrypt-messages":
+		if len(args) != 0 {
+			return errors.New("usage: encrypt-messages")
+		}
+		n, err := chat.EncryptStoredMessages(db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Encrypted %d messages\n", n)
+		return nil
+
+	case "archive-messages":
+		if len(args) != 1 {
+			return errors.New("usage: archive-messages <age>")
+		}
+		after, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		archiver := &archive.Archiver{DB: db, After: after}
+		n, err := archiver.ArchiveOnce(time.Now())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Archived %d messages to %s\n", n, archive.Dir)
+		return nil
+
+	case "grant-admin":
+		if len(args) != 1 {
+			return errors.New("usage: grant-admin <username>")
+		}
+		res, err := db.Exec("UPDATE users SET is_admin = 1 WHERE username = ?", args[0])
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("user %q not found", args[0])
+		}
+		fmt.Printf("%s is now an admin\n", args[0])
+		return nil
+
+	case "unlock-login":
+		if len(args) != 1 {
+			return errors.New("usage: unlock-login <username|ip>")
+		}
+		scope := auth.UserScope(args[0])
+		if net.ParseIP(args[0]) != nil {
+			scope = auth.IPScope(args[0])
+		}
+		if err := auth.ClearFailures(db, scope); err != nil {
+			return err
+		}
+		fmt.Printf("Cleared failed logins of %s\n", scope)
+		return nil
+
+	case "reset-2fa":
+		if len(args) != 1 {
+			return errors.New("usage: reset-2fa <username>")
+		}
+		var userID int
+		err := db.QueryRow("SELECT id FROM users WHERE username = ?", args[0]).Scan(&userID)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("user %q not found", args[0])
+		}
+		if err != nil {
+			return err
+		}
+		if err := auth.ResetTOTP(db, userID); err != nil {
+			return err
+		}
+		if err := audit.Record(db, audit.TwoFactorReset, userID, "", "reset from the command line"); err != nil {
+			return err
+		}
+		fmt.Printf("Two-factor authentication is off for %s\n", args[0])
+		return nil
+
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", command, usage)
+	}
+}
+
+func backupDir() string {
+	dir := os.Getenv("BACKUP_DIR")
+	if dir == "" {
+		dir = "./backups"
+	}
+	return dir
+}
@@ -0,0 +1,198 @@
+package archive
+
+import (
+	"chat-app/pkg/utils"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// recordsPerSegment caps how many messages a single segment file holds
+const recordsPerSegment = 10000
+
+// Archiver moves messages older than After out of the messages table and
+// into segment files
+type Archiver struct {
+	DB    *sql.DB
+	After time.Duration
+}
+
+// conversation is the unit a segment belongs to: a room, or the direct
+// messages between two users
+type conversation struct {
+	roomID       int
+	userA, userB int
+}
+
+func (c conversation) dir() string {
+	if c.roomID != 0 {
+		return fmt.Sprintf("room-%d", c.roomID)
+	}
+	return fmt.Sprintf("dm-%d-%d", c.userA, c.userB)
+}
+
+// where returns the condition selecting the conversation's messages sent
+// before a cutoff, which the caller appends as the last argument
+func (c conversation) where() (string, []interface{}) {
+	if c.roomID != 0 {
+		return "room_id = ? AND datetime(timestamp) < datetime(?)", []interface{}{c.roomID}
+	}
+	return `room_id IS NULL
+		AND ((sender_id = ? AND recipient_id = ?) OR (sender_id = ? AND recipient_id = ?))
+		AND datetime(timestamp) < datetime(?)`, []interface{}{c.userA, c.userB, c.userB, c.userA}
+}
+
+// Run archives once per interval until ctx is cancelled
+func (a *Archiver) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := a.ArchiveOnce(time.Now())
+		if err != nil {
+			utils.Log.WithError(err).Error("Error archiving messages")
+		} else if n > 0 {
+			utils.Log.WithField("messages", n).Info("Archived messages")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ArchiveOnce moves every message sent more than After before now into
+// segment files and returns how many were moved
+func (a *Archiver) ArchiveOnce(now time.Time) (int, error) {
+	cutoff := now.Add(-a.After).UTC().Format("2006-01-02 15:04:05")
+
+	conversations, err := a.conversations(cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, conv := range conversations {
+		for {
+			n, err := a.archiveSegment(conv, cutoff)
+			if err != nil {
+				return total, err
+			}
+			total += n
+			if n < recordsPerSegment {
+				break
+			}
+		}
+	}
+	return total, nil
+}
+
+func (a *Archiver) conversations(cutoff string) ([]conversation, error) {
+	rows, err := a.DB.Query(`SELECT DISTINCT room_id, 0, 0 FROM messages
+		WHERE room_id IS NOT NULL AND datetime(timestamp) < datetime(?)
+		UNION
+		SELECT 0, MIN(sender_id, recipient_id), MAX(sender_id, recipient_id) FROM messages
+		WHERE room_id IS NULL AND datetime(timestamp) < datetime(?)`, cutoff, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conversations []conversation
+	for rows.Next() {
+		var conv conversation
+		if err := rows.Scan(&conv.roomID, &conv.userA, &conv.userB); err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, conv)
+	}
+	return conversations, rows.Err()
+}
+
+// archiveSegment writes the oldest batch of a conversation's messages to a
+// new segment and deletes them from the messages table. The segment is only
+// referenced once the transaction that deletes the rows commits, so a crash
+// at any point leaves each message in exactly one place.
+func (a *Archiver) archiveSegment(conv conversation, cutoff string) (int, error) {
+	where, args := conv.where()
+	args = append(args, cutoff)
+
+	rows, err := a.DB.Query(`SELECT id, sender_id, recipient_id, room_id, content, timestamp, key_id
+		FROM messages WHERE `+where+` ORDER BY id LIMIT ?`, append(args, recordsPerSegment)...)
+	if err != nil {
+		return 0, err
+	}
+	var records []Record
+	for rows.Next() {
+		var record Record
+		var senderID, recipientID, roomID, keyID sql.NullInt64
+		err := rows.Scan(&record.ID, &senderID, &recipientID, &roomID, &record.Content, &record.Timestamp, &keyID)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		record.SenderID = int(senderID.Int64)
+		record.RecipientID = int(recipientID.Int64)
+		record.RoomID = int(roomID.Int64)
+		record.KeyID = keyID.Int64
+		records = append(records, record)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	first, last := records[0], records[len(records)-1]
+	path := filepath.Join(conv.dir(), fmt.Sprintf("%d-%d.ndjson.gz", first.ID, last.ID))
+	blocks, err := writeSegment(filepath.Join(Dir, path), records)
+	if err != nil {
+		return 0, err
+	}
+	index, err := json.Marshal(blocks)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := a.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var roomID, userA, userB sql.NullInt64
+	if conv.roomID != 0 {
+		roomID = sql.NullInt64{Int64: int64(conv.roomID), Valid: true}
+	} else {
+		userA = sql.NullInt64{Int64: int64(conv.userA), Valid: true}
+		userB = sql.NullInt64{Int64: int64(conv.userB), Valid: true}
+	}
+	_, err = tx.Exec(`INSERT INTO archive_segments
+		(room_id, dm_user_a, dm_user_b, path, first_id, last_id, first_at, last_at, message_count, blocks)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		roomID, userA, userB, path, first.ID, last.ID, first.Timestamp, last.Timestamp, len(records), string(index))
+	if err != nil {
+		os.Remove(filepath.Join(Dir, path))
+		return 0, err
+	}
+
+	// the same predicate as the select, bounded by the batch's ID range,
+	// matches exactly the rows that were written
+	_, err = tx.Exec("DELETE FROM messages WHERE "+where+" AND id BETWEEN ? AND ?", append(args, first.ID, last.ID)...)
+	if err != nil {
+		os.Remove(filepath.Join(Dir, path))
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		os.Remove(filepath.Join(Dir, path))
+		return 0, err
+	}
+	return len(records), nil
+}
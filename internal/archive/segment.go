@@ -0,0 +1,336 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"chat-app/pkg/utils"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Dir is where segment files are kept. Segments are referenced from the
+// archive_segments table by their path relative to Dir.
+var Dir = "./archive"
+
+// recordsPerBlock is how many messages go into one gzip member of a segment.
+// Every block gets an index entry, so a reader only has to decompress the
+// blocks whose ID or time range it needs.
+const recordsPerBlock = 256
+
+// Record is an archived message exactly as it was stored in the messages
+// table. Content stays encrypted if it was encrypted at rest.
+type Record struct {
+	ID          int       `json:"id"`
+	SenderID    int       `json:"sender_id,omitempty"`
+	RecipientID int       `json:"recipient_id,omitempty"`
+	RoomID      int       `json:"room_id,omitempty"`
+	Content     string    `json:"content"`
+	Timestamp   time.Time `json:"timestamp"`
+	KeyID       int64     `json:"key_id,omitempty"`
+}
+
+// Block is one entry of a segment's sparse index
+type Block struct {
+	FirstID int       `json:"first_id"`
+	LastID  int       `json:"last_id"`
+	FirstAt time.Time `json:"first_at"`
+	LastAt  time.Time `json:"last_at"`
+	Offset  int64     `json:"offset"`
+	Length  int64     `json:"length"`
+}
+
+// Segment is an immutable file of archived messages from one conversation
+type Segment struct {
+	ID      int
+	Path    string
+	FirstID int
+	LastID  int
+	Blocks  []Block
+}
+
+// writeSegment writes records, which must be in ID order, to a new segment
+// file and returns its index
+func writeSegment(path string, records []Record) ([]Block, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	defer file.Close()
+
+	var blocks []Block
+	var offset int64
+	for start := 0; start < len(records); start += recordsPerBlock {
+		end := start + recordsPerBlock
+		if end > len(records) {
+			end = len(records)
+		}
+		chunk := records[start:end]
+
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		enc := json.NewEncoder(gz)
+		for _, record := range chunk {
+			if err := enc.Encode(record); err != nil {
+				return nil, err
+			}
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		if _, err := file.Write(buf.Bytes()); err != nil {
+			return nil, err
+		}
+
+		blocks = append(blocks, Block{
+			FirstID: chunk[0].ID,
+			LastID:  chunk[len(chunk)-1].ID,
+			FirstAt: chunk[0].Timestamp,
+			LastAt:  chunk[len(chunk)-1].Timestamp,
+			Offset:  offset,
+			Length:  int64(buf.Len()),
+		})
+		offset += int64(buf.Len())
+	}
+
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return blocks, os.Rename(tmp, path)
+}
+
+// Read returns the records of the blocks of seg accepted by want, in ID order.
+// A nil want reads every block.
+func (seg Segment) Read(want func(Block) bool) ([]Record, error) {
+	file, err := os.Open(filepath.Join(Dir, seg.Path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []Record
+	for _, block := range seg.Blocks {
+		if want != nil && !want(block) {
+			continue
+		}
+		gz, err := gzip.NewReader(io.NewSectionReader(file, block.Offset, block.Length))
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bufio.NewReader(gz))
+		for {
+			var record Record
+			err := dec.Decode(&record)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				gz.Close()
+				return nil, err
+			}
+			records = append(records, record)
+		}
+		gz.Close()
+	}
+	return records, nil
+}
+
+// RoomSegments returns the segments of a room whose first message is older
+// than beforeID (any segment if beforeID is 0), newest first
+func RoomSegments(db *sql.DB, roomID, beforeID int) ([]Segment, error) {
+	return querySegments(db, `WHERE room_id = ? AND (? = 0 OR first_id < ?)
+		ORDER BY last_id DESC`, roomID, beforeID, beforeID)
+}
+
+// DMSegments returns the segments of the direct messages between two users
+// whose first message is older than beforeID (any if beforeID is 0), newest
+// first
+func DMSegments(db *sql.DB, userA, userB, beforeID int) ([]Segment, error) {
+	if userA > userB {
+		userA, userB = userB, userA
+	}
+	return querySegments(db, `WHERE room_id IS NULL AND dm_user_a = ? AND dm_user_b = ?
+		AND (? = 0 OR first_id < ?)
+		ORDER BY last_id DESC`, userA, userB, beforeID, beforeID)
+}
+
+// UserDMSegments returns the segments of every direct conversation userID
+// took part in, newest first
+func UserDMSegments(db *sql.DB, userID int) ([]Segment, error) {
+	return querySegments(db, `WHERE room_id IS NULL AND (dm_user_a = ? OR dm_user_b = ?)
+		ORDER BY last_id DESC`, userID, userID)
+}
+
+// AllRoomSegments returns the segments of every room, oldest first
+func AllRoomSegments(db *sql.DB) ([]Segment, error) {
+	return querySegments(db, "WHERE room_id IS NOT NULL ORDER BY id")
+}
+
+// Contains reports whether a message ID of a room has been archived. db may
+// be a *sql.DB or a *sql.Tx.
+func Contains(db interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, roomID, messageID int) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM archive_segments WHERE room_id = ? AND first_id <= ? AND last_id >= ?",
+		roomID, messageID, messageID).Scan(&count)
+	return count > 0, err
+}
+
+// RoomPaths returns the files of a room's segments. db may be a *sql.DB or a
+// *sql.Tx.
+func RoomPaths(db Querier, roomID int) ([]string, error) {
+	return queryPaths(db, "WHERE room_id = ?", roomID)
+}
+
+// UserDMPaths returns the files of the segments of every direct conversation
+// userID took part in
+func UserDMPaths(db Querier, userID int) ([]string, error) {
+	return queryPaths(db, "WHERE room_id IS NULL AND (dm_user_a = ? OR dm_user_b = ?)", userID, userID)
+}
+
+// RemoveFiles deletes segment files once the rows referencing them are gone,
+// along with conversation directories left empty. Failures are only logged,
+// since a leftover file is unreachable without its row.
+func RemoveFiles(paths []string) {
+	for _, path := range paths {
+		full := filepath.Join(Dir, path)
+		if err := os.Remove(full); err != nil && !os.IsNotExist(err) {
+			utils.Log.WithError(err).WithField("file", full).Warn("Error removing archive segment")
+		}
+		// only succeeds once the directory is empty
+		os.Remove(filepath.Dir(full))
+	}
+}
+
+// ScrubSender removes every archived room message sent by senderID, or with
+// keep set, keeps them without a sender. The segments holding any are
+// rewritten to new files, and deleted once no messages are left in them. It
+// returns how many messages were changed.
+func ScrubSender(db *sql.DB, senderID int, keep bool) (int, error) {
+	segments, err := AllRoomSegments(db)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, seg := range segments {
+		records, err := seg.Read(nil)
+		if err != nil {
+			return total, err
+		}
+		kept := records[:0]
+		changed := 0
+		for _, record := range records {
+			if record.SenderID == senderID {
+				changed++
+				if !keep {
+					continue
+				}
+				record.SenderID = 0
+			}
+			kept = append(kept, record)
+		}
+		if changed == 0 {
+			continue
+		}
+		if err := rewriteSegment(db, seg, kept); err != nil {
+			return total, err
+		}
+		total += changed
+	}
+	return total, nil
+}
+
+// rewriteSegment replaces the file of seg with one holding records, or
+// deletes the segment if there are none. Segment files are never modified in
+// place, so readers holding the old row still find the old file until the
+// new one is referenced.
+func rewriteSegment(db *sql.DB, seg Segment, records []Record) error {
+	if len(records) == 0 {
+		if _, err := db.Exec("DELETE FROM archive_segments WHERE id = ?", seg.ID); err != nil {
+			return err
+		}
+		RemoveFiles([]string{seg.Path})
+		return nil
+	}
+
+	first, last := records[0], records[len(records)-1]
+	path := filepath.Join(filepath.Dir(seg.Path), fmt.Sprintf("%d-%d.%d.ndjson.gz", first.ID, last.ID, time.Now().UnixNano()))
+	blocks, err := writeSegment(filepath.Join(Dir, path), records)
+	if err != nil {
+		return err
+	}
+	index, err := json.Marshal(blocks)
+	if err != nil {
+		os.Remove(filepath.Join(Dir, path))
+		return err
+	}
+	_, err = db.Exec(`UPDATE archive_segments SET path = ?, first_id = ?, last_id = ?, first_at = ?, last_at = ?,
+		message_count = ?, blocks = ? WHERE id = ?`,
+		path, first.ID, last.ID, first.Timestamp, last.Timestamp, len(records), string(index), seg.ID)
+	if err != nil {
+		os.Remove(filepath.Join(Dir, path))
+		return err
+	}
+	RemoveFiles([]string{seg.Path})
+	return nil
+}
+
+// Querier is satisfied by both *sql.DB and *sql.Tx
+type Querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func queryPaths(db Querier, where string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query("SELECT path FROM archive_segments "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+func querySegments(db *sql.DB, where string, args ...interface{}) ([]Segment, error) {
+	rows, err := db.Query("SELECT id, path, first_id, last_id, blocks FROM archive_segments "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	segments := []Segment{}
+	for rows.Next() {
+		var seg Segment
+		var blocks string
+		if err := rows.Scan(&seg.ID, &seg.Path, &seg.FirstID, &seg.LastID, &blocks); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(blocks), &seg.Blocks); err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	return segments, rows.Err()
+}
@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Events written to the audit log
+const (
+	// LoginLockout is recorded whenever failed logins lock an account or an
+	// IP address out
+	LoginLockout = "login_lockout"
+	// APITokenCreated and APITokenRevoked are recorded when a user issues
+	// or revokes an API token for themselves or one of their bots
+	APITokenCreated = "api_token_created"
+	APITokenRevoked = "api_token_revoked"
+	// IdentityLinked is recorded when an OpenID Connect account is linked to
+	// a user, including the users created for new accounts
+	IdentityLinked = "identity_linked"
+	// TwoFactorEnabled and TwoFactorDisabled are recorded when a user turns
+	// TOTP on or off, and TwoFactorReset when an admin turns it off for them
+	TwoFactorEnabled  = "2fa_enabled"
+	TwoFactorDisabled = "2fa_disabled"
+	TwoFactorReset    = "2fa_reset"
+	// PasswordChanged is recorded when a user changes their password, and
+	// PasswordReset when they set a new one with a token sent by email
+	PasswordChanged = "password_changed"
+	PasswordReset   = "password_reset"
+	// SessionRevoked is recorded when a user logs one of their sessions out
+	// from the session list
+	SessionRevoked = "session_revoked"
+)
+
+// Entry is one row of the audit log
+type Entry struct {
+	ID        int       `json:"id"`
+	Event     string    `json:"event"`
+	UserID    int       `json:"user_id,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Record appends an entry to the audit log. userID is 0 when the event does
+// not concern a known user. db may be a *sql.DB or a *sql.Tx.
+func Record(db interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}, event string, userID int, ip, detail string) error {
+	var user sql.NullInt64
+	if userID != 0 {
+		user = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
+	_, err := db.Exec("INSERT INTO audit_log (event, user_id, ip, detail) VALUES (?, ?, ?, ?)", event, user, ip, detail)
+	return err
+}
+
+// List returns up to limit entries older than beforeID (any if beforeID is
+// 0), newest first. A non-empty event only returns entries of that event.
+func List(db *sql.DB, event string, beforeID, limit int) ([]Entry, error) {
+	rows, err := db.Query(`SELECT id, event, user_id, ip, detail, created_at FROM audit_log
+		WHERE (? = '' OR event = ?) AND (? = 0 OR id < ?)
+		ORDER BY id DESC LIMIT ?`, event, event, beforeID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var entry Entry
+		var userID sql.NullInt64
+		var ip, detail sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.Event, &userID, &ip, &detail, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entry.UserID = int(userID.Int64)
+		entry.IP = ip.String
+		entry.Detail = detail.String
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
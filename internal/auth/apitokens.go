@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"chat-app/pkg/models"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APITokenPrefix starts every API token, which is how Authenticate tells them
+// from access tokens
+const APITokenPrefix = "chat_"
+
+// Scopes an API token can be granted
+const (
+	// ScopeReadRooms lists rooms and their members, reads and searches their
+	// history and receives room messages over /ws
+	ScopeReadRooms = "rooms:read"
+	// ScopeDM sends, receives and reads direct messages
+	ScopeDM = "dm"
+	// postScopePrefix is followed by a room ID, or * for every room. It
+	// allows joining, leaving and posting to the room.
+	postScopePrefix = "rooms:post:"
+)
+
+// ErrInvalidAPIToken is returned for unknown, expired and revoked API tokens
+var ErrInvalidAPIToken = errors.New("invalid API token")
+
+// PostScope is the scope that allows posting to a room
+func PostScope(roomID int) string {
+	return postScopePrefix + strconv.Itoa(roomID)
+}
+
+// Scopes are what an API token allows. Requests authenticated with an access
+// token have no Scopes and may do anything their user can.
+type Scopes []string
+
+// ParseScopes checks that every scope in list is one an API token can hold
+func ParseScopes(list []string) (Scopes, error) {
+	if len(list) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	scopes := Scopes{}
+	for _, scope := range list {
+		switch {
+		case scope == ScopeReadRooms, scope == ScopeDM, scope == postScopePrefix+"*":
+		case strings.HasPrefix(scope, postScopePrefix):
+			if id, err := strconv.Atoi(strings.TrimPrefix(scope, postScopePrefix)); err != nil || id <= 0 {
+				return nil, fmt.Errorf("invalid room in scope %q", scope)
+			}
+		default:
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// Allows reports whether scope is one of s
+func (s Scopes) Allows(scope string) bool {
+	for _, granted := range s {
+		if granted == scope || granted == postScopePrefix+"*" && strings.HasPrefix(scope, postScopePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the credentials a request was authenticated with
+// allow scope
+func HasScope(ctx context.Context, scope string) bool {
+	scopes, ok := ctx.Value("scopes").(Scopes)
+	return !ok || scopes.Allows(scope)
+}
+
+// ViaAPIToken reports whether a request was authenticated with an API token
+func ViaAPIToken(ctx context.Context) bool {
+	_, ok := ctx.Value("scopes").(Scopes)
+	return ok
+}
+
+// CreateAPIToken issues a token for userID. It expires after ttl, or never
+// if ttl is 0. The secret is only ever returned here.
+func CreateAPIToken(db *sql.DB, userID int, name string, scopes Scopes, ttl time.Duration) (*models.APIToken, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	secret := APITokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	token := &models.APIToken{
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: now,
+		Token:     secret,
+	}
+	var expiresAt sql.NullString
+	if ttl > 0 {
+		expiry := now.Add(ttl)
+		token.ExpiresAt = &expiry
+		expiresAt = sql.NullString{String: sqlTime(expiry), Valid: true}
+	}
+
+	res, err := db.Exec(`INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, userID, name, hashToken(secret), strings.Join(scopes, " "), sqlTime(now), expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	token.ID = int(id)
+	return token, nil
+}
+
+// ListAPITokens returns the tokens of ownerID and of the bots it owns,
+// including revoked and expired ones
+func ListAPITokens(db *sql.DB, ownerID int) ([]models.APIToken, error) {
+	rows, err := db.Query(`SELECT api_tokens.id, api_tokens.user_id, api_tokens.name, api_tokens.scopes,
+		api_tokens.created_at, api_tokens.last_used_at, api_tokens.expires_at, api_tokens.revoked_at
+		FROM api_tokens JOIN users ON users.id = api_tokens.user_id
+		WHERE users.id = ? OR users.owner_id = ?
+		ORDER BY api_tokens.id`, ownerID, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []models.APIToken{}
+	for rows.Next() {
+		var token models.APIToken
+		var scopes string
+		var lastUsed, expires, revoked sql.NullTime
+		err := rows.Scan(&token.ID, &token.UserID, &token.Name, &scopes,
+			&token.CreatedAt, &lastUsed, &expires, &revoked)
+		if err != nil {
+			return nil, err
+		}
+		token.Scopes = strings.Fields(scopes)
+		token.LastUsedAt = nullTime(lastUsed)
+		token.ExpiresAt = nullTime(expires)
+		token.RevokedAt = nullTime(revoked)
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken revokes a token of ownerID or of one of its bots. It returns
+// sql.ErrNoRows if there is no such token.
+func RevokeAPIToken(db *sql.DB, ownerID, tokenID int) error {
+	res, err := db.Exec(`UPDATE api_tokens SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP)
+		WHERE id = ? AND user_id IN (SELECT id FROM users WHERE id = ? OR owner_id = ?)`,
+		tokenID, ownerID, ownerID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// authenticateAPIToken looks an API token up and returns claims carrying its
+// scopes. Like sessions, its last_used_at is only written if it was last
+// used more than lastUsedInterval ago.
+func authenticateAPIToken(secret string) (*Claims, error) {
+	claims := &Claims{}
+	var scopes string
+	var expiresAt, revokedAt, lastUsedAt sql.NullTime
+	err := sessionDB.QueryRow(`SELECT api_tokens.id, users.id, users.username, users.is_bot, api_tokens.scopes,
+		api_tokens.expires_at, api_tokens.revoked_at, api_tokens.last_used_at
+		FROM api_tokens JOIN users ON users.id = api_tokens.user_id
+		WHERE api_tokens.token_hash = ?`, hashToken(secret)).
+		Scan(&claims.TokenID, &claims.UserId, &claims.Username, &claims.IsBot, &scopes, &expiresAt, &revokedAt, &lastUsedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidAPIToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid || expiresAt.Valid && time.Now().After(expiresAt.Time) {
+		return nil, ErrInvalidAPIToken
+	}
+	claims.Scopes = strings.Fields(scopes)
+	if lastUsedAt.Valid && time.Since(lastUsedAt.Time) < lastUsedInterval {
+		return claims, nil
+	}
+
+	_, err = sessionDB.Exec("UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?", claims.TokenID)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
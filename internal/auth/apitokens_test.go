@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScopesAllows(t *testing.T) {
+	tests := []struct {
+		scopes Scopes
+		scope  string
+		want   bool
+	}{
+		{Scopes{PostScope(1)}, PostScope(1), true},
+		{Scopes{PostScope(1)}, PostScope(2), false},
+		{Scopes{PostScope(1)}, PostScope(10), false},
+		{Scopes{PostScope(10)}, PostScope(1), false},
+		{Scopes{"rooms:post:*"}, PostScope(2), true},
+		{Scopes{"rooms:post:*"}, ScopeDM, false},
+		{Scopes{"rooms:post:*"}, ScopeReadRooms, false},
+		{Scopes{ScopeReadRooms}, PostScope(1), false},
+		{Scopes{ScopeReadRooms}, ScopeDM, false},
+		{Scopes{ScopeDM}, PostScope(1), false},
+		{Scopes{ScopeReadRooms, ScopeDM}, ScopeDM, true},
+		{Scopes{}, ScopeDM, false},
+	}
+	for _, test := range tests {
+		if got := test.scopes.Allows(test.scope); got != test.want {
+			t.Errorf("%v.Allows(%q) = %v, want %v", test.scopes, test.scope, got, test.want)
+		}
+	}
+}
+
+func TestAuthenticateAPIToken(t *testing.T) {
+	db := newTestDB(t)
+	userID := newUser(t, db, "alice")
+	token, err := CreateAPIToken(db, userID, "bot", Scopes{ScopeDM}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		lastUse string
+		updated bool
+	}{
+		{"never used", "", true},
+		{"just used", sqlTime(time.Now().Add(-10 * time.Second)), false},
+		{"used a while ago", sqlTime(time.Now().Add(-2 * lastUsedInterval)), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var before interface{}
+			if test.lastUse != "" {
+				before = test.lastUse
+			}
+			if _, err := db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", before, token.ID); err != nil {
+				t.Fatal(err)
+			}
+			claims, err := Authenticate(token.Token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.TokenID != token.ID || claims.UserId != userID || !claims.Scopes.Allows(ScopeDM) {
+				t.Errorf("got claims %+v", claims)
+			}
+			var after string
+			if err := db.QueryRow("SELECT COALESCE(strftime('%Y-%m-%d %H:%M:%S', last_used_at), '') FROM api_tokens WHERE id = ?", token.ID).Scan(&after); err != nil {
+				t.Fatal(err)
+			}
+			if updated := after != test.lastUse; updated != test.updated {
+				t.Errorf("last_used_at went from %q to %q, want updated %v", test.lastUse, after, test.updated)
+			}
+		})
+	}
+
+	if err := RevokeAPIToken(db, userID, token.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Authenticate(token.Token); err != ErrInvalidAPIToken {
+		t.Errorf("revoked token: got %v, want %v", err, ErrInvalidAPIToken)
+	}
+}
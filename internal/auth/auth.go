@@ -1,10 +1,14 @@
 package auth
 
 import (
+	"chat-app/internal/audit"
 	"chat-app/pkg/models"
 	"chat-app/pkg/utils"
 	"database/sql"
 	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -23,9 +27,23 @@ func VerifyPassword(password, hashedPassword string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
 }
 
+// ErrUsernameTaken is returned when registering a username that exists, or
+// that belonged to an account deleted too recently to be given out again
+var ErrUsernameTaken = errors.New("username is already taken")
+
 // RegisterUser registers a new user with a username and hashedPassword
 func RegisterUser(db *sql.DB, username, hashedPassword string) error {
-	_, err := db.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", username, hashedPassword)
+	retired, err := UsernameRetired(db, username)
+	if err != nil {
+		return err
+	}
+	if retired {
+		return ErrUsernameTaken
+	}
+	_, err = db.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", username, hashedPassword)
+	if isUniqueViolation(err) {
+		return ErrUsernameTaken
+	}
 	if err != nil {
 		utils.Log.WithError(err).Error("Error inserting user into database")
 		return err
@@ -34,28 +52,109 @@ func RegisterUser(db *sql.DB, username, hashedPassword string) error {
 	return nil
 }
 
-// LoginUser logs in a user by verifying the username and password
-func LoginUser(db *sql.DB, username, password string) (*models.Token, error) {
-	user := &models.User{}
+// dummyHash is compared against when the username does not exist, so that
+// the response takes as long as for a wrong password
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
 
+// LoginUser logs in a user by verifying the username and password. Failures
+// are counted against the username and the client's IP address, and either
+// being locked out refuses the login with a *LockedError before the password
+// is even checked. Every other failure is ErrInvalidCredentials. Users with
+// two-factor authentication enabled get a challenge instead of a token,
+// which CompleteLogin redeems. The session is started on device, whose IP
+// is the client's address.
+func LoginUser(db *sql.DB, username, password string, device Device) (*models.Token, *models.Challenge, error) {
+	ip := device.IP
+	scopes := []string{UserScope(username), IPScope(ip)}
+
+	now := time.Now()
+	if err := checkLockout(db, scopes, now); err != nil {
+		return nil, nil, err
+	}
+
+	user := &models.User{}
 	row := db.QueryRow("SELECT id, username, password_hash FROM users WHERE username = ?", username)
 	err := row.Scan(&user.ID, &user.Username, &user.PasswordHash)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, errors.New("user not found")
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+	if err == sql.ErrNoRows {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("no such user"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+	} else if VerifyPassword(password, user.PasswordHash) == nil {
+		enabled, err := TOTPEnabled(db, user.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if enabled {
+			challenge, err := issueChallenge(user.ID, user.Username, device)
+			return nil, challenge, err
+		}
+		if err := ClearFailures(db, UserScope(username)); err != nil {
+			return nil, nil, err
 		}
-		return nil, err
+		token, err := CreateSession(db, user.ID, user.Username, device)
+		return token, nil, err
 	}
 
-	err = VerifyPassword(password, user.PasswordHash)
-	if err != nil {
-		return nil, errors.New("incorrect password")
+	if err := loginFailed(db, scopes, user.ID, ip, now); err != nil {
+		return nil, nil, err
 	}
+	return nil, nil, ErrInvalidCredentials
+}
 
-	tokenString, err := GenerateJWT(user.ID, username)
+// ExternalLogin logs in a user who has proven who they are some other way
+// than with their password, such as through the identity provider. Like
+// LoginUser it only returns a challenge for users with two-factor
+// authentication enabled, which CompleteLogin redeems.
+func ExternalLogin(db *sql.DB, userID int, username string, device Device) (*models.Token, *models.Challenge, error) {
+	enabled, err := TOTPEnabled(db, userID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	if enabled {
+		challenge, err := issueChallenge(userID, username, device)
+		return nil, challenge, err
+	}
+	token, err := CreateSession(db, userID, username, device)
+	return token, nil, err
+}
 
-	return &models.Token{Token: tokenString}, nil
+// checkLockout returns a *LockedError if any of scopes is locked out
+func checkLockout(db *sql.DB, scopes []string, now time.Time) error {
+	for _, scope := range scopes {
+		until, err := lockedUntil(db, scope)
+		if err != nil {
+			return err
+		}
+		if until.After(now) {
+			return &LockedError{Until: until}
+		}
+	}
+	return nil
+}
+
+// loginFailed counts a failed login against each of scopes, logging the
+// lockouts that causes
+func loginFailed(db *sql.DB, scopes []string, userID int, ip string, now time.Time) error {
+	for _, scope := range scopes {
+		until, failures, err := recordFailure(db, scope, now)
+		if err != nil {
+			return err
+		}
+		if until.IsZero() {
+			continue
+		}
+		detail := fmt.Sprintf("%s locked out until %s after %d failed logins", scope, until.UTC().Format(time.RFC3339), failures)
+		if err := audit.Record(db, audit.LoginLockout, userID, ip, detail); err != nil {
+			return err
+		}
+		utils.Log.WithField("scope", scope).WithField("until", until).Warn("Login locked out")
+	}
+	return nil
 }
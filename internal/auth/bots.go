@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"chat-app/pkg/models"
+	"database/sql"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// CreateBot creates a bot account owned by ownerID. Bots have no password, so
+// they can only authenticate with API tokens.
+func CreateBot(db *sql.DB, ownerID int, username string) (*models.User, error) {
+	retired, err := UsernameRetired(db, username)
+	if err != nil {
+		return nil, err
+	}
+	if retired {
+		return nil, ErrUsernameTaken
+	}
+	res, err := db.Exec("INSERT INTO users (username, password_hash, is_bot, owner_id) VALUES (?, '', 1, ?)",
+		username, ownerID)
+	if isUniqueViolation(err) {
+		return nil, ErrUsernameTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &models.User{ID: int(id), Username: username, IsBot: true, OwnerID: ownerID}, nil
+}
+
+// ListBots returns the bot accounts owned by ownerID
+func ListBots(db *sql.DB, ownerID int) ([]models.User, error) {
+	rows, err := db.Query("SELECT id, username FROM users WHERE owner_id = ? AND is_bot = 1 ORDER BY id", ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bots := []models.User{}
+	for rows.Next() {
+		bot := models.User{IsBot: true, OwnerID: ownerID}
+		if err := rows.Scan(&bot.ID, &bot.Username); err != nil {
+			return nil, err
+		}
+		bots = append(bots, bot)
+	}
+	return bots, rows.Err()
+}
+
+// ManagesAccount reports whether ownerID may manage the API tokens of userID,
+// which is its own account or a bot it owns
+func ManagesAccount(db *sql.DB, ownerID, userID int) (bool, error) {
+	if ownerID == userID {
+		return true, nil
+	}
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM users WHERE id = ? AND owner_id = ? AND is_bot = 1", userID, ownerID).Scan(&count)
+	return count > 0, err
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// UsernameRetired reports whether username belonged to a deleted account
+// whose cooldown has not run out yet. db may be a *sql.DB or a *sql.Tx.
+func UsernameRetired(db interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, username string) (bool, error) {
+	var retired bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM retired_usernames
+		WHERE username = ? AND datetime(available_at) > datetime('now'))`, username).Scan(&retired)
+	return retired, err
+}
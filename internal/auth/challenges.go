@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"chat-app/pkg/models"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ChallengeTTL is how long a user has to enter their code after giving
+// their password
+const ChallengeTTL = 5 * time.Minute
+
+// maxChallengeAttempts wrong codes use a challenge up, after which the user
+// has to give their password again
+const maxChallengeAttempts = 5
+
+// ErrInvalidChallenge is returned for unknown, expired and used up login
+// challenges
+var ErrInvalidChallenge = errors.New("invalid or expired login challenge")
+
+// challenges are kept in memory only, like tickets
+var (
+	challenges     = map[string]*challenge{}
+	challengeMutex sync.Mutex
+)
+
+type challenge struct {
+	userID   int
+	username string
+	device   Device
+	attempts int
+	expires  time.Time
+}
+
+// issueChallenge starts the second step of a login for a user whose password
+// has been checked. The session it leads to is started on device.
+func issueChallenge(userID int, username string, device Device) (*models.Challenge, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	value := base64.RawURLEncoding.EncodeToString(buf)
+
+	challengeMutex.Lock()
+	defer challengeMutex.Unlock()
+
+	now := time.Now()
+	for key, c := range challenges {
+		if now.After(c.expires) {
+			delete(challenges, key)
+		}
+	}
+	challenges[hashToken(value)] = &challenge{userID: userID, username: username, device: device, expires: now.Add(ChallengeTTL)}
+	return &models.Challenge{Challenge: value, ExpiresIn: int(ChallengeTTL.Seconds())}, nil
+}
+
+// CompleteLogin redeems a challenge from LoginUser along with a TOTP code or
+// a recovery code, starting the session. Wrong codes count as failed logins,
+// so the lockout applies to guessing them too.
+func CompleteLogin(db *sql.DB, value, code, ip string) (*models.Token, error) {
+	challengeMutex.Lock()
+	c, ok := challenges[hashToken(value)]
+	if ok && time.Now().After(c.expires) {
+		delete(challenges, hashToken(value))
+		ok = false
+	}
+	var userID int
+	var username string
+	var device Device
+	if ok {
+		userID, username, device = c.userID, c.username, c.device
+	}
+	challengeMutex.Unlock()
+	if !ok {
+		return nil, ErrInvalidChallenge
+	}
+
+	scopes := []string{UserScope(username), IPScope(ip)}
+	now := time.Now()
+	if err := checkLockout(db, scopes, now); err != nil {
+		return nil, err
+	}
+
+	err := checkSecondFactor(db, userID, code)
+	if err == ErrInvalidCode {
+		challengeMutex.Lock()
+		c.attempts++
+		if c.attempts >= maxChallengeAttempts {
+			delete(challenges, hashToken(value))
+		}
+		challengeMutex.Unlock()
+		if err := loginFailed(db, scopes, userID, ip, now); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidCode
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	challengeMutex.Lock()
+	delete(challenges, hashToken(value))
+	challengeMutex.Unlock()
+
+	if err := ClearFailures(db, UserScope(username)); err != nil {
+		return nil, err
+	}
+	device.IP = ip
+	return CreateSession(db, userID, username, device)
+}
@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Lifetimes of the tokens mailed to users
+const (
+	EmailVerificationTTL = 24 * time.Hour
+	PasswordResetTTL     = time.Hour
+)
+
+const (
+	purposeVerifyEmail   = "verify_email"
+	purposeResetPassword = "reset_password"
+)
+
+var (
+	// ErrInvalidEmail is returned for strings that are not a bare email
+	// address
+	ErrInvalidEmail = errors.New("invalid email address")
+	// ErrEmailTaken is returned when another user has the address
+	ErrEmailTaken = errors.New("email address is already in use")
+	// ErrInvalidMailedToken is returned for verification and reset tokens
+	// that are malformed, expired or no longer apply
+	ErrInvalidMailedToken = errors.New("invalid or expired token")
+	// ErrWrongPassword is returned when changing a password with the wrong
+	// current one
+	ErrWrongPassword = errors.New("current password is incorrect")
+)
+
+// PolicyError is returned when a new password does not meet the policy
+type PolicyError struct {
+	Problems []string
+}
+
+func (e *PolicyError) Error() string {
+	return "password " + strings.Join(e.Problems, ", ")
+}
+
+// mailedClaims are the claims of the verification and reset tokens sent by
+// email. They are signed with the same keys as access tokens, and their
+// purpose keeps them from being accepted as one.
+type mailedClaims struct {
+	UserID  int    `json:"user_id"`
+	Purpose string `json:"purpose"`
+	// Email is the address a verification token is for, so that it stops
+	// working when the user changes their address
+	Email string `json:"email,omitempty"`
+	// Password fingerprints the password hash a reset token was issued
+	// against, so that it stops working once the password has changed
+	Password string `json:"pwd,omitempty"`
+	jwt.StandardClaims
+}
+
+func signMailedToken(claims mailedClaims, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(ttl).Unix()
+	return Keys.sign(claims)
+}
+
+func parseMailedToken(token, purpose string) (*mailedClaims, error) {
+	claims := &mailedClaims{}
+	parsed, err := jwt.ParseWithClaims(token, claims, Keys.verificationKey)
+	if err != nil || !parsed.Valid || claims.Purpose != purpose {
+		return nil, ErrInvalidMailedToken
+	}
+	return claims, nil
+}
+
+// NormalizeEmail checks that address is a bare email address and lowercases
+// it, so that addresses differing only in case are the same
+func NormalizeEmail(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address {
+		return "", ErrInvalidEmail
+	}
+	return strings.ToLower(address), nil
+}
+
+// SetEmail gives a user a new, unverified email address and returns the
+// token that verifies it
+func SetEmail(db *sql.DB, userID int, email string) (string, error) {
+	_, err := db.Exec("UPDATE users SET email = ?, email_verified_at = NULL WHERE id = ?", email, userID)
+	if isUniqueViolation(err) {
+		return "", ErrEmailTaken
+	}
+	if err != nil {
+		return "", err
+	}
+	return signMailedToken(mailedClaims{UserID: userID, Purpose: purposeVerifyEmail, Email: email}, EmailVerificationTTL)
+}
+
+// ClearEmail removes a user's email address
+func ClearEmail(db *sql.DB, userID int) error {
+	_, err := db.Exec("UPDATE users SET email = NULL, email_verified_at = NULL WHERE id = ?", userID)
+	return err
+}
+
+// VerifyEmail marks the address a verification token was sent to as
+// verified, as long as it is still the user's address
+func VerifyEmail(db *sql.DB, token string) (int, error) {
+	claims, err := parseMailedToken(token, purposeVerifyEmail)
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.Exec("UPDATE users SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP) WHERE id = ? AND email = ?",
+		claims.UserID, claims.Email)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, ErrInvalidMailedToken
+	}
+	return claims.UserID, nil
+}
+
+// PasswordResetToken returns a token that resets the password of the user
+// with the verified email address, or a zero userID if there is none
+func PasswordResetToken(db *sql.DB, email string) (int, string, error) {
+	var userID int
+	var hash string
+	err := db.QueryRow("SELECT id, password_hash FROM users WHERE email = ? AND email_verified_at IS NOT NULL AND is_bot = 0",
+		email).Scan(&userID, &hash)
+	if err == sql.ErrNoRows {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	token, err := signMailedToken(mailedClaims{UserID: userID, Purpose: purposeResetPassword, Password: fingerprint(hash)}, PasswordResetTTL)
+	return userID, token, err
+}
+
+// ResetPassword sets a new password with a reset token, which then stops
+// working. Every session of the user is logged out and their failed logins
+// are forgotten.
+func ResetPassword(db *sql.DB, token, password string) (int, error) {
+	claims, err := parseMailedToken(token, purposeResetPassword)
+	if err != nil {
+		return 0, err
+	}
+
+	var username, hash string
+	err = db.QueryRow("SELECT username, password_hash FROM users WHERE id = ?", claims.UserID).Scan(&username, &hash)
+	if err == sql.ErrNoRows || err == nil && fingerprint(hash) != claims.Password {
+		return 0, ErrInvalidMailedToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := setPassword(db, claims.UserID, username, password, 0); err != nil {
+		return 0, err
+	}
+	return claims.UserID, ClearFailures(db, UserScope(username))
+}
+
+// ChangePassword replaces a user's password after checking the current one.
+// Their sessions other than keepSessionID are logged out, and their IDs
+// returned.
+func ChangePassword(db *sql.DB, userID int, current, password string, keepSessionID int) ([]int, error) {
+	var username, hash string
+	err := db.QueryRow("SELECT username, password_hash FROM users WHERE id = ?", userID).Scan(&username, &hash)
+	if err != nil {
+		return nil, err
+	}
+	if VerifyPassword(current, hash) != nil {
+		return nil, ErrWrongPassword
+	}
+	return setPassword(db, userID, username, password, keepSessionID)
+}
+
+// setPassword checks password against the policy, stores it and revokes
+// the user's sessions other than keepSessionID
+func setPassword(db *sql.DB, userID int, username, password string, keepSessionID int) ([]int, error) {
+	if problems := Policy.Check(username, password); len(problems) > 0 {
+		return nil, &PolicyError{Problems: problems}
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, userID); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query("SELECT id FROM sessions WHERE user_id = ? AND id != ? AND revoked_at IS NULL", userID, keepSessionID)
+	if err != nil {
+		return nil, err
+	}
+	var revoked []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		revoked = append(revoked, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range revoked {
+		if err := revoke(tx, id); err != nil {
+			return nil, err
+		}
+	}
+	return revoked, tx.Commit()
+}
+
+// fingerprint identifies a password hash without revealing it
+func fingerprint(hash string) string {
+	return hashToken(hash)[:16]
+}
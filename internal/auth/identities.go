@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrIdentityLinked is returned when linking an external account that is
+// already linked to a different user
+var ErrIdentityLinked = errors.New("this account is already linked to another user")
+
+// Identity is an account at an external identity provider, as vouched for
+// by a verified ID token
+type Identity struct {
+	Issuer  string
+	Subject string
+	Email   string
+	// Username is the name the provider suggests for a new local user
+	Username string
+}
+
+// ExternalUser returns the local user an identity is linked to. If there is
+// none, a user without a password is created for it, named after the
+// identity's suggested username and numbered if that is taken. created
+// reports which of the two happened.
+func ExternalUser(db *sql.DB, identity Identity) (userID int, username string, created bool, err error) {
+	err = db.QueryRow(`SELECT users.id, users.username FROM user_identities
+		JOIN users ON users.id = user_identities.user_id
+		WHERE user_identities.issuer = ? AND user_identities.subject = ?`, identity.Issuer, identity.Subject).
+		Scan(&userID, &username)
+	if err != sql.ErrNoRows {
+		return userID, username, false, err
+	}
+
+	base := strings.TrimSpace(identity.Username)
+	if base == "" {
+		base = "user"
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", false, err
+	}
+	defer tx.Rollback()
+
+	for n := 1; ; n++ {
+		username = base
+		if n > 1 {
+			username = fmt.Sprintf("%s-%d", base, n)
+		}
+		retired, err := UsernameRetired(tx, username)
+		if err != nil {
+			return 0, "", false, err
+		}
+		if retired && n < 100 {
+			continue
+		}
+		if retired {
+			return 0, "", false, ErrUsernameTaken
+		}
+		res, err := tx.Exec("INSERT INTO users (username, password_hash) VALUES (?, '')", username)
+		if isUniqueViolation(err) && n < 100 {
+			continue
+		}
+		if err != nil {
+			return 0, "", false, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return 0, "", false, err
+		}
+		userID = int(id)
+		break
+	}
+
+	if err := linkIdentity(tx, userID, identity); err != nil {
+		return 0, "", false, err
+	}
+	return userID, username, true, tx.Commit()
+}
+
+// LinkIdentity links an identity to an existing user, so that they can log
+// in with it from then on. Linking it to the same user again does nothing.
+func LinkIdentity(db *sql.DB, userID int, identity Identity) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var linkedTo int
+	err = tx.QueryRow("SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?",
+		identity.Issuer, identity.Subject).Scan(&linkedTo)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	case linkedTo == userID:
+		return nil
+	default:
+		return ErrIdentityLinked
+	}
+
+	if err := linkIdentity(tx, userID, identity); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func linkIdentity(tx *sql.Tx, userID int, identity Identity) error {
+	_, err := tx.Exec("INSERT INTO user_identities (issuer, subject, user_id, email) VALUES (?, ?, ?, ?)",
+		identity.Issuer, identity.Subject, userID, sql.NullString{String: identity.Email, Valid: identity.Email != ""})
+	return err
+}
@@ -7,46 +7,55 @@ import (
 	"github.com/dgrijalva/jwt-go"
 )
 
-var jwtKey = []byte("my_secret_key")
-
 type Claims struct {
-	UserId   int    `json:"user_id"`
-	Username string `json:"username"`
+	UserId    int    `json:"user_id"`
+	Username  string `json:"username"`
+	SessionID int    `json:"sid"`
+	// Purpose is set on tokens that are not access tokens, such as email
+	// verification and password reset tokens, so that they can never be used
+	// as one
+	Purpose string `json:"purpose,omitempty"`
 	jwt.StandardClaims
+
+	// TokenID, IsBot and Scopes are set instead of SessionID when the
+	// request was authenticated with an API token
+	TokenID int    `json:"-"`
+	IsBot   bool   `json:"-"`
+	Scopes  Scopes `json:"-"`
 }
 
-// GenerateJWT generates a new JWT token for a user
-func GenerateJWT(userId int, username string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+// GenerateJWT generates a new access token for a user's session
+func GenerateJWT(userId int, username string, sessionID int) (string, error) {
+	now := time.Now()
 	claims := &Claims{
-		UserId:   userId,
-		Username: username,
+		UserId:    userId,
+		Username:  username,
+		SessionID: sessionID,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(AccessTokenTTL).Unix(),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	tokenString, err := Keys.sign(claims)
 	if err != nil {
 		return "", err
 	}
 	return tokenString, nil
 }
 
-// ValidateJWT validates a JWT token and returns the username
-func ValidateJWT(tokenString string) (int, string, error) {
+// ValidateJWT checks a token's signature and expiry and returns its claims.
+// Use Authenticate to also check that its session is still active.
+func ValidateJWT(tokenString string) (*Claims, error) {
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, Keys.verificationKey)
 	if err != nil {
 		if err == jwt.ErrSignatureInvalid {
-			return 0, "", errors.New("invalid token signature")
+			return nil, errors.New("invalid token signature")
 		}
-		return 0, "", err
+		return nil, err
 	}
-	if !token.Valid {
-		return 0, "", errors.New("invalid token")
+	if !token.Valid || claims.Purpose != "" {
+		return nil, errors.New("invalid token")
 	}
-	return claims.UserId, claims.Username, nil
+	return claims, nil
 }
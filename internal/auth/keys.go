@@ -0,0 +1,305 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Keys signs and verifies every token the server issues. It is set on
+// startup from LoadKeyset.
+var Keys *Keyset
+
+// minSecretLength is the shortest HS256 secret accepted, in bytes
+const minSecretLength = 32
+
+// Key is one token signing key. Keys without a private part can only verify
+// tokens, which is how retired keys are kept until their tokens expire.
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	private interface{}
+	public  interface{}
+}
+
+// Keyset is the key new tokens are signed with plus every key that tokens
+// are still accepted from
+type Keyset struct {
+	signing *Key
+	keys    []*Key
+}
+
+// keysetFile is the format of the file named by JWT_KEYS_FILE. Key files are
+// resolved relative to it.
+type keysetFile struct {
+	SigningKey string `json:"signing_key"`
+	Keys       []struct {
+		ID   string `json:"kid"`
+		Alg  string `json:"alg"`
+		File string `json:"file"`
+	} `json:"keys"`
+}
+
+// LoadKeyset reads the keys listed in the file named by JWT_KEYS_FILE, or a
+// single base64-encoded HS256 secret from JWT_SECRET. It returns nil if
+// neither is set.
+func LoadKeyset() (*Keyset, error) {
+	if path := os.Getenv("JWT_KEYS_FILE"); path != "" {
+		return ReadKeyset(path)
+	}
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		key, err := parseKey("", "HS256", []byte(secret))
+		if err != nil {
+			return nil, fmt.Errorf("JWT_SECRET: %w", err)
+		}
+		return &Keyset{signing: key, keys: []*Key{key}}, nil
+	}
+	return nil, nil
+}
+
+// ReadKeyset reads a keyset file
+func ReadKeyset(path string) (*Keyset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config keysetFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	ks := &Keyset{}
+	for _, entry := range config.Keys {
+		if entry.ID == "" {
+			return nil, fmt.Errorf("%s: every key needs a kid", path)
+		}
+		if ks.key(entry.ID) != nil {
+			return nil, fmt.Errorf("%s: duplicate kid %q", path, entry.ID)
+		}
+		file := entry.File
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		material, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", entry.ID, err)
+		}
+		key, err := parseKey(entry.ID, entry.Alg, material)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", entry.ID, err)
+		}
+		ks.keys = append(ks.keys, key)
+	}
+
+	ks.signing = ks.key(config.SigningKey)
+	if ks.signing == nil {
+		return nil, fmt.Errorf("%s: signing_key %q is not one of the keys", path, config.SigningKey)
+	}
+	if ks.signing.private == nil {
+		return nil, fmt.Errorf("%s: signing key %q has no private key", path, config.SigningKey)
+	}
+	return ks, nil
+}
+
+// EphemeralKeyset returns a random HS256 key that only lives as long as the
+// process, for running without configured keys
+func EphemeralKeyset() (*Keyset, error) {
+	secret := make([]byte, minSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	key, err := parseKey("", "HS256", []byte(base64.StdEncoding.EncodeToString(secret)))
+	if err != nil {
+		return nil, err
+	}
+	return &Keyset{signing: key, keys: []*Key{key}}, nil
+}
+
+// parseKey reads key material for alg: a base64-encoded secret for HS256, or
+// a PEM-encoded private or public key for RS256 and EdDSA. An empty id is
+// derived from the key.
+func parseKey(id, alg string, material []byte) (*Key, error) {
+	key := &Key{ID: id}
+
+	switch alg {
+	case "HS256":
+		secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(material)))
+		if err != nil {
+			return nil, fmt.Errorf("secret must be base64: %w", err)
+		}
+		if len(secret) < minSecretLength {
+			return nil, fmt.Errorf("secret must be at least %d bytes, got %d", minSecretLength, len(secret))
+		}
+		key.Method = jwt.SigningMethodHS256
+		key.private, key.public = secret, secret
+
+	case "RS256", "EdDSA":
+		block, _ := pem.Decode(material)
+		if block == nil {
+			return nil, errors.New("no PEM data found")
+		}
+		var parsed interface{}
+		var err error
+		switch block.Type {
+		case "PRIVATE KEY":
+			parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PUBLIC KEY":
+			parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+		default:
+			return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch k := parsed.(type) {
+		case *rsa.PrivateKey:
+			key.private, key.public = k, &k.PublicKey
+		case *rsa.PublicKey:
+			key.public = k
+		case ed25519.PrivateKey:
+			key.private, key.public = k, k.Public()
+		case ed25519.PublicKey:
+			key.public = k
+		default:
+			return nil, fmt.Errorf("unsupported key type %T", parsed)
+		}
+
+		_, isRSA := key.public.(*rsa.PublicKey)
+		if alg == "RS256" && !isRSA || alg == "EdDSA" && isRSA {
+			return nil, fmt.Errorf("key is not usable with %s", alg)
+		}
+		if alg == "RS256" {
+			key.Method = jwt.SigningMethodRS256
+		} else {
+			key.Method = SigningMethodEdDSA
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	if key.ID == "" {
+		sum := sha256.Sum256(material)
+		key.ID = hex.EncodeToString(sum[:8])
+	}
+	return key, nil
+}
+
+// GenerateKey returns new key material for alg in the format parseKey reads
+func GenerateKey(alg string) ([]byte, error) {
+	var private crypto.PrivateKey
+	var err error
+	switch alg {
+	case "HS256":
+		secret := make([]byte, minSecretLength)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		return []byte(base64.StdEncoding.EncodeToString(secret) + "\n"), nil
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 3072)
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// SigningKeyID returns the kid of the key new tokens are signed with
+func (ks *Keyset) SigningKeyID() string {
+	return ks.signing.ID
+}
+
+func (ks *Keyset) key(id string) *Key {
+	for _, key := range ks.keys {
+		if key.ID == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// sign signs claims with the signing key and names it in the kid header
+func (ks *Keyset) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signing.Method, claims)
+	token.Header["kid"] = ks.signing.ID
+	return token.SignedString(ks.signing.private)
+}
+
+// verificationKey is the jwt.Keyfunc that picks the key a token names. The
+// token's algorithm has to be the key's, so that for instance an RS256 public
+// key can never be used as an HS256 secret.
+func (ks *Keyset) verificationKey(token *jwt.Token) (interface{}, error) {
+	id, _ := token.Header["kid"].(string)
+	key := ks.key(id)
+	if key == nil {
+		return nil, errors.New("unknown signing key")
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, errors.New("unexpected signing algorithm")
+	}
+	return key.public, nil
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS returns the public keys of the keyset. HS256 secrets are never
+// included, so only tokens signed with RS256 or EdDSA can be verified by
+// other services.
+func (ks *Keyset) JWKS() []JWK {
+	keys := []JWK{}
+	for _, key := range ks.keys {
+		jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	return keys
+}
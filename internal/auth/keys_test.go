@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// newTestKey generates a key for alg with the given kid
+func newTestKey(t *testing.T, id, alg string) *Key {
+	t.Helper()
+	material, err := GenerateKey(alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := parseKey(id, alg, material)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerificationKeyChecksAlgorithm(t *testing.T) {
+	rsaKey := newTestKey(t, "rsa", "RS256")
+	edKey := newTestKey(t, "ed", "EdDSA")
+	hsKey := newTestKey(t, "hs", "HS256")
+	ks := &Keyset{signing: rsaKey, keys: []*Key{rsaKey, edKey, hsKey}}
+
+	previous := Keys
+	Keys = ks
+	t.Cleanup(func() { Keys = previous })
+
+	// the RSA public key as it would be published, which anyone can use as
+	// an HS256 secret
+	der, err := x509.MarshalPKIXPublicKey(rsaKey.public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	tests := []struct {
+		name   string
+		kid    string
+		method jwt.SigningMethod
+		key    interface{}
+		err    string
+	}{
+		{"RS256 with its key", "rsa", jwt.SigningMethodRS256, rsaKey.private, ""},
+		{"EdDSA with its key", "ed", SigningMethodEdDSA, edKey.private, ""},
+		{"HS256 with its key", "hs", jwt.SigningMethodHS256, hsKey.private, ""},
+		{"HS256 with the RSA public key", "rsa", jwt.SigningMethodHS256, published, "unexpected signing algorithm"},
+		{"PS256 for the RSA key", "rsa", jwt.SigningMethodPS256, rsaKey.private, "unexpected signing algorithm"},
+		{"HS256 for the EdDSA key", "ed", jwt.SigningMethodHS256, hsKey.private, "unexpected signing algorithm"},
+		{"RS256 for the HS256 key", "hs", jwt.SigningMethodRS256, rsaKey.private, "unexpected signing algorithm"},
+		{"EdDSA for the RSA key", "rsa", SigningMethodEdDSA, edKey.private, "unexpected signing algorithm"},
+		{"unknown kid", "other", jwt.SigningMethodRS256, rsaKey.private, "unknown signing key"},
+		{"no kid", "", jwt.SigningMethodRS256, rsaKey.private, "unknown signing key"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := jwt.NewWithClaims(test.method, &Claims{
+				UserId:   1,
+				Username: "alice",
+				StandardClaims: jwt.StandardClaims{
+					ExpiresAt: time.Now().Add(time.Minute).Unix(),
+				},
+			})
+			if test.kid != "" {
+				token.Header["kid"] = test.kid
+			}
+			raw, err := token.SignedString(test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = ValidateJWT(raw)
+			if test.err == "" && err != nil {
+				t.Errorf("rejected: %v", err)
+			}
+			if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Errorf("got %v, want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestParseKeyChecksAlgorithm(t *testing.T) {
+	rsaMaterial, err := GenerateKey("RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	edMaterial, err := GenerateKey("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		alg      string
+		material []byte
+	}{
+		{"RSA key as EdDSA", "EdDSA", rsaMaterial},
+		{"Ed25519 key as RS256", "RS256", edMaterial},
+		{"PEM key as HS256", "HS256", rsaMaterial},
+		{"unknown algorithm", "none", rsaMaterial},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := parseKey("k", test.alg, test.material); err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ErrInvalidCredentials is returned for every failed login, whether or not
+// the username exists
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// LockedError is returned for logins refused because of earlier failures
+type LockedError struct {
+	Until time.Time
+}
+
+func (e *LockedError) Error() string {
+	return "too many failed login attempts, try again later"
+}
+
+// LockoutPolicy decides when failed logins lock an account or an IP address
+// out, and for how long
+type LockoutPolicy struct {
+	// MaxFailures is how many failures in a row are allowed before the
+	// first lockout
+	MaxFailures int
+	// Base is how long the first lockout lasts. Every further failure
+	// doubles it, up to Max.
+	Base time.Duration
+	Max  time.Duration
+	// Window is how long after the last failure or lockout the failures are
+	// forgotten
+	Window time.Duration
+}
+
+// Lockout is applied on login. It is set on startup from LoadLockoutPolicy.
+var Lockout = LockoutPolicy{MaxFailures: 5, Base: time.Minute, Max: 24 * time.Hour, Window: time.Hour}
+
+// LoadLockoutPolicy reads LOGIN_MAX_FAILURES, LOGIN_LOCKOUT,
+// LOGIN_LOCKOUT_MAX and LOGIN_FAILURE_WINDOW
+func LoadLockoutPolicy() (LockoutPolicy, error) {
+	policy := Lockout
+	if value := os.Getenv("LOGIN_MAX_FAILURES"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return policy, fmt.Errorf("LOGIN_MAX_FAILURES must be a positive number, got %q", value)
+		}
+		policy.MaxFailures = n
+	}
+	durations := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"LOGIN_LOCKOUT", &policy.Base},
+		{"LOGIN_LOCKOUT_MAX", &policy.Max},
+		{"LOGIN_FAILURE_WINDOW", &policy.Window},
+	}
+	for _, d := range durations {
+		value := os.Getenv(d.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return policy, fmt.Errorf("%s must be a positive duration, got %q", d.name, value)
+		}
+		*d.value = parsed
+	}
+	return policy, nil
+}
+
+// lockoutFor returns how long the given number of failures locks a scope
+// out, or 0 if they are still allowed
+func (p LockoutPolicy) lockoutFor(failures int) time.Duration {
+	if failures < p.MaxFailures {
+		return 0
+	}
+	d := p.Base
+	for i := p.MaxFailures; i < failures && d < p.Max; i++ {
+		d *= 2
+	}
+	if d > p.Max {
+		d = p.Max
+	}
+	return d
+}
+
+// lockedUntil returns when the lockout of a scope ends, which is in the past
+// if it is not locked out
+func lockedUntil(db *sql.DB, scope string) (time.Time, error) {
+	var until sql.NullTime
+	err := db.QueryRow("SELECT locked_until FROM login_failures WHERE scope = ?", scope).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return until.Time, err
+}
+
+// recordFailure counts a failed login against a scope. If that locks the
+// scope out, it returns when the lockout ends and how many failures caused
+// it.
+func recordFailure(db *sql.DB, scope string, now time.Time) (time.Time, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	defer tx.Rollback()
+
+	var failures int
+	var lastFailure, until sql.NullTime
+	err = tx.QueryRow("SELECT failures, last_failure_at, locked_until FROM login_failures WHERE scope = ?", scope).
+		Scan(&failures, &lastFailure, &until)
+	if err != nil && err != sql.ErrNoRows {
+		return time.Time{}, 0, err
+	}
+
+	quietSince := lastFailure.Time
+	if until.Time.After(quietSince) {
+		quietSince = until.Time
+	}
+	if now.Sub(quietSince) > Lockout.Window {
+		failures = 0
+	}
+	failures++
+
+	var lockout sql.NullString
+	var lockedUntil time.Time
+	if d := Lockout.lockoutFor(failures); d > 0 {
+		lockedUntil = now.Add(d)
+		lockout = sql.NullString{String: sqlTime(lockedUntil), Valid: true}
+	}
+	_, err = tx.Exec(`INSERT INTO login_failures (scope, failures, last_failure_at, locked_until) VALUES (?, ?, ?, ?)
+		ON CONFLICT (scope) DO UPDATE SET failures = excluded.failures,
+		last_failure_at = excluded.last_failure_at, locked_until = excluded.locked_until`,
+		scope, failures, sqlTime(now), lockout)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return lockedUntil, failures, tx.Commit()
+}
+
+// ClearFailures forgets the failed logins of a scope, lifting any lockout
+func ClearFailures(db *sql.DB, scope string) error {
+	_, err := db.Exec("DELETE FROM login_failures WHERE scope = ?", scope)
+	return err
+}
+
+// UserScope and IPScope name what failed logins are counted against
+func UserScope(username string) string {
+	return "user:" + username
+}
+
+func IPScope(ip string) string {
+	return "ip:" + ip
+}
+
+// sqlTime formats t the way SQLite's CURRENT_TIMESTAMP does
+func sqlTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// withLockout applies policy for the rest of a test
+func withLockout(t *testing.T, policy LockoutPolicy) {
+	t.Helper()
+	previous := Lockout
+	Lockout = policy
+	t.Cleanup(func() { Lockout = previous })
+}
+
+func TestLockoutFor(t *testing.T) {
+	policy := LockoutPolicy{MaxFailures: 3, Base: time.Minute, Max: 10 * time.Minute, Window: time.Hour}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+		{6, 8 * time.Minute},
+		{7, 10 * time.Minute},
+		{100, 10 * time.Minute},
+	}
+	for _, test := range tests {
+		if got := policy.lockoutFor(test.failures); got != test.want {
+			t.Errorf("lockoutFor(%d) = %v, want %v", test.failures, got, test.want)
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	db := newTestDB(t)
+	withLockout(t, LockoutPolicy{MaxFailures: 3, Base: time.Minute, Max: time.Hour, Window: time.Hour})
+	newUser(t, db, "alice")
+	device := Device{IP: "192.0.2.1"}
+
+	tests := []struct {
+		name     string
+		password string
+		locked   bool
+	}{
+		{"first failure", "wrong", false},
+		{"second failure", "wrong", false},
+		{"third failure locks out", "wrong", false},
+		{"wrong password while locked out", "wrong", true},
+		{"right password while locked out", testPassword, true},
+	}
+	for _, test := range tests {
+		_, _, err := LoginUser(db, "alice", test.password, device)
+		var locked *LockedError
+		if test.locked && !errors.As(err, &locked) {
+			t.Fatalf("%s: got %v, want a lockout", test.name, err)
+		}
+		if !test.locked && err != ErrInvalidCredentials {
+			t.Fatalf("%s: got %v, want %v", test.name, err, ErrInvalidCredentials)
+		}
+	}
+
+	// another address is still locked out of the account
+	if _, _, err := LoginUser(db, "alice", testPassword, Device{IP: "192.0.2.2"}); !errors.As(err, new(*LockedError)) {
+		t.Fatalf("from another address: got %v, want a lockout", err)
+	}
+
+	// once the lockouts end, the right password gets in again
+	if _, err := db.Exec("UPDATE login_failures SET locked_until = ?", sqlTime(time.Now().Add(-time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := LoginUser(db, "alice", testPassword, device)
+	if err != nil || token == nil {
+		t.Fatalf("after the lockout: got %v %v", token, err)
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	db := newTestDB(t)
+	withLockout(t, LockoutPolicy{MaxFailures: 2, Base: time.Minute, Max: time.Hour, Window: time.Hour})
+	scope := UserScope("bob")
+	start := time.Now().Truncate(time.Second)
+
+	tests := []struct {
+		name     string
+		at       time.Duration
+		failures int
+		lockout  time.Duration
+	}{
+		{"first failure", 0, 1, 0},
+		{"second failure locks out", time.Minute, 2, time.Minute},
+		{"failure after the lockout doubles it", 3 * time.Minute, 3, 2 * time.Minute},
+		{"failure after the window starts over", 5*time.Minute + time.Hour + time.Second, 1, 0},
+	}
+	for _, test := range tests {
+		now := start.Add(test.at)
+		until, failures, err := recordFailure(db, scope, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failures != test.failures {
+			t.Errorf("%s: %d failures, want %d", test.name, failures, test.failures)
+		}
+		var lockout time.Duration
+		if !until.IsZero() {
+			lockout = until.Sub(now)
+		}
+		if lockout != test.lockout {
+			t.Errorf("%s: locked out for %v, want %v", test.name, lockout, test.lockout)
+		}
+	}
+
+	// a successful login lifts a lockout
+	now := start.Add(5*time.Minute + time.Hour + 2*time.Second)
+	if until, _, err := recordFailure(db, scope, now); err != nil || until.IsZero() {
+		t.Fatalf("second failure: locked until %v %v", until, err)
+	}
+	if err := ClearFailures(db, scope); err != nil {
+		t.Fatal(err)
+	}
+	if until, err := lockedUntil(db, scope); err != nil || !until.IsZero() {
+		t.Errorf("after ClearFailures: locked until %v %v", until, err)
+	}
+}
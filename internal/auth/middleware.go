@@ -6,8 +6,22 @@ import (
 	"strings"
 )
 
-// JWTMiddleware is a middleware function that validates JWT tokens
+// JWTMiddleware is a middleware function that validates JWT tokens. API
+// tokens are refused; endpoints that accept them use ScopedMiddleware.
 func JWTMiddleware(next http.Handler) http.Handler {
+	return authMiddleware(next, func(*Claims) bool { return false })
+}
+
+// ScopedMiddleware is JWTMiddleware that also accepts API tokens granted
+// scope. An empty scope accepts every API token and leaves checking its
+// scopes to the handler, with HasScope.
+func ScopedMiddleware(scope string, next http.Handler) http.Handler {
+	return authMiddleware(next, func(claims *Claims) bool {
+		return scope == "" || claims.Scopes.Allows(scope)
+	})
+}
+
+func authMiddleware(next http.Handler, acceptAPIToken func(*Claims) bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
@@ -16,14 +30,22 @@ func JWTMiddleware(next http.Handler) http.Handler {
 		}
 
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		userId, username, err := ValidateJWT(tokenString)
+		claims, err := Authenticate(tokenString)
 		if err != nil {
 			http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
 			return
 		}
+		if claims.TokenID != 0 && !acceptAPIToken(claims) {
+			http.Error(w, "API token does not allow this", http.StatusForbidden)
+			return
+		}
 
-		ctx := context.WithValue(r.Context(), "userId", userId)
-		ctx = context.WithValue(ctx, "username", username)
+		ctx := context.WithValue(r.Context(), "userId", claims.UserId)
+		ctx = context.WithValue(ctx, "username", claims.Username)
+		ctx = context.WithValue(ctx, "sessionId", claims.SessionID)
+		if claims.TokenID != 0 {
+			ctx = context.WithValue(ctx, "scopes", claims.Scopes)
+		}
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxPasswordBytes is the most bcrypt hashes; longer passwords are rejected
+// rather than silently truncated
+const maxPasswordBytes = 72
+
+// PasswordPolicy is what a new password has to satisfy
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+// Policy is checked on registration. It is set on startup from
+// LoadPasswordPolicy.
+var Policy = PasswordPolicy{MinLength: 8}
+
+// LoadPasswordPolicy reads PASSWORD_MIN_LENGTH and PASSWORD_REQUIRE, a
+// comma-separated list of character classes out of upper, lower, digit and
+// symbol
+func LoadPasswordPolicy() (PasswordPolicy, error) {
+	policy := PasswordPolicy{MinLength: 8}
+	if value := os.Getenv("PASSWORD_MIN_LENGTH"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return policy, fmt.Errorf("PASSWORD_MIN_LENGTH must be a positive number, got %q", value)
+		}
+		policy.MinLength = n
+	}
+	if value := os.Getenv("PASSWORD_REQUIRE"); value != "" {
+		for _, class := range strings.Split(value, ",") {
+			switch strings.TrimSpace(class) {
+			case "upper":
+				policy.RequireUpper = true
+			case "lower":
+				policy.RequireLower = true
+			case "digit":
+				policy.RequireDigit = true
+			case "symbol":
+				policy.RequireSymbol = true
+			default:
+				return policy, fmt.Errorf("PASSWORD_REQUIRE: unknown character class %q", class)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// Check returns a description of every rule password breaks, or nil if it
+// satisfies the policy
+func (p PasswordPolicy) Check(username, password string) []string {
+	var problems []string
+	if n := len([]rune(password)); n < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+	if len(password) > maxPasswordBytes {
+		problems = append(problems, fmt.Sprintf("must be at most %d bytes long", maxPasswordBytes))
+	}
+	if username != "" && strings.EqualFold(password, username) {
+		problems = append(problems, "must not be the username")
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		problems = append(problems, "must contain an upper-case letter")
+	}
+	if p.RequireLower && !lower {
+		problems = append(problems, "must contain a lower-case letter")
+	}
+	if p.RequireDigit && !digit {
+		problems = append(problems, "must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		problems = append(problems, "must contain a symbol")
+	}
+	return problems
+}
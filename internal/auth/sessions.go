@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"chat-app/pkg/models"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Token lifetimes, overridden on startup by ACCESS_TOKEN_TTL and
+// REFRESH_TOKEN_TTL. A session expires once it goes unused for
+// RefreshTokenTTL.
+var (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var (
+	// ErrInvalidRefreshToken is returned for unknown, expired and revoked
+	// refresh tokens
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when a refresh token is presented a
+	// second time. Only a copy of the token can do that, so the session it
+	// belongs to is revoked.
+	ErrRefreshTokenReused = errors.New("refresh token already used, session revoked")
+	// ErrSessionRevoked is returned for access tokens of a session that has
+	// been logged out
+	ErrSessionRevoked = errors.New("session has been revoked")
+)
+
+// lastUsedInterval is how stale a session's last_used_at may get before a
+// request updates it, so that requests do not each write to the database
+const lastUsedInterval = time.Minute
+
+// maxDeviceField is the longest device name or client version stored with a
+// session
+const maxDeviceField = 100
+
+// Device describes where a session was started from
+type Device struct {
+	Name          string
+	ClientVersion string
+	IP            string
+}
+
+// sessionDB is where Authenticate looks sessions up. It is set by Init.
+var sessionDB *sql.DB
+
+// Init lets Authenticate check sessions in db
+func Init(db *sql.DB) {
+	sessionDB = db
+}
+
+// CreateSession starts a new session for a user on device and returns its
+// first access and refresh tokens
+func CreateSession(db *sql.DB, userID int, username string, device Device) (*models.Token, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO sessions (user_id, expires_at, device_name, client_version, ip) VALUES (?, ?, ?, ?, ?)",
+		userID, sessionExpiry(), truncate(device.Name), truncate(device.ClientVersion), device.IP)
+	if err != nil {
+		return nil, err
+	}
+	sessionID, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := issueTokens(tx, int(sessionID), userID, username)
+	if err != nil {
+		return nil, err
+	}
+	return token, tx.Commit()
+}
+
+// RefreshSession exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token works once. The ID of the session the
+// token belonged to is returned along with ErrRefreshTokenReused, so that
+// the caller can act on the revocation. ip is recorded as the session's
+// latest address.
+func RefreshSession(db *sql.DB, refreshToken, ip string) (*models.Token, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	var sessionID, userID int
+	var username string
+	var usedAt, revokedAt sql.NullTime
+	var expiresAt time.Time
+	err = tx.QueryRow(`SELECT sessions.id, sessions.user_id, users.username, refresh_tokens.used_at,
+		sessions.revoked_at, sessions.expires_at
+		FROM refresh_tokens
+		JOIN sessions ON sessions.id = refresh_tokens.session_id
+		JOIN users ON users.id = sessions.user_id
+		WHERE refresh_tokens.token_hash = ?`, hashToken(refreshToken)).
+		Scan(&sessionID, &userID, &username, &usedAt, &revokedAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, 0, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		return nil, 0, ErrInvalidRefreshToken
+	}
+
+	if usedAt.Valid {
+		if err := revoke(tx, sessionID); err != nil {
+			return nil, 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, 0, err
+		}
+		return nil, sessionID, ErrRefreshTokenReused
+	}
+
+	_, err = tx.Exec("UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP WHERE token_hash = ?", hashToken(refreshToken))
+	if err != nil {
+		return nil, 0, err
+	}
+	_, err = tx.Exec("UPDATE sessions SET last_used_at = CURRENT_TIMESTAMP, expires_at = ?, ip = ? WHERE id = ?",
+		sessionExpiry(), ip, sessionID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	token, err := issueTokens(tx, sessionID, userID, username)
+	if err != nil {
+		return nil, 0, err
+	}
+	return token, sessionID, tx.Commit()
+}
+
+// RevokeSession logs a session out. Its access tokens are rejected from then
+// on and its refresh tokens no longer work.
+func RevokeSession(db *sql.DB, sessionID int) error {
+	return revoke(db, sessionID)
+}
+
+// RevokeUserSession logs out a session of userID. It returns sql.ErrNoRows
+// if the user has no such active session.
+func RevokeUserSession(db *sql.DB, userID, sessionID int) error {
+	res, err := db.Exec("UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListSessions returns the sessions of a user that are neither revoked nor
+// expired, most recently used first
+func ListSessions(db *sql.DB, userID int) ([]models.Session, error) {
+	rows, err := db.Query(`SELECT id, COALESCE(device_name, ''), COALESCE(client_version, ''), COALESCE(ip, ''),
+		created_at, last_used_at, expires_at
+		FROM sessions WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY last_used_at DESC, id DESC`, userID, sqlTime(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var session models.Session
+		err := rows.Scan(&session.ID, &session.DeviceName, &session.ClientVersion, &session.IP,
+			&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func revoke(db interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}, sessionID int) error {
+	_, err := db.Exec("UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND revoked_at IS NULL", sessionID)
+	return err
+}
+
+// Authenticate validates an access token and checks that its session is
+// still active, or looks up an API token
+func Authenticate(tokenString string) (*Claims, error) {
+	if strings.HasPrefix(tokenString, APITokenPrefix) {
+		return authenticateAPIToken(tokenString)
+	}
+
+	claims, err := ValidateJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkSession(claims.SessionID, claims.UserId); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkSession returns ErrSessionRevoked unless a session of userID is
+// active, and records that the session was used if it was last recorded
+// more than lastUsedInterval ago
+func checkSession(sessionID, userID int) error {
+	var revokedAt, lastUsedAt sql.NullTime
+	err := sessionDB.QueryRow("SELECT revoked_at, last_used_at FROM sessions WHERE id = ? AND user_id = ?",
+		sessionID, userID).Scan(&revokedAt, &lastUsedAt)
+	if err == sql.ErrNoRows || revokedAt.Valid {
+		return ErrSessionRevoked
+	}
+	if err != nil {
+		return err
+	}
+	if lastUsedAt.Valid && time.Since(lastUsedAt.Time) < lastUsedInterval {
+		return nil
+	}
+
+	_, err = sessionDB.Exec("UPDATE sessions SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?", sessionID)
+	return err
+}
+
+// issueTokens signs an access token for a session and stores a new refresh
+// token for it
+func issueTokens(tx *sql.Tx, sessionID, userID int, username string) (*models.Token, error) {
+	access, err := GenerateJWT(userID, username, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	refresh := base64.RawURLEncoding.EncodeToString(buf)
+	_, err = tx.Exec("INSERT INTO refresh_tokens (token_hash, session_id) VALUES (?, ?)", hashToken(refresh), sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.Token{
+		Token:        access,
+		RefreshToken: refresh,
+		ExpiresIn:    int(AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// sessionExpiry is when a session used now expires, in the format SQLite's
+// date functions compare correctly
+func sessionExpiry() string {
+	return sqlTime(time.Now().Add(RefreshTokenTTL))
+}
+
+// truncate shortens a client-supplied device field to maxDeviceField bytes,
+// without splitting a UTF-8 sequence
+func truncate(s string) string {
+	if len(s) <= maxDeviceField {
+		return s
+	}
+	s = s[:maxDeviceField]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// hashToken is how refresh tokens are stored, so that a copy of the database
+// cannot be used to log in
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
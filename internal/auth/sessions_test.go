@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"chat-app/internal/database/databasetest"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// newTestDB creates a database for a test and checks sessions in it
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db := databasetest.Open(t)
+	if Keys == nil {
+		var err error
+		if Keys, err = EphemeralKeyset(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Init(db)
+	return db
+}
+
+// testPassword is the password of users created by newUser
+const testPassword = "correct horse battery staple"
+
+// newUser registers username with testPassword and returns its ID
+func newUser(t *testing.T, db *sql.DB, username string) int {
+	t.Helper()
+	hashed, err := HashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterUser(db, username, hashed); err != nil {
+		t.Fatal(err)
+	}
+	var userID int
+	if err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+func TestCheckSessionThrottlesLastUsed(t *testing.T) {
+	db := newTestDB(t)
+	userID := newUser(t, db, "alice")
+	token, err := CreateSession(db, userID, "alice", Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ValidateJWT(token.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		lastUse time.Time
+		updated bool
+	}{
+		{"just used", time.Now().Add(-10 * time.Second), false},
+		{"used a while ago", time.Now().Add(-2 * lastUsedInterval), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := sqlTime(test.lastUse)
+			if _, err := db.Exec("UPDATE sessions SET last_used_at = ? WHERE id = ?", before, claims.SessionID); err != nil {
+				t.Fatal(err)
+			}
+			if err := checkSession(claims.SessionID, userID); err != nil {
+				t.Fatal(err)
+			}
+			var after string
+			if err := db.QueryRow("SELECT strftime('%Y-%m-%d %H:%M:%S', last_used_at) FROM sessions WHERE id = ?", claims.SessionID).Scan(&after); err != nil {
+				t.Fatal(err)
+			}
+			if updated := after != before; updated != test.updated {
+				t.Errorf("last_used_at went from %s to %s, want updated %v", before, after, test.updated)
+			}
+		})
+	}
+
+	if err := RevokeSession(db, claims.SessionID); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSession(claims.SessionID, userID); err != ErrSessionRevoked {
+		t.Errorf("revoked session: got %v, want %v", err, ErrSessionRevoked)
+	}
+}
+
+func TestRefreshSessionReplayRevokes(t *testing.T) {
+	db := newTestDB(t)
+	userID := newUser(t, db, "alice")
+	first, err := CreateSession(db, userID, "alice", Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ValidateJWT(first.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, sessionID, err := RefreshSession(db, first.RefreshToken, "192.0.2.1")
+	if err != nil || sessionID != claims.SessionID {
+		t.Fatalf("first refresh: got session %d %v", sessionID, err)
+	}
+
+	// whoever replays the used token, the thief or the user, ends the
+	// session for both
+	if token, sessionID, err := RefreshSession(db, first.RefreshToken, "198.51.100.1"); err != ErrRefreshTokenReused || token != nil || sessionID != claims.SessionID {
+		t.Fatalf("replay: got %v session %d %v, want %v", token, sessionID, err, ErrRefreshTokenReused)
+	}
+	if err := checkSession(claims.SessionID, userID); err != ErrSessionRevoked {
+		t.Errorf("session after the replay: got %v, want %v", err, ErrSessionRevoked)
+	}
+	if _, err := Authenticate(second.Token); err != ErrSessionRevoked {
+		t.Errorf("access token issued before the replay: got %v, want %v", err, ErrSessionRevoked)
+	}
+	if _, _, err := RefreshSession(db, second.RefreshToken, "192.0.2.1"); err != ErrInvalidRefreshToken {
+		t.Errorf("refresh token issued before the replay: got %v, want %v", err, ErrInvalidRefreshToken)
+	}
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+// TicketTTL is how long a WebSocket ticket can be redeemed for
+const TicketTTL = 30 * time.Second
+
+// ErrInvalidTicket is returned for unknown, expired and already used tickets
+var ErrInvalidTicket = errors.New("invalid or expired ticket")
+
+// tickets are kept in memory only: they live for seconds and are redeemed by
+// the process that issued them
+var (
+	tickets     = map[string]ticket{}
+	ticketMutex sync.Mutex
+)
+
+type ticket struct {
+	claims  Claims
+	expires time.Time
+}
+
+// IssueTicket returns a single-use ticket that opens a WebSocket connection
+// on behalf of the session in claims. Browsers cannot set the Authorization
+// header on WebSocket upgrades, so they fetch a ticket with their access
+// token and pass it in the URL or as a subprotocol instead.
+func IssueTicket(claims *Claims) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	value := base64.RawURLEncoding.EncodeToString(buf)
+
+	ticketMutex.Lock()
+	defer ticketMutex.Unlock()
+
+	now := time.Now()
+	for key, t := range tickets {
+		if now.After(t.expires) {
+			delete(tickets, key)
+		}
+	}
+	tickets[hashToken(value)] = ticket{claims: *claims, expires: now.Add(TicketTTL)}
+	return value, nil
+}
+
+// RedeemTicket uses up a ticket and returns the claims it was issued for, as
+// long as their session is still active
+func RedeemTicket(value string) (*Claims, error) {
+	ticketMutex.Lock()
+	t, ok := tickets[hashToken(value)]
+	delete(tickets, hashToken(value))
+	ticketMutex.Unlock()
+
+	if !ok || time.Now().After(t.expires) {
+		return nil, ErrInvalidTicket
+	}
+	if err := checkSession(t.claims.SessionID, t.claims.UserId); err != nil {
+		return nil, err
+	}
+	return &t.claims, nil
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// newTicketClaims opens a session for a test and returns claims for it
+func newTicketClaims(t *testing.T) *Claims {
+	t.Helper()
+	db := newTestDB(t)
+	userID := newUser(t, db, "alice")
+	token, err := CreateSession(db, userID, "alice", Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ValidateJWT(token.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestTicketWorksOnce(t *testing.T) {
+	claims := newTicketClaims(t)
+	ticket, err := IssueTicket(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redeemed, err := RedeemTicket(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redeemed.UserId != claims.UserId || redeemed.SessionID != claims.SessionID {
+		t.Errorf("got claims %+v, want %+v", redeemed, claims)
+	}
+	if _, err := RedeemTicket(ticket); err != ErrInvalidTicket {
+		t.Errorf("second use: got %v, want %v", err, ErrInvalidTicket)
+	}
+	if _, err := RedeemTicket("made up"); err != ErrInvalidTicket {
+		t.Errorf("unknown ticket: got %v, want %v", err, ErrInvalidTicket)
+	}
+}
+
+func TestTicketExpires(t *testing.T) {
+	claims := newTicketClaims(t)
+
+	tests := []struct {
+		name string
+		age  time.Duration
+		err  error
+	}{
+		{"fresh", 0, nil},
+		{"nearly expired", TicketTTL - time.Second, nil},
+		{"expired", TicketTTL + time.Second, ErrInvalidTicket},
+	}
+	for _, test := range tests {
+		ticket, err := IssueTicket(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// age the ticket as if it had been issued test.age ago
+		ticketMutex.Lock()
+		issued := tickets[hashToken(ticket)]
+		issued.expires = issued.expires.Add(-test.age)
+		tickets[hashToken(ticket)] = issued
+		ticketMutex.Unlock()
+
+		if _, err := RedeemTicket(ticket); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	// expired tickets are dropped when the next one is issued
+	stale, err := IssueTicket(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticketMutex.Lock()
+	issued := tickets[hashToken(stale)]
+	issued.expires = time.Now().Add(-time.Second)
+	tickets[hashToken(stale)] = issued
+	ticketMutex.Unlock()
+	if _, err := IssueTicket(claims); err != nil {
+		t.Fatal(err)
+	}
+	ticketMutex.Lock()
+	_, kept := tickets[hashToken(stale)]
+	ticketMutex.Unlock()
+	if kept {
+		t.Error("expired ticket was kept")
+	}
+}
+
+func TestTicketOfRevokedSession(t *testing.T) {
+	claims := newTicketClaims(t)
+	ticket, err := IssueTicket(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeSession(sessionDB, claims.SessionID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RedeemTicket(ticket); err != ErrSessionRevoked {
+		t.Errorf("got %v, want %v", err, ErrSessionRevoked)
+	}
+}
@@ -0,0 +1,270 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters. These are the RFC 6238 defaults, which is all many
+// authenticator apps support.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpModulus is 10^totpDigits
+	totpModulus = 1000000
+	// totpSkew is how many periods a code may be early or late, to allow for
+	// clock drift and slow typing
+	totpSkew = 1
+)
+
+// TOTPIssuer names the service in authenticator apps
+const TOTPIssuer = "chat-app"
+
+// recoveryCodeCount recovery codes of recoveryCodeLength characters are
+// issued when two-factor authentication is enabled
+const (
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+// recoveryCodeAlphabet leaves out characters that are easily confused
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+var (
+	// ErrTOTPEnabled is returned when enrolling a user who already has
+	// two-factor authentication enabled
+	ErrTOTPEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrTOTPNotEnrolled is returned when confirming or disabling two-factor
+	// authentication that was never set up
+	ErrTOTPNotEnrolled = errors.New("two-factor authentication is not set up")
+	// ErrInvalidCode is returned for wrong, reused and malformed codes
+	ErrInvalidCode = errors.New("invalid code")
+)
+
+// TOTPEnrollment is what a user adds to their authenticator app
+type TOTPEnrollment struct {
+	// Secret is the base32-encoded shared secret, for typing in by hand
+	Secret string `json:"secret"`
+	// ProvisioningURI is an otpauth:// URI, usually shown as a QR code
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// EnrollTOTP generates a new TOTP secret for a user. It takes effect once
+// ConfirmTOTP proves the user's authenticator has it; enrolling again before
+// that replaces the secret.
+func EnrollTOTP(db *sql.DB, userID int, username string) (*TOTPEnrollment, error) {
+	enabled, err := TOTPEnabled(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTOTPEnabled
+	}
+
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+
+	_, err = db.Exec(`INSERT INTO totp (user_id, secret) VALUES (?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, last_step = 0, created_at = CURRENT_TIMESTAMP`,
+		userID, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {TOTPIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	uri := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + TOTPIssuer + ":" + username, RawQuery: query.Encode()}
+	return &TOTPEnrollment{Secret: secret, ProvisioningURI: uri.String()}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication once the user enters a code
+// from their newly enrolled authenticator. It returns recovery codes, each
+// of which can be used once instead of a code. They are only ever returned
+// here.
+func ConfirmTOTP(db *sql.DB, userID int, code string) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var enabledAt sql.NullTime
+	err = tx.QueryRow("SELECT enabled_at FROM totp WHERE user_id = ?", userID).Scan(&enabledAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enabledAt.Valid {
+		return nil, ErrTOTPEnabled
+	}
+	if err := checkTOTP(tx, userID, code, time.Now()); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("UPDATE totp SET enabled_at = CURRENT_TIMESTAMP WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = recoveryCode(); err != nil {
+			return nil, err
+		}
+		_, err := tx.Exec("INSERT INTO recovery_codes (code_hash, user_id) VALUES (?, ?)",
+			hashToken(normalizeRecoveryCode(codes[i])), userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// DisableTOTP turns two-factor authentication off, which takes a current
+// code or a recovery code
+func DisableTOTP(db *sql.DB, userID int, code string) error {
+	enabled, err := TOTPEnabled(db, userID)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return ErrTOTPNotEnrolled
+	}
+	if err := checkSecondFactor(db, userID, code); err != nil {
+		return err
+	}
+	return ResetTOTP(db, userID)
+}
+
+// ResetTOTP removes a user's authenticator and recovery codes without asking
+// for a code, for admins helping users who have lost both
+func ResetTOTP(db *sql.DB, userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM totp WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// TOTPEnabled reports whether a user has confirmed a TOTP authenticator
+func TOTPEnabled(db *sql.DB, userID int) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM totp WHERE user_id = ? AND enabled_at IS NOT NULL", userID).Scan(&count)
+	return count > 0, err
+}
+
+// checkSecondFactor accepts a TOTP code or an unused recovery code, which is
+// used up
+func checkSecondFactor(db *sql.DB, userID int, code string) error {
+	code = strings.Join(strings.Fields(code), "")
+	if len(code) == totpDigits {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := checkTOTP(tx, userID, code, time.Now()); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	res, err := db.Exec("UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE code_hash = ? AND user_id = ? AND used_at IS NULL",
+		hashToken(normalizeRecoveryCode(code)), userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// checkTOTP verifies a code against the user's secret. Each code works only
+// once: the period it belongs to is recorded, and codes of that period or
+// earlier ones are refused from then on.
+func checkTOTP(tx *sql.Tx, userID int, code string, now time.Time) error {
+	var secret string
+	var lastStep int64
+	err := tx.QueryRow("SELECT secret, last_step FROM totp WHERE user_id = ?", userID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return err
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep || subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) != 1 {
+			continue
+		}
+		_, err := tx.Exec("UPDATE totp SET last_step = ? WHERE user_id = ?", step, userID)
+		return err
+	}
+	return ErrInvalidCode
+}
+
+// totpCode computes the code for a time step (RFC 4226 section 5.3)
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulus)
+}
+
+func recoveryCode() (string, error) {
+	code := make([]byte, recoveryCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(recoveryCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = recoveryCodeAlphabet[n.Int64()]
+	}
+	half := recoveryCodeLength / 2
+	return string(code[:half]) + "-" + string(code[half:]), nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enableTOTP turns two-factor authentication on for a user, returning the
+// authenticator's key and the recovery codes
+func enableTOTP(t *testing.T, db *sql.DB, userID int, username string) ([]byte, []string) {
+	t.Helper()
+	enrollment, err := EnrollTOTP(db, userID, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// confirm with the previous period's code, leaving the current one for
+	// the test
+	codes, err := ConfirmTOTP(db, userID, totpCode(key, time.Now().Unix()/totpPeriod-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, codes
+}
+
+func TestCheckTOTP(t *testing.T) {
+	db := newTestDB(t)
+	userID := newUser(t, db, "alice")
+	key, _ := enableTOTP(t, db, userID, "alice")
+	now := time.Now()
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		lastStep int64
+		code     string
+		err      error
+	}{
+		{"current code", current - 2, totpCode(key, current), nil},
+		{"late code", current - 2, totpCode(key, current-1), nil},
+		{"early code", current - 2, totpCode(key, current+1), nil},
+		{"too late", current - 3, totpCode(key, current-2), ErrInvalidCode},
+		{"too early", current - 2, totpCode(key, current+2), ErrInvalidCode},
+		{"reused code", current, totpCode(key, current), ErrInvalidCode},
+		{"code before the last one used", current, totpCode(key, current-1), ErrInvalidCode},
+		{"malformed code", current - 2, "abcdef", ErrInvalidCode},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := db.Exec("UPDATE totp SET last_step = ? WHERE user_id = ?", test.lastStep, userID); err != nil {
+				t.Fatal(err)
+			}
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			if err := checkTOTP(tx, userID, test.code, now); err != test.err {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			// a code that was accepted is refused the second time
+			if test.err != nil {
+				return
+			}
+			tx, err = db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			if err := checkTOTP(tx, userID, test.code, now); err != ErrInvalidCode {
+				t.Errorf("second use: got %v, want %v", err, ErrInvalidCode)
+			}
+		})
+	}
+}
+
+func TestCompleteLoginCodesWorkOnce(t *testing.T) {
+	db := newTestDB(t)
+	userID := newUser(t, db, "bob")
+	key, recovery := enableTOTP(t, db, userID, "bob")
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+
+	tests := []struct {
+		name string
+		code string
+		err  error
+	}{
+		{"TOTP code", code, nil},
+		{"same TOTP code", code, ErrInvalidCode},
+		{"recovery code", recovery[0], nil},
+		{"same recovery code", recovery[0], ErrInvalidCode},
+		{"same recovery code differently typed", " " + strings.ToUpper(strings.Replace(recovery[0], "-", " ", 1)), ErrInvalidCode},
+		{"another recovery code differently typed", strings.ToUpper(strings.Replace(recovery[1], "-", "", 1)), nil},
+		{"made up recovery code", "abcde-fghjk", ErrInvalidCode},
+	}
+	for _, test := range tests {
+		token, challenge, err := LoginUser(db, "bob", testPassword, Device{IP: "192.0.2.1"})
+		if err != nil || token != nil || challenge == nil {
+			t.Fatalf("%s: LoginUser got %v %v %v, want only a challenge", test.name, token, challenge, err)
+		}
+		token, err = CompleteLogin(db, challenge.Challenge, test.code, "192.0.2.1")
+		if err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+		if err == nil && token == nil {
+			t.Errorf("%s: no token", test.name)
+		}
+	}
+
+	var unused int
+	if err := db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&unused); err != nil {
+		t.Fatal(err)
+	}
+	if unused != recoveryCodeCount-2 {
+		t.Errorf("%d recovery codes left, want %d", unused, recoveryCodeCount-2)
+	}
+}
@@ -0,0 +1,440 @@
+package backup
+
+import (
+	"chat-app/internal/archive"
+	"chat-app/internal/database"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// pagesPerStep is how many database pages are copied while holding the read
+// lock. Between steps the server's own writes can proceed.
+const pagesPerStep = 256
+
+// Manifest describes a snapshot and is stored next to it as
+// <snapshot>.manifest.json
+type Manifest struct {
+	File          string    `json:"file"`
+	SHA256        string    `json:"sha256"`
+	Size          int64     `json:"size"`
+	Compressed    bool      `json:"compressed"`
+	SchemaVersion int       `json:"schema_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	// ArchiveSegments are the archive segment files the snapshot refers to.
+	// They are not part of the snapshot and have to be backed up along with
+	// it; Restore checks that they are in place.
+	ArchiveSegments []SegmentFile `json:"archive_segments,omitempty"`
+}
+
+// SegmentFile is an archive segment as it was when a snapshot was taken
+type SegmentFile struct {
+	// Path is relative to archive.Dir
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Missing is set if the file was already gone
+	Missing bool `json:"missing,omitempty"`
+}
+
+// MissingArchiveError is returned by Restore when segment files the snapshot
+// refers to are not in archive.Dir
+type MissingArchiveError struct {
+	Paths []string
+}
+
+func (e *MissingArchiveError) Error() string {
+	paths := e.Paths
+	if len(paths) > 5 {
+		paths = append(paths[:5:5], "...")
+	}
+	return fmt.Sprintf("%d archive segments the snapshot refers to are missing or changed in %s: %s",
+		len(e.Paths), archive.Dir, strings.Join(paths, ", "))
+}
+
+// FileName returns the default name of a snapshot taken at t
+func FileName(t time.Time, compress bool) string {
+	name := "chat-app-" + t.UTC().Format("20060102-150405") + ".db"
+	if compress {
+		name += ".gz"
+	}
+	return name
+}
+
+// ManifestPath returns where the manifest of a snapshot file is kept
+func ManifestPath(snapshot string) string {
+	return snapshot + ".manifest.json"
+}
+
+// Create takes a consistent snapshot of db using SQLite's online backup API
+// and writes it to path, gzip-compressed if compress is set. The database
+// stays usable by other connections while the copy runs.
+func Create(ctx context.Context, db *sql.DB, path string, compress bool) (*Manifest, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	tmp := path + ".tmp"
+	defer os.Remove(tmp)
+	if err := copyDatabase(ctx, tmp, db); err != nil {
+		return nil, err
+	}
+
+	version, err := schemaVersion(tmp)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := segmentFiles(tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{
+		File:            filepath.Base(path),
+		Compressed:      compress,
+		SchemaVersion:   version,
+		CreatedAt:       time.Now().UTC(),
+		ArchiveSegments: segments,
+	}
+	if err := writeSnapshot(tmp, path, compress, manifest); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(ManifestPath(path), data, 0644); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Verify checks a snapshot against its manifest and returns the manifest
+func Verify(path string) (*Manifest, error) {
+	data, err := os.ReadFile(ManifestPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	if size != manifest.Size || hex.EncodeToString(hash.Sum(nil)) != manifest.SHA256 {
+		return nil, errors.New("snapshot does not match its manifest checksum")
+	}
+	return manifest, nil
+}
+
+// Restore replaces the contents of db with the snapshot at path. The
+// snapshot's checksum, integrity and schema version are validated first,
+// and it is migrated to the current schema after being copied in. Unless
+// allowMissingArchive is set, it also refuses snapshots whose archive
+// segments are not in archive.Dir, returning a *MissingArchiveError.
+func Restore(ctx context.Context, db *sql.DB, path string, allowMissingArchive bool) error {
+	manifest, err := Verify(path)
+	if err != nil {
+		return err
+	}
+	if manifest.SchemaVersion > database.SchemaVersion {
+		return fmt.Errorf("snapshot has schema version %d, this server only knows up to %d", manifest.SchemaVersion, database.SchemaVersion)
+	}
+
+	source := path
+	if manifest.Compressed {
+		source = path + ".restore"
+		defer os.Remove(source)
+		if err := decompress(path, source); err != nil {
+			return err
+		}
+	}
+
+	if err := validate(source, manifest.SchemaVersion); err != nil {
+		return err
+	}
+	if !allowMissingArchive {
+		if err := checkArchive(source, manifest); err != nil {
+			return err
+		}
+	}
+
+	snapshot, err := sql.Open("sqlite3", "file:"+source+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	err = withRaw(ctx, db, func(dst *sqlite3.SQLiteConn) error {
+		return withRaw(ctx, snapshot, func(src *sqlite3.SQLiteConn) error {
+			// a single step so that readers see either the old or the new
+			// database, never a mix of both
+			return step(ctx, dst, src, -1)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return database.Migrate(db)
+}
+
+// copyDatabase copies db into a new database file at path
+func copyDatabase(ctx context.Context, path string, db *sql.DB) error {
+	os.Remove(path)
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	return withRaw(ctx, dest, func(dst *sqlite3.SQLiteConn) error {
+		return withRaw(ctx, db, func(src *sqlite3.SQLiteConn) error {
+			return step(ctx, dst, src, pagesPerStep)
+		})
+	})
+}
+
+func step(ctx context.Context, dst, src *sqlite3.SQLiteConn, pages int) error {
+	bk, err := dst.Backup("main", src, "main")
+	if err != nil {
+		return err
+	}
+	for {
+		done, err := bk.Step(pages)
+		if err != nil {
+			bk.Close()
+			return err
+		}
+		if done {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			bk.Close()
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return bk.Finish()
+}
+
+func withRaw(ctx context.Context, db *sql.DB, f func(*sqlite3.SQLiteConn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		sqliteConn, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return errors.New("database is not a sqlite3 connection")
+		}
+		return f(sqliteConn)
+	})
+}
+
+// writeSnapshot moves the raw database copy at tmp to path, compressing it
+// on the way if asked to, and fills in the manifest's checksum and size
+func writeSnapshot(tmp, path string, compress bool, manifest *Manifest) error {
+	in, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(out, hash)}
+	if compress {
+		gz := gzip.NewWriter(counter)
+		if _, err := io.Copy(gz, in); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	} else if _, err := io.Copy(counter, in); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+
+	manifest.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	manifest.Size = counter.n
+	return nil
+}
+
+func decompress(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, gz)
+	return err
+}
+
+// validate opens the snapshot read-only and makes sure it is an intact chat
+// database of the version recorded in its manifest
+func validate(path string, version int) error {
+	snapshot, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	var result string
+	if err := snapshot.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return fmt.Errorf("snapshot is not a readable database: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("snapshot failed integrity check: %s", result)
+	}
+
+	var actual int
+	if err := snapshot.QueryRow("PRAGMA user_version").Scan(&actual); err != nil {
+		return err
+	}
+	if actual != version {
+		return fmt.Errorf("snapshot schema version %d does not match manifest version %d", actual, version)
+	}
+
+	for _, table := range []string{"users", "chat_rooms", "room_users", "messages"} {
+		var count int
+		err := snapshot.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("snapshot is missing the %s table", table)
+		}
+	}
+	return nil
+}
+
+// segmentFiles lists the archive segments the database at path refers to,
+// with their current size in archive.Dir
+func segmentFiles(path string) ([]SegmentFile, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT path FROM archive_segments ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var segments []SegmentFile
+	for rows.Next() {
+		segment := SegmentFile{}
+		if err := rows.Scan(&segment.Path); err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(filepath.Join(archive.Dir, segment.Path))
+		if err == nil {
+			segment.Size = info.Size()
+		} else if os.IsNotExist(err) {
+			segment.Missing = true
+		} else {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	return segments, rows.Err()
+}
+
+// checkArchive makes sure the segments the snapshot at path refers to are in
+// archive.Dir, with the size recorded in its manifest. Manifests written
+// before segments were recorded only get the files checked for.
+func checkArchive(path string, manifest *Manifest) error {
+	recorded := map[string]SegmentFile{}
+	for _, segment := range manifest.ArchiveSegments {
+		recorded[segment.Path] = segment
+	}
+	segments, err := segmentFiles(path)
+	if err != nil {
+		return err
+	}
+
+	missing := &MissingArchiveError{}
+	for _, segment := range segments {
+		want, ok := recorded[segment.Path]
+		if segment.Missing || ok && !want.Missing && want.Size != segment.Size {
+			missing.Paths = append(missing.Paths, segment.Path)
+		}
+	}
+	if len(missing.Paths) > 0 {
+		return missing
+	}
+	return nil
+}
+
+func schemaVersion(path string) (int, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var version int
+	err = db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,70 @@
+package backup
+
+import (
+	"chat-app/internal/archive"
+	"chat-app/internal/database/databasetest"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// archivedSnapshot takes a snapshot of a database with one archived room
+// message, returning the snapshot and the segment's path in archive.Dir
+func archivedSnapshot(t *testing.T) (string, string) {
+	t.Helper()
+	archive.Dir = t.TempDir()
+	db := databasetest.Open(t)
+	_, err := db.Exec(`INSERT INTO users (id, username, password_hash) VALUES (1, 'ada', '');
+		INSERT INTO chat_rooms (id, name, creator_id) VALUES (1, 'old times', 1);
+		INSERT INTO messages (sender_id, room_id, content, timestamp) VALUES (1, 1, 'long ago', '2000-01-01 00:00:00')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := (&archive.Archiver{DB: db, After: time.Hour}).ArchiveOnce(time.Now()); err != nil || n != 1 {
+		t.Fatalf("archiving: got %d %v", n, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "snapshot.db")
+	manifest, err := Create(context.Background(), db, path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.ArchiveSegments) != 1 || manifest.ArchiveSegments[0].Missing || manifest.ArchiveSegments[0].Size == 0 {
+		t.Fatalf("manifest lists segments %+v", manifest.ArchiveSegments)
+	}
+	return path, filepath.Join(archive.Dir, manifest.ArchiveSegments[0].Path)
+}
+
+func TestRestoreChecksArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		damage  func(segment string) error
+		allow   bool
+		missing bool
+	}{
+		{"intact", func(string) error { return nil }, false, false},
+		{"deleted", os.Remove, false, true},
+		{"truncated", func(segment string) error { return os.Truncate(segment, 1) }, false, true},
+		{"deleted but allowed", os.Remove, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			snapshot, segment := archivedSnapshot(t)
+			if err := test.damage(segment); err != nil {
+				t.Fatal(err)
+			}
+
+			err := Restore(context.Background(), databasetest.Open(t), snapshot, test.allow)
+			var missing *MissingArchiveError
+			if test.missing && !errors.As(err, &missing) {
+				t.Errorf("got %v, want a *MissingArchiveError", err)
+			}
+			if !test.missing && err != nil {
+				t.Errorf("restoring: %v", err)
+			}
+		})
+	}
+}
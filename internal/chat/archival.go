@@ -0,0 +1,36 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// ErrRoomArchived is returned when posting to, editing messages in,
+// changing or joining an archived room
+var ErrRoomArchived = errors.New("this room is archived and read-only")
+
+// SetArchived archives a room, or brings it back if archived is false.
+// Archived rooms keep their members and history but are read-only, and are
+// left out of the room list. Archiving an archived room keeps its original
+// archival time.
+func SetArchived(db *sql.DB, roomID int, archived bool) error {
+	res, err := db.Exec(`UPDATE chat_rooms SET archived_at = CASE WHEN ? THEN COALESCE(archived_at, CURRENT_TIMESTAMP) END
+		WHERE id = ?`, archived, roomID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrRoomNotFound
+	}
+	return nil
+}
+
+// IsArchived reports whether a room is archived. A room that does not exist
+// is not. db may be a *sql.DB or a *sql.Tx.
+func IsArchived(db interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, roomID int) (bool, error) {
+	var archived bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM chat_rooms WHERE id = ? AND archived_at IS NOT NULL)", roomID).Scan(&archived)
+	return archived, err
+}
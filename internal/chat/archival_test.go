@@ -0,0 +1,113 @@
+package chat
+
+import (
+	"chat-app/internal/database/databasetest"
+	"chat-app/pkg/models"
+	"testing"
+	"time"
+)
+
+func TestArchivedRoomGainsNoMembers(t *testing.T) {
+	db := databasetest.Open(t)
+	owner := databasetest.NewUser(t, db, "olivia")
+	public := newRoom(t, db, owner, models.VisibilityPublic)
+	restricted := newRoom(t, db, owner, models.VisibilityRestricted)
+	private := newRoom(t, db, owner, models.VisibilityPrivate)
+
+	// ways in that were opened before the rooms were archived
+	code, err := CreateInviteCode(db, public, owner, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requester := databasetest.NewUser(t, db, "rita")
+	if _, err := RequestToJoin(db, restricted, requester, "let me in"); err != nil {
+		t.Fatal(err)
+	}
+	invitee := databasetest.NewUser(t, db, "ivan")
+	if err := Invite(db, private, invitee, owner); err != nil {
+		t.Fatal(err)
+	}
+	for _, roomID := range []int{public, restricted, private} {
+		if err := SetArchived(db, roomID, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		try  func(userID int) error
+	}{
+		{"join", func(userID int) error { return JoinChatRoom(db, public, userID) }},
+		{"join with an invitation", func(int) error { return JoinChatRoom(db, private, invitee) }},
+		{"redeem an invite code", func(userID int) error {
+			_, err := JoinWithInviteCode(db, code.Code, userID)
+			return err
+		}},
+		{"be added", func(userID int) error { return AddToChatRoom(db, public, userID, owner) }},
+		{"be invited", func(userID int) error { return Invite(db, public, userID, owner) }},
+		{"ask to join", func(userID int) error {
+			_, err := RequestToJoin(db, restricted, userID, "")
+			return err
+		}},
+		{"be approved", func(int) error { return ApproveJoinRequest(db, restricted, requester, owner) }},
+		{"create an invite code", func(int) error {
+			_, err := CreateInviteCode(db, public, owner, time.Hour, 1)
+			return err
+		}},
+	}
+	newcomer := databasetest.NewUser(t, db, "nina")
+	for _, test := range tests {
+		if err := test.try(newcomer); err != ErrRoomArchived {
+			t.Errorf("%s: got %v, want %v", test.name, err, ErrRoomArchived)
+		}
+	}
+
+	var members int
+	if err := db.QueryRow("SELECT COUNT(*) FROM room_users WHERE user_id != ?", owner).Scan(&members); err != nil {
+		t.Fatal(err)
+	}
+	if members != 0 {
+		t.Errorf("archived rooms gained %d members", members)
+	}
+
+	// unarchived, the room can be joined again
+	if err := SetArchived(db, public, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := JoinChatRoom(db, public, newcomer); err != nil {
+		t.Errorf("joining after unarchiving: %v", err)
+	}
+}
+
+func TestArchivedRoomTakesNoMessages(t *testing.T) {
+	db := databasetest.Open(t)
+	owner := databasetest.NewUser(t, db, "olivia")
+	roomID := newRoom(t, db, owner, models.VisibilityPublic)
+
+	if err := SaveMessage(db, &models.Message{SenderID: owner, RoomID: roomID, Content: "before"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetArchived(db, roomID, true); err != nil {
+		t.Fatal(err)
+	}
+	msg := &models.Message{SenderID: owner, RoomID: roomID, Content: "after"}
+	if err := SaveMessage(db, msg); err != ErrRoomArchived {
+		t.Errorf("posting to an archived room: got %v, want %v", err, ErrRoomArchived)
+	}
+	if msg.ID != 0 {
+		t.Errorf("message got ID %d", msg.ID)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM messages WHERE room_id = ?", roomID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d messages stored, want 1", count)
+	}
+
+	// direct messages have no room to be archived
+	other := databasetest.NewUser(t, db, "oscar")
+	if err := SaveMessage(db, &models.Message{SenderID: owner, RecipientID: other, Content: "hi"}); err != nil {
+		t.Errorf("direct message: %v", err)
+	}
+}
@@ -3,38 +3,114 @@ package chat
 import (
 	"chat-app/pkg/models"
 	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
 )
 
-// CreateChatRoom creates a new chat room with the given name
-func CreateChatRoom(db *sql.DB, name string, creatorID int) error {
-	_, err := db.Exec("INSERT INTO chat_rooms (name, creator_id) VALUES (?, ?)", name, creatorID)
+// Longest room names, topics and descriptions, in characters
+const (
+	MaxRoomName        = 100
+	MaxRoomTopic       = 250
+	MaxRoomDescription = 2000
+)
+
+// ErrRoomNameEmpty is returned when creating or renaming a room without a
+// name
+var ErrRoomNameEmpty = errors.New("room name must not be empty")
+
+// CreateChatRoom creates a new chat room and makes its creator the owner.
+// room.ID is set to the new room's ID.
+func CreateChatRoom(db *sql.DB, room *models.ChatRoom) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
-}
+	defer tx.Rollback()
 
-// JoinChatRoom adds a user to a chat room
-func JoinChatRoom(db *sql.DB, roomID, userID int) error {
-	_, err := db.Exec("INSERT INTO room_users (room_id, user_id) VALUES (?, ?)", roomID, userID)
+	res, err := tx.Exec(`INSERT INTO chat_rooms (name, creator_id, history_visibility, visibility, topic, description, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`,
+		room.Name, room.CreatorID, room.HistoryVisibility, room.Visibility, room.Topic, room.Description)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
 	if err != nil {
 		return err
 	}
+	if err := addMember(tx, int(id), room.CreatorID, room.CreatorID, models.RoleOwner); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	room.ID = int(id)
 	return nil
 }
 
-// LeaveChatRoom removes a user from a chat room
-func LeaveChatRoom(db *sql.DB, roomID, userID int) error {
-	_, err := db.Exec("DELETE FROM room_users WHERE room_id = ? AND user_id = ?", roomID, userID)
+// roomColumns are the columns scanRoom reads, for queries on chat_rooms.
+// Member counts and the time of the last message are worked out on the fly;
+// once messages are archived, the last one is found in archive_segments.
+const roomColumns = `chat_rooms.id, chat_rooms.name, chat_rooms.creator_id, chat_rooms.history_visibility,
+	chat_rooms.visibility, chat_rooms.topic, chat_rooms.description, chat_rooms.created_at,
+	(SELECT COUNT(*) FROM room_users WHERE room_users.room_id = chat_rooms.id) AS member_count,
+	COALESCE((SELECT datetime(messages.timestamp) FROM messages WHERE messages.room_id = chat_rooms.id ORDER BY messages.id DESC LIMIT 1),
+		(SELECT datetime(MAX(archive_segments.last_at)) FROM archive_segments WHERE archive_segments.room_id = chat_rooms.id)) AS last_message_at,
+	chat_rooms.archived_at`
+
+// scanRoom reads a row of roomColumns
+func scanRoom(row interface {
+	Scan(dest ...interface{}) error
+}) (*models.ChatRoom, error) {
+	room := &models.ChatRoom{}
+	var creatorID sql.NullInt64
+	var createdAt sql.NullTime
+	var lastMessageAt sql.NullString
+	var archivedAt sql.NullTime
+	err := row.Scan(&room.ID, &room.Name, &creatorID, &room.HistoryVisibility, &room.Visibility,
+		&room.Topic, &room.Description, &createdAt, &room.MemberCount, &lastMessageAt, &archivedAt)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	room.CreatorID = int(creatorID.Int64)
+	if createdAt.Valid {
+		room.CreatedAt = &createdAt.Time
+	}
+	if lastMessageAt.Valid {
+		t, err := parseSQLTime(lastMessageAt.String)
+		if err != nil {
+			return nil, err
+		}
+		room.LastMessageAt = &t
+	}
+	if archivedAt.Valid {
+		room.ArchivedAt = &archivedAt.Time
+	}
+	return room, nil
 }
 
-// ListChatRooms lists all available chat rooms
-func ListChatRooms(db *sql.DB) ([]models.ChatRoom, error) {
-	rows, err := db.Query("SELECT id, name FROM chat_rooms")
+// GetChatRoom returns a room, or ErrRoomNotFound
+func GetChatRoom(db *sql.DB, roomID int) (*models.ChatRoom, error) {
+	room, err := scanRoom(db.QueryRow("SELECT "+roomColumns+" FROM chat_rooms WHERE chat_rooms.id = ?", roomID))
+	if err == sql.ErrNoRows {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+// ListChatRooms lists the chat rooms userID can see: every public, restricted
+// and private room, and the secret rooms they are in. With all set, secret
+// rooms are listed regardless. Archived rooms are left out.
+func ListChatRooms(db *sql.DB, userID int, all bool) ([]models.ChatRoom, error) {
+	rows, err := db.Query(`SELECT `+roomColumns+` FROM chat_rooms
+		WHERE (? OR chat_rooms.visibility != ?
+			OR EXISTS (SELECT 1 FROM room_users WHERE room_users.room_id = chat_rooms.id AND room_users.user_id = ?))
+		AND chat_rooms.archived_at IS NULL
+		ORDER BY chat_rooms.id`, all, models.VisibilitySecret, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -42,14 +118,97 @@ func ListChatRooms(db *sql.DB) ([]models.ChatRoom, error) {
 
 	chatRooms := []models.ChatRoom{}
 	for rows.Next() {
-		var chatRoom models.ChatRoom
-		err := rows.Scan(&chatRoom.ID, &chatRoom.Name)
+		chatRoom, err := scanRoom(rows)
 		if err != nil {
 			return nil, err
 		}
-		chatRooms = append(chatRooms, chatRoom)
+		chatRooms = append(chatRooms, *chatRoom)
+	}
+	return chatRooms, rows.Err()
+}
+
+// RoomUpdate holds the room settings a PATCH changes. Nil fields are left
+// as they are.
+type RoomUpdate struct {
+	Name        *string `json:"name"`
+	Topic       *string `json:"topic"`
+	Description *string `json:"description"`
+}
+
+// Validate trims the fields of an update and checks their lengths
+func (u *RoomUpdate) Validate() error {
+	if u.Name != nil {
+		name, err := ValidRoomName(*u.Name)
+		if err != nil {
+			return err
+		}
+		u.Name = &name
+	}
+	for _, field := range []struct {
+		value *string
+		name  string
+		max   int
+	}{
+		{u.Topic, "topic", MaxRoomTopic},
+		{u.Description, "description", MaxRoomDescription},
+	} {
+		if field.value == nil {
+			continue
+		}
+		*field.value = strings.TrimSpace(*field.value)
+		if utf8.RuneCountInString(*field.value) > field.max {
+			return fmt.Errorf("%s must be at most %d characters", field.name, field.max)
+		}
+	}
+	return nil
+}
+
+// ValidRoomName trims a room name and checks that it is neither empty nor
+// over MaxRoomName
+func ValidRoomName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", ErrRoomNameEmpty
+	}
+	if utf8.RuneCountInString(name) > MaxRoomName {
+		return "", fmt.Errorf("room name must be at most %d characters", MaxRoomName)
+	}
+	return name, nil
+}
+
+// UpdateChatRoom applies a validated update to a room
+func UpdateChatRoom(db *sql.DB, roomID int, update RoomUpdate) error {
+	res, err := db.Exec(`UPDATE chat_rooms SET name = COALESCE(?, name), topic = COALESCE(?, topic),
+		description = COALESCE(?, description) WHERE id = ?`, update.Name, update.Topic, update.Description, roomID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrRoomNotFound
+	}
+	return nil
+}
+
+// ValidVisibility reports whether visibility is one of the room visibility
+// settings
+func ValidVisibility(visibility string) bool {
+	switch visibility {
+	case models.VisibilityPublic, models.VisibilityRestricted, models.VisibilityPrivate, models.VisibilitySecret:
+		return true
 	}
-	return chatRooms, nil
+	return false
+}
+
+// SetVisibility changes who can see and join a room
+func SetVisibility(db *sql.DB, roomID int, visibility string) error {
+	res, err := db.Exec("UPDATE chat_rooms SET visibility = ? WHERE id = ?", visibility, roomID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrRoomNotFound
+	}
+	return nil
 }
 
 // ListUsersInChatRoom lists all users in a chat room
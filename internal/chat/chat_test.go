@@ -0,0 +1,17 @@
+package chat
+
+import (
+	"chat-app/pkg/models"
+	"database/sql"
+	"testing"
+)
+
+// newRoom creates a room owned by ownerID for a test and returns its ID
+func newRoom(t *testing.T, db *sql.DB, ownerID int, visibility string) int {
+	t.Helper()
+	room := models.ChatRoom{Name: "room", CreatorID: ownerID, Visibility: visibility, HistoryVisibility: models.HistoryShared}
+	if err := CreateChatRoom(db, &room); err != nil {
+		t.Fatal(err)
+	}
+	return room.ID
+}
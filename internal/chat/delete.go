@@ -0,0 +1,160 @@
+package chat
+
+import (
+	"chat-app/internal/archive"
+	"chat-app/internal/encryption"
+	"chat-app/pkg/utils"
+	"database/sql"
+	"time"
+)
+
+// What DeleteUser does with the room messages of a deleted user
+const (
+	// AnonymizeMessages keeps them without a sender
+	AnonymizeMessages = "anonymize"
+	// DeleteMessages deletes them
+	DeleteMessages = "delete"
+)
+
+// DeletedUserMessages is AnonymizeMessages or DeleteMessages, overridden on
+// startup by DELETED_USER_MESSAGES
+var DeletedUserMessages = AnonymizeMessages
+
+// UsernameCooldown is how long the username of a deleted account is held
+// back before a new account can take it, overridden on startup by
+// USERNAME_COOLDOWN
+var UsernameCooldown = 30 * 24 * time.Hour
+
+// DeleteChatRoom deletes a room together with its members, messages,
+// membership log and archive segments. The room's data key is deleted too,
+// so any copy of its messages left in a backup can no longer be decrypted.
+// It returns the IDs of the users who were in the room.
+func DeleteChatRoom(db *sql.DB, roomID int) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	members, err := queryIDs(tx, "SELECT user_id FROM room_users WHERE room_id = ?", roomID)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := archive.RoomPaths(tx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	// room_users, messages, membership_events and archive_segments cascade
+	res, err := tx.Exec("DELETE FROM chat_rooms WHERE id = ?", roomID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, sql.ErrNoRows
+	}
+	if err := encryption.DeleteRoomKey(tx, roomID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	archive.RemoveFiles(paths)
+	return members, nil
+}
+
+// DeleteUser deletes a user along with their memberships, sessions and API
+// tokens, and their direct messages in both directions. Messages they sent
+// to rooms, archived ones included, are kept without a sender or deleted
+// as DeletedUserMessages says, and rooms they created are kept without a
+// creator. Rooms they were the last owner of pass to another member. Their
+// username cannot be registered again for UsernameCooldown. It returns the
+// IDs of the rooms the user was in, and the new owners of the rooms that
+// changed hands, by room ID.
+func DeleteUser(db *sql.DB, userID int) (rooms []int, successors map[int]int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var username string
+	err = tx.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username)
+	if err != nil {
+		return nil, nil, err
+	}
+	rooms, err = queryIDs(tx, "SELECT room_id FROM room_users WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	paths, err := archive.UserDMPaths(tx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// direct messages the user received cascade, but the ones they sent
+	// would otherwise be kept without a sender and lose their conversation
+	query := "DELETE FROM messages WHERE room_id IS NULL AND sender_id = ?"
+	if DeletedUserMessages == DeleteMessages {
+		query = "DELETE FROM messages WHERE sender_id = ?"
+	}
+	if _, err := tx.Exec(query, userID); err != nil {
+		return nil, nil, err
+	}
+	// memberships, sessions and API tokens cascade
+	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", userID); err != nil {
+		return nil, nil, err
+	}
+	successors = map[int]int{}
+	for _, roomID := range rooms {
+		successorID, err := ensureOwner(tx, roomID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if successorID != 0 {
+			successors[roomID] = successorID
+		}
+	}
+	if err := encryption.DeleteUserDMKeys(tx, userID); err != nil {
+		return nil, nil, err
+	}
+	if UsernameCooldown > 0 {
+		_, err = tx.Exec("INSERT OR REPLACE INTO retired_usernames (username, available_at) VALUES (?, ?)",
+			username, SQLTime(time.Now().Add(UsernameCooldown)))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	archive.RemoveFiles(paths)
+	// the account is gone by now, so a failure here can only be logged
+	n, err := archive.ScrubSender(db, userID, DeletedUserMessages != DeleteMessages)
+	if err != nil {
+		utils.Log.WithError(err).WithField("userID", userID).Error("Error scrubbing archived messages of deleted user")
+	} else if n > 0 {
+		utils.Log.WithField("userID", userID).WithField("messages", n).Info("Scrubbed archived messages of deleted user")
+	}
+	return rooms, successors, nil
+}
+
+func queryIDs(tx *sql.Tx, query string, args ...interface{}) ([]int, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,210 @@
+package chat
+
+import (
+	"chat-app/internal/archive"
+	"chat-app/internal/database/databasetest"
+	"chat-app/pkg/models"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withDeletion applies DeletedUserMessages and UsernameCooldown for the rest
+// of a test
+func withDeletion(t *testing.T, messages string, cooldown time.Duration) {
+	t.Helper()
+	previousMessages, previousCooldown := DeletedUserMessages, UsernameCooldown
+	DeletedUserMessages, UsernameCooldown = messages, cooldown
+	t.Cleanup(func() { DeletedUserMessages, UsernameCooldown = previousMessages, previousCooldown })
+}
+
+func TestDeleteUserMessages(t *testing.T) {
+	tests := []struct {
+		mode string
+		kept bool
+	}{
+		{AnonymizeMessages, true},
+		{DeleteMessages, false},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			withDeletion(t, test.mode, time.Hour)
+			archive.Dir = t.TempDir()
+			db := databasetest.Open(t)
+			owner := databasetest.NewUser(t, db, "olivia")
+			dana := databasetest.NewUser(t, db, "dana")
+			eve := databasetest.NewUser(t, db, "eve")
+			roomID := newRoom(t, db, owner, models.VisibilityPublic)
+			if err := JoinChatRoom(db, roomID, dana); err != nil {
+				t.Fatal(err)
+			}
+
+			// old room and direct messages in both directions that get
+			// archived, then the same again left in the messages table
+			_, err := db.Exec(`INSERT INTO messages (sender_id, room_id, content, timestamp) VALUES (?, ?, 'old', '2000-01-01 00:00:00'), (?, ?, 'old', '2000-01-01 00:00:01');
+				INSERT INTO messages (sender_id, recipient_id, content, timestamp) VALUES (?, ?, 'old', '2000-01-01 00:00:02'), (?, ?, 'old', '2000-01-01 00:00:03')`,
+				dana, roomID, owner, roomID, dana, eve, eve, dana)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n, err := (&archive.Archiver{DB: db, After: time.Hour}).ArchiveOnce(time.Now()); err != nil || n != 4 {
+				t.Fatalf("archiving: got %d %v", n, err)
+			}
+			dmPaths, err := archive.UserDMPaths(db, dana)
+			if err != nil || len(dmPaths) != 1 {
+				t.Fatalf("got DM segments %v %v", dmPaths, err)
+			}
+			for _, msg := range []models.Message{
+				{SenderID: dana, RoomID: roomID, Content: "new"},
+				{SenderID: owner, RoomID: roomID, Content: "new"},
+				{SenderID: dana, RecipientID: eve, Content: "new"},
+				{SenderID: eve, RecipientID: dana, Content: "new"},
+			} {
+				if err := SaveMessage(db, &msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rooms, successors, err := DeleteUser(db, dana)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rooms) != 1 || rooms[0] != roomID || len(successors) != 0 {
+				t.Errorf("got rooms %v and successors %v", rooms, successors)
+			}
+
+			// the owner's messages stay, and dana's with no sender if kept
+			history, err := RoomHistory(db, roomID, owner, 0, 50)
+			if err != nil {
+				t.Fatal(err)
+			}
+			senders := map[int]int{}
+			for _, msg := range history {
+				senders[msg.SenderID]++
+			}
+			want := map[int]int{owner: 2}
+			if test.kept {
+				want[0] = 2
+			}
+			if len(senders) != len(want) || senders[owner] != want[owner] || senders[0] != want[0] {
+				t.Errorf("room history has messages from %v, want %v", senders, want)
+			}
+
+			// direct messages go in both directions, archived ones included
+			var dms int
+			if err := db.QueryRow("SELECT COUNT(*) FROM messages WHERE room_id IS NULL").Scan(&dms); err != nil {
+				t.Fatal(err)
+			}
+			if dms != 0 {
+				t.Errorf("%d direct messages left", dms)
+			}
+			if segments, err := archive.UserDMSegments(db, eve); err != nil || len(segments) != 0 {
+				t.Errorf("got DM segments %v %v", segments, err)
+			}
+			if _, err := os.Stat(filepath.Join(archive.Dir, dmPaths[0])); !os.IsNotExist(err) {
+				t.Errorf("DM segment file: got %v, want it removed", err)
+			}
+		})
+	}
+}
+
+func TestDeleteUserHandsOverRooms(t *testing.T) {
+	withDeletion(t, AnonymizeMessages, time.Hour)
+	db := databasetest.Open(t)
+	dana := databasetest.NewUser(t, db, "dana")
+	admin := databasetest.NewUser(t, db, "adam")
+	member := databasetest.NewUser(t, db, "mia")
+	coOwner := databasetest.NewUser(t, db, "cora")
+
+	handedOver := newRoom(t, db, dana, models.VisibilityPublic)
+	shared := newRoom(t, db, dana, models.VisibilityPublic)
+	empty := newRoom(t, db, dana, models.VisibilityPublic)
+	for _, userID := range []int{member, admin} {
+		if err := JoinChatRoom(db, handedOver, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SetMemberRole(db, handedOver, admin, models.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if err := JoinChatRoom(db, shared, coOwner); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetMemberRole(db, shared, coOwner, models.RoleOwner); err != nil {
+		t.Fatal(err)
+	}
+
+	rooms, successors, err := DeleteUser(db, dana)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 3 {
+		t.Errorf("got rooms %v", rooms)
+	}
+	// the admin outranks the member who joined before them; the room with
+	// another owner and the room left empty change no hands
+	if len(successors) != 1 || successors[handedOver] != admin {
+		t.Errorf("got successors %v, want room %d to go to %d", successors, handedOver, admin)
+	}
+	for roomID, owner := range map[int]int{handedOver: admin, shared: coOwner} {
+		if role, err := MemberRole(db, roomID, owner); err != nil || role != models.RoleOwner {
+			t.Errorf("room %d: user %d is %q %v, want owner", roomID, owner, role, err)
+		}
+	}
+
+	// rooms outlive their creator
+	for _, roomID := range []int{handedOver, shared, empty} {
+		var creatorID sql.NullInt64
+		if err := db.QueryRow("SELECT creator_id FROM chat_rooms WHERE id = ?", roomID).Scan(&creatorID); err != nil {
+			t.Fatalf("room %d: %v", roomID, err)
+		}
+		if creatorID.Valid {
+			t.Errorf("room %d still has creator %d", roomID, creatorID.Int64)
+		}
+	}
+}
+
+func TestDeleteUserRetiresUsername(t *testing.T) {
+	tests := []struct {
+		name     string
+		cooldown time.Duration
+		retired  bool
+	}{
+		{"with a cooldown", 24 * time.Hour, true},
+		{"without a cooldown", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withDeletion(t, AnonymizeMessages, test.cooldown)
+			db := databasetest.Open(t)
+			dana := databasetest.NewUser(t, db, "dana")
+
+			before := time.Now().UTC().Truncate(time.Second)
+			if _, _, err := DeleteUser(db, dana); err != nil {
+				t.Fatal(err)
+			}
+			var availableAt time.Time
+			err := db.QueryRow("SELECT available_at FROM retired_usernames WHERE username = 'dana'").Scan(&availableAt)
+			if !test.retired {
+				if err != sql.ErrNoRows {
+					t.Errorf("got %v %v, want no retired username", availableAt, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if earliest := before.Add(test.cooldown); availableAt.Before(earliest) || availableAt.After(earliest.Add(time.Minute)) {
+				t.Errorf("available at %v, want about %v", availableAt, earliest)
+			}
+		})
+	}
+
+	withDeletion(t, AnonymizeMessages, time.Hour)
+	db := databasetest.Open(t)
+	if _, _, err := DeleteUser(db, 12345); err != sql.ErrNoRows {
+		t.Errorf("unknown user: got %v, want %v", err, sql.ErrNoRows)
+	}
+}
@@ -0,0 +1,166 @@
+package chat
+
+import (
+	"chat-app/pkg/models"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Orders the room directory can be sorted in
+const (
+	// SortActivity lists the rooms with the most recent messages first, and
+	// rooms nothing was sent to last
+	SortActivity = "activity"
+	// SortMembers lists the biggest rooms first
+	SortMembers = "members"
+	// SortName lists rooms alphabetically, ignoring case
+	SortName = "name"
+)
+
+// ErrInvalidCursor is returned for cursors that were not handed out by
+// SearchChatRooms for the same sort order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// RoomQuery is a search of the room directory
+type RoomQuery struct {
+	// Query matches rooms whose name or topic contains it, ignoring case
+	Query string
+	Sort  string
+	// Joined only lists the rooms the user is in
+	Joined bool
+	// Archived lists archived rooms instead of active ones
+	Archived bool
+	// Cursor continues from the end of the page it came with
+	Cursor string
+	Limit  int
+}
+
+// roomSorts are the ORDER BY clauses of the sort orders, the condition that
+// picks out the rooms after a cursor's key and room ID, and the key of a
+// room. Sorting on the room ID last keeps pages stable when keys tie.
+var roomSorts = map[string]struct {
+	order, after string
+	key          func(room *models.ChatRoom) string
+}{
+	SortActivity: {
+		order: "COALESCE(last_message_at, '') DESC, id",
+		after: "(COALESCE(last_message_at, '') < ? OR COALESCE(last_message_at, '') = ? AND id > ?)",
+		key: func(room *models.ChatRoom) string {
+			if room.LastMessageAt == nil {
+				return ""
+			}
+			return SQLTime(*room.LastMessageAt)
+		},
+	},
+	SortMembers: {
+		order: "member_count DESC, id",
+		after: "(member_count < ? OR member_count = ? AND id > ?)",
+		key:   func(room *models.ChatRoom) string { return strconv.Itoa(room.MemberCount) },
+	},
+	SortName: {
+		order: "name COLLATE NOCASE, id",
+		after: "(name COLLATE NOCASE > ? OR name COLLATE NOCASE = ? AND id > ?)",
+		key:   func(room *models.ChatRoom) string { return room.Name },
+	},
+}
+
+// ValidSort reports whether sort is one of the room directory's orders
+func ValidSort(sort string) bool {
+	_, ok := roomSorts[sort]
+	return ok
+}
+
+// SearchChatRooms returns a page of the rooms userID can see, as
+// ListChatRooms does, that match q. next is the cursor of the following
+// page, or empty on the last one. Cursors point between rooms rather than
+// at an offset, so rooms are neither skipped nor repeated as others are
+// created or deleted, though a room whose activity or member count changes
+// can move to a page already read.
+func SearchChatRooms(db *sql.DB, userID int, all bool, q RoomQuery) (rooms []models.ChatRoom, next string, err error) {
+	sort, ok := roomSorts[q.Sort]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown sort order %q", q.Sort)
+	}
+
+	where := []string{"1"}
+	args := []interface{}{all, models.VisibilitySecret, userID, q.Joined, userID, q.Archived}
+	if q.Query != "" {
+		pattern := "%" + likeEscaper.Replace(q.Query) + "%"
+		where = append(where, `(name LIKE ? ESCAPE '\' OR topic LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
+	}
+	if q.Cursor != "" {
+		key, id, err := decodeCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return nil, "", err
+		}
+		where = append(where, sort.after)
+		args = append(args, key, key, id)
+	}
+	args = append(args, q.Limit+1)
+
+	rows, err := db.Query(`SELECT * FROM (SELECT `+roomColumns+` FROM chat_rooms
+		WHERE (? OR chat_rooms.visibility != ?
+			OR EXISTS (SELECT 1 FROM room_users WHERE room_users.room_id = chat_rooms.id AND room_users.user_id = ?))
+		AND (NOT ? OR EXISTS (SELECT 1 FROM room_users WHERE room_users.room_id = chat_rooms.id AND room_users.user_id = ?))
+		AND (chat_rooms.archived_at IS NOT NULL) = ?)
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY `+sort.order+` LIMIT ?`, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	rooms = []models.ChatRoom{}
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(rooms) == q.Limit {
+			last := &rooms[len(rooms)-1]
+			next = encodeCursor(q.Sort, sort.key(last), last.ID)
+			break
+		}
+		rooms = append(rooms, *room)
+	}
+	return rooms, next, rows.Err()
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// encodeCursor packs the sort order, the sort key and the ID of the last room
+// of a page into an opaque cursor
+func encodeCursor(sort, key string, id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(sort + "\x00" + strconv.Itoa(id) + "\x00" + key))
+}
+
+// decodeCursor unpacks a cursor made by encodeCursor for the same sort
+// order. Member counts come back as numbers, so that they compare as such.
+func decodeCursor(cursor, sort string) (key interface{}, id int, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), "\x00", 3)
+	if len(parts) != 3 || parts[0] != sort {
+		return nil, 0, ErrInvalidCursor
+	}
+	id, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+	if sort == SortMembers {
+		count, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, 0, ErrInvalidCursor
+		}
+		return count, id, nil
+	}
+	return parts[2], id, nil
+}
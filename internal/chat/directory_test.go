@@ -0,0 +1,164 @@
+package chat
+
+import (
+	"chat-app/internal/database/databasetest"
+	"chat-app/pkg/models"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+// pageThrough reads every page of q and returns the room IDs in order
+func pageThrough(t *testing.T, db *sql.DB, userID int, q RoomQuery) []int {
+	t.Helper()
+	var ids []int
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("paging does not end")
+		}
+		rooms, next, err := SearchChatRooms(db, userID, false, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rooms) > q.Limit || next != "" && len(rooms) != q.Limit {
+			t.Fatalf("got a page of %d rooms for limit %d, next %q", len(rooms), q.Limit, next)
+		}
+		for _, room := range rooms {
+			ids = append(ids, room.ID)
+		}
+		if next == "" {
+			return ids
+		}
+		q.Cursor = next
+	}
+}
+
+// newDirectoryRoom creates a room named name with the given members besides
+// its owner, whose last message was sent at lastAt unless it is empty
+func newDirectoryRoom(t *testing.T, db *sql.DB, ownerID int, name string, members []int, lastAt string) int {
+	t.Helper()
+	room := models.ChatRoom{Name: name, CreatorID: ownerID, Visibility: models.VisibilityPublic, HistoryVisibility: models.HistoryShared}
+	if err := CreateChatRoom(db, &room); err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range members {
+		if err := JoinChatRoom(db, room.ID, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lastAt != "" {
+		if _, err := db.Exec("INSERT INTO messages (sender_id, room_id, content, timestamp) VALUES (?, ?, 'hi', ?)", ownerID, room.ID, lastAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return room.ID
+}
+
+func TestSearchChatRoomsPaging(t *testing.T) {
+	db := databasetest.Open(t)
+	owner := databasetest.NewUser(t, db, "olivia")
+	var users []int
+	for _, name := range []string{"ann", "ben", "cat"} {
+		users = append(users, databasetest.NewUser(t, db, name))
+	}
+
+	// keys tie within every sort order
+	ids := []int{
+		newDirectoryRoom(t, db, owner, "beta", nil, "2024-01-02 00:00:00"),
+		newDirectoryRoom(t, db, owner, "Alpha", users[:2], ""),
+		newDirectoryRoom(t, db, owner, "alpha", users[:1], "2024-01-02 00:00:00"),
+		newDirectoryRoom(t, db, owner, "Beta", users[1:], "2024-01-03 00:00:00"),
+		newDirectoryRoom(t, db, owner, "gamma", nil, ""),
+		newDirectoryRoom(t, db, owner, "alpha", users[2:], "2024-01-01 00:00:00"),
+		newDirectoryRoom(t, db, owner, "Delta", users, "2024-01-02 00:00:00"),
+	}
+	order := func(positions ...int) []int {
+		rooms := []int{}
+		for _, i := range positions {
+			rooms = append(rooms, ids[i-1])
+		}
+		return rooms
+	}
+	want := map[string][]int{
+		SortName:     order(2, 3, 6, 1, 4, 7, 5),
+		SortMembers:  order(7, 2, 4, 3, 6, 1, 5),
+		SortActivity: order(4, 1, 3, 7, 6, 2, 5),
+	}
+
+	for sort, rooms := range want {
+		for _, limit := range []int{1, 2, 3, 7, 10} {
+			got := pageThrough(t, db, owner, RoomQuery{Sort: sort, Limit: limit})
+			if fmt.Sprint(got) != fmt.Sprint(rooms) {
+				t.Errorf("%s, %d a page: got %v, want %v", sort, limit, got, rooms)
+			}
+		}
+	}
+}
+
+func TestSearchChatRoomsCursorSurvivesNewRooms(t *testing.T) {
+	db := databasetest.Open(t)
+	owner := databasetest.NewUser(t, db, "olivia")
+	var ids []int
+	for _, name := range []string{"alpha", "beta", "Alpha", "gamma", "delta"} {
+		ids = append(ids, newDirectoryRoom(t, db, owner, name, nil, ""))
+	}
+
+	q := RoomQuery{Sort: SortName, Limit: 2}
+	first, next, err := SearchChatRooms(db, owner, false, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 || first[0].ID != ids[0] || first[1].ID != ids[2] {
+		t.Fatalf("got first page %v", first)
+	}
+
+	// a room before the cursor is not seen, a tie after it and a room at the
+	// end are, and nothing is repeated or skipped
+	newDirectoryRoom(t, db, owner, "aardvark", nil, "")
+	tie := newDirectoryRoom(t, db, owner, "ALPHA", nil, "")
+	last := newDirectoryRoom(t, db, owner, "zebra", nil, "")
+	q.Cursor = next
+	got := pageThrough(t, db, owner, q)
+	if want := []int{tie, ids[1], ids[4], ids[3], last}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("after the first page: got %v, want %v", got, want)
+	}
+}
+
+func TestSearchChatRoomsRejectsCursors(t *testing.T) {
+	db := databasetest.Open(t)
+	owner := databasetest.NewUser(t, db, "olivia")
+	for _, name := range []string{"alpha", "beta", "gamma"} {
+		newDirectoryRoom(t, db, owner, name, nil, "")
+	}
+	cursors := map[string]string{}
+	for sort := range roomSorts {
+		_, next, err := SearchChatRooms(db, owner, false, RoomQuery{Sort: sort, Limit: 1})
+		if err != nil || next == "" {
+			t.Fatalf("%s: got cursor %q %v", sort, next, err)
+		}
+		cursors[sort] = next
+	}
+
+	encode := func(raw string) string { return base64.RawURLEncoding.EncodeToString([]byte(raw)) }
+	tests := []struct {
+		name   string
+		sort   string
+		cursor string
+	}{
+		{"name cursor for members", SortMembers, cursors[SortName]},
+		{"members cursor for activity", SortActivity, cursors[SortMembers]},
+		{"activity cursor for name", SortName, cursors[SortActivity]},
+		{"not base64", SortName, "!!!"},
+		{"missing parts", SortName, encode("name\x001")},
+		{"room ID not a number", SortName, encode("name\x00one\x00alpha")},
+		{"member count not a number", SortMembers, encode("members\x001\x00many")},
+		{"unknown sort", SortName, encode("size\x001\x00alpha")},
+	}
+	for _, test := range tests {
+		_, _, err := SearchChatRooms(db, owner, false, RoomQuery{Sort: test.sort, Limit: 1, Cursor: test.cursor})
+		if err != ErrInvalidCursor {
+			t.Errorf("%s: got %v, want %v", test.name, err, ErrInvalidCursor)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package chat
+
+import (
+	"archive/zip"
+	"chat-app/internal/archive"
+	"chat-app/internal/profile"
+	"chat-app/pkg/models"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// exportedMembership is one room of a user in their personal data export
+type exportedMembership struct {
+	RoomID   int        `json:"room_id"`
+	RoomName string     `json:"room_name"`
+	Role     string     `json:"role"`
+	JoinedAt *time.Time `json:"joined_at,omitempty"`
+}
+
+// ExportUser writes a zip archive of a user's personal data to w, one JSON
+// file each for their profile, the rooms they are in, the room messages
+// they sent, their direct messages in both directions, their contacts and
+// the users they blocked, along with their avatar if they have one. Message
+// content is written decrypted, and archived messages are included.
+func ExportUser(db *sql.DB, userID int, w io.Writer) error {
+	user, err := profile.Own(db, userID)
+	if err != nil {
+		return err
+	}
+	memberships, err := exportMemberships(db, userID)
+	if err != nil {
+		return err
+	}
+
+	roomSegments, err := archive.AllRoomSegments(db)
+	if err != nil {
+		return err
+	}
+	sent, err := exportMessages(db, `messages.room_id IS NOT NULL AND messages.sender_id = ?`, []interface{}{userID},
+		roomSegments, func(record archive.Record) bool { return record.SenderID == userID })
+	if err != nil {
+		return err
+	}
+	dmSegments, err := archive.UserDMSegments(db, userID)
+	if err != nil {
+		return err
+	}
+	direct, err := exportMessages(db, `messages.room_id IS NULL AND (messages.sender_id = ? OR messages.recipient_id = ?)`,
+		[]interface{}{userID, userID}, dmSegments, nil)
+	if err != nil {
+		return err
+	}
+
+	contacts, err := ListContacts(db, userID)
+	if err != nil {
+		return err
+	}
+	blocked, err := ListBlocked(db, userID)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	files := []struct {
+		name  string
+		value interface{}
+	}{
+		{"profile.json", user},
+		{"memberships.json", memberships},
+		{"messages.json", sent},
+		{"direct_messages.json", direct},
+		{"contacts.json", contacts},
+		{"blocked.json", blocked},
+	}
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file.value); err != nil {
+			return err
+		}
+	}
+
+	avatar, err := profile.AvatarFile(db, userID)
+	if err != nil {
+		return err
+	}
+	if avatar != "" {
+		image, err := os.ReadFile(filepath.Join(profile.Dir, avatar))
+		if err != nil {
+			return err
+		}
+		f, err := zw.Create("avatar" + filepath.Ext(avatar))
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(image); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func exportMemberships(db *sql.DB, userID int) ([]exportedMembership, error) {
+	rows, err := db.Query(`SELECT chat_rooms.id, chat_rooms.name, room_users.role, room_users.joined_at
+		FROM room_users JOIN chat_rooms ON chat_rooms.id = room_users.room_id
+		WHERE room_users.user_id = ? ORDER BY chat_rooms.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []exportedMembership{}
+	for rows.Next() {
+		var membership exportedMembership
+		var joinedAt sql.NullTime
+		if err := rows.Scan(&membership.RoomID, &membership.RoomName, &membership.Role, &joinedAt); err != nil {
+			return nil, err
+		}
+		if joinedAt.Valid {
+			membership.JoinedAt = &joinedAt.Time
+		}
+		memberships = append(memberships, membership)
+	}
+	return memberships, rows.Err()
+}
+
+// exportMessages returns the messages matching where, followed by the
+// records of segments accepted by want (every one if want is nil), all
+// decrypted and in ID order
+func exportMessages(db *sql.DB, where string, args []interface{}, segments []archive.Segment, want func(archive.Record) bool) ([]models.Message, error) {
+	rows, err := db.Query("SELECT "+messageColumns+" WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[int64][]byte{}
+	for _, seg := range segments {
+		records, err := seg.Read(nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if want != nil && !want(record) {
+				continue
+			}
+			msg, err := decryptRecord(db, keys, record)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, msg)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID < messages[j].ID
+	})
+	return messages, nil
+}
@@ -0,0 +1,228 @@
+package chat
+
+import (
+	"chat-app/pkg/models"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrInviteInvalid is returned for invite codes that do not exist, have
+	// expired or have been used up
+	ErrInviteInvalid = errors.New("invite code is invalid, expired or used up")
+	// ErrInviteRefused is returned when inviting a user who has blocked the
+	// inviter
+	ErrInviteRefused = errors.New("this user is not accepting invitations from you")
+)
+
+// usableCode restricts invite_codes to the codes that can still be used
+const usableCode = `(invite_codes.expires_at IS NULL OR datetime(invite_codes.expires_at) > datetime('now'))
+	AND (invite_codes.max_uses = 0 OR invite_codes.uses < invite_codes.max_uses)`
+
+// CreateInviteCode creates a code for joining a room that expires after ttl,
+// or never if ttl is 0, and can be used maxUses times, or any number of times
+// if maxUses is 0. Archived rooms get no new codes.
+func CreateInviteCode(db *sql.DB, roomID, creatorID int, ttl time.Duration, maxUses int) (*models.InviteCode, error) {
+	archived, err := IsArchived(db, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if archived {
+		return nil, ErrRoomArchived
+	}
+
+	buf := make([]byte, 9)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	invite := &models.InviteCode{
+		Code:      base64.RawURLEncoding.EncodeToString(buf),
+		RoomID:    roomID,
+		CreatorID: creatorID,
+		CreatedAt: now,
+		MaxUses:   maxUses,
+	}
+	var expiresAt sql.NullString
+	if ttl > 0 {
+		expiry := now.Add(ttl)
+		invite.ExpiresAt = &expiry
+		expiresAt = sql.NullString{String: SQLTime(expiry), Valid: true}
+	}
+
+	_, err = db.Exec(`INSERT INTO invite_codes (code, room_id, creator_id, created_at, expires_at, max_uses)
+		VALUES (?, ?, ?, ?, ?, ?)`, invite.Code, roomID, creatorID, SQLTime(now), expiresAt, maxUses)
+	if err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// ListInviteCodes returns the invite codes of a room that can still be used
+func ListInviteCodes(db *sql.DB, roomID int) ([]models.InviteCode, error) {
+	rows, err := db.Query(`SELECT code, room_id, creator_id, created_at, expires_at, max_uses, uses
+		FROM invite_codes WHERE room_id = ? AND `+usableCode+` ORDER BY created_at`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []models.InviteCode{}
+	for rows.Next() {
+		var invite models.InviteCode
+		var creatorID sql.NullInt64
+		var expiresAt sql.NullTime
+		err := rows.Scan(&invite.Code, &invite.RoomID, &creatorID, &invite.CreatedAt, &expiresAt, &invite.MaxUses, &invite.Uses)
+		if err != nil {
+			return nil, err
+		}
+		invite.CreatorID = int(creatorID.Int64)
+		if expiresAt.Valid {
+			invite.ExpiresAt = &expiresAt.Time
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+// RevokeInviteCode deletes an invite code of a room, returning sql.ErrNoRows
+// if the room has no such code
+func RevokeInviteCode(db *sql.DB, roomID int, code string) error {
+	res, err := db.Exec("DELETE FROM invite_codes WHERE room_id = ? AND code = ?", roomID, code)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// InviteCodeRoom returns the room a usable invite code is for, or
+// ErrInviteInvalid
+func InviteCodeRoom(db *sql.DB, code string) (int, error) {
+	var roomID int
+	err := db.QueryRow("SELECT room_id FROM invite_codes WHERE code = ? AND "+usableCode, code).Scan(&roomID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInviteInvalid
+	}
+	return roomID, err
+}
+
+// JoinWithInviteCode adds a user to the room of an invite code, whatever the
+// room's visibility, and returns the room's ID. A code is only used up by
+// users who were not already in the room.
+func JoinWithInviteCode(db *sql.DB, code string, userID int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// counting the use first means two users cannot both take the last one
+	res, err := tx.Exec("UPDATE invite_codes SET uses = uses + 1 WHERE code = ? AND "+usableCode, code)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, ErrInviteInvalid
+	}
+	var roomID int
+	if err := tx.QueryRow("SELECT room_id FROM invite_codes WHERE code = ?", code).Scan(&roomID); err != nil {
+		return 0, err
+	}
+	if err := addMember(tx, roomID, userID, userID, models.RoleMember); err != nil {
+		return roomID, err
+	}
+	return roomID, tx.Commit()
+}
+
+// Invite invites userID to a room on behalf of inviterID. Inviting someone
+// again renews the invitation. Nobody can be invited to an archived room,
+// and users who are banned from the room, or have blocked the inviter,
+// cannot be invited.
+func Invite(db *sql.DB, roomID, userID, inviterID int) error {
+	archived, err := IsArchived(db, roomID)
+	if err != nil {
+		return err
+	}
+	if archived {
+		return ErrRoomArchived
+	}
+	var exists bool
+	err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	member, err := IsMember(db, roomID, userID)
+	if err != nil {
+		return err
+	}
+	if member {
+		return ErrAlreadyMember
+	}
+	banned, err := isBanned(db, roomID, userID)
+	if err != nil {
+		return err
+	}
+	if banned {
+		return ErrBanned
+	}
+	blockers, err := BlockersOf(db, inviterID)
+	if err != nil {
+		return err
+	}
+	if blockers[userID] {
+		return ErrInviteRefused
+	}
+
+	_, err = db.Exec(`INSERT OR REPLACE INTO room_invitations (room_id, user_id, inviter_id, created_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)`, roomID, userID, inviterID)
+	return err
+}
+
+// Invitations returns the pending invitations of a user, newest first
+func Invitations(db *sql.DB, userID int) ([]models.Invitation, error) {
+	rows, err := db.Query(`SELECT chat_rooms.id, chat_rooms.name, room_invitations.inviter_id,
+		COALESCE(users.username, ''), room_invitations.created_at
+		FROM room_invitations
+		JOIN chat_rooms ON chat_rooms.id = room_invitations.room_id
+		LEFT JOIN users ON users.id = room_invitations.inviter_id
+		WHERE room_invitations.user_id = ? ORDER BY room_invitations.created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []models.Invitation{}
+	for rows.Next() {
+		var invitation models.Invitation
+		var inviterID sql.NullInt64
+		err := rows.Scan(&invitation.RoomID, &invitation.RoomName, &inviterID, &invitation.InviterUsername, &invitation.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		invitation.InviterID = int(inviterID.Int64)
+		invitations = append(invitations, invitation)
+	}
+	return invitations, rows.Err()
+}
+
+// DeclineInvitation deletes a user's invitation to a room, returning
+// sql.ErrNoRows if they have none
+func DeclineInvitation(db *sql.DB, roomID, userID int) error {
+	res, err := db.Exec("DELETE FROM room_invitations WHERE room_id = ? AND user_id = ?", roomID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
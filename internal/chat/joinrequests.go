@@ -0,0 +1,145 @@
+package chat
+
+import (
+	"chat-app/pkg/models"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxJoinRequestMessage is the longest message a request to join can carry,
+// in characters
+const MaxJoinRequestMessage = 500
+
+// JoinRequestTTL is how long a request to join waits for an answer before it
+// expires, overridden on startup by JOIN_REQUEST_TTL
+var JoinRequestTTL = 7 * 24 * time.Hour
+
+// ErrJoinMessageTooLong is returned for requests to join whose message is
+// over MaxJoinRequestMessage
+var ErrJoinMessageTooLong = fmt.Errorf("message must be at most %d characters", MaxJoinRequestMessage)
+
+// pendingRequest restricts join_requests to the requests that have not
+// expired
+const pendingRequest = "datetime(join_requests.expires_at) > datetime('now')"
+
+// RequestToJoin asks the admins of a restricted room to let userID in, with
+// an optional message. Asking again replaces the pending request and starts
+// its JoinRequestTTL over. Archived rooms take no requests.
+func RequestToJoin(db *sql.DB, roomID, userID int, message string) (*models.JoinRequest, error) {
+	message = strings.TrimSpace(message)
+	if utf8.RuneCountInString(message) > MaxJoinRequestMessage {
+		return nil, ErrJoinMessageTooLong
+	}
+
+	request := &models.JoinRequest{RoomID: roomID, UserID: userID, Message: message}
+	var archived bool
+	err := db.QueryRow(`SELECT chat_rooms.name, users.username, chat_rooms.archived_at IS NOT NULL
+		FROM chat_rooms, users WHERE chat_rooms.id = ? AND users.id = ?`,
+		roomID, userID).Scan(&request.RoomName, &request.Username, &archived)
+	if err == sql.ErrNoRows {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if archived {
+		return nil, ErrRoomArchived
+	}
+	banned, err := isBanned(db, roomID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if banned {
+		return nil, ErrBanned
+	}
+
+	// expired requests are cleared out whenever a new one comes in
+	if _, err := db.Exec("DELETE FROM join_requests WHERE NOT " + pendingRequest); err != nil {
+		return nil, err
+	}
+
+	request.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	request.ExpiresAt = request.CreatedAt.Add(JoinRequestTTL)
+	_, err = db.Exec(`INSERT OR REPLACE INTO join_requests (room_id, user_id, message, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)`, roomID, userID, message, SQLTime(request.CreatedAt), SQLTime(request.ExpiresAt))
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// JoinRequests returns the pending requests to join a room, oldest first
+func JoinRequests(db *sql.DB, roomID int) ([]models.JoinRequest, error) {
+	return queryJoinRequests(db, "join_requests.room_id = ? ORDER BY join_requests.created_at", roomID)
+}
+
+// OwnJoinRequests returns a user's pending requests to join rooms, newest
+// first
+func OwnJoinRequests(db *sql.DB, userID int) ([]models.JoinRequest, error) {
+	return queryJoinRequests(db, "join_requests.user_id = ? ORDER BY join_requests.created_at DESC", userID)
+}
+
+func queryJoinRequests(db *sql.DB, where string, arg int) ([]models.JoinRequest, error) {
+	rows, err := db.Query(`SELECT join_requests.room_id, chat_rooms.name, join_requests.user_id, users.username,
+		join_requests.message, join_requests.created_at, join_requests.expires_at
+		FROM join_requests
+		JOIN chat_rooms ON chat_rooms.id = join_requests.room_id
+		JOIN users ON users.id = join_requests.user_id
+		WHERE `+pendingRequest+` AND `+where, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []models.JoinRequest{}
+	for rows.Next() {
+		var request models.JoinRequest
+		err := rows.Scan(&request.RoomID, &request.RoomName, &request.UserID, &request.Username,
+			&request.Message, &request.CreatedAt, &request.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, rows.Err()
+}
+
+// ApproveJoinRequest adds userID to a room on behalf of actorID, who
+// approved their pending request to join. It returns sql.ErrNoRows if there
+// is no such request or it has expired.
+func ApproveJoinRequest(db *sql.DB, roomID, userID, actorID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM join_requests WHERE room_id = ? AND user_id = ? AND "+pendingRequest, roomID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := addMember(tx, roomID, userID, actorID, models.RoleMember); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteJoinRequest deletes a user's pending request to join a room, when an
+// admin denies it or the user withdraws it. It returns sql.ErrNoRows if
+// there is no such request or it has expired.
+func DeleteJoinRequest(db *sql.DB, roomID, userID int) error {
+	res, err := db.Exec("DELETE FROM join_requests WHERE room_id = ? AND user_id = ? AND "+pendingRequest, roomID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
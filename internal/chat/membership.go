@@ -0,0 +1,284 @@
+package chat
+
+import (
+	"chat-app/pkg/models"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrRoomNotFound is returned when joining a room that does not exist, or a
+// secret room without an invitation
+var ErrRoomNotFound = errors.New("room not found")
+
+// ErrInviteRequired is returned when joining a private room without an
+// invitation
+var ErrInviteRequired = errors.New("this room is invite-only")
+
+// ErrApprovalRequired is returned when joining a restricted room without an
+// invitation. The user can ask to join with RequestToJoin instead.
+var ErrApprovalRequired = errors.New("joining this room needs an admin's approval")
+
+// JoinChatRoom adds a user to a chat room and records when they joined.
+// Restricted, private and secret rooms can only be joined with a pending
+// invitation, which joining accepts. Archived rooms cannot be joined.
+func JoinChatRoom(db *sql.DB, roomID, userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var visibility string
+	var invited, member, archived bool
+	err = tx.QueryRow(`SELECT visibility, EXISTS (SELECT 1 FROM room_invitations WHERE room_id = ? AND user_id = ?),
+		EXISTS (SELECT 1 FROM room_users WHERE room_id = ? AND user_id = ?), archived_at IS NOT NULL
+		FROM chat_rooms WHERE id = ?`, roomID, userID, roomID, userID, roomID).Scan(&visibility, &invited, &member, &archived)
+	if err == sql.ErrNoRows {
+		return ErrRoomNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if member {
+		return ErrAlreadyMember
+	}
+	if !invited && visibility == models.VisibilitySecret {
+		return ErrRoomNotFound
+	}
+	if archived {
+		return ErrRoomArchived
+	}
+	if !invited && visibility == models.VisibilityPrivate {
+		return ErrInviteRequired
+	}
+	if !invited && visibility == models.VisibilityRestricted {
+		return ErrApprovalRequired
+	}
+
+	if err := addMember(tx, roomID, userID, userID, models.RoleMember); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddToChatRoom adds a user to a chat room on behalf of actorID, who invited
+// them
+func AddToChatRoom(db *sql.DB, roomID, userID, actorID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", userID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrUserNotFound
+	}
+	if err := addMember(tx, roomID, userID, actorID, models.RoleMember); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addMember adds a user to a room with role. Nobody gets into an archived
+// room or one they are banned from.
+func addMember(tx *sql.Tx, roomID, userID, actorID int, role string) error {
+	var archived bool
+	err := tx.QueryRow("SELECT archived_at IS NOT NULL FROM chat_rooms WHERE id = ?", roomID).Scan(&archived)
+	if err == sql.ErrNoRows {
+		return ErrRoomNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if archived {
+		return ErrRoomArchived
+	}
+	// no way into a room gets around a ban
+	banned, err := isBanned(tx, roomID, userID)
+	if err != nil {
+		return err
+	}
+	if banned {
+		return ErrBanned
+	}
+	var exists int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM room_users WHERE room_id = ? AND user_id = ?", roomID, userID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return ErrAlreadyMember
+	}
+
+	_, err = tx.Exec("INSERT INTO room_users (room_id, user_id, joined_at, role) VALUES (?, ?, CURRENT_TIMESTAMP, ?)", roomID, userID, role)
+	if err != nil {
+		return err
+	}
+	// however they got in, an invitation or a request to join has served
+	// its purpose
+	_, err = tx.Exec("DELETE FROM room_invitations WHERE room_id = ? AND user_id = ?", roomID, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM join_requests WHERE room_id = ? AND user_id = ?", roomID, userID)
+	if err != nil {
+		return err
+	}
+	return RecordMembershipEvent(tx, roomID, userID, actorID, models.MembershipJoin)
+}
+
+// LeaveChatRoom removes a user from a chat room. If they were its last owner,
+// ownership passes to another member, whose ID is returned as successorID.
+func LeaveChatRoom(db *sql.DB, roomID, userID int) (successorID int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := removeMember(tx, roomID, userID, userID, models.MembershipLeave); err != nil {
+		return 0, err
+	}
+	successorID, err = ensureOwner(tx, roomID)
+	if err != nil {
+		return 0, err
+	}
+	return successorID, tx.Commit()
+}
+
+// KickFromChatRoom removes a user from a chat room on behalf of actorID,
+// recording why in the moderation log. They can join again.
+func KickFromChatRoom(db *sql.DB, roomID, userID, actorID int, reason string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	removed, err := removeMember(tx, roomID, userID, actorID, models.MembershipKick)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return ErrNotMember
+	}
+	if err := recordModeration(tx, roomID, userID, actorID, models.ModerationKick, reason, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// removeMember takes a user out of a room, reporting whether they were in it
+func removeMember(tx *sql.Tx, roomID, userID, actorID int, event string) (bool, error) {
+	res, err := tx.Exec("DELETE FROM room_users WHERE room_id = ? AND user_id = ?", roomID, userID)
+	if err != nil {
+		return false, err
+	}
+	// leaving a room you are not in changes nothing, so there is nothing to log
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	return true, RecordMembershipEvent(tx, roomID, userID, actorID, event)
+}
+
+// RecordMembershipEvent appends to a room's membership log. actorID is the
+// user who performed the change, or 0 if it was done by the server itself.
+func RecordMembershipEvent(tx *sql.Tx, roomID, userID, actorID int, event string) error {
+	var actor sql.NullInt64
+	if actorID != 0 {
+		actor = sql.NullInt64{Int64: int64(actorID), Valid: true}
+	}
+	_, err := tx.Exec("INSERT INTO membership_events (room_id, user_id, actor_id, event) VALUES (?, ?, ?, ?)", roomID, userID, actor, event)
+	return err
+}
+
+// IsMember reports whether a user is currently in a chat room
+func IsMember(db *sql.DB, roomID, userID int) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM room_users WHERE room_id = ? AND user_id = ?", roomID, userID).Scan(&count)
+	return count > 0, err
+}
+
+// MembershipLog returns up to limit membership events of a room older than
+// beforeID, newest first. A non-zero userID only returns that user's events.
+func MembershipLog(db *sql.DB, roomID, userID, beforeID, limit int) ([]models.MembershipEvent, error) {
+	rows, err := db.Query(`SELECT membership_events.id, membership_events.user_id, users.username,
+		membership_events.actor_id, membership_events.event, membership_events.created_at
+		FROM membership_events LEFT JOIN users ON users.id = membership_events.user_id
+		WHERE membership_events.room_id = ? AND (? = 0 OR membership_events.user_id = ?)
+		AND (? = 0 OR membership_events.id < ?)
+		ORDER BY membership_events.id DESC LIMIT ?`, roomID, userID, userID, beforeID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.MembershipEvent{}
+	for rows.Next() {
+		event := models.MembershipEvent{RoomID: roomID}
+		var username sql.NullString
+		var actorID sql.NullInt64
+		err := rows.Scan(&event.ID, &event.UserID, &username, &actorID, &event.Event, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		event.Username = username.String
+		event.ActorID = int(actorID.Int64)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// MembersAt replays the membership log to list who was in a room at time at.
+// Members who joined before the log existed are assumed to have always been
+// in the room.
+func MembersAt(db *sql.DB, roomID int, at time.Time) ([]models.User, error) {
+	rows, err := db.Query(`SELECT users.id, users.username, last.event FROM users
+		JOIN (
+			SELECT user_id, event FROM membership_events
+			WHERE id IN (
+				SELECT MAX(id) FROM membership_events
+				WHERE room_id = ? AND datetime(created_at) <= datetime(?)
+				GROUP BY user_id
+			)
+			UNION ALL
+			SELECT room_users.user_id, ? FROM room_users
+			WHERE room_users.room_id = ? AND room_users.joined_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM membership_events
+				WHERE membership_events.room_id = room_users.room_id AND membership_events.user_id = room_users.user_id)
+		) AS last ON last.user_id = users.id
+		ORDER BY users.id`, roomID, SQLTime(at), models.MembershipJoin, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		var user models.User
+		var event string
+		if err := rows.Scan(&user.ID, &user.Username, &event); err != nil {
+			return nil, err
+		}
+		if event == models.MembershipJoin {
+			users = append(users, user)
+		}
+	}
+	return users, rows.Err()
+}
+
+// SQLTime formats t the way SQLite's CURRENT_TIMESTAMP does, so that it can be
+// compared with the timestamps the schema stores
+func SQLTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// parseSQLTime reads a timestamp formatted by SQLTime or SQLite's datetime(),
+// as computed columns come back as text rather than times
+func parseSQLTime(s string) (time.Time, error) {
+	return time.Parse("2006-01-02 15:04:05", s)
+}
@@ -0,0 +1,510 @@
+package chat
+
+import (
+	"chat-app/internal/archive"
+	"chat-app/internal/encryption"
+	"chat-app/pkg/models"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// messageColumns are the columns read by scanMessage. The wrapped data key is
+// joined in so that a page of history can be decrypted without extra queries.
+const messageColumns = `messages.id, messages.sender_id, messages.recipient_id, messages.room_id,
+	messages.content, messages.timestamp, messages.edited_at, data_keys.wrapped_key
+	FROM messages LEFT JOIN data_keys ON data_keys.id = messages.key_id`
+
+// visibleInRoom takes a user ID and restricts room messages to those that
+// user may read: messages of rooms they are in, and for rooms whose history
+// visibility is "joined", only those sent since they joined
+const visibleInRoom = `EXISTS (SELECT 1 FROM room_users JOIN chat_rooms ON chat_rooms.id = room_users.room_id
+	WHERE room_users.room_id = messages.room_id AND room_users.user_id = ?
+	AND (chat_rooms.history_visibility != 'joined' OR room_users.joined_at IS NULL
+		OR datetime(messages.timestamp) >= datetime(room_users.joined_at)))`
+
+// notBlocked takes a user ID and leaves out the room messages of the users
+// they have blocked
+const notBlocked = `(messages.room_id IS NULL OR NOT EXISTS (SELECT 1 FROM blocks
+	WHERE blocks.blocker_id = ? AND blocks.blocked_id = messages.sender_id))`
+
+// SaveMessage encrypts and stores a room or direct message and sets its ID.
+// Messages to archived rooms are refused with ErrRoomArchived.
+func SaveMessage(db encryption.Execer, msg *models.Message) error {
+	content, keyID, err := encryption.Default.Encrypt(db, keyScope(msg), msg.Content)
+	if err != nil {
+		return err
+	}
+
+	var res sql.Result
+	if msg.RoomID != 0 {
+		// checked in the same statement, so a room archived meanwhile
+		// gets nothing
+		res, err = db.Exec(`INSERT INTO messages (sender_id, room_id, content, key_id) SELECT ?, ?, ?, ?
+			WHERE NOT EXISTS (SELECT 1 FROM chat_rooms WHERE id = ? AND archived_at IS NOT NULL)`,
+			msg.SenderID, msg.RoomID, content, keyID, msg.RoomID)
+	} else {
+		res, err = db.Exec("INSERT INTO messages (sender_id, recipient_id, content, key_id) VALUES (?, ?, ?, ?)", msg.SenderID, msg.RecipientID, content, keyID)
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrRoomArchived
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	msg.ID = int(id)
+	return nil
+}
+
+// ErrMessageNotFound is returned for messages that are not in the database,
+// which includes messages moved to archive segments
+var ErrMessageNotFound = errors.New("message not found")
+
+// RoomMessageSender returns who sent a message of a room, or 0 if the sender
+// has been deleted
+func RoomMessageSender(db *sql.DB, roomID, messageID int) (int, error) {
+	var senderID sql.NullInt64
+	err := db.QueryRow("SELECT sender_id FROM messages WHERE id = ? AND room_id = ?", messageID, roomID).Scan(&senderID)
+	if err == sql.ErrNoRows {
+		return 0, ErrMessageNotFound
+	}
+	return int(senderID.Int64), err
+}
+
+// EditMessage replaces the content of a room message and returns when it was
+// edited
+func EditMessage(db *sql.DB, roomID, messageID int, content string) (time.Time, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	content, keyID, err := encryption.Default.Encrypt(tx, encryption.RoomScope(roomID), content)
+	if err != nil {
+		return time.Time{}, err
+	}
+	editedAt := time.Now().UTC().Truncate(time.Second)
+	res, err := tx.Exec("UPDATE messages SET content = ?, key_id = ?, edited_at = ? WHERE id = ? AND room_id = ?",
+		content, keyID, SQLTime(editedAt), messageID, roomID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return time.Time{}, ErrMessageNotFound
+	}
+	return editedAt, tx.Commit()
+}
+
+// RoomHistory returns up to limit messages of a room visible to userID older
+// than beforeID, or the most recent ones if beforeID is 0, oldest first.
+// Messages moved to archive segments are included, and those of users
+// userID has blocked are left out.
+func RoomHistory(db *sql.DB, roomID, userID, beforeID, limit int) ([]models.Message, error) {
+	rows, err := db.Query("SELECT "+messageColumns+`
+		WHERE messages.room_id = ? AND `+visibleInRoom+` AND `+notBlocked+` AND (? = 0 OR messages.id < ?)
+		ORDER BY messages.id DESC LIMIT ?`, roomID, userID, userID, beforeID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	live, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	since, err := visibleSince(db, roomID, userID)
+	if err != nil {
+		return nil, err
+	}
+	blocked, err := blockedBy(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := archive.RoomSegments(db, roomID, beforeID)
+	if err != nil {
+		return nil, err
+	}
+	return withArchived(db, live, segments, beforeID, since, blocked, limit)
+}
+
+// DirectHistory returns up to limit direct messages between two users older
+// than beforeID, or the most recent ones if beforeID is 0, oldest first.
+// Messages moved to archive segments are included.
+func DirectHistory(db *sql.DB, userID, otherID, beforeID, limit int) ([]models.Message, error) {
+	rows, err := db.Query("SELECT "+messageColumns+`
+		WHERE messages.room_id IS NULL
+		AND ((messages.sender_id = ? AND messages.recipient_id = ?) OR (messages.sender_id = ? AND messages.recipient_id = ?))
+		AND (? = 0 OR messages.id < ?)
+		ORDER BY messages.id DESC LIMIT ?`, userID, otherID, otherID, userID, beforeID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	live, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := archive.DMSegments(db, userID, otherID, beforeID)
+	if err != nil {
+		return nil, err
+	}
+	return withArchived(db, live, segments, beforeID, time.Time{}, nil, limit)
+}
+
+// searchBatch is how many messages SearchMessages reads from the messages
+// table at a time, and searchBudget how many it decrypts and checks in all,
+// archived ones included, before giving up on finding limit matches
+var (
+	searchBatch  = 500
+	searchBudget = 20000
+)
+
+// SearchMessages returns up to limit of the newest messages visible to userID
+// whose content contains query, ignoring case. Content is encrypted at rest,
+// so matching happens after decryption rather than in SQL, walking back from
+// the newest message a batch at a time. A non-zero roomID restricts the
+// search to that room. Archived messages are searched once the messages
+// table has no more matches. The search stops early, with fewer matches,
+// once searchBudget messages have been checked. Room messages of users
+// userID has blocked are left out.
+func SearchMessages(db *sql.DB, userID int, query string, roomID, limit int) ([]models.Message, error) {
+	query = strings.ToLower(query)
+	matches := func(msg models.Message) bool {
+		return strings.Contains(strings.ToLower(msg.Content), query)
+	}
+
+	results := []models.Message{}
+	budget := searchBudget
+	beforeID := 0
+	for len(results) < limit && budget > 0 {
+		batch := searchBatch
+		if batch > budget {
+			batch = budget
+		}
+		rows, err := db.Query("SELECT "+messageColumns+`
+			WHERE (`+visibleInRoom+`
+				OR (messages.room_id IS NULL AND (messages.sender_id = ? OR messages.recipient_id = ?)))
+			AND `+notBlocked+` AND (? = 0 OR messages.room_id = ?) AND (? = 0 OR messages.id < ?)
+			ORDER BY messages.id DESC LIMIT ?`, userID, userID, userID, userID, roomID, roomID, beforeID, beforeID, batch)
+		if err != nil {
+			return nil, err
+		}
+		messages, err := scanMessages(rows)
+		if err != nil {
+			return nil, err
+		}
+		budget -= len(messages)
+		for _, msg := range messages {
+			if matches(msg) && len(results) < limit {
+				results = append(results, msg)
+			}
+		}
+		if len(messages) < batch {
+			// the messages table has nothing older
+			break
+		}
+		beforeID = messages[len(messages)-1].ID
+	}
+	if len(results) >= limit || budget <= 0 {
+		return results, nil
+	}
+
+	archived, err := searchArchive(db, userID, roomID, matches, limit-len(results), budget)
+	if err != nil {
+		return nil, err
+	}
+	return append(results, archived...), nil
+}
+
+// archivedSegment is a segment searchArchive reads, with what userID may see
+// of it
+type archivedSegment struct {
+	archive.Segment
+	since  time.Time
+	hidden map[int]bool
+}
+
+// searchArchive returns up to limit of the newest archived messages visible
+// to userID accepted by matches, newest first. It reads segments newest
+// first, and stops once no unread segment can hold newer matches or budget
+// messages have been checked.
+func searchArchive(db *sql.DB, userID, roomID int, matches func(models.Message) bool, limit, budget int) ([]models.Message, error) {
+	rooms, err := db.Query("SELECT room_id FROM room_users WHERE user_id = ? AND (? = 0 OR room_id = ?)", userID, roomID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	var roomIDs []int
+	for rooms.Next() {
+		var id int
+		if err := rooms.Scan(&id); err != nil {
+			rooms.Close()
+			return nil, err
+		}
+		roomIDs = append(roomIDs, id)
+	}
+	rooms.Close()
+	if err := rooms.Err(); err != nil {
+		return nil, err
+	}
+
+	blocked, err := blockedBy(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []archivedSegment
+	for _, id := range roomIDs {
+		since, err := visibleSince(db, id, userID)
+		if err != nil {
+			return nil, err
+		}
+		roomSegments, err := archive.RoomSegments(db, id, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, seg := range roomSegments {
+			segments = append(segments, archivedSegment{seg, since, blocked})
+		}
+	}
+	if roomID == 0 {
+		dmSegments, err := archive.UserDMSegments(db, userID)
+		if err != nil {
+			return nil, err
+		}
+		for _, seg := range dmSegments {
+			segments = append(segments, archivedSegment{Segment: seg})
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].LastID > segments[j].LastID })
+
+	keys := map[int64][]byte{}
+	results := []models.Message{}
+	for _, seg := range segments {
+		// later segments only hold older messages than the matches so far
+		if len(results) >= limit && seg.LastID < results[limit-1].ID {
+			break
+		}
+		if budget <= 0 {
+			break
+		}
+		messages, err := readArchived(db, keys, seg.Segment, 0, seg.since, seg.hidden)
+		if err != nil {
+			return nil, err
+		}
+		budget -= len(messages)
+		for _, msg := range messages {
+			if matches(msg) {
+				results = append(results, msg)
+			}
+		}
+		sortNewestFirst(results)
+		if len(results) > limit {
+			results = results[:limit]
+		}
+	}
+	return results, nil
+}
+
+// visibleSince returns when the part of a room's history visible to userID
+// starts: their join time for rooms whose history visibility is "joined",
+// or the zero time
+func visibleSince(db *sql.DB, roomID, userID int) (time.Time, error) {
+	var visibility string
+	var joinedAt sql.NullTime
+	err := db.QueryRow(`SELECT chat_rooms.history_visibility, room_users.joined_at
+		FROM chat_rooms LEFT JOIN room_users ON room_users.room_id = chat_rooms.id AND room_users.user_id = ?
+		WHERE chat_rooms.id = ?`, userID, roomID).Scan(&visibility, &joinedAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil || visibility != models.HistoryJoined || !joinedAt.Valid {
+		return time.Time{}, err
+	}
+	return joinedAt.Time, nil
+}
+
+// withArchived merges the archived messages of segments, which must be
+// ordered newest first, into live, a newest-first page read from the
+// messages table. It returns the newest limit of them, oldest first.
+// Messages of the senders in hidden are left out.
+func withArchived(db *sql.DB, live []models.Message, segments []archive.Segment, beforeID int, since time.Time, hidden map[int]bool, limit int) ([]models.Message, error) {
+	messages := live
+	keys := map[int64][]byte{}
+	for _, seg := range segments {
+		// later segments only hold older messages than this one
+		if len(messages) >= limit && seg.LastID < messages[limit-1].ID {
+			break
+		}
+		archived, err := readArchived(db, keys, seg, beforeID, since, hidden)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, archived...)
+		sortNewestFirst(messages)
+		if len(messages) > limit {
+			messages = messages[:limit]
+		}
+	}
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// readArchived decrypts the messages of a segment older than beforeID (any
+// if it is 0) and sent at or after since, except those of the senders in
+// hidden. keys caches wrapped data keys.
+func readArchived(db *sql.DB, keys map[int64][]byte, seg archive.Segment, beforeID int, since time.Time, hidden map[int]bool) ([]models.Message, error) {
+	records, err := seg.Read(func(block archive.Block) bool {
+		return (beforeID == 0 || block.FirstID < beforeID) && !block.LastAt.Before(since)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []models.Message{}
+	for _, record := range records {
+		if (beforeID != 0 && record.ID >= beforeID) || record.Timestamp.Before(since) || hidden[record.SenderID] {
+			continue
+		}
+		msg, err := decryptRecord(db, keys, record)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// decryptRecord turns an archived record into a message. keys caches
+// wrapped data keys.
+func decryptRecord(db *sql.DB, keys map[int64][]byte, record archive.Record) (models.Message, error) {
+	var wrapped []byte
+	if record.KeyID != 0 {
+		var ok bool
+		if wrapped, ok = keys[record.KeyID]; !ok {
+			err := db.QueryRow("SELECT wrapped_key FROM data_keys WHERE id = ?", record.KeyID).Scan(&wrapped)
+			if err != nil {
+				return models.Message{}, err
+			}
+			keys[record.KeyID] = wrapped
+		}
+	}
+	content, err := encryption.Default.Decrypt(wrapped, record.Content)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	return models.Message{
+		ID:          record.ID,
+		SenderID:    record.SenderID,
+		RecipientID: record.RecipientID,
+		RoomID:      record.RoomID,
+		Content:     content,
+		Timestamp:   record.Timestamp,
+	}, nil
+}
+
+func sortNewestFirst(messages []models.Message) {
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID > messages[j].ID
+	})
+}
+
+// scanMessages reads every row, keeping their order
+func scanMessages(rows *sql.Rows) ([]models.Message, error) {
+	defer rows.Close()
+
+	messages := []models.Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func scanMessage(rows *sql.Rows) (models.Message, error) {
+	var msg models.Message
+	var senderID, recipientID, roomID sql.NullInt64
+	var editedAt sql.NullTime
+	var wrapped []byte
+	err := rows.Scan(&msg.ID, &senderID, &recipientID, &roomID, &msg.Content, &msg.Timestamp, &editedAt, &wrapped)
+	if err != nil {
+		return msg, err
+	}
+	if editedAt.Valid {
+		msg.EditedAt = &editedAt.Time
+	}
+	msg.SenderID = int(senderID.Int64)
+	msg.RecipientID = int(recipientID.Int64)
+	msg.RoomID = int(roomID.Int64)
+
+	msg.Content, err = encryption.Default.Decrypt(wrapped, msg.Content)
+	return msg, err
+}
+
+// EncryptStoredMessages encrypts messages that were stored before a master
+// key was configured and returns how many were changed
+func EncryptStoredMessages(db *sql.DB) (int, error) {
+	if encryption.Default == nil {
+		return 0, errors.New("no master key is configured")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, sender_id, recipient_id, room_id, content FROM messages WHERE key_id IS NULL")
+	if err != nil {
+		return 0, err
+	}
+	var plain []models.Message
+	for rows.Next() {
+		var msg models.Message
+		var senderID, recipientID, roomID sql.NullInt64
+		if err := rows.Scan(&msg.ID, &senderID, &recipientID, &roomID, &msg.Content); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		msg.SenderID = int(senderID.Int64)
+		msg.RecipientID = int(recipientID.Int64)
+		msg.RoomID = int(roomID.Int64)
+		plain = append(plain, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, msg := range plain {
+		content, keyID, err := encryption.Default.Encrypt(tx, keyScope(&msg), msg.Content)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec("UPDATE messages SET content = ?, key_id = ? WHERE id = ?", content, keyID, msg.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(plain), tx.Commit()
+}
+
+// keyScope names the data key of the conversation msg belongs to
+func keyScope(msg *models.Message) string {
+	if msg.RoomID != 0 {
+		return encryption.RoomScope(msg.RoomID)
+	}
+	return encryption.DMScope(msg.SenderID, msg.RecipientID)
+}
@@ -0,0 +1,81 @@
+package chat
+
+import (
+	"chat-app/internal/archive"
+	"chat-app/internal/database/databasetest"
+	"chat-app/pkg/models"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSearchMessagesIsBounded(t *testing.T) {
+	previousBatch, previousBudget := searchBatch, searchBudget
+	t.Cleanup(func() { searchBatch, searchBudget = previousBatch, previousBudget })
+	searchBatch = 2
+
+	archive.Dir = t.TempDir()
+	db := databasetest.Open(t)
+	alice := databasetest.NewUser(t, db, "alice")
+	roomID := newRoom(t, db, alice, models.VisibilityPublic)
+
+	// messages 1 to 6 get archived and 7 to 12 stay in the messages table;
+	// the even ones match
+	content := func(id int) string {
+		if id%2 == 0 {
+			return fmt.Sprintf("needle %d", id)
+		}
+		return fmt.Sprintf("hay %d", id)
+	}
+	for id := 1; id <= 6; id++ {
+		if _, err := db.Exec("INSERT INTO messages (sender_id, room_id, content, timestamp) VALUES (?, ?, ?, ?)",
+			alice, roomID, content(id), SQLTime(time.Date(2000, 1, 1, 0, 0, id, 0, time.UTC))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := (&archive.Archiver{DB: db, After: time.Hour}).ArchiveOnce(time.Now()); err != nil || n != 6 {
+		t.Fatalf("archiving: got %d %v", n, err)
+	}
+	for id := 7; id <= 12; id++ {
+		msg := models.Message{SenderID: alice, RoomID: roomID, Content: content(id)}
+		if err := SaveMessage(db, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID != id {
+			t.Fatalf("message %d got ID %d", id, msg.ID)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		limit  int
+		budget int
+		want   []int
+	}{
+		{"first batch", 1, 100, []int{12}},
+		{"across batches", 3, 100, []int{12, 10, 8}},
+		{"into the archive", 4, 100, []int{12, 10, 8, 6}},
+		{"everything", 10, 100, []int{12, 10, 8, 6, 4, 2}},
+		{"budget runs out within a batch", 10, 3, []int{12, 10}},
+		{"budget runs out before the archive", 10, 6, []int{12, 10, 8}},
+	}
+	for _, test := range tests {
+		searchBudget = test.budget
+		for _, room := range []int{0, roomID} {
+			messages, err := SearchMessages(db, alice, "NEEDLE", room, test.limit)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			var got []int
+			for _, msg := range messages {
+				if msg.Content != content(msg.ID) {
+					t.Errorf("%s: message %d reads %q", test.name, msg.ID, msg.Content)
+				}
+				got = append(got, msg.ID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("%s in room %d: got %v, want %v", test.name, room, got, test.want)
+			}
+		}
+	}
+}
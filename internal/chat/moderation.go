@@ -0,0 +1,276 @@
+package chat
+
+import (
+	"chat-app/pkg/models"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxModerationReason is the longest reason a moderation action can give,
+// in characters
+const MaxModerationReason = 500
+
+var (
+	// ErrBanned is returned when a banned user would get into a room, by
+	// joining, being added or invited, or asking to join
+	ErrBanned = errors.New("banned from this room")
+	// ErrReasonTooLong is returned for reasons over MaxModerationReason
+	ErrReasonTooLong = fmt.Errorf("reason must be at most %d characters", MaxModerationReason)
+)
+
+// activeSanction restricts room_sanctions to the bans and mutes in force
+const activeSanction = "(room_sanctions.expires_at IS NULL OR datetime(room_sanctions.expires_at) > datetime('now'))"
+
+// ValidReason trims a moderation reason and checks its length
+func ValidReason(reason string) (string, error) {
+	reason = strings.TrimSpace(reason)
+	if utf8.RuneCountInString(reason) > MaxModerationReason {
+		return "", ErrReasonTooLong
+	}
+	return reason, nil
+}
+
+// Ban keeps a user out of a room for ttl, or until they are unbanned if ttl
+// is 0, on behalf of actorID. A member is removed from the room, and pending
+// invitations and requests to join are dropped. Banning someone again
+// replaces their ban. removed reports whether they were a member.
+func Ban(db *sql.DB, roomID, userID, actorID int, reason string, ttl time.Duration) (ban *models.Sanction, removed bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists); err != nil {
+		return nil, false, err
+	}
+	if !exists {
+		return nil, false, ErrUserNotFound
+	}
+
+	removed, err = removeMember(tx, roomID, userID, actorID, models.MembershipBan)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, query := range []string{
+		"DELETE FROM room_invitations WHERE room_id = ? AND user_id = ?",
+		"DELETE FROM join_requests WHERE room_id = ? AND user_id = ?",
+	} {
+		if _, err := tx.Exec(query, roomID, userID); err != nil {
+			return nil, false, err
+		}
+	}
+
+	ban, err = sanction(tx, roomID, userID, actorID, models.SanctionBan, reason, ttl)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := recordModeration(tx, roomID, userID, actorID, models.ModerationBan, reason, ban.ExpiresAt); err != nil {
+		return nil, false, err
+	}
+	return ban, removed, tx.Commit()
+}
+
+// Mute keeps a member of a room from posting to it for ttl, on behalf of
+// actorID. They stay in the room, and leaving it does not end the mute.
+// Muting someone again replaces their mute.
+func Mute(db *sql.DB, roomID, userID, actorID int, reason string, ttl time.Duration) (*models.Sanction, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var member bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM room_users WHERE room_id = ? AND user_id = ?)", roomID, userID).Scan(&member)
+	if err != nil {
+		return nil, err
+	}
+	if !member {
+		return nil, ErrNotMember
+	}
+
+	mute, err := sanction(tx, roomID, userID, actorID, models.SanctionMute, reason, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordModeration(tx, roomID, userID, actorID, models.ModerationMute, reason, mute.ExpiresAt); err != nil {
+		return nil, err
+	}
+	return mute, tx.Commit()
+}
+
+func sanction(tx *sql.Tx, roomID, userID, actorID int, kind, reason string, ttl time.Duration) (*models.Sanction, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	s := &models.Sanction{RoomID: roomID, UserID: userID, Kind: kind, ActorID: actorID, Reason: reason, CreatedAt: now}
+	var expiresAt sql.NullString
+	if ttl > 0 {
+		expiry := now.Add(ttl)
+		s.ExpiresAt = &expiry
+		expiresAt = sql.NullString{String: SQLTime(expiry), Valid: true}
+	}
+
+	var actor sql.NullInt64
+	if actorID != 0 {
+		actor = sql.NullInt64{Int64: int64(actorID), Valid: true}
+	}
+
+	_, err := tx.Exec(`INSERT OR REPLACE INTO room_sanctions (room_id, user_id, kind, actor_id, reason, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, roomID, userID, kind, actor, reason, SQLTime(now), expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Unban lifts a user's ban from a room on behalf of actorID, returning
+// sql.ErrNoRows if they are not banned
+func Unban(db *sql.DB, roomID, userID, actorID int) error {
+	return lift(db, roomID, userID, actorID, models.SanctionBan, models.ModerationUnban)
+}
+
+// Unmute lifts a user's mute in a room on behalf of actorID, returning
+// sql.ErrNoRows if they are not muted
+func Unmute(db *sql.DB, roomID, userID, actorID int) error {
+	return lift(db, roomID, userID, actorID, models.SanctionMute, models.ModerationUnmute)
+}
+
+func lift(db *sql.DB, roomID, userID, actorID int, kind, action string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM room_sanctions WHERE room_id = ? AND user_id = ? AND kind = ? AND "+activeSanction,
+		roomID, userID, kind)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := recordModeration(tx, roomID, userID, actorID, action, "", nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Sanctions returns the bans or mutes in force in a room, newest first
+func Sanctions(db *sql.DB, roomID int, kind string) ([]models.Sanction, error) {
+	rows, err := db.Query(`SELECT room_sanctions.user_id, COALESCE(users.username, ''), room_sanctions.actor_id,
+		room_sanctions.reason, room_sanctions.created_at, room_sanctions.expires_at
+		FROM room_sanctions LEFT JOIN users ON users.id = room_sanctions.user_id
+		WHERE room_sanctions.room_id = ? AND room_sanctions.kind = ? AND `+activeSanction+`
+		ORDER BY room_sanctions.created_at DESC`, roomID, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sanctions := []models.Sanction{}
+	for rows.Next() {
+		s := models.Sanction{RoomID: roomID, Kind: kind}
+		var actorID sql.NullInt64
+		var expiresAt sql.NullTime
+		err := rows.Scan(&s.UserID, &s.Username, &actorID, &s.Reason, &s.CreatedAt, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		s.ActorID = int(actorID.Int64)
+		if expiresAt.Valid {
+			s.ExpiresAt = &expiresAt.Time
+		}
+		sanctions = append(sanctions, s)
+	}
+	return sanctions, rows.Err()
+}
+
+// isBanned reports whether a user is banned from a room. db may be a *sql.DB
+// or a *sql.Tx.
+func isBanned(db interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, roomID, userID int) (bool, error) {
+	var banned bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM room_sanctions
+		WHERE room_id = ? AND user_id = ? AND kind = ? AND `+activeSanction+`)`,
+		roomID, userID, models.SanctionBan).Scan(&banned)
+	return banned, err
+}
+
+// ActiveMute returns the mute of a member of a room if they are muted, or
+// nil if they may post
+func ActiveMute(db *sql.DB, roomID, userID int) (*models.Sanction, error) {
+	mute := &models.Sanction{RoomID: roomID, UserID: userID, Kind: models.SanctionMute}
+	var actorID sql.NullInt64
+	var expiresAt sql.NullTime
+	err := db.QueryRow(`SELECT actor_id, reason, created_at, expires_at FROM room_sanctions
+		WHERE room_id = ? AND user_id = ? AND kind = ? AND `+activeSanction,
+		roomID, userID, models.SanctionMute).Scan(&actorID, &mute.Reason, &mute.CreatedAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	mute.ActorID = int(actorID.Int64)
+	if expiresAt.Valid {
+		mute.ExpiresAt = &expiresAt.Time
+	}
+	return mute, nil
+}
+
+// recordModeration appends to a room's moderation log
+func recordModeration(tx *sql.Tx, roomID, userID, actorID int, action, reason string, expiresAt *time.Time) error {
+	var actor sql.NullInt64
+	if actorID != 0 {
+		actor = sql.NullInt64{Int64: int64(actorID), Valid: true}
+	}
+	var expiry sql.NullString
+	if expiresAt != nil {
+		expiry = sql.NullString{String: SQLTime(*expiresAt), Valid: true}
+	}
+	_, err := tx.Exec("INSERT INTO moderation_log (room_id, user_id, actor_id, action, reason, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		roomID, userID, actor, action, reason, expiry)
+	return err
+}
+
+// ModerationLog returns up to limit moderation actions in a room older than
+// beforeID, newest first. A non-zero userID only returns actions against
+// that user.
+func ModerationLog(db *sql.DB, roomID, userID, beforeID, limit int) ([]models.ModerationAction, error) {
+	rows, err := db.Query(`SELECT moderation_log.id, moderation_log.user_id, users.username, moderation_log.actor_id,
+		moderation_log.action, moderation_log.reason, moderation_log.expires_at, moderation_log.created_at
+		FROM moderation_log LEFT JOIN users ON users.id = moderation_log.user_id
+		WHERE moderation_log.room_id = ? AND (? = 0 OR moderation_log.user_id = ?)
+		AND (? = 0 OR moderation_log.id < ?)
+		ORDER BY moderation_log.id DESC LIMIT ?`, roomID, userID, userID, beforeID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	actions := []models.ModerationAction{}
+	for rows.Next() {
+		action := models.ModerationAction{RoomID: roomID}
+		var username sql.NullString
+		var actorID sql.NullInt64
+		var expiresAt sql.NullTime
+		err := rows.Scan(&action.ID, &action.UserID, &username, &actorID, &action.Action, &action.Reason, &expiresAt, &action.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		action.Username = username.String
+		action.ActorID = int(actorID.Int64)
+		if expiresAt.Valid {
+			action.ExpiresAt = &expiresAt.Time
+		}
+		actions = append(actions, action)
+	}
+	return actions, rows.Err()
+}
@@ -0,0 +1,184 @@
+package chat
+
+import (
+	"chat-app/pkg/models"
+	"database/sql"
+	"errors"
+)
+
+var (
+	// ErrSelf is returned when blocking oneself or adding oneself as a
+	// contact
+	ErrSelf = errors.New("cannot do that to yourself")
+	// ErrBlocked is returned for direct messages to a user who has blocked
+	// the sender
+	ErrBlocked = errors.New("this user is not accepting direct messages from you")
+	// ErrBlocking is returned for direct messages to a user the sender has
+	// blocked
+	ErrBlocking = errors.New("you have blocked this user")
+	// ErrSharedRoomsOnly and ErrContactsOnly are returned for direct
+	// messages the recipient's DM policy does not accept
+	ErrSharedRoomsOnly = errors.New("this user only accepts direct messages from people they share a room with")
+	ErrContactsOnly    = errors.New("this user only accepts direct messages from their contacts")
+)
+
+// CanDirectMessage returns nil if senderID may send recipientID a direct
+// message, and otherwise an error saying why not, meant for the sender
+func CanDirectMessage(db *sql.DB, senderID, recipientID int) error {
+	var policy string
+	err := db.QueryRow("SELECT dm_policy FROM users WHERE id = ?", recipientID).Scan(&policy)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if senderID == recipientID {
+		return nil
+	}
+
+	var blockerID int
+	err = db.QueryRow(`SELECT blocker_id FROM blocks
+		WHERE (blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?)
+		ORDER BY blocker_id = ? DESC LIMIT 1`,
+		recipientID, senderID, senderID, recipientID, recipientID).Scan(&blockerID)
+	if err == nil && blockerID == recipientID {
+		return ErrBlocked
+	}
+	if err == nil {
+		return ErrBlocking
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	var allowed bool
+	switch policy {
+	case models.DMSharedRooms:
+		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM room_users AS mine
+			JOIN room_users AS theirs ON theirs.room_id = mine.room_id
+			WHERE mine.user_id = ? AND theirs.user_id = ?)`, senderID, recipientID).Scan(&allowed)
+		if err == nil && !allowed {
+			return ErrSharedRoomsOnly
+		}
+		return err
+	case models.DMContacts:
+		err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM contacts WHERE user_id = ? AND contact_id = ?)",
+			recipientID, senderID).Scan(&allowed)
+		if err == nil && !allowed {
+			return ErrContactsOnly
+		}
+		return err
+	}
+	return nil
+}
+
+// IsDMRefusal reports whether err from CanDirectMessage is a reason to give
+// the sender, rather than a failure
+func IsDMRefusal(err error) bool {
+	switch err {
+	case ErrUserNotFound, ErrBlocked, ErrBlocking, ErrSharedRoomsOnly, ErrContactsOnly:
+		return true
+	}
+	return false
+}
+
+// Block adds blockedID to the block list of blockerID. Blocking a user twice
+// is not an error.
+func Block(db *sql.DB, blockerID, blockedID int) error {
+	return addRelation(db, "INSERT OR IGNORE INTO blocks (blocker_id, blocked_id) VALUES (?, ?)", blockerID, blockedID)
+}
+
+// Unblock removes blockedID from the block list of blockerID
+func Unblock(db *sql.DB, blockerID, blockedID int) error {
+	_, err := db.Exec("DELETE FROM blocks WHERE blocker_id = ? AND blocked_id = ?", blockerID, blockedID)
+	return err
+}
+
+// ListBlocked returns the users userID has blocked
+func ListBlocked(db *sql.DB, userID int) ([]models.User, error) {
+	return listRelated(db, `SELECT users.id, users.username, COALESCE(users.display_name, '')
+		FROM blocks JOIN users ON users.id = blocks.blocked_id
+		WHERE blocks.blocker_id = ? ORDER BY users.username`, userID)
+}
+
+// BlockersOf returns the IDs of the users who have blocked userID
+func BlockersOf(db *sql.DB, userID int) (map[int]bool, error) {
+	return idSet(db, "SELECT blocker_id FROM blocks WHERE blocked_id = ?", userID)
+}
+
+// blockedBy returns the IDs of the users userID has blocked
+func blockedBy(db *sql.DB, userID int) (map[int]bool, error) {
+	return idSet(db, "SELECT blocked_id FROM blocks WHERE blocker_id = ?", userID)
+}
+
+// AddContact adds contactID to the contacts of userID
+func AddContact(db *sql.DB, userID, contactID int) error {
+	return addRelation(db, "INSERT OR IGNORE INTO contacts (user_id, contact_id) VALUES (?, ?)", userID, contactID)
+}
+
+// RemoveContact removes contactID from the contacts of userID
+func RemoveContact(db *sql.DB, userID, contactID int) error {
+	_, err := db.Exec("DELETE FROM contacts WHERE user_id = ? AND contact_id = ?", userID, contactID)
+	return err
+}
+
+// ListContacts returns the contacts of userID
+func ListContacts(db *sql.DB, userID int) ([]models.User, error) {
+	return listRelated(db, `SELECT users.id, users.username, COALESCE(users.display_name, '')
+		FROM contacts JOIN users ON users.id = contacts.contact_id
+		WHERE contacts.user_id = ? ORDER BY users.username`, userID)
+}
+
+// addRelation runs insert for a user and another existing user
+func addRelation(db *sql.DB, insert string, userID, otherID int) error {
+	if userID == otherID {
+		return ErrSelf
+	}
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", otherID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	_, err = db.Exec(insert, userID, otherID)
+	return err
+}
+
+func listRelated(db *sql.DB, query string, userID int) ([]models.User, error) {
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		var user models.User
+		if err := rows.Scan(&user.ID, &user.Username, &user.DisplayName); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func idSet(db *sql.DB, query string, userID int) (map[int]bool, error) {
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
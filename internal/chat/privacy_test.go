@@ -0,0 +1,151 @@
+package chat
+
+import (
+	"chat-app/internal/archive"
+	"chat-app/internal/database/databasetest"
+	"chat-app/pkg/models"
+	"testing"
+	"time"
+)
+
+func TestCanDirectMessage(t *testing.T) {
+	db := databasetest.Open(t)
+	alice := databasetest.NewUser(t, db, "alice")
+	bob := databasetest.NewUser(t, db, "bob")
+
+	setPolicy := func(userID int, policy string) func() error {
+		return func() error {
+			_, err := db.Exec("UPDATE users SET dm_policy = ? WHERE id = ?", policy, userID)
+			return err
+		}
+	}
+	shareRoom := func() error {
+		roomID := newRoom(t, db, alice, models.VisibilityPublic)
+		return JoinChatRoom(db, roomID, bob)
+	}
+
+	// each step changes the state the next ones see
+	tests := []struct {
+		name              string
+		before            func() error
+		sender, recipient int
+		err               error
+	}{
+		{"anyone by default", nil, alice, bob, nil},
+		{"to themselves", nil, alice, alice, nil},
+		{"to nobody", nil, alice, 12345, ErrUserNotFound},
+		{"recipient blocked the sender", func() error { return Block(db, bob, alice) }, alice, bob, ErrBlocked},
+		{"sender blocked the recipient", nil, bob, alice, ErrBlocking},
+		{"both blocked each other", func() error { return Block(db, alice, bob) }, alice, bob, ErrBlocked},
+		{"both blocked each other, the other way", nil, bob, alice, ErrBlocked},
+		{"unblocked", func() error {
+			if err := Unblock(db, alice, bob); err != nil {
+				return err
+			}
+			return Unblock(db, bob, alice)
+		}, alice, bob, nil},
+		{"shared rooms without one", setPolicy(bob, models.DMSharedRooms), alice, bob, ErrSharedRoomsOnly},
+		{"the policy is the recipient's", nil, bob, alice, nil},
+		{"shared rooms with one", shareRoom, alice, bob, nil},
+		{"contacts without being one", setPolicy(bob, models.DMContacts), alice, bob, ErrContactsOnly},
+		{"contacts when the sender added the recipient", func() error { return AddContact(db, alice, bob) }, alice, bob, ErrContactsOnly},
+		{"contacts when the recipient added the sender", func() error { return AddContact(db, bob, alice) }, alice, bob, nil},
+		{"contacts but blocked", func() error { return Block(db, bob, alice) }, alice, bob, ErrBlocked},
+	}
+	for _, test := range tests {
+		if test.before != nil {
+			if err := test.before(); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		err := CanDirectMessage(db, test.sender, test.recipient)
+		if err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+		if err != nil && !IsDMRefusal(err) {
+			t.Errorf("%s: %v is not a refusal", test.name, err)
+		}
+	}
+}
+
+func TestBlockedSendersAreHidden(t *testing.T) {
+	archive.Dir = t.TempDir()
+	db := databasetest.Open(t)
+	alice := databasetest.NewUser(t, db, "alice")
+	bob := databasetest.NewUser(t, db, "bob")
+	carol := databasetest.NewUser(t, db, "carol")
+	roomID := newRoom(t, db, alice, models.VisibilityPublic)
+	for _, userID := range []int{bob, carol} {
+		if err := JoinChatRoom(db, roomID, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a message from each of bob and carol that gets archived, then one
+	// from each that stays in the messages table
+	for _, senderID := range []int{bob, carol} {
+		if _, err := db.Exec("INSERT INTO messages (sender_id, room_id, content, timestamp) VALUES (?, ?, 'hello from long ago', '2000-01-01 00:00:00')",
+			senderID, roomID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := (&archive.Archiver{DB: db, After: time.Hour}).ArchiveOnce(time.Now()); err != nil || n != 2 {
+		t.Fatalf("archiving: got %d %v", n, err)
+	}
+	for _, senderID := range []int{bob, carol} {
+		if err := SaveMessage(db, &models.Message{SenderID: senderID, RoomID: roomID, Content: "hello now"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// bob's direct messages are refused rather than hidden
+	if err := SaveMessage(db, &models.Message{SenderID: bob, RecipientID: alice, Content: "hello alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Block(db, alice, bob); err != nil {
+		t.Fatal(err)
+	}
+
+	senders := func(messages []models.Message) map[int]int {
+		counts := map[int]int{}
+		for _, msg := range messages {
+			counts[msg.SenderID]++
+		}
+		return counts
+	}
+	tests := []struct {
+		name   string
+		read   func(userID int) ([]models.Message, error)
+		userID int
+		want   map[int]int
+	}{
+		{"history of the blocker", func(userID int) ([]models.Message, error) {
+			return RoomHistory(db, roomID, userID, 0, 50)
+		}, alice, map[int]int{carol: 2}},
+		{"history of someone else", func(userID int) ([]models.Message, error) {
+			return RoomHistory(db, roomID, userID, 0, 50)
+		}, carol, map[int]int{bob: 2, carol: 2}},
+		{"search by the blocker", func(userID int) ([]models.Message, error) {
+			return SearchMessages(db, userID, "hello", 0, 50)
+		}, alice, map[int]int{carol: 2, bob: 1}},
+		{"search by someone else", func(userID int) ([]models.Message, error) {
+			return SearchMessages(db, userID, "hello", roomID, 50)
+		}, carol, map[int]int{bob: 2, carol: 2}},
+	}
+	for _, test := range tests {
+		messages, err := test.read(test.userID)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		got := senders(messages)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got messages from %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for senderID, n := range test.want {
+			if got[senderID] != n {
+				t.Errorf("%s: got messages from %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package chat
+
+import (
+	"chat-app/pkg/models"
+	"database/sql"
+	"errors"
+)
+
+// Permissions a room role can grant
+const (
+	PermPost        = "post"
+	PermInvite      = "invite"
+	PermKick        = "kick"
+	PermEditOthers  = "edit_others"
+	PermChangeTopic = "change_topic"
+	// PermModerate covers bans, mutes and the moderation log
+	PermModerate = "moderate"
+	// PermManageRoom covers a room's name and visibility, its invite codes
+	// and requests to join it
+	PermManageRoom = "manage_room"
+)
+
+// Permissions is the permission matrix: what the members of a room may do,
+// by role
+var Permissions = map[string][]string{
+	models.RoleOwner:     {PermPost, PermInvite, PermKick, PermModerate, PermEditOthers, PermChangeTopic, PermManageRoom},
+	models.RoleAdmin:     {PermPost, PermInvite, PermKick, PermModerate, PermEditOthers, PermChangeTopic, PermManageRoom},
+	models.RoleModerator: {PermPost, PermInvite, PermKick, PermModerate, PermEditOthers},
+	models.RoleMember:    {PermPost, PermInvite},
+	models.RoleReadOnly:  {},
+}
+
+// roleRanks orders the roles. Members can only act on members ranked below
+// them.
+var roleRanks = map[string]int{
+	models.RoleOwner:     4,
+	models.RoleAdmin:     3,
+	models.RoleModerator: 2,
+	models.RoleMember:    1,
+	models.RoleReadOnly:  0,
+}
+
+var (
+	// ErrNotMember is returned when acting on a user who is not in the room
+	ErrNotMember = errors.New("not a member of this room")
+	// ErrAlreadyMember is returned when adding a user who is in the room
+	ErrAlreadyMember = errors.New("already a member of this room")
+	// ErrUserNotFound is returned when adding, blocking or messaging a user
+	// who does not exist
+	ErrUserNotFound = errors.New("user not found")
+	// ErrLastOwner is returned when a change would leave a room without an
+	// owner
+	ErrLastOwner = errors.New("a room needs at least one owner")
+)
+
+// ValidRole reports whether role is one of the room roles
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// Can reports whether role has permission
+func Can(role, permission string) bool {
+	for _, p := range Permissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Outranks reports whether a member with role actor may act on a member with
+// role target, for instance to kick them
+func Outranks(actor, target string) bool {
+	return roleRanks[actor] > roleRanks[target]
+}
+
+// CanAssign reports whether a member with role actor may change a member's
+// role from target to role. Owners may change any role; admins may only move
+// members below them between roles below their own.
+func CanAssign(actor, target, role string) bool {
+	if actor == models.RoleOwner {
+		return true
+	}
+	return actor == models.RoleAdmin && Outranks(actor, target) && Outranks(actor, role)
+}
+
+// MemberRole returns a user's role in a room, or "" if they are not in it
+func MemberRole(db *sql.DB, roomID, userID int) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT role FROM room_users WHERE room_id = ? AND user_id = ?", roomID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// SetMemberRole changes the role of a member of a room
+func SetMemberRole(db *sql.DB, roomID, userID int, role string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRow("SELECT role FROM room_users WHERE room_id = ? AND user_id = ?", roomID, userID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return ErrNotMember
+	}
+	if err != nil {
+		return err
+	}
+
+	if current == models.RoleOwner && role != models.RoleOwner {
+		var owners int
+		err := tx.QueryRow("SELECT COUNT(*) FROM room_users WHERE room_id = ? AND role = ?", roomID, models.RoleOwner).Scan(&owners)
+		if err != nil {
+			return err
+		}
+		if owners == 1 {
+			return ErrLastOwner
+		}
+	}
+
+	_, err = tx.Exec("UPDATE room_users SET role = ? WHERE room_id = ? AND user_id = ?", role, roomID, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// TransferOwnership makes toID an owner of a room on behalf of fromID. If
+// fromID is an owner of the room they become an admin, so that ownership
+// passes from one to the other; server admins acting on a room they are not
+// in only hand it over. demoted reports whether fromID was made an admin.
+func TransferOwnership(db *sql.DB, roomID, fromID, toID int) (demoted bool, err error) {
+	if fromID == toID {
+		return false, ErrSelf
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE room_users SET role = ? WHERE room_id = ? AND user_id = ?", models.RoleOwner, roomID, toID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, ErrNotMember
+	}
+	res, err = tx.Exec("UPDATE room_users SET role = ? WHERE room_id = ? AND user_id = ? AND role = ?",
+		models.RoleAdmin, roomID, fromID, models.RoleOwner)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, tx.Commit()
+}
+
+// ensureOwner makes sure a room that still has members has an owner. If the
+// last one is gone, the longest-standing admin becomes owner, or failing
+// that the longest-standing moderator, member and read-only member in turn,
+// preferring people over bots. It returns the new owner's ID, or 0 if the
+// room already had an owner or has no members left.
+func ensureOwner(tx *sql.Tx, roomID int) (int, error) {
+	var successorID int
+	err := tx.QueryRow(`SELECT room_users.user_id FROM room_users JOIN users ON users.id = room_users.user_id
+		WHERE room_users.room_id = ?
+		AND NOT EXISTS (SELECT 1 FROM room_users AS owners WHERE owners.room_id = room_users.room_id AND owners.role = ?)
+		ORDER BY users.is_bot, CASE room_users.role WHEN ? THEN 0 WHEN ? THEN 1 WHEN ? THEN 2 ELSE 3 END,
+			room_users.joined_at, room_users.user_id
+		LIMIT 1`, roomID, models.RoleOwner, models.RoleAdmin, models.RoleModerator, models.RoleMember).Scan(&successorID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE room_users SET role = ? WHERE room_id = ? AND user_id = ?", models.RoleOwner, roomID, successorID)
+	if err != nil {
+		return 0, err
+	}
+	return successorID, nil
+}
+
+// Members lists the current members of a room with their roles
+func Members(db *sql.DB, roomID int) ([]models.RoomMember, error) {
+	rows, err := db.Query(`SELECT users.id, users.username, room_users.role, room_users.joined_at
+		FROM users JOIN room_users ON users.id = room_users.user_id
+		WHERE room_users.room_id = ? ORDER BY users.id`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []models.RoomMember{}
+	for rows.Next() {
+		var member models.RoomMember
+		var joinedAt sql.NullTime
+		if err := rows.Scan(&member.ID, &member.Username, &member.Role, &joinedAt); err != nil {
+			return nil, err
+		}
+		if joinedAt.Valid {
+			t := joinedAt.Time
+			member.JoinedAt = &t
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
@@ -0,0 +1,148 @@
+package chat
+
+import (
+	"chat-app/internal/database/databasetest"
+	"chat-app/pkg/models"
+	"testing"
+)
+
+func TestPermissions(t *testing.T) {
+	// the matrix documented in the readme
+	want := map[string]map[string]bool{
+		models.RoleOwner:     {PermPost: true, PermInvite: true, PermKick: true, PermModerate: true, PermEditOthers: true, PermChangeTopic: true, PermManageRoom: true},
+		models.RoleAdmin:     {PermPost: true, PermInvite: true, PermKick: true, PermModerate: true, PermEditOthers: true, PermChangeTopic: true, PermManageRoom: true},
+		models.RoleModerator: {PermPost: true, PermInvite: true, PermKick: true, PermModerate: true, PermEditOthers: true},
+		models.RoleMember:    {PermPost: true, PermInvite: true},
+		models.RoleReadOnly:  {},
+		"":                   {},
+		"superuser":          {},
+	}
+	permissions := []string{PermPost, PermInvite, PermKick, PermModerate, PermEditOthers, PermChangeTopic, PermManageRoom}
+
+	for role, allowed := range want {
+		for _, permission := range permissions {
+			if got := Can(role, permission); got != allowed[permission] {
+				t.Errorf("Can(%q, %q) = %v, want %v", role, permission, got, allowed[permission])
+			}
+		}
+	}
+	for role := range Permissions {
+		if _, ok := want[role]; !ok {
+			t.Errorf("role %q is not covered", role)
+		}
+	}
+}
+
+func TestOutranks(t *testing.T) {
+	order := []string{models.RoleReadOnly, models.RoleMember, models.RoleModerator, models.RoleAdmin, models.RoleOwner}
+	for i, actor := range order {
+		for j, target := range order {
+			if got := Outranks(actor, target); got != (i > j) {
+				t.Errorf("Outranks(%q, %q) = %v", actor, target, got)
+			}
+		}
+	}
+}
+
+func TestCanAssign(t *testing.T) {
+	tests := []struct {
+		actor, target, role string
+		want                bool
+	}{
+		{models.RoleOwner, models.RoleMember, models.RoleOwner, true},
+		{models.RoleOwner, models.RoleMember, models.RoleAdmin, true},
+		{models.RoleOwner, models.RoleAdmin, models.RoleReadOnly, true},
+		{models.RoleOwner, models.RoleOwner, models.RoleAdmin, true},
+		{models.RoleAdmin, models.RoleMember, models.RoleModerator, true},
+		{models.RoleAdmin, models.RoleModerator, models.RoleReadOnly, true},
+		{models.RoleAdmin, models.RoleReadOnly, models.RoleMember, true},
+		// admins cannot grant their own rank or above
+		{models.RoleAdmin, models.RoleMember, models.RoleAdmin, false},
+		{models.RoleAdmin, models.RoleMember, models.RoleOwner, false},
+		// nor touch members of their own rank or above
+		{models.RoleAdmin, models.RoleAdmin, models.RoleMember, false},
+		{models.RoleAdmin, models.RoleOwner, models.RoleMember, false},
+		{models.RoleModerator, models.RoleMember, models.RoleReadOnly, false},
+		{models.RoleModerator, models.RoleReadOnly, models.RoleMember, false},
+		{models.RoleMember, models.RoleReadOnly, models.RoleMember, false},
+		{models.RoleReadOnly, models.RoleReadOnly, models.RoleMember, false},
+	}
+	for _, test := range tests {
+		if got := CanAssign(test.actor, test.target, test.role); got != test.want {
+			t.Errorf("CanAssign(%q, %q, %q) = %v, want %v", test.actor, test.target, test.role, got, test.want)
+		}
+	}
+}
+
+func TestSetMemberRole(t *testing.T) {
+	db := databasetest.Open(t)
+	owner := databasetest.NewUser(t, db, "olivia")
+	member := databasetest.NewUser(t, db, "mia")
+	outsider := databasetest.NewUser(t, db, "oscar")
+	roomID := newRoom(t, db, owner, models.VisibilityPublic)
+	if err := JoinChatRoom(db, roomID, member); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		userID int
+		role   string
+		err    error
+	}{
+		{"last owner steps down", owner, models.RoleAdmin, ErrLastOwner},
+		{"last owner stays owner", owner, models.RoleOwner, nil},
+		{"outsider", outsider, models.RoleMember, ErrNotMember},
+		{"second owner", member, models.RoleOwner, nil},
+		{"first owner steps down", owner, models.RoleAdmin, nil},
+		{"now the last owner steps down", member, models.RoleMember, ErrLastOwner},
+	}
+	for _, test := range tests {
+		if err := SetMemberRole(db, roomID, test.userID, test.role); err != test.err {
+			t.Fatalf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	for userID, want := range map[int]string{owner: models.RoleAdmin, member: models.RoleOwner} {
+		if role, err := MemberRole(db, roomID, userID); err != nil || role != want {
+			t.Errorf("user %d: got %q %v, want %q", userID, role, err, want)
+		}
+	}
+}
+
+func TestTransferOwnership(t *testing.T) {
+	db := databasetest.Open(t)
+	owner := databasetest.NewUser(t, db, "olivia")
+	member := databasetest.NewUser(t, db, "mia")
+	outsider := databasetest.NewUser(t, db, "oscar")
+	roomID := newRoom(t, db, owner, models.VisibilityPublic)
+	if err := JoinChatRoom(db, roomID, member); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := TransferOwnership(db, roomID, owner, owner); err != ErrSelf {
+		t.Errorf("to themselves: got %v, want %v", err, ErrSelf)
+	}
+	if _, err := TransferOwnership(db, roomID, owner, outsider); err != ErrNotMember {
+		t.Errorf("to an outsider: got %v, want %v", err, ErrNotMember)
+	}
+
+	demoted, err := TransferOwnership(db, roomID, owner, member)
+	if err != nil || !demoted {
+		t.Fatalf("got %v %v, want the owner demoted", demoted, err)
+	}
+	for userID, want := range map[int]string{owner: models.RoleAdmin, member: models.RoleOwner} {
+		if role, err := MemberRole(db, roomID, userID); err != nil || role != want {
+			t.Errorf("user %d: got %q %v, want %q", userID, role, err, want)
+		}
+	}
+
+	// a server admin acting on a room they are not in only hands it over
+	demoted, err = TransferOwnership(db, roomID, outsider, owner)
+	if err != nil || demoted {
+		t.Fatalf("by an outsider: got %v %v, want nobody demoted", demoted, err)
+	}
+	if role, _ := MemberRole(db, roomID, member); role != models.RoleOwner {
+		t.Errorf("previous owner is now %q", role)
+	}
+}
@@ -0,0 +1,38 @@
+// Package databasetest sets up databases for tests
+package databasetest
+
+import (
+	"chat-app/internal/database"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// Open creates a migrated database in a temporary directory, which is
+// closed and removed when the test ends
+func Open(t testing.TB) *sql.DB {
+	t.Helper()
+	path := database.DSN(filepath.Join(t.TempDir(), "chat.db"))
+	database.InitDatabase(path)
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// NewUser inserts a user who cannot log in with a password and returns
+// their ID
+func NewUser(t testing.TB, db *sql.DB, username string) int {
+	t.Helper()
+	res, err := db.Exec("INSERT INTO users (username, password_hash) VALUES (?, '')", username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(id)
+}
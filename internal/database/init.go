@@ -1,9 +1,11 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -44,6 +46,451 @@ CREATE TABLE IF NOT EXISTS messages (
 
 `
 
+// migrations are applied in order on top of schema. PRAGMA user_version
+// records how many of them have already run against a database file.
+var migrations = []string{
+	// 1: server admins and the ID map used by room import
+	`ALTER TABLE users ADD COLUMN is_admin INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS import_map (
+		kind TEXT NOT NULL,
+		origin TEXT NOT NULL,
+		local_id INTEGER NOT NULL,
+		PRIMARY KEY (kind, origin)
+	);
+	CREATE TABLE IF NOT EXISTS server_meta (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`,
+	// 2: encryption at rest for message content
+	`CREATE TABLE IF NOT EXISTS data_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		scope TEXT UNIQUE NOT NULL,
+		wrapped_key BLOB NOT NULL,
+		master_key_id TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	ALTER TABLE messages ADD COLUMN key_id INTEGER REFERENCES data_keys(id);`,
+	// 3: membership history and join-time history visibility
+	`ALTER TABLE room_users ADD COLUMN joined_at DATETIME;
+	ALTER TABLE chat_rooms ADD COLUMN history_visibility TEXT NOT NULL DEFAULT 'shared';
+	CREATE TABLE IF NOT EXISTS membership_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		room_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		actor_id INTEGER,
+		event TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (room_id) REFERENCES chat_rooms(id),
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (actor_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS membership_events_room ON membership_events (room_id, id);`,
+	// 4: index of message segments moved out of the database by the archiver
+	`CREATE TABLE IF NOT EXISTS archive_segments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		room_id INTEGER,
+		dm_user_a INTEGER,
+		dm_user_b INTEGER,
+		path TEXT NOT NULL,
+		first_id INTEGER NOT NULL,
+		last_id INTEGER NOT NULL,
+		first_at DATETIME NOT NULL,
+		last_at DATETIME NOT NULL,
+		message_count INTEGER NOT NULL,
+		blocks TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS archive_segments_room ON archive_segments (room_id, last_id);
+	CREATE INDEX IF NOT EXISTS archive_segments_dm ON archive_segments (dm_user_a, dm_user_b, last_id);`,
+	// 5: explicit ON DELETE behavior, which SQLite can only add by rebuilding
+	// the tables. Rows pointing at rooms or users that no longer exist are
+	// dropped or detached first, since foreign keys are now enforced.
+	`CREATE TEMP TABLE saved_sequence AS SELECT name, seq FROM sqlite_sequence;
+
+	DELETE FROM room_users WHERE room_id NOT IN (SELECT id FROM chat_rooms) OR user_id NOT IN (SELECT id FROM users);
+	DELETE FROM membership_events WHERE room_id NOT IN (SELECT id FROM chat_rooms) OR user_id NOT IN (SELECT id FROM users);
+	DELETE FROM messages WHERE room_id IS NOT NULL AND room_id NOT IN (SELECT id FROM chat_rooms);
+	DELETE FROM messages WHERE recipient_id IS NOT NULL AND recipient_id NOT IN (SELECT id FROM users);
+	DELETE FROM archive_segments WHERE room_id IS NOT NULL AND room_id NOT IN (SELECT id FROM chat_rooms);
+
+	CREATE TABLE chat_rooms_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		creator_id INTEGER,
+		history_visibility TEXT NOT NULL DEFAULT 'shared',
+		FOREIGN KEY (creator_id) REFERENCES users(id) ON DELETE SET NULL
+	);
+	INSERT INTO chat_rooms_new (id, name, creator_id, history_visibility)
+		SELECT id, name, (SELECT users.id FROM users WHERE users.id = chat_rooms.creator_id), history_visibility
+		FROM chat_rooms;
+	DROP TABLE chat_rooms;
+	ALTER TABLE chat_rooms_new RENAME TO chat_rooms;
+
+	CREATE TABLE room_users_new (
+		room_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		joined_at DATETIME,
+		FOREIGN KEY (room_id) REFERENCES chat_rooms(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		PRIMARY KEY (room_id, user_id)
+	);
+	INSERT INTO room_users_new SELECT room_id, user_id, joined_at FROM room_users;
+	DROP TABLE room_users;
+	ALTER TABLE room_users_new RENAME TO room_users;
+
+	CREATE TABLE messages_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sender_id INTEGER,
+		recipient_id INTEGER,
+		room_id INTEGER,
+		content TEXT NOT NULL,
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+		key_id INTEGER,
+		FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE SET NULL,
+		FOREIGN KEY (recipient_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (room_id) REFERENCES chat_rooms(id) ON DELETE CASCADE,
+		FOREIGN KEY (key_id) REFERENCES data_keys(id)
+	);
+	INSERT INTO messages_new (id, sender_id, recipient_id, room_id, content, timestamp, key_id)
+		SELECT id, (SELECT users.id FROM users WHERE users.id = messages.sender_id), recipient_id, room_id, content, timestamp, key_id
+		FROM messages;
+	DROP TABLE messages;
+	ALTER TABLE messages_new RENAME TO messages;
+
+	CREATE TABLE membership_events_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		room_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		actor_id INTEGER,
+		event TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (room_id) REFERENCES chat_rooms(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE SET NULL
+	);
+	INSERT INTO membership_events_new (id, room_id, user_id, actor_id, event, created_at)
+		SELECT id, room_id, user_id, (SELECT users.id FROM users WHERE users.id = membership_events.actor_id), event, created_at
+		FROM membership_events;
+	DROP TABLE membership_events;
+	ALTER TABLE membership_events_new RENAME TO membership_events;
+	CREATE INDEX membership_events_room ON membership_events (room_id, id);
+
+	CREATE TABLE archive_segments_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		room_id INTEGER,
+		dm_user_a INTEGER,
+		dm_user_b INTEGER,
+		path TEXT NOT NULL,
+		first_id INTEGER NOT NULL,
+		last_id INTEGER NOT NULL,
+		first_at DATETIME NOT NULL,
+		last_at DATETIME NOT NULL,
+		message_count INTEGER NOT NULL,
+		blocks TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (room_id) REFERENCES chat_rooms(id) ON DELETE CASCADE,
+		FOREIGN KEY (dm_user_a) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (dm_user_b) REFERENCES users(id) ON DELETE CASCADE
+	);
+	INSERT INTO archive_segments_new SELECT * FROM archive_segments;
+	DROP TABLE archive_segments;
+	ALTER TABLE archive_segments_new RENAME TO archive_segments;
+	CREATE INDEX archive_segments_room ON archive_segments (room_id, last_id);
+	CREATE INDEX archive_segments_dm ON archive_segments (dm_user_a, dm_user_b, last_id);
+
+	-- the rebuilt tables would otherwise restart their IDs after the highest
+	-- row left, reusing the IDs of deleted or archived messages
+	DELETE FROM sqlite_sequence WHERE name IN (SELECT name FROM saved_sequence);
+	INSERT INTO sqlite_sequence (name, seq) SELECT name, seq FROM saved_sequence;
+	DROP TABLE saved_sequence;`,
+	// 6: login sessions and their rotating refresh tokens
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL,
+		revoked_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS sessions_user ON sessions (user_id);
+	CREATE TABLE IF NOT EXISTS refresh_tokens (
+		token_hash TEXT PRIMARY KEY,
+		session_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		used_at DATETIME,
+		FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS refresh_tokens_session ON refresh_tokens (session_id);`,
+	// 7: failed login tracking and the audit log
+	`CREATE TABLE IF NOT EXISTS login_failures (
+		scope TEXT PRIMARY KEY,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_failure_at DATETIME,
+		locked_until DATETIME
+	);
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event TEXT NOT NULL,
+		user_id INTEGER,
+		ip TEXT,
+		detail TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS audit_log_event ON audit_log (event, id);`,
+	// 8: bot accounts and their scoped API tokens
+	`ALTER TABLE users ADD COLUMN is_bot INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN owner_id INTEGER REFERENCES users(id) ON DELETE CASCADE;
+	CREATE INDEX IF NOT EXISTS users_owner ON users (owner_id);
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		token_hash TEXT UNIQUE NOT NULL,
+		scopes TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME,
+		expires_at DATETIME,
+		revoked_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS api_tokens_user ON api_tokens (user_id);`,
+	// 9: per-room roles, with room creators as owners, and message edits
+	`ALTER TABLE room_users ADD COLUMN role TEXT NOT NULL DEFAULT 'member';
+	UPDATE room_users SET role = 'owner'
+		WHERE user_id = (SELECT creator_id FROM chat_rooms WHERE chat_rooms.id = room_users.room_id);
+	ALTER TABLE messages ADD COLUMN edited_at DATETIME;`,
+	// 10: accounts at external OpenID Connect providers linked to local users
+	`CREATE TABLE IF NOT EXISTS user_identities (
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id INTEGER NOT NULL,
+		email TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (issuer, subject),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS user_identities_user ON user_identities (user_id);`,
+	// 11: TOTP two-factor authentication and its recovery codes
+	`CREATE TABLE IF NOT EXISTS totp (
+		user_id INTEGER PRIMARY KEY,
+		secret TEXT NOT NULL,
+		enabled_at DATETIME,
+		last_step INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		code_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		used_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS recovery_codes_user ON recovery_codes (user_id);`,
+	// 12: optional email addresses, unique once given
+	`ALTER TABLE users ADD COLUMN email TEXT;
+	ALTER TABLE users ADD COLUMN email_verified_at DATETIME;
+	CREATE UNIQUE INDEX IF NOT EXISTS users_email ON users (email);`,
+	// 13: where each session was started from
+	`ALTER TABLE sessions ADD COLUMN device_name TEXT;
+	ALTER TABLE sessions ADD COLUMN client_version TEXT;
+	ALTER TABLE sessions ADD COLUMN ip TEXT;`,
+	// 14: user profiles
+	`ALTER TABLE users ADD COLUMN display_name TEXT;
+	ALTER TABLE users ADD COLUMN bio TEXT;
+	ALTER TABLE users ADD COLUMN status TEXT;
+	ALTER TABLE users ADD COLUMN avatar TEXT;`,
+	// 15: block lists, contacts and who may send a user direct messages
+	`CREATE TABLE IF NOT EXISTS blocks (
+		blocker_id INTEGER NOT NULL,
+		blocked_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (blocker_id, blocked_id),
+		FOREIGN KEY (blocker_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (blocked_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS blocks_blocked ON blocks (blocked_id);
+	CREATE TABLE IF NOT EXISTS contacts (
+		user_id INTEGER NOT NULL,
+		contact_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, contact_id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (contact_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS contacts_contact ON contacts (contact_id);
+	ALTER TABLE users ADD COLUMN dm_policy TEXT NOT NULL DEFAULT 'everyone';`,
+	// 16: usernames of deleted accounts, held back from new accounts for a
+	// while
+	`CREATE TABLE IF NOT EXISTS retired_usernames (
+		username TEXT PRIMARY KEY,
+		available_at DATETIME NOT NULL
+	);`,
+	// 17: room visibility, invite codes and direct invitations
+	`ALTER TABLE chat_rooms ADD COLUMN visibility TEXT NOT NULL DEFAULT 'public';
+	CREATE TABLE IF NOT EXISTS invite_codes (
+		code TEXT PRIMARY KEY,
+		room_id INTEGER NOT NULL,
+		creator_id INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME,
+		max_uses INTEGER NOT NULL DEFAULT 0,
+		uses INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (room_id) REFERENCES chat_rooms(id) ON DELETE CASCADE,
+		FOREIGN KEY (creator_id) REFERENCES users(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS invite_codes_room ON invite_codes (room_id);
+	CREATE TABLE IF NOT EXISTS room_invitations (
+		room_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		inviter_id INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (room_id, user_id),
+		FOREIGN KEY (room_id) REFERENCES chat_rooms(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (inviter_id) REFERENCES users(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS room_invitations_user ON room_invitations (user_id);`,
+	// 18: requests to join restricted rooms
+	`CREATE TABLE IF NOT EXISTS join_requests (
+		room_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		message TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL,
+		PRIMARY KEY (room_id, user_id),
+		FOREIGN KEY (room_id) REFERENCES chat_rooms(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS join_requests_user ON join_requests (user_id);`,
+	// 19: bans, mutes and the moderation log
+	`CREATE TABLE IF NOT EXISTS room_sanctions (
+		room_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		actor_id INTEGER,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME,
+		PRIMARY KEY (room_id, user_id, kind),
+		FOREIGN KEY (room_id) REFERENCES chat_rooms(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE SET NULL
+	);
+	CREATE TABLE IF NOT EXISTS moderation_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		room_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		actor_id INTEGER,
+		action TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		expires_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (room_id) REFERENCES chat_rooms(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS moderation_log_room ON moderation_log (room_id, id);`,
+	// 20: room topics, descriptions and creation times. Rooms created before
+	// this are dated by their earliest recorded membership.
+	`ALTER TABLE chat_rooms ADD COLUMN topic TEXT NOT NULL DEFAULT '';
+	ALTER TABLE chat_rooms ADD COLUMN description TEXT NOT NULL DEFAULT '';
+	ALTER TABLE chat_rooms ADD COLUMN created_at DATETIME;
+	UPDATE chat_rooms SET created_at = COALESCE(
+		(SELECT MIN(created_at) FROM membership_events WHERE membership_events.room_id = chat_rooms.id),
+		(SELECT MIN(joined_at) FROM room_users WHERE room_users.room_id = chat_rooms.id));
+	CREATE INDEX IF NOT EXISTS messages_room ON messages (room_id, id);`,
+	// 21: room archival
+	`ALTER TABLE chat_rooms ADD COLUMN archived_at DATETIME;`,
+}
+
+// SchemaVersion is the user_version of a fully migrated database
+var SchemaVersion = len(migrations)
+
+// Migrate brings the schema of db up to SchemaVersion. Foreign keys are
+// switched off while it runs so that migrations can rebuild tables, and
+// checked before the last one commits.
+func Migrate(db *sql.DB) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var version int
+	if err := conn.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version >= len(migrations) {
+		return nil
+	}
+
+	var foreignKeys bool
+	if err := conn.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&foreignKeys); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return err
+	}
+	if foreignKeys {
+		defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		// older databases may hold dangling rows until the migration that
+		// cleans them up, so only the end result has to be consistent
+		if i == len(migrations)-1 {
+			if err := checkForeignKeys(tx); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d: %w", i+1, err)
+			}
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkForeignKeys fails if any row references a row that does not exist
+func checkForeignKeys(tx *sql.Tx) error {
+	var table, parent string
+	var rowID sql.NullInt64
+	var fkID int
+	err := tx.QueryRow("PRAGMA foreign_key_check").Scan(&table, &rowID, &parent, &fkID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("row %d of %s references a missing row of %s", rowID.Int64, table, parent)
+}
+
+// DSN returns the data source name for a database file, with the options
+// every connection needs: SQLite only enforces foreign keys on connections
+// that ask for it.
+func DSN(path string) string {
+	if strings.Contains(path, "?") {
+		return path + "&_foreign_keys=1"
+	}
+	return path + "?_foreign_keys=1"
+}
+
 func InitDatabase(dataSourceName string) {
 	db, err := sql.Open("sqlite3", dataSourceName)
 	if err != nil {
@@ -57,6 +504,12 @@ func InitDatabase(dataSourceName string) {
 		fmt.Println("Error initializing database:", err)
 		os.Exit(1)
 	}
+
+	err = Migrate(db)
+	if err != nil {
+		fmt.Println("Error migrating database:", err)
+		os.Exit(1)
+	}
 }
 
 func ClearDatabase(dataSourceName string) {
@@ -0,0 +1,354 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Default is the keyring used for message content. It is nil when no master
+// key is configured, in which case content is stored as plain text.
+var Default *Keyring
+
+// Execer is satisfied by both *sql.DB and *sql.Tx
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Keyring encrypts message content with per-room and per-DM data keys, which
+// are stored in the data_keys table wrapped by the master key.
+type Keyring struct {
+	master cipher.AEAD
+	id     string
+
+	mu        sync.Mutex
+	unwrapped map[string]cipher.AEAD
+}
+
+// NewKeyring creates a keyring from a 32-byte AES-256 master key
+func NewKeyring(master []byte) (*Keyring, error) {
+	if len(master) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(master))
+	}
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(master)
+	return &Keyring{
+		master:    aead,
+		id:        hex.EncodeToString(sum[:8]),
+		unwrapped: map[string]cipher.AEAD{},
+	}, nil
+}
+
+// LoadKeyring reads the base64-encoded master key from the file named by
+// MESSAGE_KEY_FILE, or from MESSAGE_KEY. It returns nil if neither is set.
+func LoadKeyring() (*Keyring, error) {
+	return loadKeyring("MESSAGE_KEY")
+}
+
+// LoadPreviousKeyring reads the master key that was replaced by rotating to
+// the current one from MESSAGE_KEY_PREVIOUS_FILE or MESSAGE_KEY_PREVIOUS. It
+// returns nil if neither is set.
+func LoadPreviousKeyring() (*Keyring, error) {
+	return loadKeyring("MESSAGE_KEY_PREVIOUS")
+}
+
+// loadKeyring reads a master key from the file named by variable_FILE, or
+// from variable itself
+func loadKeyring(variable string) (*Keyring, error) {
+	encoded := os.Getenv(variable)
+	if path := os.Getenv(variable + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	return ParseKey(encoded)
+}
+
+// ParseKey creates a keyring from a base64-encoded master key
+func ParseKey(encoded string) (*Keyring, error) {
+	master, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid base64: %w", err)
+	}
+	return NewKeyring(master)
+}
+
+// GenerateKey returns a new random master key, base64-encoded
+func GenerateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ID identifies the master key without revealing it
+func (k *Keyring) ID() string {
+	return k.id
+}
+
+// RoomScope names the data key of a chat room
+func RoomScope(roomID int) string {
+	return fmt.Sprintf("room:%d", roomID)
+}
+
+// DMScope names the data key of the direct messages between two users
+func DMScope(userA, userB int) string {
+	if userA > userB {
+		userA, userB = userB, userA
+	}
+	return fmt.Sprintf("dm:%d:%d", userA, userB)
+}
+
+// DeleteRoomKey removes the data key of a room. Anything still encrypted
+// under it, such as archived copies of the room's messages, can no longer be
+// read.
+func DeleteRoomKey(db Execer, roomID int) error {
+	_, err := db.Exec("DELETE FROM data_keys WHERE scope = ?", RoomScope(roomID))
+	return err
+}
+
+// DeleteUserDMKeys removes the data keys of every direct conversation a user
+// took part in
+func DeleteUserDMKeys(db Execer, userID int) error {
+	_, err := db.Exec("DELETE FROM data_keys WHERE scope LIKE ? OR scope LIKE ?",
+		fmt.Sprintf("dm:%d:%%", userID), fmt.Sprintf("dm:%%:%d", userID))
+	return err
+}
+
+// Encrypt seals plaintext with the data key of scope, creating the data key
+// if the conversation has none yet. It returns the ciphertext and the ID of
+// the data key, which must be stored alongside it. A nil keyring returns the
+// plaintext unchanged with an invalid key ID.
+func (k *Keyring) Encrypt(db Execer, scope, plaintext string) (string, sql.NullInt64, error) {
+	if k == nil {
+		return plaintext, sql.NullInt64{}, nil
+	}
+
+	keyID, wrapped, err := k.dataKey(db, scope)
+	if err != nil {
+		return "", sql.NullInt64{}, err
+	}
+	aead, err := k.unwrap(wrapped)
+	if err != nil {
+		return "", sql.NullInt64{}, err
+	}
+
+	sealed, err := seal(aead, []byte(plaintext))
+	if err != nil {
+		return "", sql.NullInt64{}, err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), sql.NullInt64{Int64: keyID, Valid: true}, nil
+}
+
+// Decrypt opens content that was encrypted with the wrapped data key. Content
+// stored without a data key is returned as is.
+func (k *Keyring) Decrypt(wrapped []byte, content string) (string, error) {
+	if wrapped == nil {
+		return content, nil
+	}
+	if k == nil {
+		return "", errors.New("message is encrypted but no master key is configured")
+	}
+
+	aead, err := k.unwrap(wrapped)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(aead, sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Check makes sure every data key in db can be unwrapped by this keyring.
+// Data keys still wrapped by previous, the master key this one replaced, are
+// re-wrapped first: a server that kept running through a rotation creates
+// them under its old key. It returns how many were re-wrapped.
+func (k *Keyring) Check(db *sql.DB, previous *Keyring) (int, error) {
+	var count int
+	if k == nil {
+		if previous != nil {
+			return 0, errors.New("a previous master key is set without a current one")
+		}
+		err := db.QueryRow("SELECT COUNT(*) FROM data_keys").Scan(&count)
+		if err == nil && count > 0 {
+			err = errors.New("messages are encrypted but no master key is configured (set MESSAGE_KEY_FILE or MESSAGE_KEY)")
+		}
+		return 0, err
+	}
+
+	rewrapped := 0
+	if previous != nil && previous.id != k.id {
+		var err error
+		if rewrapped, err = previous.rewrap(db, k, previous.id); err != nil {
+			return 0, err
+		}
+	}
+
+	err := db.QueryRow("SELECT COUNT(*) FROM data_keys WHERE master_key_id != ?", k.id).Scan(&count)
+	if err == nil && count > 0 {
+		err = fmt.Errorf("%d data keys are wrapped by a different master key than %s", count, k.id)
+	}
+	return rewrapped, err
+}
+
+// Rewrap re-encrypts every data key under next, so that next can replace k as
+// the master key. Keys already wrapped by next are left alone, which makes an
+// interrupted rotation safe to run again.
+func (k *Keyring) Rewrap(db *sql.DB, next *Keyring) (int, error) {
+	return k.rewrap(db, next, "")
+}
+
+// rewrap re-encrypts the data keys wrapped by master key from, or every one
+// not yet wrapped by next if from is empty, under next
+func (k *Keyring) rewrap(db *sql.DB, next *Keyring, from string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := "SELECT id, wrapped_key FROM data_keys WHERE master_key_id != ?"
+	args := []interface{}{next.id}
+	if from != "" {
+		query += " AND master_key_id = ?"
+		args = append(args, from)
+	}
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	rewrapped := map[int64][]byte{}
+	for rows.Next() {
+		var id int64
+		var wrapped []byte
+		if err := rows.Scan(&id, &wrapped); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		raw, err := open(k.master, wrapped)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("data key %d: %w", id, err)
+		}
+		rewrapped[id], err = seal(next.master, raw)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, wrapped := range rewrapped {
+		_, err := tx.Exec("UPDATE data_keys SET wrapped_key = ?, master_key_id = ? WHERE id = ?", wrapped, next.id, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(rewrapped), tx.Commit()
+}
+
+// dataKey returns the wrapped data key of scope, creating it on first use
+func (k *Keyring) dataKey(db Execer, scope string) (int64, []byte, error) {
+	var id int64
+	var wrapped []byte
+	err := db.QueryRow("SELECT id, wrapped_key FROM data_keys WHERE scope = ?", scope).Scan(&id, &wrapped)
+	if err == nil {
+		return id, wrapped, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, nil, err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return 0, nil, err
+	}
+	wrapped, err = seal(k.master, raw)
+	if err != nil {
+		return 0, nil, err
+	}
+	// another connection may create the key between the SELECT and the
+	// INSERT, in which case its key wins and is the one both use
+	_, err = db.Exec(`INSERT INTO data_keys (scope, wrapped_key, master_key_id) VALUES (?, ?, ?)
+		ON CONFLICT (scope) DO NOTHING`, scope, wrapped, k.id)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = db.QueryRow("SELECT id, wrapped_key FROM data_keys WHERE scope = ?", scope).Scan(&id, &wrapped)
+	return id, wrapped, err
+}
+
+// unwrap decrypts a wrapped data key. Results are cached by the wrapped bytes
+// rather than by key ID, so a key created in a rolled back transaction can
+// never be confused with a later one that reuses its ID.
+func (k *Keyring) unwrap(wrapped []byte) (cipher.AEAD, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if aead, ok := k.unwrapped[string(wrapped)]; ok {
+		return aead, nil
+	}
+	raw, err := open(k.master, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key: %w", err)
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+	k.unwrapped[string(wrapped)] = aead
+	return aead, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns nonce || ciphertext
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
@@ -0,0 +1,249 @@
+package encryption
+
+import (
+	"chat-app/internal/database/databasetest"
+	"database/sql"
+	"encoding/base64"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := ParseKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// wrappedKey returns the wrapped data key stored under id
+func wrappedKey(t *testing.T, db *sql.DB, id sql.NullInt64) []byte {
+	t.Helper()
+	var wrapped []byte
+	if err := db.QueryRow("SELECT wrapped_key FROM data_keys WHERE id = ?", id).Scan(&wrapped); err != nil {
+		t.Fatal(err)
+	}
+	return wrapped
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	db := databasetest.Open(t)
+	k := newTestKeyring(t)
+
+	tests := []struct {
+		name      string
+		scope     string
+		plaintext string
+	}{
+		{"room", RoomScope(1), "hello"},
+		{"empty", RoomScope(1), ""},
+		{"unicode", RoomScope(2), "héllo wörld 👋"},
+		{"dm", DMScope(3, 4), "just between us"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ciphertext, keyID, err := k.Encrypt(db, test.scope, test.plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !keyID.Valid {
+				t.Fatal("no data key ID")
+			}
+			if test.plaintext != "" && ciphertext == test.plaintext {
+				t.Fatal("content was not encrypted")
+			}
+			plaintext, err := k.Decrypt(wrappedKey(t, db, keyID), ciphertext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plaintext != test.plaintext {
+				t.Errorf("got %q, want %q", plaintext, test.plaintext)
+			}
+		})
+	}
+
+	// both participants of a conversation share its key
+	_, forward, err := k.Encrypt(db, DMScope(3, 4), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, backward, err := k.Encrypt(db, DMScope(4, 3), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forward != backward {
+		t.Errorf("DM data keys differ by direction: %v and %v", forward, backward)
+	}
+}
+
+func TestNilKeyring(t *testing.T) {
+	var k *Keyring
+	ciphertext, keyID, err := k.Encrypt(nil, RoomScope(1), "plain")
+	if err != nil || keyID.Valid || ciphertext != "plain" {
+		t.Errorf("Encrypt without a key: got %q %v %v", ciphertext, keyID, err)
+	}
+	plaintext, err := k.Decrypt(nil, "plain")
+	if err != nil || plaintext != "plain" {
+		t.Errorf("Decrypt without a key: got %q %v", plaintext, err)
+	}
+	if _, err := k.Decrypt([]byte("wrapped"), "sealed"); err == nil {
+		t.Error("decrypted encrypted content without a key")
+	}
+}
+
+func TestTamperDetection(t *testing.T) {
+	db := databasetest.Open(t)
+	k := newTestKeyring(t)
+
+	ciphertext, keyID, err := k.Encrypt(db, RoomScope(1), "attack at dawn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := wrappedKey(t, db, keyID)
+	_, otherID, err := k.Encrypt(db, RoomScope(2), "other room")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipped := append([]byte(nil), sealed...)
+	flipped[len(flipped)-1] ^= 1
+	flippedKey := append([]byte(nil), wrapped...)
+	flippedKey[len(flippedKey)-1] ^= 1
+
+	tests := []struct {
+		name       string
+		keyring    *Keyring
+		wrapped    []byte
+		ciphertext string
+	}{
+		{"modified ciphertext", k, wrapped, base64.StdEncoding.EncodeToString(flipped)},
+		{"truncated ciphertext", k, wrapped, base64.StdEncoding.EncodeToString(sealed[:4])},
+		{"another room's key", k, wrappedKey(t, db, otherID), ciphertext},
+		{"modified data key", k, flippedKey, ciphertext},
+		{"another master key", newTestKeyring(t), wrapped, ciphertext},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if plaintext, err := test.keyring.Decrypt(test.wrapped, test.ciphertext); err == nil {
+				t.Errorf("decrypted to %q", plaintext)
+			}
+		})
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	db := databasetest.Open(t)
+	old, next := newTestKeyring(t), newTestKeyring(t)
+
+	ciphertext, keyID, err := old.Encrypt(db, RoomScope(1), "before rotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := old.Encrypt(db, DMScope(1, 2), "dm"); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := old.Rewrap(db, next)
+	if err != nil || n != 2 {
+		t.Fatalf("Rewrap: got %d %v, want 2", n, err)
+	}
+	plaintext, err := next.Decrypt(wrappedKey(t, db, keyID), ciphertext)
+	if err != nil || plaintext != "before rotation" {
+		t.Errorf("decrypting with the new key: got %q %v", plaintext, err)
+	}
+	if _, err := old.Check(db, nil); err == nil {
+		t.Error("the old master key still checks out")
+	}
+	if _, err := next.Check(db, nil); err != nil {
+		t.Errorf("Check with the new master key: %v", err)
+	}
+
+	// running it again after an interruption does nothing
+	if n, err := old.Rewrap(db, next); err != nil || n != 0 {
+		t.Errorf("second Rewrap: got %d %v, want 0", n, err)
+	}
+}
+
+func TestCheckRewrapsPrevious(t *testing.T) {
+	db := databasetest.Open(t)
+	old, next := newTestKeyring(t), newTestKeyring(t)
+
+	if _, _, err := old.Encrypt(db, RoomScope(1), "before rotation"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Rewrap(db, next); err != nil {
+		t.Fatal(err)
+	}
+	// a server still running with the old key creates a data key after
+	// the rotation
+	ciphertext, keyID, err := old.Encrypt(db, RoomScope(2), "during rotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := next.Check(db, nil); err == nil {
+		t.Fatal("Check missed a data key under the old master key")
+	}
+	n, err := next.Check(db, old)
+	if err != nil || n != 1 {
+		t.Fatalf("Check with the previous key: got %d %v, want 1", n, err)
+	}
+	plaintext, err := next.Decrypt(wrappedKey(t, db, keyID), ciphertext)
+	if err != nil || plaintext != "during rotation" {
+		t.Errorf("got %q %v", plaintext, err)
+	}
+	if _, err := next.Check(db, nil); err != nil {
+		t.Errorf("Check after re-wrapping: %v", err)
+	}
+
+	// keys under some other master key are not the previous key's to fix
+	if _, _, err := newTestKeyring(t).Encrypt(db, RoomScope(3), "stranger"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := next.Check(db, old); err == nil {
+		t.Error("Check accepted a data key under an unknown master key")
+	}
+}
+
+// racingExecer creates the data key of scope from another keyring just
+// before dataKey inserts its own, as a concurrent writer would
+type racingExecer struct {
+	*sql.DB
+	rival *Keyring
+	scope string
+}
+
+func (r *racingExecer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if _, _, err := r.rival.dataKey(r.DB, r.scope); err != nil {
+		return nil, err
+	}
+	return r.DB.Exec(query, args...)
+}
+
+func TestDataKeyRace(t *testing.T) {
+	db := databasetest.Open(t)
+	k := newTestKeyring(t)
+	scope := RoomScope(1)
+
+	id, wrapped, err := k.dataKey(&racingExecer{DB: db, rival: k, scope: scope}, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	var storedID int64
+	var stored []byte
+	if err := db.QueryRow("SELECT COUNT(*), MAX(id), wrapped_key FROM data_keys WHERE scope = ?", scope).Scan(&count, &storedID, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || id != storedID || string(wrapped) != string(stored) {
+		t.Errorf("got data key %d, stored are %d keys, the last %d", id, count, storedID)
+	}
+}
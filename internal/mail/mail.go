@@ -0,0 +1,118 @@
+// Package mail sends the emails the server needs, such as address
+// verification and password reset messages.
+package mail
+
+import (
+	"chat-app/pkg/utils"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Load picks the mailer from the environment: SMTP if MAIL_SMTP_ADDR is set,
+// otherwise files in MAIL_DIR, otherwise the log
+func Load() (Mailer, error) {
+	if addr := os.Getenv("MAIL_SMTP_ADDR"); addr != "" {
+		from := os.Getenv("MAIL_FROM")
+		if from == "" {
+			return nil, errors.New("MAIL_FROM is required with MAIL_SMTP_ADDR")
+		}
+		return &SMTPMailer{
+			Addr:     addr,
+			From:     from,
+			Username: os.Getenv("MAIL_SMTP_USERNAME"),
+			Password: os.Getenv("MAIL_SMTP_PASSWORD"),
+		}, nil
+	}
+	if dir := os.Getenv("MAIL_DIR"); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		return &FileMailer{Dir: dir}, nil
+	}
+	return LogMailer{}, nil
+}
+
+// SMTPMailer sends messages through an SMTP server, authenticating with
+// PLAIN if Username is set. net/smtp only sends credentials over TLS or to
+// localhost, and upgrades with STARTTLS when the server offers it.
+type SMTPMailer struct {
+	// Addr is the server's host:port
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, format(m.From, msg))
+}
+
+// FileMailer writes each message to its own file in Dir instead of sending
+// it, for local development and tests
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), safeName(msg.To))
+	return os.WriteFile(filepath.Join(m.Dir, name), format("chat-app", msg), 0600)
+}
+
+// LogMailer writes messages to the log instead of sending them. Messages
+// carry tokens, so it is only meant for local development.
+type LogMailer struct{}
+
+func (LogMailer) Send(msg Message) error {
+	utils.Log.WithField("to", msg.To).WithField("subject", msg.Subject).Info("Mail not sent, no mailer configured:\n" + msg.Body)
+	return nil
+}
+
+// format renders msg as an RFC 5322 message
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// safeName keeps the letters, digits and punctuation of an address that are
+// safe in a file name
+func safeName(address string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '@' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, address)
+}
@@ -0,0 +1,182 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Device authorizations let a client without a browser, like the CLI, log
+// in (RFC 8628). The client gets a short user code and a URL, the user opens
+// the URL anywhere and logs in with the provider, and meanwhile the client
+// polls with the device code until the login is done.
+const (
+	// DeviceCodeTTL is how long the user has to complete the login
+	DeviceCodeTTL = 10 * time.Minute
+	// DevicePollInterval is how often the client may poll
+	DevicePollInterval = 5 * time.Second
+)
+
+// Errors PollDevice returns, named after the RFC 8628 error codes
+var (
+	ErrAuthorizationPending = errors.New("authorization_pending")
+	ErrSlowDown             = errors.New("slow_down")
+	ErrExpiredToken         = errors.New("expired_token")
+)
+
+// userCodeAlphabet has no vowels, so user codes never spell words, and no
+// letters that look like digits
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// DeviceAuthorization is what a client is told when it starts a device login
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// PendingDevice is a device login waiting for the user, with what the user
+// is shown of the device before they approve it
+type PendingDevice struct {
+	DeviceCode string
+	UserCode   string
+	// Name and IP are the device's, as given when it started the login
+	Name    string
+	IP      string
+	Started time.Time
+}
+
+type device struct {
+	userCode string
+	name     string
+	ip       string
+	started  time.Time
+	expires  time.Time
+	lastPoll time.Time
+	// userID and username are set once the user has logged in
+	userID   int
+	username string
+}
+
+var (
+	devices     = map[string]*device{}
+	deviceMutex sync.Mutex
+)
+
+// StartDevice starts a device login for the device name at ip.
+// verificationURI is the page where the user enters the user code.
+func StartDevice(verificationURI, name, ip string) (*DeviceAuthorization, error) {
+	deviceCode, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8)
+	for i := range buf {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return nil, err
+		}
+		buf[i] = userCodeAlphabet[n.Int64()]
+	}
+	userCode := string(buf[:4]) + "-" + string(buf[4:])
+
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+
+	now := time.Now()
+	for key, d := range devices {
+		if now.After(d.expires) {
+			delete(devices, key)
+		}
+	}
+	devices[deviceCode] = &device{
+		userCode: normalizeUserCode(userCode),
+		name:     name,
+		ip:       ip,
+		started:  now,
+		expires:  now.Add(DeviceCodeTTL),
+	}
+
+	return &DeviceAuthorization{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?user_code=" + url.QueryEscape(userCode),
+		ExpiresIn:               int(DeviceCodeTTL.Seconds()),
+		Interval:                int(DevicePollInterval.Seconds()),
+	}, nil
+}
+
+// DeviceForUserCode returns the pending login a user code belongs to. Case,
+// spaces and dashes in the user code are ignored.
+func DeviceForUserCode(userCode string) (*PendingDevice, bool) {
+	userCode = normalizeUserCode(userCode)
+
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+	for deviceCode, d := range devices {
+		if d.userCode == userCode && d.userID == 0 && time.Now().Before(d.expires) {
+			return &PendingDevice{
+				DeviceCode: deviceCode,
+				UserCode:   d.userCode[:4] + "-" + d.userCode[4:],
+				Name:       d.name,
+				IP:         d.ip,
+				Started:    d.started,
+			}, true
+		}
+	}
+	return nil, false
+}
+
+// ApproveDevice completes a device login as userID, once the user has
+// logged in with the provider
+func ApproveDevice(deviceCode string, userID int, username string) error {
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+
+	d, ok := devices[deviceCode]
+	if !ok || time.Now().After(d.expires) {
+		return ErrExpiredToken
+	}
+	d.userID = userID
+	d.username = username
+	return nil
+}
+
+// PollDevice returns the user a device login was completed as, using it up.
+// Until then it returns ErrAuthorizationPending, or ErrSlowDown if the
+// client polls more often than DevicePollInterval.
+func PollDevice(deviceCode string) (int, string, error) {
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+
+	d, ok := devices[deviceCode]
+	now := time.Now()
+	if !ok || now.After(d.expires) {
+		return 0, "", ErrExpiredToken
+	}
+	if d.userID != 0 {
+		delete(devices, deviceCode)
+		return d.userID, d.username, nil
+	}
+	// a second of slack, so that clients sleeping for exactly the interval
+	// are not told off for timer jitter
+	tooSoon := now.Sub(d.lastPoll) < DevicePollInterval-time.Second
+	d.lastPoll = now
+	if tooSoon {
+		return 0, "", ErrSlowDown
+	}
+	return 0, "", ErrAuthorizationPending
+}
+
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
@@ -0,0 +1,92 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+// LoginTTL is how long a user has to complete a login at the provider
+const LoginTTL = 10 * time.Minute
+
+// ErrUnknownLogin is returned when the provider sends back a state we did
+// not issue, or one that has expired or already been used
+var ErrUnknownLogin = errors.New("unknown or expired login")
+
+// Login is a login sent to the provider and waiting for the user to come
+// back
+type Login struct {
+	// LinkUserID is the user the identity is being linked to, or 0 if the
+	// identity is being used to log in
+	LinkUserID int
+	// DeviceCode is the device authorization the login approves, if any
+	DeviceCode string
+
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+// logins are kept in memory only: they last minutes and are finished by the
+// process that started them
+var (
+	logins     = map[string]*Login{}
+	loginMutex sync.Mutex
+)
+
+// StartLogin remembers login and returns the provider URL to send the user
+// to, along with the state the provider will send them back with. The
+// caller binds the state to the user's browser, so that nobody else can
+// finish the login; its nonce and PKCE verifier never leave the server.
+func (p *Provider) StartLogin(login Login) (authURL, state string, err error) {
+	if state, err = randomString(); err != nil {
+		return "", "", err
+	}
+	if login.nonce, err = randomString(); err != nil {
+		return "", "", err
+	}
+	if login.verifier, err = randomString(); err != nil {
+		return "", "", err
+	}
+
+	loginMutex.Lock()
+	defer loginMutex.Unlock()
+
+	now := time.Now()
+	for key, l := range logins {
+		if now.After(l.expires) {
+			delete(logins, key)
+		}
+	}
+	login.expires = now.Add(LoginTTL)
+	logins[state] = &login
+	return p.AuthCodeURL(state, login.nonce, login.verifier), state, nil
+}
+
+// FinishLogin uses up the login a state belongs to and redeems the code the
+// provider sent the user back with, returning the verified ID token
+func (p *Provider) FinishLogin(state, code string) (*Login, *IDToken, error) {
+	loginMutex.Lock()
+	login, ok := logins[state]
+	delete(logins, state)
+	loginMutex.Unlock()
+
+	if !ok || time.Now().After(login.expires) {
+		return nil, nil, ErrUnknownLogin
+	}
+	token, err := p.Exchange(code, login.verifier, login.nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return login, token, nil
+}
+
+func randomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
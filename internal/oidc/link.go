@@ -0,0 +1,66 @@
+package oidc
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Linking an account is asked for with an access token, which the browser
+// that logs in with the provider usually does not have. So the user gets a
+// URL with a link ticket instead, and the browser that opens it first starts
+// the login there.
+
+// LinkTTL is how long the URL for linking an account can be opened
+const LinkTTL = 2 * time.Minute
+
+// ErrUnknownLink is returned for link tickets that were never issued, have
+// expired or have already been used
+var ErrUnknownLink = errors.New("unknown or expired link")
+
+// PendingLink is a user waiting to link an account to theirs
+type PendingLink struct {
+	UserID   int
+	Username string
+	expires  time.Time
+}
+
+// links are kept in memory only: they last minutes and are redeemed by the
+// process that issued them
+var (
+	links     = map[string]*PendingLink{}
+	linkMutex sync.Mutex
+)
+
+// StartLink returns a single-use ticket for linking an account to userID
+func StartLink(userID int, username string) (string, error) {
+	ticket, err := randomString()
+	if err != nil {
+		return "", err
+	}
+
+	linkMutex.Lock()
+	defer linkMutex.Unlock()
+
+	now := time.Now()
+	for key, l := range links {
+		if now.After(l.expires) {
+			delete(links, key)
+		}
+	}
+	links[ticket] = &PendingLink{UserID: userID, Username: username, expires: now.Add(LinkTTL)}
+	return ticket, nil
+}
+
+// RedeemLink uses up a link ticket and returns the user it was issued for
+func RedeemLink(ticket string) (*PendingLink, error) {
+	linkMutex.Lock()
+	l, ok := links[ticket]
+	delete(links, ticket)
+	linkMutex.Unlock()
+
+	if !ok || time.Now().After(l.expires) {
+		return nil, ErrUnknownLink
+	}
+	return l, nil
+}
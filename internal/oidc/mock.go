@@ -0,0 +1,241 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// mockKeyID names the mock provider's only signing key
+const mockKeyID = "mock"
+
+// MockProvider is a minimal identity provider for development and tests, so
+// that the whole login flow runs offline. It implements just enough of
+// OpenID Connect for Provider: discovery, keys, and the authorization code
+// flow with PKCE. Anyone can log in as any username, without a password.
+type MockProvider struct {
+	Issuer string
+
+	key   *rsa.PrivateKey
+	mutex sync.Mutex
+	codes map[string]mockCode
+}
+
+type mockCode struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	username    string
+	expires     time.Time
+}
+
+// NewMockProvider creates a mock provider that serves issuer, which must be
+// the URL it is mounted at
+func NewMockProvider(issuer string) (*MockProvider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &MockProvider{Issuer: strings.TrimSuffix(issuer, "/"), key: key, codes: map[string]mockCode{}}, nil
+}
+
+// Provider returns a Provider for logging in with the mock. The endpoints
+// are filled in directly rather than discovered, so that this works before
+// the server the mock is mounted on is listening.
+func (m *MockProvider) Provider(clientID, redirectURL string) *Provider {
+	return &Provider{
+		Issuer:                m.Issuer,
+		ClientID:              clientID,
+		RedirectURL:           redirectURL,
+		AuthorizationEndpoint: m.Issuer + "/authorize",
+		TokenEndpoint:         m.Issuer + "/token",
+		JWKSURI:               m.Issuer + "/jwks",
+	}
+}
+
+func (m *MockProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	issuer, err := url.Parse(m.Issuer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, issuer.Path) {
+	case "/.well-known/openid-configuration":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                m.Issuer,
+			"authorization_endpoint":                m.Issuer + "/authorize",
+			"token_endpoint":                        m.Issuer + "/token",
+			"jwks_uri":                              m.Issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	case "/jwks":
+		public := m.key.PublicKey
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": mockKeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}}})
+	case "/authorize":
+		m.authorize(w, r)
+	case "/token":
+		m.token(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var mockLoginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<title>Mock identity provider</title>
+<form method="post">
+{{range $name, $values := .}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<label>Username <input name="username" autofocus></label>
+<button>Log in</button>
+</form>
+`))
+
+// authorize shows a login form on GET and, when it is posted, sends the user
+// back to the client with a code
+func (m *MockProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		mockLoginPage.Execute(w, r.Form)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	redirectURI, err := url.Parse(r.Form.Get("redirect_uri"))
+	switch {
+	case err != nil || !redirectURI.IsAbs():
+		http.Error(w, "redirect_uri must be an absolute URL", http.StatusBadRequest)
+		return
+	case r.Form.Get("response_type") != "code":
+		http.Error(w, "response_type must be code", http.StatusBadRequest)
+		return
+	case r.Form.Get("client_id") == "":
+		http.Error(w, "client_id is required", http.StatusBadRequest)
+		return
+	case r.Form.Get("code_challenge") == "" || r.Form.Get("code_challenge_method") != "S256":
+		http.Error(w, "an S256 code_challenge is required", http.StatusBadRequest)
+		return
+	case strings.TrimSpace(r.Form.Get("username")) == "":
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+
+	code, err := randomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m.mutex.Lock()
+	m.codes[code] = mockCode{
+		clientID:    r.Form.Get("client_id"),
+		redirectURI: r.Form.Get("redirect_uri"),
+		challenge:   r.Form.Get("code_challenge"),
+		nonce:       r.Form.Get("nonce"),
+		username:    strings.TrimSpace(r.Form.Get("username")),
+		expires:     time.Now().Add(time.Minute),
+	}
+	m.mutex.Unlock()
+
+	query := redirectURI.Query()
+	query.Set("code", code)
+	query.Set("state", r.Form.Get("state"))
+	redirectURI.RawQuery = query.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token redeems a code for an ID token, once the PKCE verifier checks out
+func (m *MockProvider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		mockTokenError(w, "invalid_request")
+		return
+	}
+	if r.Form.Get("grant_type") != "authorization_code" {
+		mockTokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	m.mutex.Lock()
+	code, ok := m.codes[r.Form.Get("code")]
+	delete(m.codes, r.Form.Get("code"))
+	m.mutex.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || time.Now().After(code.expires) ||
+		code.clientID != r.Form.Get("client_id") ||
+		code.redirectURI != r.Form.Get("redirect_uri") ||
+		code.challenge != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+		mockTokenError(w, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                m.Issuer,
+		"sub":                code.username,
+		"aud":                code.clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"nonce":              code.nonce,
+		"preferred_username": code.username,
+		"email":              code.username + "@example.com",
+		"email_verified":     true,
+	})
+	token.Header["kid"] = mockKeyID
+	idToken, err := token.SignedString(m.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	accessToken, err := randomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func mockTokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
@@ -0,0 +1,289 @@
+package oidc
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// newMock serves a mock provider for a test and returns it with a Provider
+// that logs in with it
+func newMock(t *testing.T) (*MockProvider, *Provider) {
+	t.Helper()
+	var mock *MockProvider
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mock.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	mock, err := NewMockProvider(srv.URL + "/idp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mock, mock.Provider("chat-app", "http://chat.example/oidc/callback")
+}
+
+// logInAt posts the mock's login form for authURL as username, returning the
+// state and code it sends the user back with
+func logInAt(t *testing.T, authURL, username string) (state, code string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := u.Query()
+	form.Set("username", username)
+	u.RawQuery = ""
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.PostForm(u.String(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: %s", resp.Status)
+	}
+	back, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return back.Query().Get("state"), back.Query().Get("code")
+}
+
+func TestLogin(t *testing.T) {
+	_, p := newMock(t)
+
+	authURL, state, err := p.StartLogin(Login{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	returnedState, code := logInAt(t, authURL, "alice")
+	if returnedState != state {
+		t.Fatalf("provider sent back state %q, want %q", returnedState, state)
+	}
+
+	login, token, err := p.FinishLogin(state, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login.LinkUserID != 0 || login.DeviceCode != "" {
+		t.Errorf("plain login came back as %+v", login)
+	}
+	if token.Subject != "alice" || token.PreferredUsername != "alice" || !token.EmailVerified {
+		t.Errorf("unexpected ID token %+v", token)
+	}
+
+	if _, _, err := p.FinishLogin(state, code); err != ErrUnknownLogin {
+		t.Errorf("finishing a login twice: got %v, want %v", err, ErrUnknownLogin)
+	}
+	if _, _, err := p.FinishLogin("made-up", code); err != ErrUnknownLogin {
+		t.Errorf("unknown state: got %v, want %v", err, ErrUnknownLogin)
+	}
+}
+
+func TestLinkLogin(t *testing.T) {
+	_, p := newMock(t)
+
+	authURL, state, err := p.StartLogin(Login{LinkUserID: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, code := logInAt(t, authURL, "bob")
+	login, token, err := p.FinishLogin(state, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login.LinkUserID != 42 {
+		t.Errorf("LinkUserID = %d, want 42", login.LinkUserID)
+	}
+	if token.Subject != "bob" {
+		t.Errorf("Subject = %q, want bob", token.Subject)
+	}
+}
+
+func TestPKCE(t *testing.T) {
+	_, p := newMock(t)
+
+	authURL, state, err := p.StartLogin(Login{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, code := logInAt(t, authURL, "carol")
+
+	// someone who intercepts the code cannot redeem it without the
+	// verifier, which never leaves the server
+	loginMutex.Lock()
+	nonce := logins[state].nonce
+	loginMutex.Unlock()
+	if _, err := p.Exchange(code, "not-the-verifier", nonce); err == nil {
+		t.Fatal("exchanged a code with the wrong PKCE verifier")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	mock, p := newMock(t)
+	now := time.Now()
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":   mock.Issuer,
+			"sub":   "dave",
+			"aud":   "chat-app",
+			"iat":   now.Unix(),
+			"exp":   now.Add(5 * time.Minute).Unix(),
+			"nonce": "n-0",
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(claims jwt.MapClaims, header map[string]interface{})
+		ok     bool
+	}{
+		{"valid", func(jwt.MapClaims, map[string]interface{}) {}, true},
+		{"audience list", func(c jwt.MapClaims, _ map[string]interface{}) { c["aud"] = []string{"other", "chat-app"} }, true},
+		{"wrong nonce", func(c jwt.MapClaims, _ map[string]interface{}) { c["nonce"] = "n-1" }, false},
+		{"missing nonce", func(c jwt.MapClaims, _ map[string]interface{}) { delete(c, "nonce") }, false},
+		{"wrong audience", func(c jwt.MapClaims, _ map[string]interface{}) { c["aud"] = "other" }, false},
+		{"wrong issuer", func(c jwt.MapClaims, _ map[string]interface{}) { c["iss"] = "https://evil.example" }, false},
+		{"expired", func(c jwt.MapClaims, _ map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() }, false},
+		{"no subject", func(c jwt.MapClaims, _ map[string]interface{}) { delete(c, "sub") }, false},
+		{"unknown key", func(_ jwt.MapClaims, h map[string]interface{}) { h["kid"] = "other" }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := valid()
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+			token.Header["kid"] = mockKeyID
+			test.modify(claims, token.Header)
+			raw, err := token.SignedString(mock.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = p.Verify(raw, "n-0")
+			if test.ok && err != nil {
+				t.Errorf("rejected: %v", err)
+			}
+			if !test.ok && !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("got %v, want %v", err, ErrInvalidIDToken)
+			}
+		})
+	}
+
+	t.Run("HS256", func(t *testing.T) {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, valid())
+		token.Header["kid"] = mockKeyID
+		raw, err := token.SignedString([]byte("shared"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Verify(raw, "n-0"); !errors.Is(err, ErrInvalidIDToken) {
+			t.Errorf("got %v, want %v", err, ErrInvalidIDToken)
+		}
+	})
+}
+
+func TestDeviceFlow(t *testing.T) {
+	_, p := newMock(t)
+
+	authorization, err := StartDevice("http://chat.example/oidc/device", "laptop", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := PollDevice(authorization.DeviceCode); err != ErrAuthorizationPending {
+		t.Fatalf("first poll: got %v, want %v", err, ErrAuthorizationPending)
+	}
+	if _, _, err := PollDevice(authorization.DeviceCode); err != ErrSlowDown {
+		t.Fatalf("polling too soon: got %v, want %v", err, ErrSlowDown)
+	}
+
+	// the user enters the code in whatever case and spacing
+	pending, ok := DeviceForUserCode(" " + authorization.UserCode[:4] + " " + authorization.UserCode[5:])
+	if !ok {
+		t.Fatal("user code not found")
+	}
+	if pending.DeviceCode != authorization.DeviceCode || pending.UserCode != authorization.UserCode ||
+		pending.Name != "laptop" || pending.IP != "192.0.2.1" {
+		t.Errorf("unexpected pending device %+v", pending)
+	}
+
+	authURL, state, err := p.StartLogin(Login{DeviceCode: pending.DeviceCode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, code := logInAt(t, authURL, "erin")
+	login, _, err := p.FinishLogin(state, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApproveDevice(login.DeviceCode, 7, "erin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := DeviceForUserCode(authorization.UserCode); ok {
+		t.Error("an approved user code can still be entered")
+	}
+
+	userID, username, err := PollDevice(authorization.DeviceCode)
+	if err != nil || userID != 7 || username != "erin" {
+		t.Fatalf("approved poll: got %d %q %v", userID, username, err)
+	}
+	if _, _, err := PollDevice(authorization.DeviceCode); err != ErrExpiredToken {
+		t.Errorf("polling a used up login: got %v, want %v", err, ErrExpiredToken)
+	}
+}
+
+func TestDeviceExpiry(t *testing.T) {
+	authorization, err := StartDevice("http://chat.example/oidc/device", "laptop", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceMutex.Lock()
+	devices[authorization.DeviceCode].expires = time.Now().Add(-time.Second)
+	deviceMutex.Unlock()
+
+	if _, ok := DeviceForUserCode(authorization.UserCode); ok {
+		t.Error("an expired user code can still be entered")
+	}
+	if err := ApproveDevice(authorization.DeviceCode, 7, "erin"); err != ErrExpiredToken {
+		t.Errorf("approving: got %v, want %v", err, ErrExpiredToken)
+	}
+	if _, _, err := PollDevice(authorization.DeviceCode); err != ErrExpiredToken {
+		t.Errorf("polling: got %v, want %v", err, ErrExpiredToken)
+	}
+}
+
+func TestLinkTicket(t *testing.T) {
+	ticket, err := StartLink(7, "erin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := RedeemLink(ticket)
+	if err != nil || link.UserID != 7 || link.Username != "erin" {
+		t.Fatalf("got %+v %v", link, err)
+	}
+	if _, err := RedeemLink(ticket); err != ErrUnknownLink {
+		t.Errorf("second use: got %v, want %v", err, ErrUnknownLink)
+	}
+
+	expired, err := StartLink(7, "erin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkMutex.Lock()
+	links[expired].expires = time.Now().Add(-time.Second)
+	linkMutex.Unlock()
+	if _, err := RedeemLink(expired); err != ErrUnknownLink {
+		t.Errorf("expired: got %v, want %v", err, ErrUnknownLink)
+	}
+	if _, err := RedeemLink(""); err != ErrUnknownLink {
+		t.Errorf("no ticket: got %v, want %v", err, ErrUnknownLink)
+	}
+}
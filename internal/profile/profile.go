@@ -0,0 +1,215 @@
+// Package profile manages what users show others about themselves: display
+// names, bios, status messages and avatars.
+package profile
+
+import (
+	"chat-app/pkg/models"
+	"chat-app/pkg/utils"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on the profile fields, in characters
+const (
+	MaxDisplayName = 64
+	MaxBio         = 500
+	MaxStatus      = 140
+)
+
+// MaxAvatarSize is the largest avatar image accepted, in bytes
+const MaxAvatarSize = 1 << 20
+
+// Dir is where avatar images are stored, overridden on startup by
+// AVATAR_DIR
+var Dir = "./avatars"
+
+var (
+	// ErrAvatarType is returned for avatars that are not one of the
+	// accepted image types
+	ErrAvatarType = errors.New("avatar must be a PNG, JPEG, GIF or WebP image")
+	// ErrAvatarTooLarge is returned for avatars over MaxAvatarSize
+	ErrAvatarTooLarge = fmt.Errorf("avatar must be at most %d bytes", MaxAvatarSize)
+)
+
+// avatarTypes are the image types accepted as avatars, by the extension
+// their files are stored with
+var avatarTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// Update changes the text fields of a profile and the user's DM policy.
+// Nil fields are left as they are, and empty text fields cleared.
+type Update struct {
+	DisplayName *string `json:"display_name"`
+	Bio         *string `json:"bio"`
+	Status      *string `json:"status"`
+	DMPolicy    *string `json:"dm_policy"`
+}
+
+// Validate trims the text fields of u and checks their length, and checks
+// the DM policy. Only the bio may span lines.
+func (u *Update) Validate() error {
+	if u.DMPolicy != nil {
+		switch *u.DMPolicy {
+		case models.DMEveryone, models.DMSharedRooms, models.DMContacts:
+		default:
+			return fmt.Errorf("dm_policy must be %q, %q or %q", models.DMEveryone, models.DMSharedRooms, models.DMContacts)
+		}
+	}
+
+	fields := []struct {
+		name      string
+		value     *string
+		max       int
+		multiline bool
+	}{
+		{"display_name", u.DisplayName, MaxDisplayName, false},
+		{"bio", u.Bio, MaxBio, true},
+		{"status", u.Status, MaxStatus, false},
+	}
+	for _, field := range fields {
+		if field.value == nil {
+			continue
+		}
+		*field.value = strings.TrimSpace(*field.value)
+		if utf8.RuneCountInString(*field.value) > field.max {
+			return fmt.Errorf("%s must be at most %d characters", field.name, field.max)
+		}
+		for _, r := range *field.value {
+			if unicode.IsControl(r) && !(field.multiline && r == '\n') {
+				return fmt.Errorf("%s must not contain control characters", field.name)
+			}
+		}
+	}
+	return nil
+}
+
+// Get returns the public profile of a user, or sql.ErrNoRows if there is no
+// such user
+func Get(db *sql.DB, userID int) (*models.User, error) {
+	return get(db, userID, false)
+}
+
+// Own returns a user's profile as they see it themselves, with their email
+// address and DM policy
+func Own(db *sql.DB, userID int) (*models.User, error) {
+	return get(db, userID, true)
+}
+
+func get(db *sql.DB, userID int, own bool) (*models.User, error) {
+	user := &models.User{}
+	var ownerID sql.NullInt64
+	var avatar, email, dmPolicy string
+	var emailVerified bool
+	err := db.QueryRow(`SELECT id, username, is_bot, owner_id, COALESCE(display_name, ''), COALESCE(bio, ''),
+		COALESCE(status, ''), COALESCE(avatar, ''), COALESCE(email, ''), email_verified_at IS NOT NULL, dm_policy
+		FROM users WHERE id = ?`, userID).
+		Scan(&user.ID, &user.Username, &user.IsBot, &ownerID, &user.DisplayName, &user.Bio,
+			&user.Status, &avatar, &email, &emailVerified, &dmPolicy)
+	if err != nil {
+		return nil, err
+	}
+	user.OwnerID = int(ownerID.Int64)
+	if avatar != "" {
+		user.AvatarURL = avatarURL(user.ID)
+	}
+	if own {
+		user.Email = email
+		user.EmailVerified = emailVerified
+		user.DMPolicy = dmPolicy
+	}
+	return user, nil
+}
+
+// Apply stores a validated update to a user's profile
+func Apply(db *sql.DB, userID int, u Update) error {
+	_, err := db.Exec(`UPDATE users SET display_name = COALESCE(?, display_name), bio = COALESCE(?, bio),
+		status = COALESCE(?, status), dm_policy = COALESCE(?, dm_policy) WHERE id = ?`,
+		u.DisplayName, u.Bio, u.Status, u.DMPolicy, userID)
+	return err
+}
+
+// SetAvatar stores image as a user's avatar, replacing the one they had
+func SetAvatar(db *sql.DB, userID int, image []byte) error {
+	if len(image) > MaxAvatarSize {
+		return ErrAvatarTooLarge
+	}
+	ext, ok := avatarTypes[http.DetectContentType(image)]
+	if !ok {
+		return ErrAvatarType
+	}
+
+	// a new name each time, so that clients holding the old file notice
+	// the change
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s%s", userID, hex.EncodeToString(buf), ext)
+	if err := os.MkdirAll(Dir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(Dir, name), image, 0644); err != nil {
+		return err
+	}
+
+	old, err := AvatarFile(db, userID)
+	if err == nil {
+		_, err = db.Exec("UPDATE users SET avatar = ? WHERE id = ?", name, userID)
+	}
+	if err != nil {
+		RemoveFile(name)
+		return err
+	}
+	RemoveFile(old)
+	return nil
+}
+
+// RemoveAvatar deletes a user's avatar, if they have one
+func RemoveAvatar(db *sql.DB, userID int) error {
+	old, err := AvatarFile(db, userID)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET avatar = NULL WHERE id = ?", userID); err != nil {
+		return err
+	}
+	RemoveFile(old)
+	return nil
+}
+
+// AvatarFile returns the name of a user's avatar file in Dir, which is
+// empty if they have none
+func AvatarFile(db *sql.DB, userID int) (string, error) {
+	var name string
+	err := db.QueryRow("SELECT COALESCE(avatar, '') FROM users WHERE id = ?", userID).Scan(&name)
+	return name, err
+}
+
+// RemoveFile deletes an avatar file from Dir. Failures are only logged,
+// since the database no longer refers to the file.
+func RemoveFile(name string) {
+	if name == "" {
+		return
+	}
+	path := filepath.Join(Dir, name)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		utils.Log.WithError(err).WithField("file", path).Warn("Error removing avatar")
+	}
+}
+
+func avatarURL(userID int) string {
+	return fmt.Sprintf("/users/%d/avatar", userID)
+}
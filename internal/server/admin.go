@@ -0,0 +1,141 @@
+package server
+
+import (
+	"chat-app/internal/audit"
+	"chat-app/internal/backup"
+	"chat-app/internal/chat"
+	"chat-app/internal/transfer"
+	"chat-app/pkg/utils"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// AdminMiddleware only lets server admins through. It must be wrapped by
+// auth.JWTMiddleware, which puts the caller's user ID into the context.
+func (s *Server) AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := r.Context().Value("userId").(int)
+
+		if !s.isAdmin(userID) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdmin reports whether a user is a server admin
+func (s *Server) isAdmin(userID int) bool {
+	var isAdmin bool
+	err := s.DB.QueryRow("SELECT is_admin FROM users WHERE id = ?", userID).Scan(&isAdmin)
+	return err == nil && isAdmin
+}
+
+// requireMember writes a 403 and returns false unless userID is a member of
+// the room, or a server admin if allowAdmin is set
+func (s *Server) requireMember(w http.ResponseWriter, roomID, userID int, allowAdmin bool) bool {
+	member, err := chat.IsMember(s.DB, roomID, userID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error checking room membership")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if member || (allowAdmin && s.isAdmin(userID)) {
+		return true
+	}
+	http.Error(w, "Not a member of this room", http.StatusForbidden)
+	return false
+}
+
+func (s *Server) ExportRoomHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(r.URL.Query().Get("room_id"))
+	if err != nil {
+		http.Error(w, "Invalid room_id", http.StatusBadRequest)
+		return
+	}
+
+	var exists int
+	err = s.DB.QueryRow("SELECT COUNT(*) FROM chat_rooms WHERE id = ?", roomID).Scan(&exists)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching chat room")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if exists == 0 {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=room-%d.ndjson", roomID))
+	err = transfer.ExportRoom(s.DB, roomID, w)
+	if err != nil {
+		// the status line is already sent, so all we can do is log
+		utils.Log.WithError(err).WithField("roomID", roomID).Error("Error exporting chat room")
+	}
+}
+
+func (s *Server) ImportRoomHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := transfer.ImportRoom(s.DB, r.Body)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error importing chat room")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	utils.Log.WithField("roomID", result.RoomID).Info("Imported chat room")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// BackupHandler snapshots the database into the backup directory while the
+// server keeps serving. Pass ?gzip=true to compress the snapshot.
+func (s *Server) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	compress := r.URL.Query().Get("gzip") == "true"
+	path := filepath.Join(s.BackupDir, backup.FileName(time.Now(), compress))
+
+	manifest, err := backup.Create(r.Context(), s.DB, path, compress)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error backing up database")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Log.WithField("file", path).Info("Database backed up")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(manifest)
+}
+
+// AuditLogHandler serves GET /admin/audit-log?event=&before=&limit=, newest
+// entries first
+func (s *Server) AuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	before, limit, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	entries, err := audit.List(s.DB, r.URL.Query().Get("event"), before, limit)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching audit log")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entries)
+}
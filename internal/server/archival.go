@@ -0,0 +1,61 @@
+package server
+
+import (
+	"chat-app/internal/chat"
+	"chat-app/internal/websocket"
+	"chat-app/pkg/utils"
+	"encoding/json"
+	"net/http"
+)
+
+// writable writes a 403 and returns false if a room is archived, so that
+// nothing in it may change
+func (s *Server) writable(w http.ResponseWriter, roomID int) bool {
+	archived, err := chat.IsArchived(s.DB, roomID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error checking whether room is archived")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if archived {
+		http.Error(w, "Room is archived", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// ArchiveRoomHandler serves PUT /rooms/{id}/archive, which archives the room,
+// and DELETE /rooms/{id}/archive, which brings it back. It needs the
+// manage_room permission.
+func (s *Server) ArchiveRoomHandler(w http.ResponseWriter, r *http.Request, roomID int, archived bool) {
+	userID := r.Context().Value("userId").(int)
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	if !chat.Can(role, chat.PermManageRoom) {
+		http.Error(w, "Your role in this room does not allow archiving it", http.StatusForbidden)
+		return
+	}
+
+	err := chat.SetArchived(s.DB, roomID, archived)
+	if err == chat.ErrRoomNotFound {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error archiving chat room")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.ArchivedChanged(roomID, userID, archived)
+
+	utils.Log.WithField("roomID", roomID).WithField("actorID", userID).WithField("archived", archived).Info("Changed room archival")
+	w.WriteHeader(http.StatusOK)
+	if archived {
+		json.NewEncoder(w).Encode("Room archived successfully")
+	} else {
+		json.NewEncoder(w).Encode("Room unarchived successfully")
+	}
+}
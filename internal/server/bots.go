@@ -0,0 +1,225 @@
+package server
+
+import (
+	"chat-app/internal/audit"
+	"chat-app/internal/auth"
+	"chat-app/internal/websocket"
+	"chat-app/pkg/utils"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BotRoutes serves /bots and /bots/{id}, where users manage the bot accounts
+// they own
+func (s *Server) BotRoutes(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r.URL.Path, "/bots")
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		s.CreateBotHandler(w, r)
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		s.ListBotsHandler(w, r)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		botID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "Invalid bot ID", http.StatusBadRequest)
+			return
+		}
+		s.DeleteBotHandler(w, r, botID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// CreateBotHandler serves POST /bots {"username": ...}
+func (s *Server) CreateBotHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Username) == "" {
+		http.Error(w, "Username is required", http.StatusBadRequest)
+		return
+	}
+
+	bot, err := auth.CreateBot(s.DB, userID, req.Username)
+	if err == auth.ErrUsernameTaken {
+		http.Error(w, "Username is already taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error creating bot")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Log.WithField("userID", userID).WithField("botID", bot.ID).Info("Created bot")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(bot)
+}
+
+// ListBotsHandler serves GET /bots, the caller's bot accounts
+func (s *Server) ListBotsHandler(w http.ResponseWriter, r *http.Request) {
+	bots, err := auth.ListBots(s.DB, r.Context().Value("userId").(int))
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching bots")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(bots)
+}
+
+// DeleteBotHandler serves DELETE /bots/{id}, deleting a bot account the
+// caller owns
+func (s *Server) DeleteBotHandler(w http.ResponseWriter, r *http.Request, botID int) {
+	userID := r.Context().Value("userId").(int)
+
+	owned, err := auth.ManagesAccount(s.DB, userID, botID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching bot")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !owned || botID == userID {
+		http.Error(w, "Bot not found", http.StatusNotFound)
+		return
+	}
+	if !s.deleteUser(w, botID) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Bot deleted successfully")
+}
+
+// TokenRoutes serves /tokens and /tokens/{id}, where users manage the API
+// tokens of their own account and of their bots
+func (s *Server) TokenRoutes(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r.URL.Path, "/tokens")
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		s.CreateAPITokenHandler(w, r)
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		s.ListAPITokensHandler(w, r)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		tokenID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "Invalid token ID", http.StatusBadRequest)
+			return
+		}
+		s.RevokeAPITokenHandler(w, r, tokenID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// CreateAPITokenHandler serves POST /tokens {"user_id", "name", "scopes",
+// "expires_in"}. user_id defaults to the caller and may be one of its bots;
+// expires_in is in seconds and 0 means the token never expires.
+func (s *Server) CreateAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+
+	var req struct {
+		UserID    int      `json:"user_id"`
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		ExpiresIn int      `json:"expires_in"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 {
+		req.UserID = userID
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresIn < 0 {
+		http.Error(w, "expires_in must not be negative", http.StatusBadRequest)
+		return
+	}
+	scopes, err := auth.ParseScopes(req.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	allowed, err := auth.ManagesAccount(s.DB, userID, req.UserID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching bot")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "You can only create tokens for yourself and your bots", http.StatusForbidden)
+		return
+	}
+
+	token, err := auth.CreateAPIToken(s.DB, req.UserID, req.Name, scopes, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error creating API token")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	detail := fmt.Sprintf("token %d %q for user %d with scopes %s", token.ID, token.Name, token.UserID, strings.Join(token.Scopes, " "))
+	if err := audit.Record(s.DB, audit.APITokenCreated, userID, clientIP(r), detail); err != nil {
+		utils.Log.WithError(err).Error("Error writing audit log")
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+// ListAPITokensHandler serves GET /tokens, the tokens of the caller and its
+// bots without their secrets
+func (s *Server) ListAPITokensHandler(w http.ResponseWriter, r *http.Request) {
+	tokens, err := auth.ListAPITokens(s.DB, r.Context().Value("userId").(int))
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching API tokens")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// RevokeAPITokenHandler serves DELETE /tokens/{id}
+func (s *Server) RevokeAPITokenHandler(w http.ResponseWriter, r *http.Request, tokenID int) {
+	userID := r.Context().Value("userId").(int)
+
+	err := auth.RevokeAPIToken(s.DB, userID, tokenID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error revoking API token")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := audit.Record(s.DB, audit.APITokenRevoked, userID, clientIP(r), fmt.Sprintf("token %d", tokenID)); err != nil {
+		utils.Log.WithError(err).Error("Error writing audit log")
+	}
+	websocket.CloseAPIToken(tokenID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Token revoked successfully")
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"chat-app/internal/auth"
+	"chat-app/internal/chat"
+	"chat-app/internal/profile"
+	"chat-app/internal/websocket"
+	"chat-app/pkg/models"
+	"chat-app/pkg/utils"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+)
+
+// DeleteRoomHandler serves DELETE /rooms/{id} to the room's owners and
+// server admins
+func (s *Server) DeleteRoomHandler(w http.ResponseWriter, r *http.Request, roomID int) {
+	userID := r.Context().Value("userId").(int)
+
+	var exists int
+	err := s.DB.QueryRow("SELECT COUNT(*) FROM chat_rooms WHERE id = ?", roomID).Scan(&exists)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching chat room")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if exists == 0 {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	role, err := chat.MemberRole(s.DB, roomID, userID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching room role")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if role != models.RoleOwner && !s.isAdmin(userID) {
+		http.Error(w, "Only the room's owners or a server admin can delete it", http.StatusForbidden)
+		return
+	}
+
+	members, err := chat.DeleteChatRoom(s.DB, roomID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error deleting chat room")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.RoomDeleted(roomID, members)
+
+	utils.Log.WithField("roomID", roomID).WithField("userID", userID).Info("Deleted chat room")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Chat room deleted successfully")
+}
+
+// DeleteAccountHandler serves DELETE /users/me, deleting the caller's own
+// account along with the bots it owns
+func (s *Server) DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+
+	bots, err := auth.ListBots(s.DB, userID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching bots")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, bot := range bots {
+		if !s.deleteUser(w, bot.ID) {
+			return
+		}
+	}
+	if !s.deleteUser(w, userID) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Account deleted successfully")
+}
+
+// deleteUser deletes an account and tells its rooms. It writes an error
+// response and returns false if that fails.
+func (s *Server) deleteUser(w http.ResponseWriter, userID int) bool {
+	avatar, err := profile.AvatarFile(s.DB, userID)
+	if err != nil && err != sql.ErrNoRows {
+		utils.Log.WithError(err).Error("Error fetching avatar")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	rooms, successors, err := chat.DeleteUser(s.DB, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error deleting user")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	profile.RemoveFile(avatar)
+	websocket.Disconnect(userID)
+	for _, roomID := range rooms {
+		websocket.MemberRemoved(roomID, userID)
+	}
+	for roomID, successorID := range successors {
+		websocket.RoleChanged(roomID, successorID, models.RoleOwner)
+		utils.Log.WithField("roomID", roomID).WithField("userID", successorID).Info("Passed ownership of room to successor")
+	}
+
+	utils.Log.WithField("userID", userID).Info("Deleted user")
+	return true
+}
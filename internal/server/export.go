@@ -0,0 +1,27 @@
+package server
+
+import (
+	"bytes"
+	"chat-app/internal/chat"
+	"chat-app/pkg/utils"
+	"fmt"
+	"net/http"
+)
+
+// ExportAccountHandler serves GET /users/me/export, a zip archive of the
+// caller's personal data
+func (s *Server) ExportAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+
+	// built in memory first, so that a failure can still be reported
+	var buf bytes.Buffer
+	if err := chat.ExportUser(s.DB, userID, &buf); err != nil {
+		utils.Log.WithError(err).WithField("userID", userID).Error("Error exporting account")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=account-%d.zip", userID))
+	w.Write(buf.Bytes())
+}
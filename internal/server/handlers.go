@@ -2,15 +2,31 @@ package server
 
 import (
 	"chat-app/internal/auth"
+	"chat-app/internal/chat"
+	"chat-app/internal/mail"
+	"chat-app/internal/oidc"
+	"chat-app/internal/websocket"
 	"chat-app/pkg/models"
 	"chat-app/pkg/utils"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Server struct {
 	DB *sql.DB
+	// BackupDir is where snapshots taken through /admin/backup are written
+	BackupDir string
+	// OIDC is the identity provider users can also log in with, or nil
+	OIDC *oidc.Provider
+	// Mailer sends verification and password reset emails, which link to
+	// PublicURL, the address users reach the server at
+	Mailer    mail.Mailer
+	PublicURL string
 }
 
 type RegisterRequest struct {
@@ -21,6 +37,9 @@ type RegisterRequest struct {
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// DeviceName and ClientVersion describe the client in the session list
+	DeviceName    string `json:"device_name,omitempty"`
+	ClientVersion string `json:"client_version,omitempty"`
 }
 
 func (s *Server) RegisterHandler(w http.ResponseWriter, r *http.Request) {
@@ -32,6 +51,15 @@ func (s *Server) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if strings.TrimSpace(req.Username) == "" {
+		http.Error(w, "Username is required", http.StatusBadRequest)
+		return
+	}
+	if problems := auth.Policy.Check(req.Username, req.Password); len(problems) > 0 {
+		http.Error(w, "Password "+strings.Join(problems, ", "), http.StatusBadRequest)
+		return
+	}
+
 	hashedPassword, err := auth.HashPassword(req.Password)
 	if err != nil {
 		utils.Log.WithError(err).Error("Error hashing password")
@@ -40,6 +68,10 @@ func (s *Server) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	err = auth.RegisterUser(s.DB, req.Username, hashedPassword)
+	if err == auth.ErrUsernameTaken {
+		http.Error(w, "Username is already taken", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		utils.Log.WithError(err).Error("Error registering user")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -59,10 +91,24 @@ func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := auth.LoginUser(s.DB, req.Username, req.Password)
+	token, challenge, err := auth.LoginUser(s.DB, req.Username, req.Password, requestDevice(r, req.DeviceName, req.ClientVersion))
+	var locked *auth.LockedError
+	if errors.As(err, &locked) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(locked.Until).Seconds())+1))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err == auth.ErrInvalidCredentials {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 	if err != nil {
 		utils.Log.WithError(err).Error("Error logging in user")
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if challenge != nil {
+		json.NewEncoder(w).Encode(challenge)
 		return
 	}
 
@@ -88,7 +134,34 @@ func (s *Server) CreateRoomHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = s.DB.Exec("INSERT INTO chat_rooms (name, creator_id) VALUES (?, ?)", room.Name, userID)
+	if room.HistoryVisibility == "" {
+		room.HistoryVisibility = models.HistoryShared
+	}
+	if room.HistoryVisibility != models.HistoryShared && room.HistoryVisibility != models.HistoryJoined {
+		http.Error(w, "history_visibility must be shared or joined", http.StatusBadRequest)
+		return
+	}
+	if room.Visibility == "" {
+		room.Visibility = models.VisibilityPublic
+	}
+	if !chat.ValidVisibility(room.Visibility) {
+		http.Error(w, "visibility must be public, restricted, private or secret", http.StatusBadRequest)
+		return
+	}
+
+	room.Name, err = chat.ValidRoomName(room.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	update := chat.RoomUpdate{Topic: &room.Topic, Description: &room.Description}
+	if err := update.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	room.CreatorID = userID
+	err = chat.CreateChatRoom(s.DB, &room)
 	if err != nil {
 		utils.Log.WithError(err).Error("Error creating chat room")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -99,9 +172,14 @@ func (s *Server) CreateRoomHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode("Chat room created successfully")
 }
 
+// JoinRoomHandler serves POST /join-room {"room_id": ...} or {"invite_code":
+// ...}. Only public rooms can be joined by ID without an invitation.
 func (s *Server) JoinRoomHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		RoomID int `json:"room_id"`
+		RoomID     int    `json:"room_id"`
+		InviteCode string `json:"invite_code"`
+		// Message goes with the request to join a restricted room
+		Message string `json:"message"`
 	}
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
@@ -109,6 +187,23 @@ func (s *Server) JoinRoomHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if req.InviteCode != "" {
+		req.RoomID, err = chat.InviteCodeRoom(s.DB, req.InviteCode)
+		if err == chat.ErrInviteInvalid {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			utils.Log.WithError(err).Error("Error fetching invite code")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if !auth.HasScope(r.Context(), auth.PostScope(req.RoomID)) {
+		http.Error(w, "API token does not allow this room", http.StatusForbidden)
+		return
+	}
 
 	username := r.Context().Value("username").(string)
 	row := s.DB.QueryRow("SELECT id FROM users WHERE username = ?", username)
@@ -120,15 +215,53 @@ func (s *Server) JoinRoomHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = s.DB.Exec("INSERT INTO room_users (room_id, user_id) VALUES (?, ?)", req.RoomID, userID)
+	if req.InviteCode != "" {
+		_, err = chat.JoinWithInviteCode(s.DB, req.InviteCode, userID)
+	} else {
+		err = chat.JoinChatRoom(s.DB, req.RoomID, userID)
+	}
+	if errors.Is(err, chat.ErrRoomNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, chat.ErrInviteInvalid) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, chat.ErrInviteRequired) {
+		http.Error(w, "This room is invite-only", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, chat.ErrBanned) {
+		http.Error(w, "You are banned from this room", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, chat.ErrRoomArchived) {
+		http.Error(w, "Room is archived", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, chat.ErrApprovalRequired) {
+		s.requestToJoin(w, req.RoomID, userID, req.Message)
+		return
+	}
+	if errors.Is(err, chat.ErrAlreadyMember) {
+		http.Error(w, "Already a member of this room", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		utils.Log.WithError(err).Error("Error joining chat room")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	room, err := chat.GetChatRoom(s.DB, req.RoomID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching chat room")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode("Joined chat room successfully")
+	json.NewEncoder(w).Encode(room)
 }
 
 func (s *Server) LeaveRoomHandler(w http.ResponseWriter, r *http.Request) {
@@ -142,6 +275,11 @@ func (s *Server) LeaveRoomHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !auth.HasScope(r.Context(), auth.PostScope(req.RoomID)) {
+		http.Error(w, "API token does not allow this room", http.StatusForbidden)
+		return
+	}
+
 	username := r.Context().Value("username").(string)
 	row := s.DB.QueryRow("SELECT id FROM users WHERE username = ?", username)
 	var userID int
@@ -152,17 +290,24 @@ func (s *Server) LeaveRoomHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = s.DB.Exec("DELETE FROM room_users WHERE room_id = ? AND user_id = ?", req.RoomID, userID)
+	successorID, err := chat.LeaveChatRoom(s.DB, req.RoomID, userID)
 	if err != nil {
 		utils.Log.WithError(err).Error("Error leaving chat room")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	websocket.MemberRemoved(req.RoomID, userID)
+	if successorID != 0 {
+		websocket.RoleChanged(req.RoomID, successorID, models.RoleOwner)
+		utils.Log.WithField("roomID", req.RoomID).WithField("userID", successorID).Info("Passed ownership of room to successor")
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode("Left chat room successfully")
 }
 
+// ListUsersInRoomHandler serves /list-users {"room_id": ...}, listing the
+// members of a room the caller is in
 func (s *Server) ListUsersInRoomHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		RoomID int `json:"room_id"`
@@ -174,6 +319,11 @@ func (s *Server) ListUsersInRoomHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	userID := r.Context().Value("userId").(int)
+	if !s.requireMember(w, req.RoomID, userID, true) {
+		return
+	}
+
 	rows, err := s.DB.Query("SELECT users.username FROM users JOIN room_users ON users.id = room_users.user_id WHERE room_users.room_id = ?", req.RoomID)
 	if err != nil {
 		utils.Log.WithError(err).Error("Error fetching users in room")
@@ -198,27 +348,132 @@ func (s *Server) ListUsersInRoomHandler(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(users)
 }
 
+// ListRoomsHandler serves GET /list-rooms: every public and private room,
+// and the secret rooms the caller is in. Server admins see every room.
 func (s *Server) ListRoomsHandler(w http.ResponseWriter, r *http.Request) {
-	rows, err := s.DB.Query("SELECT id, name FROM chat_rooms")
+	userID := r.Context().Value("userId").(int)
+
+	rooms, err := chat.ListChatRooms(s.DB, userID, s.isAdmin(userID))
 	if err != nil {
 		utils.Log.WithError(err).Error("Error fetching chat rooms")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	rooms := []models.ChatRoom{}
-	for rows.Next() {
-		var room models.ChatRoom
-		err := rows.Scan(&room.ID, &room.Name)
-		if err != nil {
-			utils.Log.WithError(err).Error("Error scanning room row")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		rooms = append(rooms, room)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rooms)
+}
+
+// RoomDirectoryHandler serves GET /rooms?q=&sort=activity|members|name&joined=&archived=&cursor=&limit=,
+// a page of the rooms the caller can see whose name or topic contains q,
+// most active first by default. joined=true only lists the caller's rooms,
+// and archived=true archived rooms instead of active ones.
+func (s *Server) RoomDirectoryHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+
+	query := chat.RoomQuery{
+		Query:  r.URL.Query().Get("q"),
+		Sort:   r.URL.Query().Get("sort"),
+		Cursor: r.URL.Query().Get("cursor"),
+	}
+	if query.Sort == "" {
+		query.Sort = chat.SortActivity
+	}
+	if !chat.ValidSort(query.Sort) {
+		http.Error(w, "sort must be activity, members or name", http.StatusBadRequest)
+		return
+	}
+	var ok bool
+	if query.Joined, ok = queryBool(r, "joined"); !ok {
+		http.Error(w, "Invalid joined", http.StatusBadRequest)
+		return
+	}
+	if query.Archived, ok = queryBool(r, "archived"); !ok {
+		http.Error(w, "Invalid archived", http.StatusBadRequest)
+		return
+	}
+	_, query.Limit, ok = pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	rooms, next, err := chat.SearchChatRooms(s.DB, userID, s.isAdmin(userID), query)
+	if err == chat.ErrInvalidCursor {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error searching chat rooms")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(rooms)
+	json.NewEncoder(w).Encode(models.RoomPage{Rooms: rooms, NextCursor: next})
+}
+
+// UpdateRoomHandler serves PATCH /rooms/{id} {"name": ..., "topic": ...,
+// "description": ...}, changing whichever fields are given and returning the
+// room. Renaming needs the manage_room permission, the topic and description
+// change_topic. The room's connected members are told what changed.
+func (s *Server) UpdateRoomHandler(w http.ResponseWriter, r *http.Request, roomID int) {
+	userID := r.Context().Value("userId").(int)
+
+	var update chat.RoomUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := update.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	if update.Name != nil && !chat.Can(role, chat.PermManageRoom) {
+		http.Error(w, "Your role in this room does not allow renaming it", http.StatusForbidden)
+		return
+	}
+	if (update.Topic != nil || update.Description != nil) && !chat.Can(role, chat.PermChangeTopic) {
+		http.Error(w, "Your role in this room does not allow changing its topic", http.StatusForbidden)
+		return
+	}
+	if !s.writable(w, roomID) {
+		return
+	}
+
+	before, err := chat.GetChatRoom(s.DB, roomID)
+	if err == chat.ErrRoomNotFound {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching chat room")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = chat.UpdateChatRoom(s.DB, roomID, update)
+	if err == chat.ErrRoomNotFound {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error updating chat room")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	room, err := chat.GetChatRoom(s.DB, roomID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching chat room")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.RoomUpdated(before, room, userID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(room)
 }
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"chat-app/internal/chat"
+	"chat-app/internal/database/databasetest"
+	"chat-app/pkg/models"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// asUser makes r look like it was authenticated as userID
+func asUser(r *http.Request, userID int) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), "userId", userID))
+}
+
+func TestListUsersInRoomRequiresMembership(t *testing.T) {
+	s := &Server{DB: newTestDB(t)}
+	owner := databasetest.NewUser(t, s.DB, "olivia")
+	outsider := databasetest.NewUser(t, s.DB, "oscar")
+
+	room := models.ChatRoom{Name: "secret plans", CreatorID: owner, Visibility: models.VisibilitySecret, HistoryVisibility: models.HistoryShared}
+	if err := chat.CreateChatRoom(s.DB, &room); err != nil {
+		t.Fatal(err)
+	}
+	body := `{"room_id": ` + strconv.Itoa(room.ID) + `}`
+
+	tests := []struct {
+		name   string
+		userID int
+		status int
+	}{
+		{"member", owner, http.StatusOK},
+		{"outsider", outsider, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/list-users", strings.NewReader(body))
+			s.ListUsersInRoomHandler(w, asUser(r, test.userID))
+			if w.Code != test.status {
+				t.Errorf("got %d, want %d", w.Code, test.status)
+			}
+			if w.Code != http.StatusOK && strings.Contains(w.Body.String(), "olivia") {
+				t.Errorf("members leaked: %s", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"chat-app/internal/chat"
+	"chat-app/internal/websocket"
+	"chat-app/pkg/utils"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// SetVisibilityHandler serves PUT /rooms/{id}/visibility {"visibility":
+// "public"|"restricted"|"private"|"secret"}. It needs the manage_room
+// permission.
+func (s *Server) SetVisibilityHandler(w http.ResponseWriter, r *http.Request, roomID int) {
+	userID := r.Context().Value("userId").(int)
+
+	var req struct {
+		Visibility string `json:"visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !chat.ValidVisibility(req.Visibility) {
+		http.Error(w, "visibility must be public, restricted, private or secret", http.StatusBadRequest)
+		return
+	}
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	if !chat.Can(role, chat.PermManageRoom) {
+		http.Error(w, "Your role in this room does not allow changing its visibility", http.StatusForbidden)
+		return
+	}
+
+	err := chat.SetVisibility(s.DB, roomID, req.Visibility)
+	if err == chat.ErrRoomNotFound {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error changing room visibility")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Room visibility changed successfully")
+}
+
+// CreateInviteCodeHandler serves POST /rooms/{id}/invite-codes {"expires_in":
+// ..., "max_uses": ...}. expires_in is in seconds and max_uses a count; 0,
+// the default for both, means no limit. It needs the invite permission.
+func (s *Server) CreateInviteCodeHandler(w http.ResponseWriter, r *http.Request, roomID int) {
+	userID := r.Context().Value("userId").(int)
+
+	var req struct {
+		ExpiresIn int `json:"expires_in"`
+		MaxUses   int `json:"max_uses"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresIn < 0 || req.MaxUses < 0 {
+		http.Error(w, "expires_in and max_uses must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	if !chat.Can(role, chat.PermInvite) {
+		http.Error(w, "Your role in this room does not allow inviting", http.StatusForbidden)
+		return
+	}
+
+	invite, err := chat.CreateInviteCode(s.DB, roomID, userID, time.Duration(req.ExpiresIn)*time.Second, req.MaxUses)
+	if err == chat.ErrRoomArchived {
+		http.Error(w, "Room is archived", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error creating invite code")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invite)
+}
+
+// ListInviteCodesHandler serves GET /rooms/{id}/invite-codes, the room's
+// invite codes that can still be used. It needs the manage_room permission.
+func (s *Server) ListInviteCodesHandler(w http.ResponseWriter, r *http.Request, roomID int) {
+	userID := r.Context().Value("userId").(int)
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	if !chat.Can(role, chat.PermManageRoom) {
+		http.Error(w, "Your role in this room does not allow managing invite codes", http.StatusForbidden)
+		return
+	}
+
+	invites, err := chat.ListInviteCodes(s.DB, roomID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching invite codes")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(invites)
+}
+
+// RevokeInviteCodeHandler serves DELETE /rooms/{id}/invite-codes/{code}. It
+// needs the manage_room permission.
+func (s *Server) RevokeInviteCodeHandler(w http.ResponseWriter, r *http.Request, roomID int, code string) {
+	userID := r.Context().Value("userId").(int)
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	if !chat.Can(role, chat.PermManageRoom) {
+		http.Error(w, "Your role in this room does not allow managing invite codes", http.StatusForbidden)
+		return
+	}
+
+	err := chat.RevokeInviteCode(s.DB, roomID, code)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invite code not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error revoking invite code")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Invite code revoked successfully")
+}
+
+// InviteHandler serves POST /rooms/{id}/invites {"user_id": ...}, inviting a
+// user to the room. The user is told over their WebSocket connections and
+// accepts by joining. It needs the invite permission.
+func (s *Server) InviteHandler(w http.ResponseWriter, r *http.Request, roomID int) {
+	userID := r.Context().Value("userId").(int)
+
+	var req struct {
+		UserID int `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	if !chat.Can(role, chat.PermInvite) {
+		http.Error(w, "Your role in this room does not allow inviting", http.StatusForbidden)
+		return
+	}
+	room, err := chat.GetChatRoom(s.DB, roomID)
+	if err == chat.ErrRoomNotFound {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching chat room")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = chat.Invite(s.DB, roomID, req.UserID, userID)
+	switch {
+	case errors.Is(err, chat.ErrUserNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	case errors.Is(err, chat.ErrAlreadyMember):
+		http.Error(w, "User is already a member of this room", http.StatusConflict)
+		return
+	case errors.Is(err, chat.ErrInviteRefused):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, chat.ErrBanned):
+		http.Error(w, "User is banned from this room", http.StatusForbidden)
+		return
+	case errors.Is(err, chat.ErrRoomArchived):
+		http.Error(w, "Room is archived", http.StatusForbidden)
+		return
+	case err != nil:
+		utils.Log.WithError(err).Error("Error inviting user")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.Invited(roomID, room.Name, req.UserID, userID)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode("User invited successfully")
+}
+
+// InvitationsHandler serves GET /users/me/invites, the caller's pending
+// invitations
+func (s *Server) InvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+
+	invitations, err := chat.Invitations(s.DB, userID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching invitations")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(invitations)
+}
+
+// DeclineInvitationHandler serves DELETE /users/me/invites/{room_id}
+func (s *Server) DeclineInvitationHandler(w http.ResponseWriter, r *http.Request, roomID int) {
+	userID := r.Context().Value("userId").(int)
+
+	err := chat.DeclineInvitation(s.DB, roomID, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error declining invitation")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode("Invitation declined")
+}
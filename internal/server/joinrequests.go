@@ -0,0 +1,159 @@
+package server
+
+import (
+	"chat-app/internal/chat"
+	"chat-app/internal/websocket"
+	"chat-app/pkg/utils"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// requestToJoin asks to join a restricted room on behalf of userID, after
+// JoinRoomHandler found they cannot join it directly
+func (s *Server) requestToJoin(w http.ResponseWriter, roomID, userID int, message string) {
+	request, err := chat.RequestToJoin(s.DB, roomID, userID, message)
+	if err == chat.ErrJoinMessageTooLong {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == chat.ErrRoomNotFound {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err == chat.ErrBanned {
+		http.Error(w, "You are banned from this room", http.StatusForbidden)
+		return
+	}
+	if err == chat.ErrRoomArchived {
+		http.Error(w, "Room is archived", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error requesting to join chat room")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.JoinRequested(request)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(request)
+}
+
+// JoinRequestsHandler serves GET /rooms/{id}/join-requests, the pending
+// requests to join the room. It needs the manage_room permission.
+func (s *Server) JoinRequestsHandler(w http.ResponseWriter, r *http.Request, roomID int) {
+	userID := r.Context().Value("userId").(int)
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	if !chat.Can(role, chat.PermManageRoom) {
+		http.Error(w, "Your role in this room does not allow answering requests to join", http.StatusForbidden)
+		return
+	}
+
+	requests, err := chat.JoinRequests(s.DB, roomID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching join requests")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(requests)
+}
+
+// AnswerJoinRequestHandler serves POST /rooms/{id}/join-requests/{user_id}/approve
+// and DELETE /rooms/{id}/join-requests/{user_id}, which denies the request.
+// The requester is told the answer over their WebSocket connections. It
+// needs the manage_room permission.
+func (s *Server) AnswerJoinRequestHandler(w http.ResponseWriter, r *http.Request, roomID, targetID int, approve bool) {
+	userID := r.Context().Value("userId").(int)
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	if !chat.Can(role, chat.PermManageRoom) {
+		http.Error(w, "Your role in this room does not allow answering requests to join", http.StatusForbidden)
+		return
+	}
+	room, err := chat.GetChatRoom(s.DB, roomID)
+	if err == chat.ErrRoomNotFound {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching chat room")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if approve {
+		err = chat.ApproveJoinRequest(s.DB, roomID, targetID, userID)
+	} else {
+		err = chat.DeleteJoinRequest(s.DB, roomID, targetID)
+	}
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "Request to join not found", http.StatusNotFound)
+		return
+	case errors.Is(err, chat.ErrAlreadyMember):
+		http.Error(w, "User is already a member of this room", http.StatusConflict)
+		return
+	case errors.Is(err, chat.ErrBanned):
+		http.Error(w, "User is banned from this room", http.StatusForbidden)
+		return
+	case errors.Is(err, chat.ErrRoomArchived):
+		http.Error(w, "Room is archived", http.StatusForbidden)
+		return
+	case err != nil:
+		utils.Log.WithError(err).Error("Error answering join request")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.JoinRequestAnswered(roomID, room.Name, targetID, userID, approve)
+
+	w.WriteHeader(http.StatusOK)
+	if approve {
+		json.NewEncoder(w).Encode("Request to join approved")
+	} else {
+		json.NewEncoder(w).Encode("Request to join denied")
+	}
+}
+
+// OwnJoinRequestsHandler serves GET /users/me/join-requests, the caller's
+// pending requests to join rooms
+func (s *Server) OwnJoinRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+
+	requests, err := chat.OwnJoinRequests(s.DB, userID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching join requests")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(requests)
+}
+
+// WithdrawJoinRequestHandler serves DELETE /users/me/join-requests/{room_id}
+func (s *Server) WithdrawJoinRequestHandler(w http.ResponseWriter, r *http.Request, roomID int) {
+	userID := r.Context().Value("userId").(int)
+
+	err := chat.DeleteJoinRequest(s.DB, roomID, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Request to join not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error withdrawing join request")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode("Request to join withdrawn")
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"chat-app/internal/auth"
+	"encoding/json"
+	"net/http"
+)
+
+// JWKSHandler serves GET /.well-known/jwks.json: the public keys that tokens
+// issued by this server can be verified with
+func (s *Server) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	// verifiers may cache keys, but should notice a rotation within minutes
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string][]auth.JWK{"keys": auth.Keys.JWKS()})
+}
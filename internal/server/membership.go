@@ -0,0 +1,76 @@
+package server
+
+import (
+	"chat-app/internal/chat"
+	"chat-app/pkg/utils"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// MembershipLogHandler serves GET /rooms/{id}/membership-log?user_id=&before=&limit=
+// to members of the room and server admins
+func (s *Server) MembershipLogHandler(w http.ResponseWriter, r *http.Request, roomID int) {
+	userID := r.Context().Value("userId").(int)
+	if !s.requireMember(w, roomID, userID, true) {
+		return
+	}
+
+	filter, ok := queryInt(r, "user_id", 0)
+	if !ok {
+		http.Error(w, "Invalid user_id", http.StatusBadRequest)
+		return
+	}
+	before, limit, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	events, err := chat.MembershipLog(s.DB, roomID, filter, before, limit)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching membership log")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(events)
+}
+
+// MembersAtHandler serves GET /rooms/{id}/members?at=<RFC 3339 time>, listing
+// who was in the room at that moment, or the current members and their roles
+// if at is omitted
+func (s *Server) MembersAtHandler(w http.ResponseWriter, r *http.Request, roomID int) {
+	userID := r.Context().Value("userId").(int)
+	if !s.requireMember(w, roomID, userID, true) {
+		return
+	}
+
+	value := r.URL.Query().Get("at")
+	if value == "" {
+		members, err := chat.Members(s.DB, roomID)
+		if err != nil {
+			utils.Log.WithError(err).Error("Error fetching room members")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(members)
+		return
+	}
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		http.Error(w, "at must be an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+
+	users, err := chat.MembersAt(s.DB, roomID, at)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error replaying membership log")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(users)
+}
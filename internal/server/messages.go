@@ -0,0 +1,255 @@
+package server
+
+import (
+	"chat-app/internal/auth"
+	"chat-app/internal/chat"
+	"chat-app/internal/profile"
+	"chat-app/internal/websocket"
+	"chat-app/pkg/models"
+	"chat-app/pkg/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// pageParams reads the before and limit query parameters shared by the
+// history and search endpoints
+func pageParams(w http.ResponseWriter, r *http.Request) (before, limit int, ok bool) {
+	before, ok = queryInt(r, "before", 0)
+	if !ok {
+		http.Error(w, "Invalid before", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	limit, ok = queryInt(r, "limit", defaultPageSize)
+	if !ok || limit <= 0 {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return before, limit, true
+}
+
+// RoomHistoryHandler serves GET /rooms/{id}/messages?before=&limit= to
+// members of the room
+func (s *Server) RoomHistoryHandler(w http.ResponseWriter, r *http.Request, roomID int) {
+	userID := r.Context().Value("userId").(int)
+	before, limit, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.requireMember(w, roomID, userID, false) {
+		return
+	}
+
+	messages, err := chat.RoomHistory(s.DB, roomID, userID, before, limit)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching room history")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(messages)
+}
+
+// EditMessageHandler serves PATCH /rooms/{id}/messages/{message_id}
+// {"content": ...}. Members may edit their own messages if they may post, and
+// other members' messages with the edit_others permission and a role above
+// the sender's.
+func (s *Server) EditMessageHandler(w http.ResponseWriter, r *http.Request, roomID, messageID int) {
+	userID := r.Context().Value("userId").(int)
+
+	var req struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Content == "" {
+		http.Error(w, "Content is required", http.StatusBadRequest)
+		return
+	}
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	senderID, err := chat.RoomMessageSender(s.DB, roomID, messageID)
+	if errors.Is(err, chat.ErrMessageNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching message")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if senderID == userID {
+		if !chat.Can(role, chat.PermPost) {
+			http.Error(w, "Your role in this room does not allow posting", http.StatusForbidden)
+			return
+		}
+	} else {
+		senderRole, err := chat.MemberRole(s.DB, roomID, senderID)
+		if err != nil {
+			utils.Log.WithError(err).Error("Error fetching room role")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !chat.Can(role, chat.PermEditOthers) || !chat.Outranks(role, senderRole) {
+			http.Error(w, "Your role in this room does not allow editing this message", http.StatusForbidden)
+			return
+		}
+	}
+
+	if !s.writable(w, roomID) {
+		return
+	}
+
+	editedAt, err := chat.EditMessage(s.DB, roomID, messageID, req.Content)
+	if errors.Is(err, chat.ErrMessageNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error editing message")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.MessageEdited(roomID, messageID, userID, req.Content)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": messageID, "edited_at": editedAt})
+}
+
+// DirectHistoryHandler serves GET /dms/{user_id}/messages?before=&limit=
+func (s *Server) DirectHistoryHandler(w http.ResponseWriter, r *http.Request, otherID int) {
+	userID := r.Context().Value("userId").(int)
+	before, limit, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	messages, err := chat.DirectHistory(s.DB, userID, otherID, before, limit)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching direct message history")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(messages)
+}
+
+// SendDirectMessageHandler serves POST /dms/{user_id}/messages {"content":
+// ...}, sending a direct message without a WebSocket connection. The
+// recipient's block list and DM policy apply as they do over /ws.
+func (s *Server) SendDirectMessageHandler(w http.ResponseWriter, r *http.Request, recipientID int) {
+	userID := r.Context().Value("userId").(int)
+
+	var req struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Content == "" {
+		http.Error(w, "Content is required", http.StatusBadRequest)
+		return
+	}
+
+	err := chat.CanDirectMessage(s.DB, userID, recipientID)
+	if err == chat.ErrUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if chat.IsDMRefusal(err) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error checking direct message")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	msg := &models.Message{SenderID: userID, RecipientID: recipientID, Content: req.Content}
+	if err := chat.SaveMessage(s.DB, msg); err != nil {
+		utils.Log.WithError(err).Error("Error saving message")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	msg.Timestamp = time.Now().UTC().Truncate(time.Second)
+
+	sender, err := profile.Get(s.DB, userID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching sender profile")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.DirectMessage(websocket.Message{
+		SenderID:          userID,
+		RecipientID:       recipientID,
+		Content:           msg.Content,
+		IsBot:             sender.IsBot,
+		SenderUsername:    sender.Username,
+		SenderDisplayName: sender.DisplayName,
+		SenderAvatarURL:   sender.AvatarURL,
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(msg)
+}
+
+// SearchHandler serves GET /search?q=&room_id=&limit= over the rooms and
+// direct messages visible to the caller
+func (s *Server) SearchHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		http.Error(w, "Missing q", http.StatusBadRequest)
+		return
+	}
+	roomID, ok := queryInt(r, "room_id", 0)
+	if !ok {
+		http.Error(w, "Invalid room_id", http.StatusBadRequest)
+		return
+	}
+	_, limit, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	messages, err := chat.SearchMessages(s.DB, userID, query, roomID, limit)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error searching messages")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !auth.HasScope(r.Context(), auth.ScopeDM) {
+		roomMessages := messages[:0]
+		for _, msg := range messages {
+			if msg.RoomID != 0 {
+				roomMessages = append(roomMessages, msg)
+			}
+		}
+		messages = roomMessages
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(messages)
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"chat-app/internal/chat"
+	"chat-app/internal/websocket"
+	"chat-app/pkg/utils"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// moderationRequest is the body of a ban or mute. ExpiresIn is in seconds.
+type moderationRequest struct {
+	Reason    string `json:"reason"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// decodeModeration reads and checks a ban or mute request, writing a 400 and
+// returning false if it is malformed
+func decodeModeration(w http.ResponseWriter, r *http.Request) (moderationRequest, bool) {
+	var req moderationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return req, false
+	}
+	if req.ExpiresIn < 0 {
+		http.Error(w, "expires_in must not be negative", http.StatusBadRequest)
+		return req, false
+	}
+	reason, err := chat.ValidReason(req.Reason)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return req, false
+	}
+	req.Reason = reason
+	return req, true
+}
+
+// mayModerate writes a 403 and returns false unless userID may ban or mute
+// targetID in a room. Members can only be moderated by members ranked above
+// them; users outside the room by anyone with the moderate permission.
+func (s *Server) mayModerate(w http.ResponseWriter, roomID, userID, targetID int) bool {
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return false
+	}
+	target, err := chat.MemberRole(s.DB, roomID, targetID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching room role")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !chat.Can(role, chat.PermModerate) || target != "" && !chat.Outranks(role, target) || targetID == userID {
+		http.Error(w, "Your role in this room does not allow moderating this user", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// BanHandler serves PUT /rooms/{id}/bans/{user_id} {"reason": ...,
+// "expires_in": ...}, removing the user from the room and keeping them out
+// for expires_in seconds, or until they are unbanned if it is 0. It needs
+// the moderate permission and a role above the target's.
+func (s *Server) BanHandler(w http.ResponseWriter, r *http.Request, roomID, targetID int) {
+	userID := r.Context().Value("userId").(int)
+
+	req, ok := decodeModeration(w, r)
+	if !ok {
+		return
+	}
+	if !s.mayModerate(w, roomID, userID, targetID) {
+		return
+	}
+
+	ban, _, err := chat.Ban(s.DB, roomID, targetID, userID, req.Reason, time.Duration(req.ExpiresIn)*time.Second)
+	if errors.Is(err, chat.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error banning user")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.Banned(ban)
+
+	utils.Log.WithField("roomID", roomID).WithField("userID", targetID).WithField("actorID", userID).Info("Banned user from room")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ban)
+}
+
+// UnbanHandler serves DELETE /rooms/{id}/bans/{user_id}. It needs the
+// moderate permission.
+func (s *Server) UnbanHandler(w http.ResponseWriter, r *http.Request, roomID, targetID int) {
+	userID := r.Context().Value("userId").(int)
+
+	if !s.mayModerate(w, roomID, userID, targetID) {
+		return
+	}
+
+	err := chat.Unban(s.DB, roomID, targetID, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User is not banned from this room", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error unbanning user")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.Unbanned(roomID, targetID, userID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("User unbanned successfully")
+}
+
+// MuteHandler serves PUT /rooms/{id}/mutes/{user_id} {"reason": ...,
+// "expires_in": ...}, keeping a member from posting for expires_in seconds.
+// It needs the moderate permission and a role above the target's.
+func (s *Server) MuteHandler(w http.ResponseWriter, r *http.Request, roomID, targetID int) {
+	userID := r.Context().Value("userId").(int)
+
+	req, ok := decodeModeration(w, r)
+	if !ok {
+		return
+	}
+	if req.ExpiresIn == 0 {
+		http.Error(w, "expires_in is required", http.StatusBadRequest)
+		return
+	}
+	if !s.mayModerate(w, roomID, userID, targetID) {
+		return
+	}
+
+	mute, err := chat.Mute(s.DB, roomID, targetID, userID, req.Reason, time.Duration(req.ExpiresIn)*time.Second)
+	if errors.Is(err, chat.ErrNotMember) {
+		http.Error(w, "User is not a member of this room", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error muting user")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.Muted(mute)
+
+	utils.Log.WithField("roomID", roomID).WithField("userID", targetID).WithField("actorID", userID).Info("Muted room member")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(mute)
+}
+
+// UnmuteHandler serves DELETE /rooms/{id}/mutes/{user_id}. It needs the
+// moderate permission and a role above the target's.
+func (s *Server) UnmuteHandler(w http.ResponseWriter, r *http.Request, roomID, targetID int) {
+	userID := r.Context().Value("userId").(int)
+
+	if !s.mayModerate(w, roomID, userID, targetID) {
+		return
+	}
+
+	err := chat.Unmute(s.DB, roomID, targetID, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User is not muted in this room", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error unmuting user")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.Unmuted(roomID, targetID, userID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("User unmuted successfully")
+}
+
+// SanctionsHandler serves GET /rooms/{id}/bans and GET /rooms/{id}/mutes,
+// the bans or mutes in force. It needs the moderate permission.
+func (s *Server) SanctionsHandler(w http.ResponseWriter, r *http.Request, roomID int, kind string) {
+	userID := r.Context().Value("userId").(int)
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	if !chat.Can(role, chat.PermModerate) {
+		http.Error(w, "Your role in this room does not allow moderating", http.StatusForbidden)
+		return
+	}
+
+	sanctions, err := chat.Sanctions(s.DB, roomID, kind)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching sanctions")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sanctions)
+}
+
+// ModerationLogHandler serves GET /rooms/{id}/moderation-log?user_id=&before=&limit=.
+// It needs the moderate permission.
+func (s *Server) ModerationLogHandler(w http.ResponseWriter, r *http.Request, roomID int) {
+	userID := r.Context().Value("userId").(int)
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	if !chat.Can(role, chat.PermModerate) {
+		http.Error(w, "Your role in this room does not allow moderating", http.StatusForbidden)
+		return
+	}
+
+	filter, ok := queryInt(r, "user_id", 0)
+	if !ok {
+		http.Error(w, "Invalid user_id", http.StatusBadRequest)
+		return
+	}
+	before, limit, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	actions, err := chat.ModerationLog(s.DB, roomID, filter, before, limit)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching moderation log")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(actions)
+}
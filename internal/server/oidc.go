@@ -0,0 +1,418 @@
+package server
+
+import (
+	"chat-app/internal/audit"
+	"chat-app/internal/auth"
+	"chat-app/internal/oidc"
+	"chat-app/pkg/utils"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// stateCookie holds a hash of the state of the login a browser started. The
+// callback only finishes a login for the browser that started it, so that
+// nobody can log a victim in as themselves, or link their own account to the
+// victim's, by sending them a provider URL.
+const stateCookie = "oidc_state"
+
+// deviceCSRFCookie holds the token the device confirmation form has to be
+// posted with, so that other sites cannot approve device logins for the user
+const deviceCSRFCookie = "oidc_device_csrf"
+
+// OIDCLoginHandler serves GET /oidc/login, sending the user to the identity
+// provider to log in. They come back to OIDCCallbackHandler.
+func (s *Server) OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.redirectToProvider(w, r, oidc.Login{})
+}
+
+// OIDCLinkHandler serves POST /oidc/link, returning a single-use URL where
+// the logged-in user can log in with the provider to link that account to
+// theirs. Afterwards they can log in either way. The URL can be opened in
+// any browser, which is where the login then has to be finished.
+func (s *Server) OIDCLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ticket, err := oidc.StartLink(r.Context().Value("userId").(int), r.Context().Value("username").(string))
+	if err != nil {
+		utils.Log.WithError(err).Error("Error starting account link")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	linkURL, err := s.publicURL("/oidc/link/start?ticket=" + url.QueryEscape(ticket))
+	if err != nil {
+		utils.Log.WithError(err).Error("Invalid OIDC redirect URL")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"link_url":   linkURL,
+		"expires_in": int(oidc.LinkTTL.Seconds()),
+	})
+}
+
+var linkConfirmPage = template.Must(template.New("link").Parse(`<!DOCTYPE html>
+<title>Link an account to chat-app</title>
+<p>The account you log in with next will be linked to the chat-app user
+<b>{{.Username}}</b>, and can then be used to log in as them. Only continue
+if you are {{.Username}} and asked for this link yourself.</p>
+<p><a href="{{.AuthURL}}">Continue to the identity provider</a></p>
+`))
+
+// OIDCLinkStartHandler serves GET /oidc/link/start?ticket=..., the URL from
+// OIDCLinkHandler. It uses up the ticket, binds the login to this browser
+// and shows who the account is being linked to before the user goes on to
+// the provider, so that a link sent to someone else is not followed blindly.
+func (s *Server) OIDCLinkStartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("X-Frame-Options", "DENY")
+
+	link, err := oidc.RedeemLink(r.URL.Query().Get("ticket"))
+	if err != nil {
+		http.Error(w, "Link has expired or was already used, please ask for a new one", http.StatusNotFound)
+		return
+	}
+	authURL, state, err := s.OIDC.StartLogin(oidc.Login{LinkUserID: link.UserID})
+	if err != nil {
+		utils.Log.WithError(err).Error("Error starting OIDC login")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.bindState(w, state)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	linkConfirmPage.Execute(w, struct {
+		Username string
+		AuthURL  string
+	}{link.Username, authURL})
+}
+
+// OIDCCallbackHandler serves GET /oidc/callback, where the provider sends
+// the user back. Depending on how the login was started it links the
+// account, approves a device login or logs the user in, creating a user for
+// accounts seen for the first time. Like a password, the provider's login
+// only gets users with two-factor authentication a challenge.
+func (s *Server) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		http.Error(w, "Login failed at the identity provider: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie(stateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(hashState(state))) != 1 {
+		http.Error(w, "Login was not started in this browser, please start again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/oidc/", MaxAge: -1, HttpOnly: true, Secure: s.secureCookies()})
+
+	login, idToken, err := s.OIDC.FinishLogin(state, query.Get("code"))
+	if err == oidc.ErrUnknownLogin {
+		http.Error(w, "Login has expired, please start again", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, oidc.ErrInvalidIDToken) {
+		utils.Log.WithError(err).Warn("Rejected OIDC ID token")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error completing OIDC login")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	identity := auth.Identity{Issuer: idToken.Issuer, Subject: idToken.Subject, Username: idToken.PreferredUsername}
+	if idToken.EmailVerified {
+		identity.Email = idToken.Email
+	}
+	if identity.Username == "" && identity.Email != "" {
+		identity.Username = strings.SplitN(identity.Email, "@", 2)[0]
+	}
+	detail := fmt.Sprintf("%s at %s", identity.Subject, identity.Issuer)
+
+	if login.LinkUserID != 0 {
+		err := auth.LinkIdentity(s.DB, login.LinkUserID, identity)
+		if err == auth.ErrIdentityLinked {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			utils.Log.WithError(err).Error("Error linking identity")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := audit.Record(s.DB, audit.IdentityLinked, login.LinkUserID, clientIP(r), detail); err != nil {
+			utils.Log.WithError(err).Error("Error writing audit log")
+		}
+		json.NewEncoder(w).Encode("Account linked successfully")
+		return
+	}
+
+	userID, username, created, err := auth.ExternalUser(s.DB, identity)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error finding user for identity")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if created {
+		if err := audit.Record(s.DB, audit.IdentityLinked, userID, clientIP(r), detail+", new user"); err != nil {
+			utils.Log.WithError(err).Error("Error writing audit log")
+		}
+		utils.Log.WithField("username", username).Info("Created user for OIDC login")
+	}
+
+	if login.DeviceCode != "" {
+		if err := oidc.ApproveDevice(login.DeviceCode, userID, username); err != nil {
+			http.Error(w, "Device login has expired, please start again", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode("Logged in as " + username + ", you can return to your device")
+		return
+	}
+
+	token, challenge, err := auth.ExternalLogin(s.DB, userID, username, requestDevice(r, "", ""))
+	if err != nil {
+		utils.Log.WithError(err).Error("Error creating session")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if challenge != nil {
+		json.NewEncoder(w).Encode(challenge)
+		return
+	}
+	json.NewEncoder(w).Encode(token)
+}
+
+// DeviceAuthorizationHandler serves POST /oidc/device/authorize, starting a
+// device login for a client that cannot open a browser itself
+func (s *Server) DeviceAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// the body is optional, a device that sends none is named after its
+	// User-Agent
+	var req struct {
+		DeviceName string `json:"device_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	verificationURI, err := s.publicURL("/oidc/device")
+	if err != nil {
+		utils.Log.WithError(err).Error("Invalid OIDC redirect URL")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	device := requestDevice(r, req.DeviceName, "")
+	authorization, err := oidc.StartDevice(verificationURI, device.Name, device.IP)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error starting device login")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(authorization)
+}
+
+var deviceCodePage = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<title>Log in to chat-app</title>
+<form method="get">
+<label>Code shown on your device <input name="user_code" autofocus></label>
+<button>Continue</button>
+</form>
+`))
+
+var deviceConfirmPage = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<title>Log in to chat-app</title>
+<p>A device is asking to log in to your account. Only continue if you started
+this login yourself and your device shows the code below.</p>
+<dl>
+<dt>Code</dt><dd>{{.Device.UserCode}}</dd>
+<dt>Device</dt><dd>{{.Device.Name}}</dd>
+<dt>IP address</dt><dd>{{.Device.IP}}</dd>
+<dt>Started</dt><dd>{{.Device.Started.Format "2006-01-02 15:04:05 MST"}}</dd>
+</dl>
+<form method="post">
+<input type="hidden" name="user_code" value="{{.Device.UserCode}}">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<button>Log in this device</button>
+</form>
+`))
+
+// DeviceVerifyHandler serves /oidc/device, where the user enters the code
+// their device shows. GET shows the device the code belongs to; only posting
+// the confirmation form sends the user to the provider to log in, so that a
+// link with someone else's code cannot log their device in unnoticed.
+func (s *Server) DeviceVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("X-Frame-Options", "DENY")
+
+	userCode := r.FormValue("user_code")
+	if userCode == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		deviceCodePage.Execute(w, nil)
+		return
+	}
+	device, ok := oidc.DeviceForUserCode(userCode)
+	if !ok {
+		http.Error(w, "Unknown or expired code", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		cookie, err := r.Cookie(deviceCSRFCookie)
+		if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.PostFormValue("csrf_token"))) != 1 {
+			http.Error(w, "Invalid form, please enter the code again", http.StatusForbidden)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: deviceCSRFCookie, Path: "/oidc/device", MaxAge: -1, HttpOnly: true, Secure: s.secureCookies()})
+		s.redirectToProvider(w, r, oidc.Login{DeviceCode: device.DeviceCode})
+		return
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		utils.Log.WithError(err).Error("Error generating CSRF token")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	csrfToken := base64.RawURLEncoding.EncodeToString(buf)
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceCSRFCookie,
+		Value:    csrfToken,
+		Path:     "/oidc/device",
+		MaxAge:   int(time.Until(device.Started.Add(oidc.DeviceCodeTTL)).Seconds()) + 1,
+		HttpOnly: true,
+		Secure:   s.secureCookies(),
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	deviceConfirmPage.Execute(w, struct {
+		Device    *oidc.PendingDevice
+		CSRFToken string
+	}{device, csrfToken})
+}
+
+// DeviceTokenHandler serves POST /oidc/device/token {"device_code": ...,
+// "device_name": ..., "client_version": ...}, which the device polls until
+// the user has logged in. Until then it answers 400 with an RFC 8628 error
+// code. Users with two-factor authentication get a challenge instead of
+// tokens, as from LoginHandler.
+func (s *Server) DeviceTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		DeviceCode    string `json:"device_code"`
+		DeviceName    string `json:"device_name"`
+		ClientVersion string `json:"client_version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID, username, err := oidc.PollDevice(req.DeviceCode)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	token, challenge, err := auth.ExternalLogin(s.DB, userID, username, requestDevice(r, req.DeviceName, req.ClientVersion))
+	if err != nil {
+		utils.Log.WithError(err).Error("Error creating session")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if challenge != nil {
+		json.NewEncoder(w).Encode(challenge)
+		return
+	}
+	json.NewEncoder(w).Encode(token)
+}
+
+func (s *Server) redirectToProvider(w http.ResponseWriter, r *http.Request, login oidc.Login) {
+	authURL, state, err := s.OIDC.StartLogin(login)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error starting OIDC login")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.bindState(w, state)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// bindState ties a login's state to the browser the response goes to. The
+// cookie is sent along when the provider redirects back, which is a top
+// level navigation, so SameSite=Lax lets it through.
+func (s *Server) bindState(w http.ResponseWriter, state string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    hashState(state),
+		Path:     "/oidc/",
+		MaxAge:   int(oidc.LoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   s.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// publicURL resolves ref against the callback, whose URL is the only public
+// address of the server we know
+func (s *Server) publicURL(ref string) (string, error) {
+	callback, err := url.Parse(s.OIDC.RedirectURL)
+	if err != nil {
+		return "", err
+	}
+	target, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return callback.ResolveReference(target).String(), nil
+}
+
+// secureCookies is whether the server is reached over HTTPS, going by the
+// redirect URL registered with the provider
+func (s *Server) secureCookies() bool {
+	return strings.HasPrefix(s.OIDC.RedirectURL, "https://")
+}
+
+func hashState(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
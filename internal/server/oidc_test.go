@@ -0,0 +1,337 @@
+package server
+
+import (
+	"chat-app/internal/auth"
+	"chat-app/internal/database/databasetest"
+	"chat-app/internal/oidc"
+	"chat-app/internal/websocket"
+	"chat-app/pkg/models"
+	"database/sql"
+	"encoding/json"
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// newTestDB creates a database for a test, which sessions are checked and
+// room members looked up in
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db := databasetest.Open(t)
+	if auth.Keys == nil {
+		var err error
+		if auth.Keys, err = auth.EphemeralKeyset(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auth.Init(db)
+	websocket.Init(db)
+	return db
+}
+
+// newOIDCServer serves the OIDC endpoints for a test, logging in with a mock
+// provider mounted at /idp
+func newOIDCServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	s := &Server{DB: newTestDB(t)}
+	mux := http.NewServeMux()
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	mock, err := oidc.NewMockProvider(ts.URL + "/idp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.OIDC = mock.Provider("chat-app", ts.URL+"/oidc/callback")
+	mux.Handle("/idp/", mock)
+	mux.HandleFunc("/oidc/login", s.OIDCLoginHandler)
+	mux.HandleFunc("/oidc/callback", s.OIDCCallbackHandler)
+	mux.Handle("/oidc/link", auth.JWTMiddleware(http.HandlerFunc(s.OIDCLinkHandler)))
+	mux.HandleFunc("/oidc/link/start", s.OIDCLinkStartHandler)
+	return s, ts
+}
+
+// browser is a client that keeps cookies, like the user's browser
+func browser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+// logInAtMock posts the mock provider's login form for authURL as username.
+// The response is the callback's, unless client does not follow redirects.
+func logInAtMock(t *testing.T, client *http.Client, authURL, username string) *http.Response {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := u.Query()
+	form.Set("username", username)
+	u.RawQuery = ""
+	resp, err := client.PostForm(u.String(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// authURLFrom starts a login at /oidc/login, returning where it redirects to
+func authURLFrom(t *testing.T, client *http.Client, ts *httptest.Server) string {
+	t.Helper()
+	noFollow := *client
+	noFollow.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := noFollow.Get(ts.URL + "/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("/oidc/login: %s", resp.Status)
+	}
+	return resp.Header.Get("Location")
+}
+
+func TestOIDCCallbackLogsIn(t *testing.T) {
+	_, ts := newOIDCServer(t)
+	client := browser(t)
+
+	resp := logInAtMock(t, client, authURLFrom(t, client, ts), "alice")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("callback: %s", resp.Status)
+	}
+	var token models.Token
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := auth.Authenticate(token.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Username != "alice" {
+		t.Errorf("logged in as %q, want alice", claims.Username)
+	}
+}
+
+func TestOIDCCallbackRequiresStartingBrowser(t *testing.T) {
+	_, ts := newOIDCServer(t)
+	attacker, victim := browser(t), browser(t)
+
+	// the attacker logs in at the provider but hands the way back to the
+	// victim, who would end up logged in as the attacker
+	noFollow := *attacker
+	noFollow.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp := logInAtMock(t, &noFollow, authURLFrom(t, attacker, ts), "mallory")
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: %s", resp.Status)
+	}
+
+	resp, err := victim.Get(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback in another browser: got %s, want 400", resp.Status)
+	}
+}
+
+// linkURLFor registers username and asks for a link URL with their access
+// token, as the CLI does, without any cookies
+func linkURLFor(t *testing.T, s *Server, ts *httptest.Server, username string) string {
+	t.Helper()
+	if err := auth.RegisterUser(s.DB, username, "unused"); err != nil {
+		t.Fatal(err)
+	}
+	var userID int
+	if err := s.DB.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.CreateSession(s.DB, userID, username, auth.Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/oidc/link", nil)
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/oidc/link: %s", resp.Status)
+	}
+	var body struct {
+		LinkURL   string `json:"link_url"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(body.LinkURL, ts.URL+"/oidc/link/start?ticket=") || body.ExpiresIn <= 0 {
+		t.Fatalf("got %+v", body)
+	}
+	return body.LinkURL
+}
+
+// continueURL matches the link to the provider on the link confirmation page
+var continueURL = regexp.MustCompile(`<a href="([^"]+)">`)
+
+// openLink opens a link URL in client, returning the provider URL the page
+// continues to, or the response if the page was refused
+func openLink(t *testing.T, client *http.Client, linkURL string) (string, *http.Response) {
+	t.Helper()
+	resp, err := client.Get(linkURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	page, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", resp
+	}
+	match := continueURL.FindSubmatch(page)
+	if match == nil {
+		t.Fatalf("no way on in %s", page)
+	}
+	return html.UnescapeString(string(match[1])), resp
+}
+
+func TestOIDCLink(t *testing.T) {
+	s, ts := newOIDCServer(t)
+
+	link := func(username string) *http.Response {
+		t.Helper()
+		client := browser(t)
+		authURL, resp := openLink(t, client, linkURLFor(t, s, ts, username))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("opening the link: %s", resp.Status)
+		}
+		return logInAtMock(t, client, authURL, "frank-sso")
+	}
+
+	if resp := link("frank"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("linking: %s", resp.Status)
+	}
+	var linked string
+	err := s.DB.QueryRow(`SELECT users.username FROM user_identities
+		JOIN users ON users.id = user_identities.user_id
+		WHERE user_identities.subject = 'frank-sso'`).Scan(&linked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked != "frank" {
+		t.Errorf("identity linked to %q, want frank", linked)
+	}
+
+	// the account is taken, so nobody else can link it
+	if resp := link("grace"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("linking a linked account: got %s, want 409", resp.Status)
+	}
+
+	// and logging in with it logs in as the user it is linked to
+	client := browser(t)
+	resp := logInAtMock(t, client, authURLFrom(t, client, ts), "frank-sso")
+	var token models.Token
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := auth.Authenticate(token.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Username != "frank" {
+		t.Errorf("logged in as %q, want frank", claims.Username)
+	}
+}
+
+func TestOIDCLinkURL(t *testing.T) {
+	s, ts := newOIDCServer(t)
+	linkURL := linkURLFor(t, s, ts, "ivy")
+
+	// the browser that opens the link first gets the login
+	first, second := browser(t), browser(t)
+	authURL, resp := openLink(t, first, linkURL)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first open: %s", resp.Status)
+	}
+	if _, resp := openLink(t, second, linkURL); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second open: got %s, want 404", resp.Status)
+	}
+
+	// and only it can finish the login
+	if resp := logInAtMock(t, second, authURL, "ivy-sso"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("finishing in another browser: got %s, want 400", resp.Status)
+	}
+	if resp := logInAtMock(t, first, authURL, "ivy-sso"); resp.StatusCode != http.StatusOK {
+		t.Errorf("finishing in the browser that opened the link: %s", resp.Status)
+	}
+
+	if _, resp := openLink(t, browser(t), ts.URL+"/oidc/link/start?ticket=made-up"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("made up link: got %s, want 404", resp.Status)
+	}
+}
+
+func TestOIDCLoginAsksForSecondFactor(t *testing.T) {
+	s, ts := newOIDCServer(t)
+
+	// the first login creates the user, who then turns on two-factor
+	// authentication
+	client := browser(t)
+	resp := logInAtMock(t, client, authURLFrom(t, client, ts), "henry")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first login: %s", resp.Status)
+	}
+	var userID int
+	if err := s.DB.QueryRow("SELECT id FROM users WHERE username = 'henry'").Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.DB.Exec("INSERT INTO totp (user_id, secret, enabled_at) VALUES (?, 'JBSWY3DPEHPK3PXP', CURRENT_TIMESTAMP)", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var login struct {
+		Token     string `json:"token"`
+		Challenge string `json:"challenge"`
+	}
+	resp = logInAtMock(t, client, authURLFrom(t, client, ts), "henry")
+	if err := json.NewDecoder(resp.Body).Decode(&login); err != nil {
+		t.Fatal(err)
+	}
+	if login.Token != "" || login.Challenge == "" {
+		t.Errorf("callback: got %+v, want only a challenge", login)
+	}
+
+	authorization, err := oidc.StartDevice(ts.URL+"/oidc/device", "laptop", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := oidc.ApproveDevice(authorization.DeviceCode, userID, "henry"); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	body := `{"device_code": "` + authorization.DeviceCode + `"}`
+	s.DeviceTokenHandler(w, httptest.NewRequest(http.MethodPost, "/oidc/device/token", strings.NewReader(body)))
+	login.Token, login.Challenge = "", ""
+	if err := json.NewDecoder(w.Body).Decode(&login); err != nil {
+		t.Fatal(err)
+	}
+	if login.Token != "" || login.Challenge == "" {
+		t.Errorf("device token: got %+v, want only a challenge", login)
+	}
+}
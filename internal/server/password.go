@@ -0,0 +1,234 @@
+package server
+
+import (
+	"chat-app/internal/audit"
+	"chat-app/internal/auth"
+	"chat-app/internal/mail"
+	"chat-app/internal/websocket"
+	"chat-app/pkg/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SetEmailHandler serves PUT /users/me/email {"email": ...}, giving the user
+// a new address and mailing it a verification link. An empty address removes
+// it.
+func (s *Server) SetEmailHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+	username := r.Context().Value("username").(string)
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Email == "" {
+		if err := auth.ClearEmail(s.DB, userID); err != nil {
+			utils.Log.WithError(err).Error("Error removing email")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode("Email address removed")
+		return
+	}
+
+	email, err := auth.NormalizeEmail(req.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, err := auth.SetEmail(s.DB, userID, email)
+	if err == auth.ErrEmailTaken {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error setting email")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	link := s.PublicURL + "/email/verify?token=" + url.QueryEscape(token)
+	err = s.Mailer.Send(mail.Message{
+		To:      email,
+		Subject: "Verify your chat-app email address",
+		Body: fmt.Sprintf("Hi %s,\n\nopen this link to verify your email address:\n\n%s\n\nThe link expires in %s.\n",
+			username, link, auth.EmailVerificationTTL),
+	})
+	if err != nil {
+		utils.Log.WithError(err).Error("Error sending verification email")
+		http.Error(w, "Could not send the verification email", http.StatusBadGateway)
+		return
+	}
+
+	json.NewEncoder(w).Encode("Verification email sent")
+}
+
+// VerifyEmailHandler serves GET /email/verify?token=..., the link in the
+// verification email
+func (s *Server) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := auth.VerifyEmail(s.DB, r.URL.Query().Get("token"))
+	if err == auth.ErrInvalidMailedToken {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error verifying email")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Log.WithField("userID", userID).Info("Verified email address")
+	json.NewEncoder(w).Encode("Email address verified")
+}
+
+// ForgotPasswordHandler serves POST /password/forgot {"email": ...}, mailing
+// a reset token to the address if it belongs to a user who verified it. The
+// answer is the same either way, so that it does not reveal who has an
+// account.
+func (s *Server) ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	email, err := auth.NormalizeEmail(req.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	userID, token, err := auth.PasswordResetToken(s.DB, email)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error creating password reset token")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if userID != 0 {
+		// sent in the background, since how long it takes would tell
+		// whether there was anything to send
+		go func() {
+			err := s.Mailer.Send(mail.Message{
+				To:      email,
+				Subject: "Reset your chat-app password",
+				Body: fmt.Sprintf("Someone asked to reset the password of your chat-app account. If it was you, "+
+					"send this token with your new password to POST %s/password/reset:\n\n%s\n\n"+
+					"The token expires in %s. If it was not you, you can ignore this email.\n",
+					s.PublicURL, token, auth.PasswordResetTTL),
+			})
+			if err != nil {
+				utils.Log.WithError(err).WithField("userID", userID).Error("Error sending password reset email")
+			}
+		}()
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode("If the address belongs to an account, a reset token has been sent to it")
+}
+
+// ResetPasswordHandler serves POST /password/reset {"token": ...,
+// "password": ...}, logging the user out everywhere
+func (s *Server) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID, err := auth.ResetPassword(s.DB, req.Token, req.Password)
+	if !s.passwordSet(w, err) {
+		return
+	}
+	websocket.Disconnect(userID)
+	if err := audit.Record(s.DB, audit.PasswordReset, userID, clientIP(r), ""); err != nil {
+		utils.Log.WithError(err).Error("Error writing audit log")
+	}
+
+	json.NewEncoder(w).Encode("Password reset successfully")
+}
+
+// ChangePasswordHandler serves POST /password/change {"current_password":
+// ..., "new_password": ...}. The user's other sessions are logged out.
+func (s *Server) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userId").(int)
+	sessionID := r.Context().Value("sessionId").(int)
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := auth.ChangePassword(s.DB, userID, req.CurrentPassword, req.NewPassword, sessionID)
+	if err == auth.ErrWrongPassword {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !s.passwordSet(w, err) {
+		return
+	}
+	for _, id := range revoked {
+		websocket.CloseSession(id)
+	}
+	if err := audit.Record(s.DB, audit.PasswordChanged, userID, clientIP(r), ""); err != nil {
+		utils.Log.WithError(err).Error("Error writing audit log")
+	}
+
+	json.NewEncoder(w).Encode("Password changed successfully")
+}
+
+// passwordSet writes the error response for setting a password, returning
+// false if there was an error
+func (s *Server) passwordSet(w http.ResponseWriter, err error) bool {
+	var policy *auth.PolicyError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &policy):
+		http.Error(w, "Password "+strings.Join(policy.Problems, ", "), http.StatusBadRequest)
+	case err == auth.ErrInvalidMailedToken:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		utils.Log.WithError(err).Error("Error setting password")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"chat-app/internal/chat"
+	"chat-app/pkg/models"
+	"chat-app/pkg/utils"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+)
+
+// ListBlocksHandler serves GET /users/me/blocks, the users the caller has
+// blocked
+func (s *Server) ListBlocksHandler(w http.ResponseWriter, r *http.Request) {
+	s.listUsers(w, r, chat.ListBlocked)
+}
+
+// BlockHandler serves PUT and DELETE /users/me/blocks/{user_id}, blocking
+// and unblocking a user, and returns the updated list. Blocked users cannot
+// send the caller direct messages, and their room messages are hidden from
+// the caller.
+func (s *Server) BlockHandler(w http.ResponseWriter, r *http.Request, otherID int) {
+	s.changeRelation(w, r, otherID, chat.Block, chat.Unblock, chat.ListBlocked)
+}
+
+// ListContactsHandler serves GET /users/me/contacts
+func (s *Server) ListContactsHandler(w http.ResponseWriter, r *http.Request) {
+	s.listUsers(w, r, chat.ListContacts)
+}
+
+// ContactHandler serves PUT and DELETE /users/me/contacts/{user_id}, adding
+// and removing a contact, and returns the updated list. With the "contacts"
+// DM policy, only contacts can send the caller direct messages.
+func (s *Server) ContactHandler(w http.ResponseWriter, r *http.Request, otherID int) {
+	s.changeRelation(w, r, otherID, chat.AddContact, chat.RemoveContact, chat.ListContacts)
+}
+
+func (s *Server) listUsers(w http.ResponseWriter, r *http.Request, list func(*sql.DB, int) ([]models.User, error)) {
+	userID := r.Context().Value("userId").(int)
+
+	users, err := list(s.DB, userID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching users")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(users)
+}
+
+// changeRelation runs add for PUT and remove for DELETE between the caller
+// and otherID, then responds with list
+func (s *Server) changeRelation(w http.ResponseWriter, r *http.Request, otherID int, add, remove func(*sql.DB, int, int) error,
+	list func(*sql.DB, int) ([]models.User, error)) {
+	userID := r.Context().Value("userId").(int)
+
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		err = add(s.DB, userID, otherID)
+	case http.MethodDelete:
+		err = remove(s.DB, userID, otherID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case err == chat.ErrUserNotFound:
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	case err == chat.ErrSelf:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		utils.Log.WithError(err).Error("Error updating user list")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.listUsers(w, r, list)
+}
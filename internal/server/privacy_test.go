@@ -0,0 +1,53 @@
+package server
+
+import (
+	"chat-app/internal/chat"
+	"chat-app/internal/database/databasetest"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSendDirectMessageRefusals(t *testing.T) {
+	s := &Server{DB: newTestDB(t)}
+	alice := databasetest.NewUser(t, s.DB, "alice")
+	bob := databasetest.NewUser(t, s.DB, "bob")
+	carol := databasetest.NewUser(t, s.DB, "carol")
+	if err := chat.Block(s.DB, bob, alice); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		sender    int
+		recipient int
+		status    int
+		body      string
+	}{
+		{"blocked by the recipient", alice, bob, http.StatusForbidden, chat.ErrBlocked.Error()},
+		{"blocking the recipient", bob, alice, http.StatusForbidden, chat.ErrBlocking.Error()},
+		{"nobody", alice, 12345, http.StatusNotFound, "User not found"},
+		{"allowed", alice, carol, http.StatusCreated, ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/dms/"+strconv.Itoa(test.recipient)+"/messages", strings.NewReader(`{"content": "hi"}`))
+		s.SendDirectMessageHandler(w, asUser(r, test.sender), test.recipient)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d %s, want %d", test.name, w.Code, strings.TrimSpace(w.Body.String()), test.status)
+		}
+		if test.body != "" && strings.TrimSpace(w.Body.String()) != test.body {
+			t.Errorf("%s: got %q, want %q", test.name, strings.TrimSpace(w.Body.String()), test.body)
+		}
+	}
+
+	var stored int
+	if err := s.DB.QueryRow("SELECT COUNT(*) FROM messages WHERE recipient_id IS NOT NULL").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 {
+		t.Errorf("%d direct messages stored, want only the allowed one", stored)
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"chat-app/internal/profile"
+	"chat-app/pkg/utils"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+)
+
+// OwnProfileHandler serves GET /users/me, the caller's profile including
+// their email address
+func (s *Server) OwnProfileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+
+	user, err := profile.Own(s.DB, userID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching profile")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(user)
+}
+
+// ProfileHandler serves GET /users/{id}, the public profile of a user
+func (s *Server) ProfileHandler(w http.ResponseWriter, r *http.Request, userID int) {
+	user, err := profile.Get(s.DB, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching profile")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(user)
+}
+
+// UpdateProfileHandler serves PATCH /users/me {"display_name": ..., "bio":
+// ..., "status": ...}. Fields left out are unchanged, and empty ones are
+// cleared. It returns the updated profile.
+func (s *Server) UpdateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+
+	var update profile.Update
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := update.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := profile.Apply(s.DB, userID, update); err != nil {
+		utils.Log.WithError(err).Error("Error updating profile")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.OwnProfileHandler(w, r)
+}
+
+// SetAvatarHandler serves PUT /users/me/avatar, whose body is a PNG, JPEG,
+// GIF or WebP image of at most profile.MaxAvatarSize bytes
+func (s *Server) SetAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+
+	// one byte over the limit is enough to tell the image is too large
+	image, err := io.ReadAll(io.LimitReader(r.Body, profile.MaxAvatarSize+1))
+	if err != nil {
+		utils.Log.WithError(err).Error("Error reading avatar")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = profile.SetAvatar(s.DB, userID, image)
+	if err == profile.ErrAvatarTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err == profile.ErrAvatarType {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error storing avatar")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.OwnProfileHandler(w, r)
+}
+
+// RemoveAvatarHandler serves DELETE /users/me/avatar
+func (s *Server) RemoveAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+
+	if err := profile.RemoveAvatar(s.DB, userID); err != nil {
+		utils.Log.WithError(err).Error("Error removing avatar")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode("Avatar removed")
+}
+
+// AvatarHandler serves GET /users/{id}/avatar, the user's avatar image
+func (s *Server) AvatarHandler(w http.ResponseWriter, r *http.Request, userID int) {
+	name, err := profile.AvatarFile(s.DB, userID)
+	if err == sql.ErrNoRows || err == nil && name == "" {
+		http.Error(w, "Avatar not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching avatar")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, filepath.Join(profile.Dir, name))
+}
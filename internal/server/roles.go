@@ -0,0 +1,246 @@
+package server
+
+import (
+	"chat-app/internal/chat"
+	"chat-app/internal/websocket"
+	"chat-app/pkg/models"
+	"chat-app/pkg/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// roomRole returns the role userID acts with in a room: their role as a
+// member, or owner for server admins. It writes a 403 and returns false if
+// they are neither.
+func (s *Server) roomRole(w http.ResponseWriter, roomID, userID int) (string, bool) {
+	role, err := chat.MemberRole(s.DB, roomID, userID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching room role")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+	if role == "" && s.isAdmin(userID) {
+		role = models.RoleOwner
+	}
+	if role == "" {
+		http.Error(w, "Not a member of this room", http.StatusForbidden)
+		return "", false
+	}
+	return role, true
+}
+
+// targetRole returns the role of the member an action is aimed at, writing a
+// 404 and returning false if they are not in the room
+func (s *Server) targetRole(w http.ResponseWriter, roomID, userID int) (string, bool) {
+	role, err := chat.MemberRole(s.DB, roomID, userID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching room role")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+	if role == "" {
+		http.Error(w, "User is not a member of this room", http.StatusNotFound)
+		return "", false
+	}
+	return role, true
+}
+
+// AddMemberHandler serves POST /rooms/{id}/members {"user_id": ...}, adding
+// another user to the room. It needs the invite permission.
+func (s *Server) AddMemberHandler(w http.ResponseWriter, r *http.Request, roomID int) {
+	userID := r.Context().Value("userId").(int)
+
+	var req struct {
+		UserID int `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	if !chat.Can(role, chat.PermInvite) {
+		http.Error(w, "Your role in this room does not allow inviting", http.StatusForbidden)
+		return
+	}
+
+	err := chat.AddToChatRoom(s.DB, roomID, req.UserID, userID)
+	switch {
+	case errors.Is(err, chat.ErrRoomNotFound):
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	case errors.Is(err, chat.ErrUserNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	case errors.Is(err, chat.ErrAlreadyMember):
+		http.Error(w, "User is already a member of this room", http.StatusConflict)
+		return
+	case errors.Is(err, chat.ErrBanned):
+		http.Error(w, "User is banned from this room", http.StatusForbidden)
+		return
+	case errors.Is(err, chat.ErrRoomArchived):
+		http.Error(w, "Room is archived", http.StatusForbidden)
+		return
+	case err != nil:
+		utils.Log.WithError(err).Error("Error adding room member")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("User added to chat room successfully")
+}
+
+// KickMemberHandler serves DELETE /rooms/{id}/members/{user_id}?reason=. It
+// needs the kick permission and a role above the target's.
+func (s *Server) KickMemberHandler(w http.ResponseWriter, r *http.Request, roomID, targetID int) {
+	userID := r.Context().Value("userId").(int)
+
+	reason, err := chat.ValidReason(r.URL.Query().Get("reason"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	target, ok := s.targetRole(w, roomID, targetID)
+	if !ok {
+		return
+	}
+	if !chat.Can(role, chat.PermKick) || !chat.Outranks(role, target) {
+		http.Error(w, "Your role in this room does not allow kicking this member", http.StatusForbidden)
+		return
+	}
+
+	err = chat.KickFromChatRoom(s.DB, roomID, targetID, userID, reason)
+	if errors.Is(err, chat.ErrNotMember) {
+		http.Error(w, "User is not a member of this room", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error kicking room member")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.Kicked(roomID, targetID, userID, reason)
+
+	utils.Log.WithField("roomID", roomID).WithField("userID", targetID).WithField("actorID", userID).Info("Kicked room member")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("User kicked from chat room successfully")
+}
+
+// SetRoleHandler serves PUT /rooms/{id}/members/{user_id}/role {"role": ...}
+func (s *Server) SetRoleHandler(w http.ResponseWriter, r *http.Request, roomID, targetID int) {
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !chat.ValidRole(req.Role) {
+		http.Error(w, "role must be owner, admin, moderator, member or read-only", http.StatusBadRequest)
+		return
+	}
+	s.changeRole(w, r, roomID, targetID, req.Role)
+}
+
+// RevokeRoleHandler serves DELETE /rooms/{id}/members/{user_id}/role, making
+// the member a plain member again
+func (s *Server) RevokeRoleHandler(w http.ResponseWriter, r *http.Request, roomID, targetID int) {
+	s.changeRole(w, r, roomID, targetID, models.RoleMember)
+}
+
+func (s *Server) changeRole(w http.ResponseWriter, r *http.Request, roomID, targetID int, newRole string) {
+	userID := r.Context().Value("userId").(int)
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	target, ok := s.targetRole(w, roomID, targetID)
+	if !ok {
+		return
+	}
+	if !chat.CanAssign(role, target, newRole) {
+		http.Error(w, "Your role in this room does not allow this role change", http.StatusForbidden)
+		return
+	}
+
+	err := chat.SetMemberRole(s.DB, roomID, targetID, newRole)
+	if errors.Is(err, chat.ErrLastOwner) {
+		http.Error(w, "The room's last owner cannot give up ownership", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, chat.ErrNotMember) {
+		http.Error(w, "User is not a member of this room", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error changing room role")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.RoleChanged(roomID, targetID, newRole)
+
+	utils.Log.WithField("roomID", roomID).WithField("userID", targetID).WithField("role", newRole).Info("Changed room role")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Role changed successfully")
+}
+
+// TransferOwnershipHandler serves POST /rooms/{id}/transfer-ownership
+// {"user_id": ...}, making a member an owner and the caller an admin. Only
+// owners may hand a room over.
+func (s *Server) TransferOwnershipHandler(w http.ResponseWriter, r *http.Request, roomID int) {
+	userID := r.Context().Value("userId").(int)
+
+	var req struct {
+		UserID int `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	role, ok := s.roomRole(w, roomID, userID)
+	if !ok {
+		return
+	}
+	if role != models.RoleOwner {
+		http.Error(w, "Only owners can transfer ownership of a room", http.StatusForbidden)
+		return
+	}
+
+	demoted, err := chat.TransferOwnership(s.DB, roomID, userID, req.UserID)
+	if errors.Is(err, chat.ErrSelf) {
+		http.Error(w, "You already own this room", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, chat.ErrNotMember) {
+		http.Error(w, "User is not a member of this room", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error transferring room ownership")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.RoleChanged(roomID, req.UserID, models.RoleOwner)
+	if demoted {
+		websocket.RoleChanged(roomID, userID, models.RoleAdmin)
+	}
+
+	utils.Log.WithField("roomID", roomID).WithField("userID", req.UserID).WithField("actorID", userID).Info("Transferred room ownership")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Ownership transferred successfully")
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"chat-app/internal/chat"
+	"chat-app/internal/database/databasetest"
+	"chat-app/pkg/models"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestChangeRole(t *testing.T) {
+	s := &Server{DB: newTestDB(t)}
+	owner := databasetest.NewUser(t, s.DB, "olivia")
+	admin := databasetest.NewUser(t, s.DB, "adam")
+	member := databasetest.NewUser(t, s.DB, "mia")
+	outsider := databasetest.NewUser(t, s.DB, "oscar")
+	serverAdmin := databasetest.NewUser(t, s.DB, "root")
+	if _, err := s.DB.Exec("UPDATE users SET is_admin = 1 WHERE id = ?", serverAdmin); err != nil {
+		t.Fatal(err)
+	}
+	room := models.ChatRoom{Name: "room", CreatorID: owner, Visibility: models.VisibilityPublic, HistoryVisibility: models.HistoryShared}
+	if err := chat.CreateChatRoom(s.DB, &room); err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []int{admin, member} {
+		if err := chat.JoinChatRoom(s.DB, room.ID, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := chat.SetMemberRole(s.DB, room.ID, admin, models.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		actor  int
+		target int
+		role   string
+		status int
+	}{
+		{"not a role", owner, member, "god", http.StatusBadRequest},
+		{"admin grants owner", admin, member, models.RoleOwner, http.StatusForbidden},
+		{"admin grants admin", admin, member, models.RoleAdmin, http.StatusForbidden},
+		{"admin demotes owner", admin, owner, models.RoleMember, http.StatusForbidden},
+		{"member grants moderator", member, member, models.RoleModerator, http.StatusForbidden},
+		{"outsider", outsider, member, models.RoleModerator, http.StatusForbidden},
+		{"target is not a member", owner, outsider, models.RoleModerator, http.StatusNotFound},
+		{"last owner steps down", owner, owner, models.RoleAdmin, http.StatusConflict},
+		{"admin grants moderator", admin, member, models.RoleModerator, http.StatusOK},
+		{"server admin grants read-only", serverAdmin, member, models.RoleReadOnly, http.StatusOK},
+		{"owner grants owner", owner, member, models.RoleOwner, http.StatusOK},
+		{"first owner steps down", owner, owner, models.RoleAdmin, http.StatusOK},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/rooms/"+strconv.Itoa(room.ID)+"/members/"+strconv.Itoa(test.target)+"/role",
+			strings.NewReader(`{"role": "`+test.role+`"}`))
+		s.SetRoleHandler(w, asUser(r, test.actor), room.ID, test.target)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d %s, want %d", test.name, w.Code, strings.TrimSpace(w.Body.String()), test.status)
+		}
+	}
+
+	for userID, want := range map[int]string{owner: models.RoleAdmin, admin: models.RoleAdmin, member: models.RoleOwner} {
+		if role, err := chat.MemberRole(s.DB, room.ID, userID); err != nil || role != want {
+			t.Errorf("user %d: got %q %v, want %q", userID, role, err, want)
+		}
+	}
+}
+
+func TestTransferOwnershipHandler(t *testing.T) {
+	s := &Server{DB: newTestDB(t)}
+	owner := databasetest.NewUser(t, s.DB, "olivia")
+	admin := databasetest.NewUser(t, s.DB, "adam")
+	room := models.ChatRoom{Name: "room", CreatorID: owner, Visibility: models.VisibilityPublic, HistoryVisibility: models.HistoryShared}
+	if err := chat.CreateChatRoom(s.DB, &room); err != nil {
+		t.Fatal(err)
+	}
+	if err := chat.JoinChatRoom(s.DB, room.ID, admin); err != nil {
+		t.Fatal(err)
+	}
+	if err := chat.SetMemberRole(s.DB, room.ID, admin, models.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	transfer := func(actor, to int) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/rooms/"+strconv.Itoa(room.ID)+"/transfer-ownership",
+			strings.NewReader(`{"user_id": `+strconv.Itoa(to)+`}`))
+		s.TransferOwnershipHandler(w, asUser(r, actor), room.ID)
+		return w.Code
+	}
+	if code := transfer(admin, admin); code != http.StatusForbidden {
+		t.Errorf("admin takes the room: got %d, want 403", code)
+	}
+	if code := transfer(owner, admin); code != http.StatusOK {
+		t.Fatalf("owner hands the room over: got %d", code)
+	}
+	if role, _ := chat.MemberRole(s.DB, room.ID, owner); role != models.RoleAdmin {
+		t.Errorf("previous owner is now %q, want admin", role)
+	}
+	if code := transfer(owner, admin); code != http.StatusForbidden {
+		t.Errorf("previous owner hands the room over again: got %d, want 403", code)
+	}
+}
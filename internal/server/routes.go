@@ -0,0 +1,262 @@
+package server
+
+import (
+	"chat-app/internal/auth"
+	"chat-app/pkg/models"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// pathSegments splits what follows prefix in path, so that /rooms/5/messages
+// with the prefix /rooms/ yields ["5", "messages"]
+func pathSegments(path, prefix string) []string {
+	rest := strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if rest == "" {
+		return nil
+	}
+	return strings.Split(rest, "/")
+}
+
+// queryInt reads an integer query parameter, falling back to def when it is
+// missing. ok is false if the parameter is present but not a number.
+func queryInt(r *http.Request, name string, def int) (int, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// queryBool reads a boolean query parameter, which is false when missing. ok
+// is false if the parameter is present but not a boolean.
+func queryBool(r *http.Request, name string) (value, ok bool) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return false, true
+	}
+	value, err := strconv.ParseBool(raw)
+	return value, err == nil
+}
+
+// pathID parses an ID taken from a path segment, writing a 400 naming what
+// it identifies if it is not a number
+func pathID(w http.ResponseWriter, segment, what string) (int, bool) {
+	id, err := strconv.Atoi(segment)
+	if err != nil {
+		http.Error(w, "Invalid "+what+" ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// clientIP returns the address a request came from, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RoomRoutes serves GET /rooms and the /rooms/{id}/... endpoints
+func (s *Server) RoomRoutes(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r.URL.Path, "/rooms")
+	if len(parts) == 0 && r.Method == http.MethodGet {
+		s.RoomDirectoryHandler(w, r)
+		return
+	}
+	if len(parts) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	roomID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodGet && auth.ViaAPIToken(r.Context()) {
+		http.Error(w, "API token does not allow this", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodPatch:
+		s.UpdateRoomHandler(w, r, roomID)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.DeleteRoomHandler(w, r, roomID)
+	case len(parts) == 2 && parts[1] == "messages" && r.Method == http.MethodGet:
+		s.RoomHistoryHandler(w, r, roomID)
+	case len(parts) == 2 && parts[1] == "membership-log" && r.Method == http.MethodGet:
+		s.MembershipLogHandler(w, r, roomID)
+	case len(parts) == 2 && parts[1] == "members" && r.Method == http.MethodGet:
+		s.MembersAtHandler(w, r, roomID)
+	case len(parts) == 2 && parts[1] == "members" && r.Method == http.MethodPost:
+		s.AddMemberHandler(w, r, roomID)
+	case len(parts) == 2 && parts[1] == "archive" && r.Method == http.MethodPut:
+		s.ArchiveRoomHandler(w, r, roomID, true)
+	case len(parts) == 2 && parts[1] == "archive" && r.Method == http.MethodDelete:
+		s.ArchiveRoomHandler(w, r, roomID, false)
+	case len(parts) == 2 && parts[1] == "transfer-ownership" && r.Method == http.MethodPost:
+		s.TransferOwnershipHandler(w, r, roomID)
+	case len(parts) == 2 && parts[1] == "visibility" && r.Method == http.MethodPut:
+		s.SetVisibilityHandler(w, r, roomID)
+	case len(parts) == 2 && parts[1] == "invites" && r.Method == http.MethodPost:
+		s.InviteHandler(w, r, roomID)
+	case len(parts) == 2 && parts[1] == "invite-codes" && r.Method == http.MethodGet:
+		s.ListInviteCodesHandler(w, r, roomID)
+	case len(parts) == 2 && parts[1] == "invite-codes" && r.Method == http.MethodPost:
+		s.CreateInviteCodeHandler(w, r, roomID)
+	case len(parts) == 3 && parts[1] == "invite-codes" && r.Method == http.MethodDelete:
+		s.RevokeInviteCodeHandler(w, r, roomID, parts[2])
+	case len(parts) == 2 && parts[1] == "moderation-log" && r.Method == http.MethodGet:
+		s.ModerationLogHandler(w, r, roomID)
+	case len(parts) == 2 && parts[1] == "bans" && r.Method == http.MethodGet:
+		s.SanctionsHandler(w, r, roomID, models.SanctionBan)
+	case len(parts) == 2 && parts[1] == "mutes" && r.Method == http.MethodGet:
+		s.SanctionsHandler(w, r, roomID, models.SanctionMute)
+	case len(parts) == 3 && parts[1] == "bans" && r.Method == http.MethodPut:
+		if targetID, ok := pathID(w, parts[2], "user"); ok {
+			s.BanHandler(w, r, roomID, targetID)
+		}
+	case len(parts) == 3 && parts[1] == "bans" && r.Method == http.MethodDelete:
+		if targetID, ok := pathID(w, parts[2], "user"); ok {
+			s.UnbanHandler(w, r, roomID, targetID)
+		}
+	case len(parts) == 3 && parts[1] == "mutes" && r.Method == http.MethodPut:
+		if targetID, ok := pathID(w, parts[2], "user"); ok {
+			s.MuteHandler(w, r, roomID, targetID)
+		}
+	case len(parts) == 3 && parts[1] == "mutes" && r.Method == http.MethodDelete:
+		if targetID, ok := pathID(w, parts[2], "user"); ok {
+			s.UnmuteHandler(w, r, roomID, targetID)
+		}
+	case len(parts) == 2 && parts[1] == "join-requests" && r.Method == http.MethodGet:
+		s.JoinRequestsHandler(w, r, roomID)
+	case len(parts) == 3 && parts[1] == "join-requests" && r.Method == http.MethodDelete:
+		if targetID, ok := pathID(w, parts[2], "user"); ok {
+			s.AnswerJoinRequestHandler(w, r, roomID, targetID, false)
+		}
+	case len(parts) == 4 && parts[1] == "join-requests" && parts[3] == "approve" && r.Method == http.MethodPost:
+		if targetID, ok := pathID(w, parts[2], "user"); ok {
+			s.AnswerJoinRequestHandler(w, r, roomID, targetID, true)
+		}
+	case len(parts) == 3 && parts[1] == "messages" && r.Method == http.MethodPatch:
+		if messageID, ok := pathID(w, parts[2], "message"); ok {
+			s.EditMessageHandler(w, r, roomID, messageID)
+		}
+	case len(parts) == 3 && parts[1] == "members" && r.Method == http.MethodDelete:
+		if targetID, ok := pathID(w, parts[2], "user"); ok {
+			s.KickMemberHandler(w, r, roomID, targetID)
+		}
+	case len(parts) == 4 && parts[1] == "members" && parts[3] == "role" && r.Method == http.MethodPut:
+		if targetID, ok := pathID(w, parts[2], "user"); ok {
+			s.SetRoleHandler(w, r, roomID, targetID)
+		}
+	case len(parts) == 4 && parts[1] == "members" && parts[3] == "role" && r.Method == http.MethodDelete:
+		if targetID, ok := pathID(w, parts[2], "user"); ok {
+			s.RevokeRoleHandler(w, r, roomID, targetID)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// DMRoutes serves the /dms/{user_id}/... endpoints
+func (s *Server) DMRoutes(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r.URL.Path, "/dms/")
+	if len(parts) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	otherID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && parts[1] == "messages" && r.Method == http.MethodGet:
+		s.DirectHistoryHandler(w, r, otherID)
+	case len(parts) == 2 && parts[1] == "messages" && r.Method == http.MethodPost:
+		s.SendDirectMessageHandler(w, r, otherID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// UserRoutes serves the /users/... endpoints
+func (s *Server) UserRoutes(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r.URL.Path, "/users/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "me" && r.Method == http.MethodGet:
+		s.OwnProfileHandler(w, r)
+	case len(parts) == 1 && parts[0] == "me" && r.Method == http.MethodPatch:
+		s.UpdateProfileHandler(w, r)
+	case len(parts) == 1 && parts[0] == "me" && r.Method == http.MethodDelete:
+		s.DeleteAccountHandler(w, r)
+	case len(parts) == 2 && parts[0] == "me" && parts[1] == "export" && r.Method == http.MethodGet:
+		s.ExportAccountHandler(w, r)
+	case len(parts) == 2 && parts[0] == "me" && parts[1] == "avatar" && r.Method == http.MethodPut:
+		s.SetAvatarHandler(w, r)
+	case len(parts) == 2 && parts[0] == "me" && parts[1] == "avatar" && r.Method == http.MethodDelete:
+		s.RemoveAvatarHandler(w, r)
+	case len(parts) == 2 && parts[0] == "me" && parts[1] == "email" && r.Method == http.MethodPut:
+		s.SetEmailHandler(w, r)
+	case len(parts) == 2 && parts[0] == "me" && parts[1] == "blocks" && r.Method == http.MethodGet:
+		s.ListBlocksHandler(w, r)
+	case len(parts) == 3 && parts[0] == "me" && parts[1] == "blocks":
+		if otherID, ok := pathID(w, parts[2], "user"); ok {
+			s.BlockHandler(w, r, otherID)
+		}
+	case len(parts) == 2 && parts[0] == "me" && parts[1] == "invites" && r.Method == http.MethodGet:
+		s.InvitationsHandler(w, r)
+	case len(parts) == 3 && parts[0] == "me" && parts[1] == "invites" && r.Method == http.MethodDelete:
+		if roomID, ok := pathID(w, parts[2], "room"); ok {
+			s.DeclineInvitationHandler(w, r, roomID)
+		}
+	case len(parts) == 2 && parts[0] == "me" && parts[1] == "join-requests" && r.Method == http.MethodGet:
+		s.OwnJoinRequestsHandler(w, r)
+	case len(parts) == 3 && parts[0] == "me" && parts[1] == "join-requests" && r.Method == http.MethodDelete:
+		if roomID, ok := pathID(w, parts[2], "room"); ok {
+			s.WithdrawJoinRequestHandler(w, r, roomID)
+		}
+	case len(parts) == 2 && parts[0] == "me" && parts[1] == "contacts" && r.Method == http.MethodGet:
+		s.ListContactsHandler(w, r)
+	case len(parts) == 3 && parts[0] == "me" && parts[1] == "contacts":
+		if otherID, ok := pathID(w, parts[2], "user"); ok {
+			s.ContactHandler(w, r, otherID)
+		}
+	case len(parts) == 3 && parts[0] == "me" && parts[1] == "2fa" && r.Method == http.MethodPost:
+		switch parts[2] {
+		case "enroll":
+			s.EnrollTwoFactorHandler(w, r)
+		case "verify":
+			s.VerifyTwoFactorHandler(w, r)
+		case "disable":
+			s.DisableTwoFactorHandler(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	case len(parts) == 1 && parts[0] != "me" && r.Method == http.MethodGet:
+		userID, ok := pathID(w, parts[0], "user")
+		if !ok {
+			return
+		}
+		s.ProfileHandler(w, r, userID)
+	case len(parts) == 2 && parts[0] != "me" && parts[1] == "avatar" && r.Method == http.MethodGet:
+		userID, ok := pathID(w, parts[0], "user")
+		if !ok {
+			return
+		}
+		s.AvatarHandler(w, r, userID)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"chat-app/internal/audit"
+	"chat-app/internal/auth"
+	"chat-app/internal/websocket"
+	"chat-app/pkg/utils"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// requestDevice describes the client making r for the session it starts.
+// name and version are what the client says about itself; without a name,
+// its User-Agent is used.
+func requestDevice(r *http.Request, name, version string) auth.Device {
+	if name == "" {
+		name = r.UserAgent()
+	}
+	return auth.Device{Name: name, ClientVersion: version, IP: clientIP(r)}
+}
+
+// RefreshTokenHandler serves POST /token/refresh, exchanging a refresh token
+// for a new access token and refresh token
+func (s *Server) RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, sessionID, err := auth.RefreshSession(s.DB, req.RefreshToken, clientIP(r))
+	if err == auth.ErrRefreshTokenReused {
+		utils.Log.WithField("sessionID", sessionID).Warn("Refresh token reused, session revoked")
+		websocket.CloseSession(sessionID)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err == auth.ErrInvalidRefreshToken {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error refreshing session")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(token)
+}
+
+// LogoutHandler serves POST /logout, revoking the session of the access
+// token it is called with and closing that session's WebSocket connection
+func (s *Server) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := r.Context().Value("sessionId").(int)
+
+	err := auth.RevokeSession(s.DB, sessionID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error revoking session")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.CloseSession(sessionID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Logged out successfully")
+}
+
+// SessionRoutes serves /sessions and /sessions/{id}, where users see and end
+// the sessions of their account
+func (s *Server) SessionRoutes(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r.URL.Path, "/sessions")
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		s.ListSessionsHandler(w, r)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		sessionID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "Invalid session ID", http.StatusBadRequest)
+			return
+		}
+		s.RevokeSessionHandler(w, r, sessionID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// ListSessionsHandler serves GET /sessions, the caller's active sessions
+// with the device each was started on, marking the caller's own and those
+// with a WebSocket connection open
+func (s *Server) ListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+	sessionID := r.Context().Value("sessionId").(int)
+
+	sessions, err := auth.ListSessions(s.DB, userID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching sessions")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	connected := websocket.ConnectedSessions(userID)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == sessionID
+		sessions[i].Connected = connected[sessions[i].ID]
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// RevokeSessionHandler serves DELETE /sessions/{id}, logging one of the
+// caller's sessions out and closing its WebSocket connections
+func (s *Server) RevokeSessionHandler(w http.ResponseWriter, r *http.Request, sessionID int) {
+	userID := r.Context().Value("userId").(int)
+
+	err := auth.RevokeUserSession(s.DB, userID, sessionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error revoking session")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	websocket.CloseSession(sessionID)
+	if err := audit.Record(s.DB, audit.SessionRevoked, userID, clientIP(r), fmt.Sprintf("session %d", sessionID)); err != nil {
+		utils.Log.WithError(err).Error("Error writing audit log")
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Session revoked successfully")
+}
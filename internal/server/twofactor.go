@@ -0,0 +1,189 @@
+package server
+
+import (
+	"chat-app/internal/audit"
+	"chat-app/internal/auth"
+	"chat-app/pkg/utils"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type codeRequest struct {
+	Code string `json:"code"`
+}
+
+// LoginSecondFactorHandler serves POST /login/2fa {"challenge": ..., "code":
+// ...}, the second step of logging in with two-factor authentication. code
+// is a TOTP code or a recovery code.
+func (s *Server) LoginSecondFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, err := auth.CompleteLogin(s.DB, req.Challenge, req.Code, clientIP(r))
+	var locked *auth.LockedError
+	if errors.As(err, &locked) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(locked.Until).Seconds())+1))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err == auth.ErrInvalidChallenge || err == auth.ErrInvalidCode {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error completing login")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(token)
+}
+
+// EnrollTwoFactorHandler serves POST /users/me/2fa/enroll, returning a new
+// TOTP secret to add to an authenticator app. It takes effect once confirmed
+// with VerifyTwoFactorHandler.
+func (s *Server) EnrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+	username := r.Context().Value("username").(string)
+
+	enrollment, err := auth.EnrollTOTP(s.DB, userID, username)
+	if err == auth.ErrTOTPEnabled {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error enrolling TOTP")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+// VerifyTwoFactorHandler serves POST /users/me/2fa/verify {"code": ...},
+// enabling two-factor authentication and returning the recovery codes
+func (s *Server) VerifyTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+
+	var req codeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	codes, err := auth.ConfirmTOTP(s.DB, userID, req.Code)
+	switch {
+	case err == auth.ErrTOTPNotEnrolled:
+		http.Error(w, "Enroll an authenticator first", http.StatusConflict)
+		return
+	case err == auth.ErrTOTPEnabled:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err == auth.ErrInvalidCode:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		utils.Log.WithError(err).Error("Error confirming TOTP")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := audit.Record(s.DB, audit.TwoFactorEnabled, userID, clientIP(r), ""); err != nil {
+		utils.Log.WithError(err).Error("Error writing audit log")
+	}
+
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// DisableTwoFactorHandler serves POST /users/me/2fa/disable {"code": ...},
+// which takes a current TOTP code or a recovery code
+func (s *Server) DisableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userId").(int)
+
+	var req codeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := auth.DisableTOTP(s.DB, userID, req.Code)
+	switch {
+	case err == auth.ErrTOTPNotEnrolled:
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	case err == auth.ErrInvalidCode:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		utils.Log.WithError(err).Error("Error disabling TOTP")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := audit.Record(s.DB, audit.TwoFactorDisabled, userID, clientIP(r), ""); err != nil {
+		utils.Log.WithError(err).Error("Error writing audit log")
+	}
+
+	json.NewEncoder(w).Encode("Two-factor authentication disabled")
+}
+
+// ResetTwoFactorHandler serves POST /admin/reset-2fa {"username": ...},
+// turning two-factor authentication off for a user who has lost their
+// authenticator and recovery codes
+func (s *Server) ResetTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	adminID := r.Context().Value("userId").(int)
+
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.Log.WithError(err).Error("Error decoding request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	err := s.DB.QueryRow("SELECT id FROM users WHERE username = ?", req.Username).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching user ID")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := auth.ResetTOTP(s.DB, userID); err != nil {
+		utils.Log.WithError(err).Error("Error resetting TOTP")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	detail := "reset by admin " + strconv.Itoa(adminID)
+	if err := audit.Record(s.DB, audit.TwoFactorReset, userID, clientIP(r), detail); err != nil {
+		utils.Log.WithError(err).Error("Error writing audit log")
+	}
+
+	utils.Log.WithField("userID", userID).WithField("adminID", adminID).Info("Reset two-factor authentication")
+	json.NewEncoder(w).Encode("Two-factor authentication reset")
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"chat-app/internal/auth"
+	"chat-app/internal/websocket"
+	"chat-app/pkg/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ticketProtocolPrefix marks the subprotocol that carries a ticket, as in
+// new WebSocket(url, ["ticket." + ticket]) in a browser
+const ticketProtocolPrefix = "ticket."
+
+// WebSocketTicketHandler serves POST /ws-ticket, issuing a single-use ticket
+// for opening a WebSocket connection with the caller's session
+func (s *Server) WebSocketTicketHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ticket, err := auth.IssueTicket(&auth.Claims{
+		UserId:    r.Context().Value("userId").(int),
+		Username:  r.Context().Value("username").(string),
+		SessionID: r.Context().Value("sessionId").(int),
+	})
+	if err != nil {
+		utils.Log.WithError(err).Error("Error issuing WebSocket ticket")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ticket":     ticket,
+		"expires_in": int(auth.TicketTTL.Seconds()),
+	})
+}
+
+// WebSocketHandler serves /ws. The connection is authenticated with a ticket
+// from /ws-ticket, passed as the ticket query parameter or as a
+// "ticket.<ticket>" subprotocol, or with an access token or API token in the
+// Authorization header.
+func (s *Server) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	claims, protocol, err := webSocketCredentials(r)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// a browser drops the connection unless the server picks one of the
+	// subprotocols it offered
+	var header http.Header
+	if protocol != "" {
+		header = http.Header{"Sec-Websocket-Protocol": {protocol}}
+	}
+	websocket.HandleConnections(w, r, s.DB, claims, header)
+}
+
+// webSocketCredentials authenticates a WebSocket upgrade request. protocol is
+// the subprotocol the ticket came in, if it came in one.
+func webSocketCredentials(r *http.Request) (claims *auth.Claims, protocol string, err error) {
+	if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+		claims, err = auth.RedeemTicket(ticket)
+		return claims, "", err
+	}
+
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, offered := range strings.Split(value, ",") {
+			offered = strings.TrimSpace(offered)
+			if ticket, ok := strings.CutPrefix(offered, ticketProtocolPrefix); ok {
+				claims, err = auth.RedeemTicket(ticket)
+				return claims, offered, err
+			}
+		}
+	}
+
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, "", errors.New("missing ticket or authorization header")
+	}
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || token == "" {
+		return nil, "", errors.New("malformed authorization header")
+	}
+	claims, err = auth.Authenticate(token)
+	return claims, "", err
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"chat-app/internal/auth"
+	"chat-app/internal/database/databasetest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketCredentials(t *testing.T) {
+	s := &Server{DB: newTestDB(t)}
+	userID := databasetest.NewUser(t, s.DB, "alice")
+	token, err := auth.CreateSession(s.DB, userID, "alice", auth.Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := auth.ValidateJWT(token.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(s.WebSocketHandler))
+	t.Cleanup(ts.Close)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	newTicket := func() string {
+		ticket, err := auth.IssueTicket(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ticket
+	}
+	used := newTicket()
+	if _, err := auth.RedeemTicket(used); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("ticket subprotocol is echoed", func(t *testing.T) {
+		protocol := "ticket." + newTicket()
+		conn, resp, err := (&websocket.Dialer{Subprotocols: []string{"chat", protocol}}).Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if conn.Subprotocol() != protocol || resp.Header.Get("Sec-WebSocket-Protocol") != protocol {
+			t.Errorf("got subprotocol %q, want %q", conn.Subprotocol(), protocol)
+		}
+	})
+
+	accepted := []struct {
+		name   string
+		query  string
+		header http.Header
+	}{
+		{"ticket parameter", "?ticket=" + newTicket(), nil},
+		{"access token", "", http.Header{"Authorization": {"Bearer " + token.Token}}},
+	}
+	for _, test := range accepted {
+		t.Run(test.name, func(t *testing.T) {
+			conn, _, err := websocket.DefaultDialer.Dial(url+test.query, test.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if conn.Subprotocol() != "" {
+				t.Errorf("got subprotocol %q", conn.Subprotocol())
+			}
+		})
+	}
+
+	// refusals are plain 401s before any upgrade
+	refused := []struct {
+		name   string
+		query  string
+		header map[string]string
+	}{
+		{"nothing", "", nil},
+		{"used ticket", "?ticket=" + used, nil},
+		{"used ticket subprotocol", "", map[string]string{"Sec-WebSocket-Protocol": "ticket." + used}},
+		{"made up ticket", "?ticket=nope", nil},
+		{"basic authorization", "", map[string]string{"Authorization": "Basic YWxpY2U6c2VjcmV0"}},
+		{"bearer without a token", "", map[string]string{"Authorization": "Bearer "}},
+		{"bearer without a space", "", map[string]string{"Authorization": "Bearer" + token.Token}},
+		{"token without bearer", "", map[string]string{"Authorization": token.Token}},
+		{"garbage token", "", map[string]string{"Authorization": "Bearer not.a.jwt"}},
+	}
+	for _, test := range refused {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/ws"+test.query, nil)
+			for key, value := range test.header {
+				r.Header.Set(key, value)
+			}
+			s.WebSocketHandler(w, r)
+			if w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Body.String(), "Unauthorized: ") {
+				t.Errorf("got %d %s, want a 401", w.Code, strings.TrimSpace(w.Body.String()))
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package transfer
+
+import (
+	"chat-app/internal/archive"
+	"chat-app/internal/encryption"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// FormatVersion is written into every room header so that importers can
+// reject exports they do not understand
+const FormatVersion = 1
+
+type roomRecord struct {
+	Type       string    `json:"type"`
+	Version    int       `json:"version"`
+	Origin     string    `json:"origin"`
+	Name       string    `json:"name"`
+	Creator    string    `json:"creator,omitempty"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+type memberRecord struct {
+	Type     string     `json:"type"`
+	Username string     `json:"username"`
+	JoinedAt *time.Time `json:"joined_at,omitempty"`
+	Role     string     `json:"role,omitempty"`
+}
+
+type messageRecord struct {
+	Type      string    `json:"type"`
+	Origin    string    `json:"origin"`
+	Sender    string    `json:"sender,omitempty"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ExportRoom writes the room's metadata, members and message history to w
+// as NDJSON: one room record, then one record per member, then one record
+// per message in ID order. Message content is written decrypted.
+func ExportRoom(db *sql.DB, roomID int, w io.Writer) error {
+	instance, err := instanceID(db)
+	if err != nil {
+		return err
+	}
+
+	room := roomRecord{Type: "room", Version: FormatVersion, ExportedAt: time.Now().UTC()}
+	var creator, origin sql.NullString
+	row := db.QueryRow(`SELECT chat_rooms.name, users.username, import_map.origin
+		FROM chat_rooms
+		LEFT JOIN users ON users.id = chat_rooms.creator_id
+		LEFT JOIN import_map ON import_map.kind = 'room' AND import_map.local_id = chat_rooms.id
+		WHERE chat_rooms.id = ?`, roomID)
+	err = row.Scan(&room.Name, &creator, &origin)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("room %d not found", roomID)
+		}
+		return err
+	}
+	room.Creator = creator.String
+	room.Origin = originOf(origin, instance, roomID)
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(room); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`SELECT users.username, room_users.joined_at, room_users.role FROM users
+		JOIN room_users ON users.id = room_users.user_id
+		WHERE room_users.room_id = ? ORDER BY users.id`, roomID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		member := memberRecord{Type: "member"}
+		var joinedAt sql.NullTime
+		if err := rows.Scan(&member.Username, &joinedAt, &member.Role); err != nil {
+			return err
+		}
+		if joinedAt.Valid {
+			member.JoinedAt = &joinedAt.Time
+		}
+		if err := enc.Encode(member); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if err := exportArchived(db, roomID, instance, enc); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(`SELECT messages.id, users.username, messages.content, messages.timestamp, import_map.origin, data_keys.wrapped_key
+		FROM messages
+		LEFT JOIN users ON users.id = messages.sender_id
+		LEFT JOIN import_map ON import_map.kind = 'message' AND import_map.local_id = messages.id
+		LEFT JOIN data_keys ON data_keys.id = messages.key_id
+		WHERE messages.room_id = ? ORDER BY messages.id`, roomID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var sender, origin sql.NullString
+		var wrapped []byte
+		message := messageRecord{Type: "message"}
+		if err := rows.Scan(&id, &sender, &message.Content, &message.Timestamp, &origin, &wrapped); err != nil {
+			return err
+		}
+		message.Content, err = encryption.Default.Decrypt(wrapped, message.Content)
+		if err != nil {
+			return fmt.Errorf("message %d: %w", id, err)
+		}
+		message.Sender = sender.String
+		message.Origin = originOf(origin, instance, id)
+		if err := enc.Encode(message); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// exportArchived writes the messages of a room that were moved to archive
+// segments. They are older than what is left in the messages table.
+func exportArchived(db *sql.DB, roomID int, instance string, enc *json.Encoder) error {
+	segments, err := archive.RoomSegments(db, roomID, 0)
+	if err != nil {
+		return err
+	}
+
+	usernames := map[int]string{}
+	keys := map[int64][]byte{}
+	for i := len(segments) - 1; i >= 0; i-- {
+		records, err := segments[i].Read(nil)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			var origin sql.NullString
+			err := db.QueryRow("SELECT origin FROM import_map WHERE kind = 'message' AND local_id = ?", record.ID).Scan(&origin)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+
+			sender, ok := usernames[record.SenderID]
+			if !ok && record.SenderID != 0 {
+				err := db.QueryRow("SELECT username FROM users WHERE id = ?", record.SenderID).Scan(&sender)
+				if err != nil && err != sql.ErrNoRows {
+					return err
+				}
+				usernames[record.SenderID] = sender
+			}
+
+			wrapped, ok := keys[record.KeyID]
+			if !ok && record.KeyID != 0 {
+				err := db.QueryRow("SELECT wrapped_key FROM data_keys WHERE id = ?", record.KeyID).Scan(&wrapped)
+				if err != nil {
+					return err
+				}
+				keys[record.KeyID] = wrapped
+			}
+			content, err := encryption.Default.Decrypt(wrapped, record.Content)
+			if err != nil {
+				return fmt.Errorf("message %d: %w", record.ID, err)
+			}
+
+			err = enc.Encode(messageRecord{
+				Type:      "message",
+				Origin:    originOf(origin, instance, record.ID),
+				Sender:    sender,
+				Content:   content,
+				Timestamp: record.Timestamp,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// originOf returns the stable identity of a row: where it was first created,
+// which survives any number of export/import hops between instances
+func originOf(imported sql.NullString, instance string, localID int) string {
+	if imported.Valid {
+		return imported.String
+	}
+	return fmt.Sprintf("%s:%d", instance, localID)
+}
+
+// instanceID returns the random identifier of this server's database,
+// generating it on first use
+func instanceID(db *sql.DB) (string, error) {
+	var id string
+	err := db.QueryRow("SELECT value FROM server_meta WHERE key = 'instance_id'").Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	_, err = db.Exec("INSERT OR IGNORE INTO server_meta (key, value) VALUES ('instance_id', ?)", hex.EncodeToString(buf))
+	if err != nil {
+		return "", err
+	}
+	err = db.QueryRow("SELECT value FROM server_meta WHERE key = 'instance_id'").Scan(&id)
+	return id, err
+}
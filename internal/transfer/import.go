@@ -0,0 +1,335 @@
+package transfer
+
+import (
+	"chat-app/internal/archive"
+	"chat-app/internal/auth"
+	"chat-app/internal/chat"
+	"chat-app/internal/encryption"
+	"chat-app/pkg/models"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// placeholderHash is stored for users created by an import. It is not a valid
+// bcrypt hash, so nobody can log in as them until an admin sets a password.
+const placeholderHash = "!imported"
+
+// ImportResult summarises what ImportRoom changed
+type ImportResult struct {
+	RoomID          int  `json:"room_id"`
+	RoomCreated     bool `json:"room_created"`
+	UsersCreated    int  `json:"users_created"`
+	MembersAdded    int  `json:"members_added"`
+	MessagesAdded   int  `json:"messages_added"`
+	MessagesSkipped int  `json:"messages_skipped"`
+}
+
+// ImportRoom reads an export produced by ExportRoom and recreates it in db.
+// Users are matched by username and created if missing, and room and message
+// IDs are remapped. Usernames of deleted accounts still in their cooldown
+// are not recreated: their messages are imported without a sender. Importing the same export twice, or an export of a room
+// that itself came from this instance, only adds messages not yet present.
+func ImportRoom(db *sql.DB, r io.Reader) (*ImportResult, error) {
+	instance, err := instanceID(db)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	imp := &importer{tx: tx, instance: instance, users: map[string]int{}, result: &ImportResult{}}
+
+	dec := json.NewDecoder(r)
+	line := 0
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", line+1, err)
+		}
+		line++
+
+		if err := imp.apply(raw, line); err != nil {
+			return nil, fmt.Errorf("record %d: %w", line, err)
+		}
+	}
+	if line == 0 {
+		return nil, errors.New("empty export")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return imp.result, nil
+}
+
+type importer struct {
+	tx       *sql.Tx
+	instance string
+	users    map[string]int
+	result   *ImportResult
+}
+
+func (imp *importer) apply(raw json.RawMessage, line int) error {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &head); err != nil {
+		return err
+	}
+	if line == 1 && head.Type != "room" {
+		return errors.New("export must start with a room record")
+	}
+	if line > 1 && head.Type == "room" {
+		return errors.New("export contains more than one room")
+	}
+
+	switch head.Type {
+	case "room":
+		var room roomRecord
+		if err := json.Unmarshal(raw, &room); err != nil {
+			return err
+		}
+		return imp.room(room)
+
+	case "member":
+		var member memberRecord
+		if err := json.Unmarshal(raw, &member); err != nil {
+			return err
+		}
+		return imp.member(member)
+
+	case "message":
+		var message messageRecord
+		if err := json.Unmarshal(raw, &message); err != nil {
+			return err
+		}
+		return imp.message(message)
+
+	default:
+		return fmt.Errorf("unknown record type %q", head.Type)
+	}
+}
+
+func (imp *importer) room(room roomRecord) error {
+	if room.Version != FormatVersion {
+		return fmt.Errorf("unsupported export version %d", room.Version)
+	}
+	if room.Origin == "" || room.Name == "" {
+		return errors.New("room record needs an origin and a name")
+	}
+
+	roomID, found, err := imp.lookup("room", "chat_rooms", room.Origin)
+	if err != nil {
+		return err
+	}
+	if found {
+		imp.result.RoomID = roomID
+		return nil
+	}
+
+	var creatorID sql.NullInt64
+	if room.Creator != "" {
+		id, err := imp.user(room.Creator)
+		if err != nil {
+			return err
+		}
+		creatorID = sql.NullInt64{Int64: int64(id), Valid: id != 0}
+	}
+
+	res, err := imp.tx.Exec("INSERT INTO chat_rooms (name, creator_id, created_at) VALUES (?, ?, CURRENT_TIMESTAMP)", room.Name, creatorID)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	imp.result.RoomID = int(id)
+	imp.result.RoomCreated = true
+	return imp.remember("room", room.Origin, int(id))
+}
+
+func (imp *importer) member(member memberRecord) error {
+	if member.Username == "" {
+		return errors.New("member record needs a username")
+	}
+	userID, err := imp.user(member.Username)
+	if err != nil || userID == 0 {
+		return err
+	}
+	joinedAt := time.Now().UTC()
+	if member.JoinedAt != nil {
+		joinedAt = *member.JoinedAt
+	}
+	role := member.Role
+	if !chat.ValidRole(role) {
+		role = models.RoleMember
+	}
+	res, err := imp.tx.Exec("INSERT OR IGNORE INTO room_users (room_id, user_id, joined_at, role) VALUES (?, ?, ?, ?)",
+		imp.result.RoomID, userID, chat.SQLTime(joinedAt), role)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	imp.result.MembersAdded++
+	// backdated to the original join so that the log replays correctly; the
+	// import performed the join, so there is no acting user
+	_, err = imp.tx.Exec("INSERT INTO membership_events (room_id, user_id, event, created_at) VALUES (?, ?, ?, ?)",
+		imp.result.RoomID, userID, models.MembershipJoin, chat.SQLTime(joinedAt))
+	return err
+}
+
+func (imp *importer) message(message messageRecord) error {
+	if message.Origin == "" {
+		return errors.New("message record needs an origin")
+	}
+	_, found, err := imp.lookup("message", "messages", message.Origin)
+	if err != nil {
+		return err
+	}
+	if found {
+		imp.result.MessagesSkipped++
+		return nil
+	}
+
+	var senderID sql.NullInt64
+	if message.Sender != "" {
+		id, err := imp.user(message.Sender)
+		if err != nil {
+			return err
+		}
+		senderID = sql.NullInt64{Int64: int64(id), Valid: id != 0}
+	}
+
+	content, keyID, err := encryption.Default.Encrypt(imp.tx, encryption.RoomScope(imp.result.RoomID), message.Content)
+	if err != nil {
+		return err
+	}
+	res, err := imp.tx.Exec("INSERT INTO messages (sender_id, room_id, content, timestamp, key_id) VALUES (?, ?, ?, ?, ?)",
+		senderID, imp.result.RoomID, content, message.Timestamp, keyID)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	imp.result.MessagesAdded++
+	return imp.remember("message", message.Origin, int(id))
+}
+
+// user maps a username to a local user ID, creating a placeholder account
+// when the user does not exist on this instance. It returns 0 for the
+// username of a deleted account whose cooldown has not run out, which must
+// not be taken over by a placeholder.
+func (imp *importer) user(username string) (int, error) {
+	if id, ok := imp.users[username]; ok {
+		return id, nil
+	}
+
+	var id int
+	err := imp.tx.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&id)
+	if err == sql.ErrNoRows {
+		retired, err := auth.UsernameRetired(imp.tx, username)
+		if err != nil {
+			return 0, err
+		}
+		if retired {
+			imp.users[username] = 0
+			return 0, nil
+		}
+		res, err := imp.tx.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", username, placeholderHash)
+		if err != nil {
+			return 0, err
+		}
+		id64, err := res.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		id = int(id64)
+		imp.result.UsersCreated++
+	} else if err != nil {
+		return 0, err
+	}
+
+	imp.users[username] = id
+	return id, nil
+}
+
+// lookup finds the local row for origin: either a row native to this
+// instance, or one recorded in import_map by an earlier import
+func (imp *importer) lookup(kind, table, origin string) (int, bool, error) {
+	if id, ok := imp.native(origin); ok {
+		exists, err := imp.exists(kind, table, id)
+		if err != nil {
+			return 0, false, err
+		}
+		if exists {
+			return id, true, nil
+		}
+	}
+
+	var id int
+	err := imp.tx.QueryRow("SELECT local_id FROM import_map WHERE kind = ? AND origin = ?", kind, origin).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	// the mapped row may have been deleted since the last import
+	exists, err := imp.exists(kind, table, id)
+	if err != nil {
+		return 0, false, err
+	}
+	if !exists {
+		_, err = imp.tx.Exec("DELETE FROM import_map WHERE kind = ? AND origin = ?", kind, origin)
+		return 0, false, err
+	}
+	return id, true, nil
+}
+
+// exists reports whether a row is still present, counting messages moved to
+// archive segments
+func (imp *importer) exists(kind, table string, id int) (bool, error) {
+	var count int
+	err := imp.tx.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE id = ?", id).Scan(&count)
+	if err != nil || count > 0 || kind != "message" {
+		return count > 0, err
+	}
+	return archive.Contains(imp.tx, imp.result.RoomID, id)
+}
+
+func (imp *importer) native(origin string) (int, bool) {
+	rest, ok := strings.CutPrefix(origin, imp.instance+":")
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.Atoi(rest)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+func (imp *importer) remember(kind, origin string, localID int) error {
+	_, err := imp.tx.Exec("INSERT OR REPLACE INTO import_map (kind, origin, local_id) VALUES (?, ?, ?)", kind, origin, localID)
+	return err
+}
@@ -0,0 +1,206 @@
+package transfer
+
+import (
+	"bytes"
+	"chat-app/internal/archive"
+	"chat-app/internal/chat"
+	"chat-app/internal/database/databasetest"
+	"chat-app/pkg/models"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// exportRoom exports a room of db for a test
+func exportRoom(t *testing.T, db *sql.DB, roomID int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := ExportRoom(db, roomID, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportKeepsRetiredUsernames(t *testing.T) {
+	source := databasetest.Open(t)
+	dana := databasetest.NewUser(t, source, "dana")
+	olivia := databasetest.NewUser(t, source, "olivia")
+	room := models.ChatRoom{Name: "room", CreatorID: dana, Visibility: models.VisibilityPublic, HistoryVisibility: models.HistoryShared}
+	if err := chat.CreateChatRoom(source, &room); err != nil {
+		t.Fatal(err)
+	}
+	if err := chat.JoinChatRoom(source, room.ID, olivia); err != nil {
+		t.Fatal(err)
+	}
+	for _, senderID := range []int{dana, olivia} {
+		if err := chat.SaveMessage(source, &models.Message{SenderID: senderID, RoomID: room.ID, Content: "hi"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	export := exportRoom(t, source, room.ID)
+
+	// dana deleted their account here recently, olivia long enough ago
+	db := databasetest.Open(t)
+	_, err := db.Exec("INSERT INTO retired_usernames (username, available_at) VALUES ('dana', ?), ('olivia', ?)",
+		chat.SQLTime(time.Now().Add(time.Hour)), chat.SQLTime(time.Now().Add(-time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ImportRoom(db, bytes.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.UsersCreated != 1 || result.MembersAdded != 1 || result.MessagesAdded != 2 {
+		t.Errorf("got %+v, want olivia created and both messages added", result)
+	}
+	var danas int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE username = 'dana'").Scan(&danas); err != nil {
+		t.Fatal(err)
+	}
+	if danas != 0 {
+		t.Error("the retired username was taken by the import")
+	}
+
+	var creatorID sql.NullInt64
+	if err := db.QueryRow("SELECT creator_id FROM chat_rooms WHERE id = ?", result.RoomID).Scan(&creatorID); err != nil {
+		t.Fatal(err)
+	}
+	if creatorID.Valid {
+		t.Errorf("room has creator %d, want none", creatorID.Int64)
+	}
+	var anonymous int
+	if err := db.QueryRow("SELECT COUNT(*) FROM messages WHERE room_id = ? AND sender_id IS NULL", result.RoomID).Scan(&anonymous); err != nil {
+		t.Fatal(err)
+	}
+	if anonymous != 1 {
+		t.Errorf("%d messages without a sender, want dana's", anonymous)
+	}
+}
+
+// importRoom imports an export into db for a test
+func importRoom(t *testing.T, db *sql.DB, export []byte) *ImportResult {
+	t.Helper()
+	result, err := ImportRoom(db, bytes.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// importMapSize counts the import_map rows of kind in db
+func importMapSize(t *testing.T, db *sql.DB, kind string) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM import_map WHERE kind = ?", kind).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	archive.Dir = t.TempDir()
+	source := databasetest.Open(t)
+	ada := databasetest.NewUser(t, source, "ada")
+	bob := databasetest.NewUser(t, source, "bob")
+	room := models.ChatRoom{Name: "round trip", CreatorID: ada, Visibility: models.VisibilityPublic, HistoryVisibility: models.HistoryShared}
+	if err := chat.CreateChatRoom(source, &room); err != nil {
+		t.Fatal(err)
+	}
+	if err := chat.JoinChatRoom(source, room.ID, bob); err != nil {
+		t.Fatal(err)
+	}
+	// three messages that get archived before the export, then two that
+	// stay in the messages table
+	for i, senderID := range []int{ada, bob, ada} {
+		if _, err := source.Exec("INSERT INTO messages (sender_id, room_id, content, timestamp) VALUES (?, ?, ?, ?)",
+			senderID, room.ID, "old", chat.SQLTime(time.Date(2000, 1, 1, 0, 0, i, 0, time.UTC))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := (&archive.Archiver{DB: source, After: time.Hour}).ArchiveOnce(time.Now()); err != nil || n != 3 {
+		t.Fatalf("archiving the source: got %d %v", n, err)
+	}
+	for _, senderID := range []int{bob, ada} {
+		if err := chat.SaveMessage(source, &models.Message{SenderID: senderID, RoomID: room.ID, Content: "new"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const n = 5
+	export := exportRoom(t, source, room.ID)
+
+	// the target has a room of its own, so that archive paths of the two
+	// databases do not collide
+	target := databasetest.Open(t)
+	newcomer := databasetest.NewUser(t, target, "nina")
+	if err := chat.CreateChatRoom(target, &models.ChatRoom{Name: "other", CreatorID: newcomer, Visibility: models.VisibilityPublic}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := importRoom(t, target, export)
+	if !first.RoomCreated || first.UsersCreated != 2 || first.MembersAdded != 2 || first.MessagesAdded != n || first.MessagesSkipped != 0 {
+		t.Fatalf("first import: got %+v", first)
+	}
+	if importMapSize(t, target, "room") != 1 || importMapSize(t, target, "message") != n {
+		t.Errorf("import_map holds %d rooms and %d messages", importMapSize(t, target, "room"), importMapSize(t, target, "message"))
+	}
+
+	again := importRoom(t, target, export)
+	if again.RoomCreated || again.RoomID != first.RoomID || again.UsersCreated != 0 || again.MembersAdded != 0 ||
+		again.MessagesAdded != 0 || again.MessagesSkipped != n {
+		t.Errorf("re-import: got %+v", again)
+	}
+
+	// origins survive a second hop: the target's export of the room points
+	// back at the source, which recognises its own room and messages
+	back := importRoom(t, source, exportRoom(t, target, first.RoomID))
+	if back.RoomCreated || back.RoomID != room.ID || back.MessagesAdded != 0 || back.MessagesSkipped != n {
+		t.Errorf("import back into the source: got %+v", back)
+	}
+	if importMapSize(t, source, "room") != 0 || importMapSize(t, source, "message") != 0 {
+		t.Error("the source mapped its own rows")
+	}
+
+	// messages archived on the target since are still recognised
+	archived, err := (&archive.Archiver{DB: target, After: time.Hour}).ArchiveOnce(time.Now())
+	if err != nil || archived != 3 {
+		t.Fatalf("archiving the target: got %d %v", archived, err)
+	}
+	again = importRoom(t, target, export)
+	if again.MessagesAdded != 0 || again.MessagesSkipped != n {
+		t.Errorf("re-import after archiving: got %+v", again)
+	}
+
+	// a message deleted on the target since is imported again, and its
+	// stale mapping replaced
+	var deletedID int
+	if err := target.QueryRow("SELECT MAX(id) FROM messages WHERE room_id = ?", first.RoomID).Scan(&deletedID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.Exec("DELETE FROM messages WHERE id = ?", deletedID); err != nil {
+		t.Fatal(err)
+	}
+	again = importRoom(t, target, export)
+	if again.MessagesAdded != 1 || again.MessagesSkipped != n-1 {
+		t.Errorf("re-import after a deletion: got %+v", again)
+	}
+	var stale int
+	if err := target.QueryRow("SELECT COUNT(*) FROM import_map WHERE kind = 'message' AND local_id = ?", deletedID).Scan(&stale); err != nil {
+		t.Fatal(err)
+	}
+	if stale != 0 || importMapSize(t, target, "message") != n {
+		t.Errorf("after re-importing a deleted message, import_map maps %d to it and holds %d messages", stale, importMapSize(t, target, "message"))
+	}
+
+	// a room deleted on the target since is created again
+	if _, err := chat.DeleteChatRoom(target, first.RoomID); err != nil {
+		t.Fatal(err)
+	}
+	again = importRoom(t, target, export)
+	if !again.RoomCreated || again.RoomID == first.RoomID || again.MessagesAdded != n || again.MessagesSkipped != 0 {
+		t.Errorf("import after deleting the room: got %+v", again)
+	}
+	if importMapSize(t, target, "room") != 1 || importMapSize(t, target, "message") != n {
+		t.Errorf("import_map holds %d rooms and %d messages", importMapSize(t, target, "room"), importMapSize(t, target, "message"))
+	}
+}
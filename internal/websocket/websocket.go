@@ -1,15 +1,27 @@
 package websocket
 
 import (
+	"chat-app/internal/auth"
+	"chat-app/internal/chat"
+	"chat-app/internal/profile"
+	"chat-app/pkg/models"
 	"chat-app/pkg/utils"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// sendBufferSize is how many messages may wait for a slow client. A client
+// that falls further behind is disconnected, so that it cannot hold up
+// delivery to everyone else.
+const sendBufferSize = 256
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -19,11 +31,17 @@ var upgrader = websocket.Upgrader{
 }
 
 type Client struct {
-	ID     int
-	Conn   *websocket.Conn
-	Send   chan []byte
-	DB     *sql.DB
-	UserID int
+	ID        int
+	Conn      *websocket.Conn
+	Send      chan []byte
+	DB        *sql.DB
+	UserID    int
+	SessionID int
+	// TokenID, IsBot and Scopes are set when the connection was opened with
+	// an API token
+	TokenID int
+	IsBot   bool
+	Scopes  auth.Scopes
 }
 
 type Message struct {
@@ -31,39 +49,113 @@ type Message struct {
 	RecipientID int    `json:"recipient_id,omitempty"`
 	RoomID      int    `json:"room_id,omitempty"`
 	Content     string `json:"content"`
+	IsBot       bool   `json:"is_bot"`
+	// SenderUsername, SenderDisplayName and SenderAvatarURL show who sent
+	// the message, as their profile was when they sent it
+	SenderUsername    string `json:"sender_username,omitempty"`
+	SenderDisplayName string `json:"sender_display_name,omitempty"`
+	SenderAvatarURL   string `json:"sender_avatar_url,omitempty"`
+}
+
+// Event tells clients about a change to a room, as opposed to a Message
+type Event struct {
+	Type      string `json:"type"`
+	RoomID    int    `json:"room_id"`
+	UserID    int    `json:"user_id,omitempty"`
+	Role      string `json:"role,omitempty"`
+	MessageID int    `json:"message_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+	// Error says why a message the client sent was refused
+	Error string `json:"error,omitempty"`
+	// RoomName is sent with invitations and answers to requests to join,
+	// about rooms the user is not in, and when a room is renamed
+	RoomName string `json:"room_name,omitempty"`
+	// ActorID, Reason and ExpiresAt describe moderation actions
+	ActorID   int        `json:"actor_id,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
+// Command asks the server to do something other than deliver a message. A
+// client sends one instead of a Message, telling them apart by its type.
+type Command struct {
+	Type   string `json:"type"`
+	RoomID int    `json:"room_id"`
+	UserID int    `json:"user_id"`
+}
+
+// Command types
+const (
+	CommandApproveJoin = "approve-join-request"
+	CommandDenyJoin    = "deny-join-request"
+)
+
+// Event types
+const (
+	EventRoomDeleted   = "room-deleted"
+	EventMemberRemoved = "member-removed"
+	EventRoleChanged   = "role-changed"
+	EventMessageEdited = "message-edited"
+	// EventMemberBanned, EventMemberUnbanned, EventMemberMuted and
+	// EventMemberUnmuted are sent to the room and to the user concerned
+	EventMemberBanned   = "member-banned"
+	EventMemberUnbanned = "member-unbanned"
+	EventMemberMuted    = "member-muted"
+	EventMemberUnmuted  = "member-unmuted"
+	// EventError is sent only to the client whose message or command was
+	// refused
+	EventError = "error"
+	// EventInvited is sent only to the invited user
+	EventInvited = "invited"
+	// EventJoinRequested is sent to the members who may answer a request to
+	// join, with the request's message as its content
+	EventJoinRequested = "join-requested"
+	// EventJoinApproved and EventJoinDenied are sent only to the user who
+	// asked to join
+	EventJoinApproved = "join-approved"
+	EventJoinDenied   = "join-denied"
+	// EventRoomRenamed, EventTopicChanged and EventDescriptionChanged carry
+	// the new name as RoomName, and the new topic or description as content
+	EventRoomRenamed        = "room-renamed"
+	EventTopicChanged       = "topic-changed"
+	EventDescriptionChanged = "description-changed"
+	EventRoomArchived       = "room-archived"
+	EventRoomUnarchived     = "room-unarchived"
+)
+
 var (
-	clients   = make(map[int]*Client)
+	// clients holds every open connection. A user has one for each device
+	// they are connected from.
+	clients   = make(map[*Client]bool)
 	broadcast = make(chan Message)
 	mutex     sync.Mutex
+	db        *sql.DB
 )
 
-func HandleConnections(w http.ResponseWriter, r *http.Request, db *sql.DB, userID int) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// HandleConnections upgrades an authenticated request to a WebSocket
+// connection. responseHeader may select the subprotocol.
+func HandleConnections(w http.ResponseWriter, r *http.Request, db *sql.DB, claims *auth.Claims, responseHeader http.Header) {
+	userID := claims.UserId
+
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		utils.Log.WithError(err).Error("Error upgrading to WebSocket")
 		return
 	}
 
-	mutex.Lock()
-
-	// Check if a client with the same userID already exists
-	if _, exists := clients[userID]; exists {
-		utils.Log.WithField("userID", userID).Error("Client with this userID already exists")
-		conn.Close() // Close the new connection as it's a duplicate
-		return
-	}
-
 	client := &Client{
-		Conn:   conn,
-		Send:   make(chan []byte),
-		DB:     db,
-		UserID: userID,
+		Conn:      conn,
+		Send:      make(chan []byte, sendBufferSize),
+		DB:        db,
+		UserID:    userID,
+		SessionID: claims.SessionID,
+		TokenID:   claims.TokenID,
+		IsBot:     claims.IsBot,
+		Scopes:    claims.Scopes,
 	}
 
-	clients[userID] = client
-
+	mutex.Lock()
+	clients[client] = true
 	mutex.Unlock()
 
 	go client.readMessages()
@@ -73,7 +165,11 @@ func HandleConnections(w http.ResponseWriter, r *http.Request, db *sql.DB, userI
 func (c *Client) readMessages() {
 	defer func() {
 		mutex.Lock()
-		delete(clients, c.UserID)
+		delete(clients, c)
+		// nothing sends to a client once it is out of clients, and the
+		// client's own events are sent from this goroutine, so this
+		// safely ends writeMessages
+		close(c.Send)
 		mutex.Unlock()
 		c.Conn.Close()
 	}()
@@ -83,22 +179,187 @@ func (c *Client) readMessages() {
 			utils.Log.WithError(err).Error("Error reading message")
 			return
 		}
-		isSenderInRoom := senderInRoom(c.DB, c.UserID, 1)
-		if !isSenderInRoom {
-			utils.Log.WithField("userID", c.UserID).Error("Sender not in room")
+		var command Command
+		if err := json.Unmarshal(msg, &command); err != nil {
+			utils.Log.WithError(err).Error("Error unmarshalling message")
+			continue
+		}
+		if command.Type != "" {
+			c.runCommand(command)
 			continue
 		}
-
 		var message Message
 		if err := json.Unmarshal(msg, &message); err != nil {
 			utils.Log.WithError(err).Error("Error unmarshalling message")
 			continue
 		}
+		if !c.maySend(message) {
+			continue
+		}
 		message.SenderID = c.UserID
+		message.IsBot = c.IsBot
+		if !c.save(message) {
+			continue
+		}
+		c.addSender(&message)
 		broadcast <- message
 	}
 }
 
+// maySend checks that the sender of a room message is in the room with a
+// role that may post, that the recipient of a direct message accepts it, and
+// that an API token allows posting there or sending direct messages. The
+// sender is told why a message was refused. Whether the room is archived is
+// left to save.
+func (c *Client) maySend(message Message) bool {
+	scope := auth.ScopeDM
+	if message.RoomID != 0 {
+		scope = auth.PostScope(message.RoomID)
+	}
+	if !c.allows(scope) {
+		c.sendEvent(Event{Type: EventError, RoomID: message.RoomID, UserID: message.RecipientID, Error: "API token does not allow this"})
+		return false
+	}
+	if message.RoomID == 0 {
+		err := chat.CanDirectMessage(c.DB, c.UserID, message.RecipientID)
+		if err == nil {
+			return true
+		}
+		if chat.IsDMRefusal(err) {
+			c.sendEvent(Event{Type: EventError, UserID: message.RecipientID, Error: err.Error()})
+		} else {
+			utils.Log.WithError(err).Error("Error checking direct message")
+		}
+		return false
+	}
+
+	role, err := chat.MemberRole(c.DB, message.RoomID, c.UserID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching room role")
+		return false
+	}
+	if role == "" {
+		c.sendEvent(Event{Type: EventError, RoomID: message.RoomID, Error: "you are not a member of this room"})
+		return false
+	}
+	if !chat.Can(role, chat.PermPost) {
+		c.sendEvent(Event{Type: EventError, RoomID: message.RoomID, Error: "your role in this room does not allow posting"})
+		return false
+	}
+	mute, err := chat.ActiveMute(c.DB, message.RoomID, c.UserID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching mute")
+		return false
+	}
+	if mute != nil {
+		refusal := "you are muted in this room"
+		if mute.ExpiresAt != nil {
+			refusal += " until " + mute.ExpiresAt.Format(time.RFC3339)
+		}
+		c.sendEvent(Event{Type: EventError, RoomID: message.RoomID, Error: refusal, ExpiresAt: mute.ExpiresAt})
+		return false
+	}
+	return true
+}
+
+// runCommand carries out a command, sending the client an error event if it
+// cannot
+func (c *Client) runCommand(command Command) {
+	var err error
+	switch command.Type {
+	case CommandApproveJoin:
+		err = c.answerJoinRequest(command.RoomID, command.UserID, true)
+	case CommandDenyJoin:
+		err = c.answerJoinRequest(command.RoomID, command.UserID, false)
+	default:
+		err = fmt.Errorf("unknown command %q", command.Type)
+	}
+	if err != nil {
+		c.sendEvent(Event{Type: EventError, RoomID: command.RoomID, UserID: command.UserID, Error: err.Error()})
+	}
+}
+
+// answerJoinRequest approves or denies userID's request to join a room, as
+// POST /rooms/{id}/join-requests/{user_id}/approve and DELETE
+// /rooms/{id}/join-requests/{user_id} do
+func (c *Client) answerJoinRequest(roomID, userID int, approve bool) error {
+	// API tokens cannot manage rooms over REST either
+	if c.TokenID != 0 {
+		return errors.New("API token does not allow this")
+	}
+	role, err := chat.MemberRole(c.DB, roomID, c.UserID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching room role")
+		return err
+	}
+	if !chat.Can(role, chat.PermManageRoom) {
+		return errors.New("your role in this room does not allow answering requests to join")
+	}
+	room, err := chat.GetChatRoom(c.DB, roomID)
+	if err != nil {
+		return err
+	}
+
+	if approve {
+		err = chat.ApproveJoinRequest(c.DB, roomID, userID, c.UserID)
+	} else {
+		err = chat.DeleteJoinRequest(c.DB, roomID, userID)
+	}
+	if err == sql.ErrNoRows {
+		return errors.New("request to join not found")
+	}
+	if err == chat.ErrRoomArchived {
+		return err
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error answering request to join")
+		return err
+	}
+	JoinRequestAnswered(roomID, room.Name, userID, c.UserID, approve)
+	return nil
+}
+
+// addSender fills in the sender's profile on a message they sent
+func (c *Client) addSender(message *Message) {
+	sender, err := profile.Get(c.DB, c.UserID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching sender profile")
+		return
+	}
+	message.SenderUsername = sender.Username
+	message.SenderDisplayName = sender.DisplayName
+	message.SenderAvatarURL = sender.AvatarURL
+}
+
+// allows reports whether the credentials the client connected with allow
+// scope
+func (c *Client) allows(scope string) bool {
+	return c.Scopes == nil || c.Scopes.Allows(scope)
+}
+
+// sendEvent sends an event to this client only
+func (c *Client) sendEvent(event Event) {
+	jsonEvent, _ := json.Marshal(event)
+	mutex.Lock()
+	c.deliver(jsonEvent)
+	mutex.Unlock()
+}
+
+// deliver queues a message for the client without waiting. A client whose
+// queue is full is dropped and its connection closed, which ends
+// readMessages. It must be called with mutex held.
+func (c *Client) deliver(msg []byte) {
+	select {
+	case c.Send <- msg:
+	default:
+		if clients[c] {
+			utils.Log.WithField("userID", c.UserID).Warn("Disconnecting client that is not keeping up")
+			delete(clients, c)
+			c.Conn.Close()
+		}
+	}
+}
+
 func (c *Client) writeMessages() {
 	defer c.Conn.Close()
 	for msg := range c.Send {
@@ -115,72 +376,315 @@ func handleMessages() {
 		jsonMsg, _ := json.Marshal(msg)
 
 		if msg.RoomID != 0 {
+			// the sender's room messages are not shown to users who
+			// blocked them
+			blockers, err := chat.BlockersOf(db, msg.SenderID)
+			if err != nil {
+				utils.Log.WithError(err).Error("Error fetching blockers")
+			}
+			members := roomMembers(msg.RoomID)
 			mutex.Lock()
-			for userID, client := range clients {
-				if isUserInRoom(client.DB, userID, msg.RoomID) {
-					client.Send <- jsonMsg
+			for client := range clients {
+				if client.allows(auth.ScopeReadRooms) && !blockers[client.UserID] && members[client.UserID] {
+					client.deliver(jsonMsg)
 				}
 			}
-
 			mutex.Unlock()
 		} else if msg.RecipientID != 0 {
-			mutex.Lock()
+			toParticipants(msg, jsonMsg)
+		}
+	}
+}
 
-			for userId, client := range clients {
-				if userId == msg.RecipientID || userId == msg.SenderID {
-					client.Send <- jsonMsg
-				}
-			}
-			mutex.Unlock()
+// DirectMessage delivers a direct message that was sent and stored without
+// a WebSocket connection to its sender and recipient
+func DirectMessage(msg Message) {
+	jsonMsg, _ := json.Marshal(msg)
+	toParticipants(msg, jsonMsg)
+}
+
+// toParticipants sends a direct message to the connections of its sender
+// and recipient that may receive direct messages
+func toParticipants(msg Message, jsonMsg []byte) {
+	mutex.Lock()
+	for client := range clients {
+		if (client.UserID == msg.RecipientID || client.UserID == msg.SenderID) && client.allows(auth.ScopeDM) {
+			client.deliver(jsonMsg)
 		}
+	}
+	mutex.Unlock()
+}
 
-		saveMessageToDB(msg)
+// roomMembers returns the IDs of a room's members. It is looked up before
+// taking mutex, so that delivery never waits for the database with every
+// connection locked.
+func roomMembers(roomID int) map[int]bool {
+	members := map[int]bool{}
+	rows, err := db.Query("SELECT user_id FROM room_users WHERE room_id = ?", roomID)
+	if err != nil {
+		utils.Log.WithError(err).Error("Error fetching room members")
+		return members
 	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			utils.Log.WithError(err).Error("Error fetching room members")
+			return members
+		}
+		members[userID] = true
+	}
+	return members
 }
 
-func isUserInRoom(db *sql.DB, userID, roomID int) bool {
-	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM room_users WHERE user_id = ? AND room_id = ?", userID, roomID).Scan(&count)
-	if err != nil || count == 0 {
+// save stores a message the client sent before it is delivered, reporting
+// whether it was. The client is told if the room is archived.
+func (c *Client) save(msg Message) bool {
+	err := chat.SaveMessage(c.DB, &models.Message{
+		SenderID:    msg.SenderID,
+		RecipientID: msg.RecipientID,
+		RoomID:      msg.RoomID,
+		Content:     msg.Content,
+	})
+	if err == chat.ErrRoomArchived {
+		c.sendEvent(Event{Type: EventError, RoomID: msg.RoomID, Error: err.Error()})
+		return false
+	}
+	if err != nil {
+		utils.Log.WithError(err).Error("Error saving message to database")
 		return false
 	}
 	return true
 }
 
-func saveMessageToDB(msg Message) {
-	db := getDBConnection()
-	defer db.Close()
+// RoomDeleted tells the connected former members of a deleted room that it
+// is gone
+func RoomDeleted(roomID int, memberIDs []int) {
+	jsonEvent, _ := json.Marshal(Event{Type: EventRoomDeleted, RoomID: roomID})
 
-	if msg.RoomID != 0 {
-		_, err := db.Exec("INSERT INTO messages (sender_id, room_id, content) VALUES (?, ?, ?)", msg.SenderID, msg.RoomID, msg.Content)
-		if err != nil {
-			utils.Log.WithError(err).Error("Error saving room message to database")
+	members := make(map[int]bool, len(memberIDs))
+	for _, memberID := range memberIDs {
+		members[memberID] = true
+	}
+
+	mutex.Lock()
+	for client := range clients {
+		if members[client.UserID] {
+			client.deliver(jsonEvent)
 		}
-	} else if msg.RecipientID != 0 {
-		_, err := db.Exec("INSERT INTO messages (sender_id, recipient_id, content) VALUES (?, ?, ?)", msg.SenderID, msg.RecipientID, msg.Content)
-		if err != nil {
-			utils.Log.WithError(err).Error("Error saving direct message to database")
+	}
+	mutex.Unlock()
+}
+
+// MemberRemoved tells the connected members of a room, and the removed user,
+// that userID is no longer in it
+func MemberRemoved(roomID, userID int) {
+	toMembersAnd(roomID, userID, Event{Type: EventMemberRemoved, RoomID: roomID, UserID: userID})
+}
+
+// Kicked tells the connected members of a room, and the kicked user, that
+// actorID kicked userID out of it
+func Kicked(roomID, userID, actorID int, reason string) {
+	toMembersAnd(roomID, userID, Event{Type: EventMemberRemoved, RoomID: roomID, UserID: userID, ActorID: actorID, Reason: reason})
+}
+
+// Banned tells the connected members of a room, and the banned user, that
+// actorID banned userID from it
+func Banned(ban *models.Sanction) {
+	toMembersAnd(ban.RoomID, ban.UserID, Event{Type: EventMemberBanned, RoomID: ban.RoomID, UserID: ban.UserID,
+		ActorID: ban.ActorID, Reason: ban.Reason, ExpiresAt: ban.ExpiresAt})
+}
+
+// Unbanned tells the connected members of a room, and the user, that
+// actorID lifted userID's ban
+func Unbanned(roomID, userID, actorID int) {
+	toMembersAnd(roomID, userID, Event{Type: EventMemberUnbanned, RoomID: roomID, UserID: userID, ActorID: actorID})
+}
+
+// Muted tells the connected members of a room that actorID muted userID
+func Muted(mute *models.Sanction) {
+	toMembersAnd(mute.RoomID, mute.UserID, Event{Type: EventMemberMuted, RoomID: mute.RoomID, UserID: mute.UserID,
+		ActorID: mute.ActorID, Reason: mute.Reason, ExpiresAt: mute.ExpiresAt})
+}
+
+// Unmuted tells the connected members of a room that actorID lifted
+// userID's mute
+func Unmuted(roomID, userID, actorID int) {
+	toMembersAnd(roomID, userID, Event{Type: EventMemberUnmuted, RoomID: roomID, UserID: userID, ActorID: actorID})
+}
+
+// toMembersAnd sends an event to the connected members of a room and to
+// userID, who may no longer be one
+func toMembersAnd(roomID, userID int, event Event) {
+	jsonEvent, _ := json.Marshal(event)
+	members := roomMembers(roomID)
+
+	mutex.Lock()
+	for client := range clients {
+		if client.UserID == userID || members[client.UserID] {
+			client.deliver(jsonEvent)
 		}
 	}
+	mutex.Unlock()
 }
 
-func senderInRoom(db *sql.DB, senderID, roomID int) bool {
-	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM room_users WHERE user_id = ? AND room_id = ? limit 1", senderID, roomID).Scan(&count)
-	if err != nil || count == 0 {
-		return false
+// RoleChanged tells the connected members of a room that a member's role
+// changed
+func RoleChanged(roomID, userID int, role string) {
+	toMembers(roomID, Event{Type: EventRoleChanged, RoomID: roomID, UserID: userID, Role: role})
+}
+
+// MessageEdited tells the connected members of a room that editorID changed
+// the content of a message
+func MessageEdited(roomID, messageID, editorID int, content string) {
+	toMembers(roomID, Event{Type: EventMessageEdited, RoomID: roomID, UserID: editorID, MessageID: messageID, Content: content})
+}
+
+// RoomUpdated tells the connected members of a room that actorID changed
+// its name, topic or description, with an event for each that differs
+// between before and after
+func RoomUpdated(before, after *models.ChatRoom, actorID int) {
+	if after.Name != before.Name {
+		toMembers(after.ID, Event{Type: EventRoomRenamed, RoomID: after.ID, UserID: actorID, RoomName: after.Name})
+	}
+	if after.Topic != before.Topic {
+		toMembers(after.ID, Event{Type: EventTopicChanged, RoomID: after.ID, UserID: actorID, Content: after.Topic})
+	}
+	if after.Description != before.Description {
+		toMembers(after.ID, Event{Type: EventDescriptionChanged, RoomID: after.ID, UserID: actorID, Content: after.Description})
 	}
-	return true
 }
 
-func getDBConnection() *sql.DB {
-	db, err := sql.Open("sqlite3", "./chat-app.db")
+// ArchivedChanged tells the connected members of a room that actorID archived
+// it, or brought it back if archived is false
+func ArchivedChanged(roomID, actorID int, archived bool) {
+	event := Event{Type: EventRoomUnarchived, RoomID: roomID, UserID: actorID}
+	if archived {
+		event.Type = EventRoomArchived
+	}
+	toMembers(roomID, event)
+}
+
+// Invited tells a user that inviterID invited them to a room
+func Invited(roomID int, roomName string, userID, inviterID int) {
+	toUser(userID, Event{Type: EventInvited, RoomID: roomID, RoomName: roomName, UserID: inviterID})
+}
+
+// JoinRequested tells the connected members of a room who may answer it
+// that a user asked to join
+func JoinRequested(request *models.JoinRequest) {
+	event := Event{Type: EventJoinRequested, RoomID: request.RoomID, UserID: request.UserID, Content: request.Message}
+	jsonEvent, _ := json.Marshal(event)
+
+	members, err := chat.Members(db, request.RoomID)
 	if err != nil {
-		utils.Log.WithError(err).Fatal("Failed to connect to database")
+		utils.Log.WithError(err).Error("Error fetching room members")
+		return
+	}
+	managers := map[int]bool{}
+	for _, member := range members {
+		if chat.Can(member.Role, chat.PermManageRoom) {
+			managers[member.ID] = true
+		}
+	}
+
+	mutex.Lock()
+	for client := range clients {
+		if client.allows(auth.ScopeReadRooms) && managers[client.UserID] {
+			client.deliver(jsonEvent)
+		}
+	}
+	mutex.Unlock()
+}
+
+// JoinRequestAnswered tells a user that actorID approved or denied their
+// request to join a room
+func JoinRequestAnswered(roomID int, roomName string, userID, actorID int, approved bool) {
+	eventType := EventJoinDenied
+	if approved {
+		eventType = EventJoinApproved
+	}
+	toUser(userID, Event{Type: eventType, RoomID: roomID, RoomName: roomName, UserID: actorID})
+}
+
+// toUser sends an event to every connection of a user
+func toUser(userID int, event Event) {
+	jsonEvent, _ := json.Marshal(event)
+
+	mutex.Lock()
+	for client := range clients {
+		if client.UserID == userID {
+			client.deliver(jsonEvent)
+		}
+	}
+	mutex.Unlock()
+}
+
+// toMembers sends an event to the connected members of a room who may read
+// it
+func toMembers(roomID int, event Event) {
+	jsonEvent, _ := json.Marshal(event)
+	members := roomMembers(roomID)
+
+	mutex.Lock()
+	for client := range clients {
+		if client.allows(auth.ScopeReadRooms) && members[client.UserID] {
+			client.deliver(jsonEvent)
+		}
+	}
+	mutex.Unlock()
+}
+
+// Disconnect closes every connection of a user
+func Disconnect(userID int) {
+	closeWhere(func(client *Client) bool { return client.UserID == userID })
+}
+
+// CloseSession closes the connections opened with a session's access
+// tokens
+func CloseSession(sessionID int) {
+	closeWhere(func(client *Client) bool { return client.SessionID == sessionID })
+}
+
+// CloseAPIToken closes the connections opened with an API token
+func CloseAPIToken(tokenID int) {
+	closeWhere(func(client *Client) bool { return client.TokenID == tokenID })
+}
+
+// closeWhere closes the connections match picks. They are closed after
+// releasing mutex; each one's readMessages then removes it from clients.
+func closeWhere(match func(*Client) bool) {
+	var matched []*Client
+	mutex.Lock()
+	for client := range clients {
+		if match(client) {
+			matched = append(matched, client)
+		}
+	}
+	mutex.Unlock()
+
+	for _, client := range matched {
+		client.Conn.Close()
+	}
+}
+
+// ConnectedSessions returns the IDs of a user's sessions that have an open
+// connection
+func ConnectedSessions(userID int) map[int]bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	sessions := map[int]bool{}
+	for client := range clients {
+		if client.UserID == userID && client.SessionID != 0 {
+			sessions[client.SessionID] = true
+		}
 	}
-	return db
+	return sessions
 }
 
-func Init() {
+// Init starts delivering messages to the members of their rooms in database.
+// Clients store the messages they send before they are delivered.
+func Init(database *sql.DB) {
+	db = database
 	go handleMessages()
 }
@@ -0,0 +1,169 @@
+package websocket
+
+import (
+	"chat-app/internal/auth"
+	"chat-app/internal/chat"
+	"chat-app/internal/database/databasetest"
+	"chat-app/pkg/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSlowClientIsDropped(t *testing.T) {
+	connected := make(chan *Client)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// nothing writes the client's messages out, as if it had
+		// stopped reading
+		client := &Client{Conn: conn, Send: make(chan []byte, sendBufferSize), UserID: 1}
+		mutex.Lock()
+		clients[client] = true
+		mutex.Unlock()
+		connected <- client
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := <-connected
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i <= sendBufferSize; i++ {
+			toUser(1, Event{Type: EventRoleChanged})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery blocked on a slow client")
+	}
+
+	mutex.Lock()
+	stillConnected := clients[client]
+	mutex.Unlock()
+	if stillConnected {
+		t.Error("slow client was not dropped")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("slow client's connection was not closed")
+	}
+}
+
+func TestMaySendTellsRefusedSenders(t *testing.T) {
+	db := databasetest.Open(t)
+	owner := databasetest.NewUser(t, db, "olivia")
+	room := models.ChatRoom{Name: "room", CreatorID: owner, Visibility: models.VisibilityPublic, HistoryVisibility: models.HistoryShared}
+	if err := chat.CreateChatRoom(db, &room); err != nil {
+		t.Fatal(err)
+	}
+	member := databasetest.NewUser(t, db, "mia")
+	reader := databasetest.NewUser(t, db, "rex")
+	outsider := databasetest.NewUser(t, db, "oscar")
+	for _, userID := range []int{member, reader} {
+		if err := chat.JoinChatRoom(db, room.ID, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := chat.SetMemberRole(db, room.ID, reader, models.RoleReadOnly); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		userID  int
+		allowed bool
+	}{
+		{"member", member, true},
+		{"read-only member", reader, false},
+		{"outsider", outsider, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &Client{DB: db, Send: make(chan []byte, sendBufferSize), UserID: test.userID}
+			if allowed := client.maySend(Message{RoomID: room.ID, Content: "hi"}); allowed != test.allowed {
+				t.Fatalf("maySend = %v, want %v", allowed, test.allowed)
+			}
+			select {
+			case msg := <-client.Send:
+				var event Event
+				if err := json.Unmarshal(msg, &event); err != nil {
+					t.Fatal(err)
+				}
+				if test.allowed || event.Type != EventError || event.RoomID != room.ID || event.Error == "" {
+					t.Errorf("got %s", msg)
+				}
+			default:
+				if !test.allowed {
+					t.Error("the sender was not told")
+				}
+			}
+		})
+	}
+}
+
+func TestMaySendChecksScopes(t *testing.T) {
+	db := databasetest.Open(t)
+	bot := databasetest.NewUser(t, db, "bot")
+	friend := databasetest.NewUser(t, db, "fred")
+	var rooms []int
+	for i := 0; i < 2; i++ {
+		room := models.ChatRoom{Name: "room", CreatorID: bot, Visibility: models.VisibilityPublic, HistoryVisibility: models.HistoryShared}
+		if err := chat.CreateChatRoom(db, &room); err != nil {
+			t.Fatal(err)
+		}
+		rooms = append(rooms, room.ID)
+	}
+	dm := Message{RecipientID: friend, Content: "hi"}
+	post := Message{RoomID: rooms[0], Content: "hi"}
+
+	tests := []struct {
+		name    string
+		scopes  auth.Scopes
+		message Message
+		allowed bool
+	}{
+		{"access token posting", nil, post, true},
+		{"access token sending a DM", nil, dm, true},
+		{"posting to the room", auth.Scopes{auth.PostScope(rooms[0])}, post, true},
+		{"posting to every room", auth.Scopes{"rooms:post:*"}, post, true},
+		{"posting to another room", auth.Scopes{auth.PostScope(rooms[1])}, post, false},
+		{"posting with read only", auth.Scopes{auth.ScopeReadRooms}, post, false},
+		{"posting with dm", auth.Scopes{auth.ScopeDM}, post, false},
+		{"DM with dm", auth.Scopes{auth.ScopeDM}, dm, true},
+		{"DM without dm", auth.Scopes{auth.ScopeReadRooms, "rooms:post:*"}, dm, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &Client{DB: db, Send: make(chan []byte, sendBufferSize), UserID: bot, Scopes: test.scopes}
+			if allowed := client.maySend(test.message); allowed != test.allowed {
+				t.Fatalf("maySend = %v, want %v", allowed, test.allowed)
+			}
+			select {
+			case msg := <-client.Send:
+				if test.allowed || !strings.Contains(string(msg), "API token does not allow this") {
+					t.Errorf("got %s", msg)
+				}
+			default:
+				if !test.allowed {
+					t.Error("the sender was not told")
+				}
+			}
+		})
+	}
+}
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"chat-app/internal/archive"
 	"chat-app/internal/auth"
+	"chat-app/internal/chat"
 	"chat-app/internal/database"
+	"chat-app/internal/encryption"
+	"chat-app/internal/mail"
+	"chat-app/internal/oidc"
+	"chat-app/internal/profile"
 	"chat-app/internal/server"
 	"chat-app/internal/websocket"
 	"chat-app/pkg/utils"
+	"context"
 	"database/sql"
+	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -19,7 +29,7 @@ func main() {
 		dbPath = "./chat-app.db"
 	}
 
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := sql.Open("sqlite3", database.DSN(dbPath))
 	if err != nil {
 		utils.Log.WithError(err).Fatal("Failed to connect to database")
 	}
@@ -32,25 +42,182 @@ func main() {
 	// Initialize the database
 	database.InitDatabase(dbPath)
 
-	srv := &server.Server{DB: db}
+	encryption.Default, err = encryption.LoadKeyring()
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Failed to load message encryption key")
+	}
+
+	if dir := os.Getenv("ARCHIVE_DIR"); dir != "" {
+		archive.Dir = dir
+	}
+	if dir := os.Getenv("AVATAR_DIR"); dir != "" {
+		profile.Dir = dir
+	}
+	switch policy := os.Getenv("DELETED_USER_MESSAGES"); policy {
+	case "":
+	case chat.AnonymizeMessages, chat.DeleteMessages:
+		chat.DeletedUserMessages = policy
+	default:
+		utils.Log.WithField("value", policy).Fatal("DELETED_USER_MESSAGES must be \"anonymize\" or \"delete\"")
+	}
+	if value := os.Getenv("USERNAME_COOLDOWN"); value != "" {
+		chat.UsernameCooldown, err = time.ParseDuration(value)
+		if err != nil {
+			utils.Log.WithError(err).Fatal("Invalid USERNAME_COOLDOWN")
+		}
+	}
+	if value := os.Getenv("JOIN_REQUEST_TTL"); value != "" {
+		chat.JoinRequestTTL, err = time.ParseDuration(value)
+		if err != nil {
+			utils.Log.WithError(err).Fatal("Invalid JOIN_REQUEST_TTL")
+		}
+	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(db, os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	serve(db)
+}
+
+func serve(db *sql.DB) {
+	previous, err := encryption.LoadPreviousKeyring()
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Failed to load previous message encryption key")
+	}
+	rewrapped, err := encryption.Default.Check(db, previous)
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Message encryption key does not match the database")
+	}
+	if rewrapped > 0 {
+		utils.Log.WithField("count", rewrapped).Info("Re-wrapped data keys left under the previous master key")
+	}
+	if encryption.Default == nil {
+		utils.Log.Warn("No MESSAGE_KEY_FILE or MESSAGE_KEY set, message content will be stored unencrypted")
+	}
 
+	auth.Keys, err = auth.LoadKeyset()
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Failed to load token signing keys")
+	}
+	if auth.Keys == nil {
+		utils.Log.Warn("No JWT_KEYS_FILE or JWT_SECRET set, signing tokens with a random key that is lost on restart")
+		auth.Keys, err = auth.EphemeralKeyset()
+		if err != nil {
+			utils.Log.WithError(err).Fatal("Failed to generate a token signing key")
+		}
+	}
+	utils.Log.WithField("kid", auth.Keys.SigningKeyID()).Info("Signing tokens")
+	if value := os.Getenv("ACCESS_TOKEN_TTL"); value != "" {
+		auth.AccessTokenTTL, err = time.ParseDuration(value)
+		if err != nil {
+			utils.Log.WithError(err).Fatal("Invalid ACCESS_TOKEN_TTL")
+		}
+	}
+	if value := os.Getenv("REFRESH_TOKEN_TTL"); value != "" {
+		auth.RefreshTokenTTL, err = time.ParseDuration(value)
+		if err != nil {
+			utils.Log.WithError(err).Fatal("Invalid REFRESH_TOKEN_TTL")
+		}
+	}
+	auth.Policy, err = auth.LoadPasswordPolicy()
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Invalid password policy")
+	}
+	auth.Lockout, err = auth.LoadLockoutPolicy()
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Invalid login lockout policy")
+	}
+	auth.Init(db)
+
+	srv := &server.Server{DB: db, BackupDir: backupDir()}
+	srv.Mailer, err = mail.Load()
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Invalid mail configuration")
+	}
+	srv.PublicURL = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if srv.PublicURL == "" {
+		srv.PublicURL = "http://localhost:8080"
+	}
+	srv.OIDC, err = oidc.Load()
+	if err != nil {
+		utils.Log.WithError(err).Fatal("Failed to set up OpenID Connect")
+	}
+	if srv.OIDC == nil && os.Getenv("OIDC_MOCK") != "" {
+		utils.Log.Warn("OIDC_MOCK is set, anyone can log in through the mock identity provider at /mock-idp")
+		mock, err := oidc.NewMockProvider("http://localhost:8080/mock-idp")
+		if err != nil {
+			utils.Log.WithError(err).Fatal("Failed to start the mock identity provider")
+		}
+		http.Handle("/mock-idp/", mock)
+		srv.OIDC = mock.Provider("chat-app", "http://localhost:8080/oidc/callback")
+	}
+
+	http.Handle("/.well-known/jwks.json", http.HandlerFunc(srv.JWKSHandler))
 	http.Handle("/register", http.HandlerFunc(srv.RegisterHandler))
 	http.Handle("/login", http.HandlerFunc(srv.LoginHandler))
+	http.Handle("/login/2fa", http.HandlerFunc(srv.LoginSecondFactorHandler))
+	if srv.OIDC != nil {
+		http.Handle("/oidc/login", http.HandlerFunc(srv.OIDCLoginHandler))
+		http.Handle("/oidc/callback", http.HandlerFunc(srv.OIDCCallbackHandler))
+		http.Handle("/oidc/link", auth.JWTMiddleware(http.HandlerFunc(srv.OIDCLinkHandler)))
+		http.Handle("/oidc/link/start", http.HandlerFunc(srv.OIDCLinkStartHandler))
+		http.Handle("/oidc/device", http.HandlerFunc(srv.DeviceVerifyHandler))
+		http.Handle("/oidc/device/authorize", http.HandlerFunc(srv.DeviceAuthorizationHandler))
+		http.Handle("/oidc/device/token", http.HandlerFunc(srv.DeviceTokenHandler))
+	}
+	http.Handle("/email/verify", http.HandlerFunc(srv.VerifyEmailHandler))
+	http.Handle("/password/forgot", http.HandlerFunc(srv.ForgotPasswordHandler))
+	http.Handle("/password/reset", http.HandlerFunc(srv.ResetPasswordHandler))
+	http.Handle("/password/change", auth.JWTMiddleware(http.HandlerFunc(srv.ChangePasswordHandler)))
+	http.Handle("/token/refresh", http.HandlerFunc(srv.RefreshTokenHandler))
+	http.Handle("/logout", auth.JWTMiddleware(http.HandlerFunc(srv.LogoutHandler)))
+	http.Handle("/sessions", auth.JWTMiddleware(http.HandlerFunc(srv.SessionRoutes)))
+	http.Handle("/sessions/", auth.JWTMiddleware(http.HandlerFunc(srv.SessionRoutes)))
 	http.Handle("/create-room", auth.JWTMiddleware(http.HandlerFunc(srv.CreateRoomHandler)))
-	http.Handle("/join-room", auth.JWTMiddleware(http.HandlerFunc(srv.JoinRoomHandler)))
-	http.Handle("/leave-room", auth.JWTMiddleware(http.HandlerFunc(srv.LeaveRoomHandler)))
-	http.Handle("/list-users", auth.JWTMiddleware(http.HandlerFunc(srv.ListUsersInRoomHandler)))
-	http.Handle("/list-rooms", auth.JWTMiddleware(http.HandlerFunc(srv.ListRoomsHandler)))
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		userID, _, err := auth.ValidateJWT(r.Header.Get("Authorization")[7:])
+	http.Handle("/join-room", auth.ScopedMiddleware("", http.HandlerFunc(srv.JoinRoomHandler)))
+	http.Handle("/leave-room", auth.ScopedMiddleware("", http.HandlerFunc(srv.LeaveRoomHandler)))
+	http.Handle("/list-users", auth.ScopedMiddleware(auth.ScopeReadRooms, http.HandlerFunc(srv.ListUsersInRoomHandler)))
+	http.Handle("/list-rooms", auth.ScopedMiddleware(auth.ScopeReadRooms, http.HandlerFunc(srv.ListRoomsHandler)))
+	http.Handle("/rooms", auth.ScopedMiddleware(auth.ScopeReadRooms, http.HandlerFunc(srv.RoomRoutes)))
+	http.Handle("/rooms/", auth.ScopedMiddleware(auth.ScopeReadRooms, http.HandlerFunc(srv.RoomRoutes)))
+	http.Handle("/dms/", auth.ScopedMiddleware(auth.ScopeDM, http.HandlerFunc(srv.DMRoutes)))
+	http.Handle("/users/", auth.JWTMiddleware(http.HandlerFunc(srv.UserRoutes)))
+	http.Handle("/bots", auth.JWTMiddleware(http.HandlerFunc(srv.BotRoutes)))
+	http.Handle("/bots/", auth.JWTMiddleware(http.HandlerFunc(srv.BotRoutes)))
+	http.Handle("/tokens", auth.JWTMiddleware(http.HandlerFunc(srv.TokenRoutes)))
+	http.Handle("/tokens/", auth.JWTMiddleware(http.HandlerFunc(srv.TokenRoutes)))
+	http.Handle("/search", auth.ScopedMiddleware(auth.ScopeReadRooms, http.HandlerFunc(srv.SearchHandler)))
+	http.Handle("/admin/export-room", auth.JWTMiddleware(srv.AdminMiddleware(http.HandlerFunc(srv.ExportRoomHandler))))
+	http.Handle("/admin/import-room", auth.JWTMiddleware(srv.AdminMiddleware(http.HandlerFunc(srv.ImportRoomHandler))))
+	http.Handle("/admin/backup", auth.JWTMiddleware(srv.AdminMiddleware(http.HandlerFunc(srv.BackupHandler))))
+	http.Handle("/admin/reset-2fa", auth.JWTMiddleware(srv.AdminMiddleware(http.HandlerFunc(srv.ResetTwoFactorHandler))))
+	http.Handle("/admin/audit-log", auth.JWTMiddleware(srv.AdminMiddleware(http.HandlerFunc(srv.AuditLogHandler))))
+	http.Handle("/ws-ticket", auth.JWTMiddleware(http.HandlerFunc(srv.WebSocketTicketHandler)))
+	http.Handle("/ws", http.HandlerFunc(srv.WebSocketHandler))
+
+	websocket.Init(db)
+
+	// Move old messages out of the database if ARCHIVE_AFTER is set
+	if after := os.Getenv("ARCHIVE_AFTER"); after != "" {
+		archiveAfter, err := time.ParseDuration(after)
 		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+			utils.Log.WithError(err).Fatal("Invalid ARCHIVE_AFTER")
 		}
-		websocket.HandleConnections(w, r, db, userID)
-	})
-
-	websocket.Init()
+		interval := time.Hour
+		if value := os.Getenv("ARCHIVE_INTERVAL"); value != "" {
+			interval, err = time.ParseDuration(value)
+			if err != nil {
+				utils.Log.WithError(err).Fatal("Invalid ARCHIVE_INTERVAL")
+			}
+		}
+		archiver := &archive.Archiver{DB: db, After: archiveAfter}
+		go archiver.Run(context.Background(), interval)
+	}
 
 	utils.Log.Info("Starting server on :8080")
 	if err := http.ListenAndServe(":8080", nil); err != nil {
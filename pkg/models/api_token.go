@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// APIToken is a long-lived token that authenticates a user or bot with a
+// limited set of scopes
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	// Token is the secret itself, only returned when the token is created
+	Token string `json:"token,omitempty"`
+}
@@ -1,7 +1,163 @@
 package models
 
+import "time"
+
+// History visibility settings of a chat room
+const (
+	// HistoryShared lets members read everything ever sent to the room
+	HistoryShared = "shared"
+	// HistoryJoined only shows members what was sent since they joined
+	HistoryJoined = "joined"
+)
+
+// Visibility settings of a chat room
+const (
+	// VisibilityPublic rooms are listed to everyone and anyone can join
+	VisibilityPublic = "public"
+	// VisibilityPrivate rooms are listed to everyone, but only invited
+	// users can join
+	VisibilityPrivate = "private"
+	// VisibilitySecret rooms are only listed to their members, and only
+	// invited users can join
+	VisibilitySecret = "secret"
+	// VisibilityRestricted rooms are listed to everyone, and anyone can ask
+	// to join. Invited users join without asking.
+	VisibilityRestricted = "restricted"
+)
+
+// Roles of room members, from most to least privileged
+const (
+	RoleOwner     = "owner"
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+	RoleReadOnly  = "read-only"
+)
+
 type ChatRoom struct {
-	ID        int    `json:"id"`
-	Name      string `json:"name"`
-	CreatorID int    `json:"creator_id"`
+	ID                int        `json:"id"`
+	Name              string     `json:"name"`
+	CreatorID         int        `json:"creator_id"`
+	HistoryVisibility string     `json:"history_visibility,omitempty"`
+	Visibility        string     `json:"visibility,omitempty"`
+	Topic             string     `json:"topic"`
+	Description       string     `json:"description"`
+	CreatedAt         *time.Time `json:"created_at,omitempty"`
+	MemberCount       int        `json:"member_count"`
+	// LastMessageAt is when the latest message was sent to the room, archived
+	// or not. It is nil if nothing was ever sent.
+	LastMessageAt *time.Time `json:"last_message_at,omitempty"`
+	// ArchivedAt is when the room was archived, making it read-only. It is
+	// nil for active rooms.
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+}
+
+// RoomPage is a page of the room directory. NextCursor fetches the next
+// one, and is left out on the last page.
+type RoomPage struct {
+	Rooms      []ChatRoom `json:"rooms"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// InviteCode lets whoever has it join a room until it expires or has been
+// used MaxUses times
+type InviteCode struct {
+	Code      string     `json:"code"`
+	RoomID    int        `json:"room_id"`
+	CreatorID int        `json:"creator_id,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// MaxUses is 0 for codes that can be used any number of times
+	MaxUses int `json:"max_uses,omitempty"`
+	Uses    int `json:"uses"`
+}
+
+// Invitation is a pending invitation of a user to a room, which they accept
+// by joining it
+type Invitation struct {
+	RoomID          int       `json:"room_id"`
+	RoomName        string    `json:"room_name"`
+	InviterID       int       `json:"inviter_id,omitempty"`
+	InviterUsername string    `json:"inviter_username,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// JoinRequest is a pending request of a user to join a restricted room,
+// which the room's admins approve or deny
+type JoinRequest struct {
+	RoomID    int       `json:"room_id"`
+	RoomName  string    `json:"room_name,omitempty"`
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Membership events recorded in a room's membership log
+const (
+	MembershipJoin  = "join"
+	MembershipLeave = "leave"
+	MembershipKick  = "kick"
+	MembershipBan   = "ban"
+)
+
+type MembershipEvent struct {
+	ID        int       `json:"id"`
+	RoomID    int       `json:"room_id"`
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	ActorID   int       `json:"actor_id,omitempty"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Kinds of sanctions against a user in a room
+const (
+	// SanctionBan keeps a user out of the room
+	SanctionBan = "ban"
+	// SanctionMute keeps a member from posting to the room
+	SanctionMute = "mute"
+)
+
+// Sanction is a ban or mute of a user in a room, in force until ExpiresAt,
+// or until it is lifted if ExpiresAt is nil
+type Sanction struct {
+	RoomID    int        `json:"room_id"`
+	UserID    int        `json:"user_id"`
+	Username  string     `json:"username,omitempty"`
+	Kind      string     `json:"kind"`
+	ActorID   int        `json:"actor_id,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Actions recorded in a room's moderation log
+const (
+	ModerationKick   = "kick"
+	ModerationBan    = "ban"
+	ModerationUnban  = "unban"
+	ModerationMute   = "mute"
+	ModerationUnmute = "unmute"
+)
+
+type ModerationAction struct {
+	ID        int        `json:"id"`
+	RoomID    int        `json:"room_id"`
+	UserID    int        `json:"user_id"`
+	Username  string     `json:"username"`
+	ActorID   int        `json:"actor_id,omitempty"`
+	Action    string     `json:"action"`
+	Reason    string     `json:"reason,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// RoomMember is a current member of a room and their role in it
+type RoomMember struct {
+	ID       int        `json:"id"`
+	Username string     `json:"username"`
+	Role     string     `json:"role"`
+	JoinedAt *time.Time `json:"joined_at,omitempty"`
 }
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+type Message struct {
+	ID          int        `json:"id"`
+	SenderID    int        `json:"sender_id"`
+	RecipientID int        `json:"recipient_id,omitempty"`
+	RoomID      int        `json:"room_id,omitempty"`
+	Content     string     `json:"content"`
+	Timestamp   time.Time  `json:"timestamp"`
+	EditedAt    *time.Time `json:"edited_at,omitempty"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// Session is an active login of a user on one device
+type Session struct {
+	ID            int       `json:"id"`
+	DeviceName    string    `json:"device_name,omitempty"`
+	ClientVersion string    `json:"client_version,omitempty"`
+	IP            string    `json:"ip,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	LastUsedAt    time.Time `json:"last_used_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	// Current is set on the session the list was requested with
+	Current bool `json:"current"`
+	// Connected is set while the session has an open WebSocket connection
+	Connected bool `json:"connected"`
+}
@@ -1,5 +1,17 @@
 package models
 
 type Token struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// ExpiresIn is how many seconds Token is valid for
+	ExpiresIn int `json:"expires_in,omitempty"`
+}
+
+// Challenge is returned by login instead of a Token when the user has
+// two-factor authentication enabled. It is redeemed for a Token along with
+// a code from their authenticator.
+type Challenge struct {
+	Challenge string `json:"challenge"`
+	// ExpiresIn is how many seconds the challenge can be redeemed for
+	ExpiresIn int `json:"expires_in"`
 }
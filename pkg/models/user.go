@@ -1,7 +1,32 @@
 package models
 
+// Settings for who may send a user direct messages
+const (
+	// DMEveryone accepts direct messages from anyone
+	DMEveryone = "everyone"
+	// DMSharedRooms accepts them from people sharing a room with the user
+	DMSharedRooms = "shared_rooms"
+	// DMContacts accepts them only from the user's contacts
+	DMContacts = "contacts"
+)
+
 type User struct {
-	ID           int    `json:"id"`
-	Username     string `json:"username"`
-	PasswordHash string `json:"password_hash"`
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	// PasswordHash is never sent to clients
+	PasswordHash string `json:"-"`
+	IsBot        bool   `json:"is_bot,omitempty"`
+	// OwnerID is the user who created a bot account
+	OwnerID int `json:"owner_id,omitempty"`
+
+	DisplayName string `json:"display_name,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	Status      string `json:"status,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+
+	// Email, EmailVerified and DMPolicy are only filled in for the user
+	// themselves
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	DMPolicy      string `json:"dm_policy,omitempty"`
 }